@@ -40,6 +40,7 @@ import (
 	_ "github.com/nyaruka/mailroom/web/msg"
 	_ "github.com/nyaruka/mailroom/web/org"
 	_ "github.com/nyaruka/mailroom/web/po"
+	_ "github.com/nyaruka/mailroom/web/session"
 	_ "github.com/nyaruka/mailroom/web/simulation"
 	_ "github.com/nyaruka/mailroom/web/surveyor"
 	_ "github.com/nyaruka/mailroom/web/ticket"
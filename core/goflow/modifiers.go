@@ -2,12 +2,12 @@ package goflow
 
 import (
 	"encoding/json"
+	"fmt"
+	"regexp"
 
 	"github.com/nyaruka/goflow/assets"
 	"github.com/nyaruka/goflow/flows"
 	"github.com/nyaruka/goflow/flows/modifiers"
-
-	"github.com/pkg/errors"
 )
 
 // MissingAssets is the type for defining missing assets behavior
@@ -19,10 +19,56 @@ const (
 	ErrorOnMissing MissingAssets = 1
 )
 
-// ReadModifiers reads modifiers from the given JSON
+// matches the field named in a validation error from the engine, e.g. field 'field' is required
+var validationFieldRegex = regexp.MustCompile(`^field '([^']+)'`)
+
+// ModifierError is returned when one of the modifiers being read is invalid. It's a rich error so the index of the
+// modifier, and the invalid field if known, are included in error responses.
+type ModifierError struct {
+	Index int
+	Type  string
+	Field string
+	err   error
+}
+
+func newModifierError(index int, data json.RawMessage, err error) *ModifierError {
+	e := &ModifierError{Index: index, err: err}
+
+	header := &struct {
+		Type string `json:"type"`
+	}{}
+	if json.Unmarshal(data, header) == nil {
+		e.Type = header.Type
+	}
+
+	if m := validationFieldRegex.FindStringSubmatch(err.Error()); m != nil {
+		e.Field = m[1]
+	}
+	return e
+}
+
+func (e *ModifierError) Error() string {
+	return fmt.Sprintf("error reading modifier[%d]: %s", e.Index, e.err)
+}
+
+func (e *ModifierError) Unwrap() error { return e.err }
+func (e *ModifierError) Code() string  { return "invalid_modifier" }
+
+func (e *ModifierError) Extra() map[string]string {
+	extra := map[string]string{"index": fmt.Sprint(e.Index)}
+	if e.Type != "" {
+		extra["type"] = e.Type
+	}
+	if e.Field != "" {
+		extra["field"] = e.Field
+	}
+	return extra
+}
+
+// ReadModifiers reads modifiers from the given JSON. If any modifier is invalid, a *ModifierError is returned.
 func ReadModifiers(sa flows.SessionAssets, data []json.RawMessage, missing MissingAssets) ([]flows.Modifier, error) {
 	mods := make([]flows.Modifier, 0, len(data))
-	for _, m := range data {
+	for i, m := range data {
 		mod, err := modifiers.ReadModifier(sa, m, assets.IgnoreMissing)
 
 		// if this modifier turned into a no-op, ignore
@@ -30,7 +76,7 @@ func ReadModifiers(sa flows.SessionAssets, data []json.RawMessage, missing Missi
 			continue
 		}
 		if err != nil {
-			return nil, errors.Wrapf(err, "error reading modifier: %s", string(m))
+			return nil, newModifierError(i, m, err)
 		}
 		mods = append(mods, mod)
 	}
@@ -52,12 +52,37 @@ func TestReadModifiers(t *testing.T) {
 		[]byte(`{"type": "field", "field": {"key": "blood_type", "name": "Blood Type"}, "value": "O"}`),
 		[]byte(`{"type": "language", "language": "spa"}`),
 	}, goflow.ErrorOnMissing)
-	assert.EqualError(t, err, `error reading modifier: {"type": "field", "field": {"key": "blood_type", "name": "Blood Type"}, "value": "O"}: no modifier to return because of missing assets`)
+	assert.EqualError(t, err, `error reading modifier[1]: no modifier to return because of missing assets`)
 
 	// error if any modifier structurally invalid
 	_, err = goflow.ReadModifiers(oa.SessionAssets(), []json.RawMessage{
 		[]byte(`{"type": "field", "value": "O"}`),
 		[]byte(`{"type": "language", "language": "spa"}`),
 	}, goflow.ErrorOnMissing)
-	assert.EqualError(t, err, `error reading modifier: {"type": "field", "value": "O"}: field 'field' is required`)
+	assert.EqualError(t, err, `error reading modifier[0]: field 'field' is required`)
+
+	// errors identify which modifier was invalid and why
+	tcs := []struct {
+		modifier string
+		extra    map[string]string
+	}{
+		{`{"type": "field", "value": "O"}`, map[string]string{"index": "1", "type": "field", "field": "field"}},
+		{`{"type": "language"}`, map[string]string{"index": "1", "type": "language", "field": "language"}},
+		{`{"type": "xyz"}`, map[string]string{"index": "1", "type": "xyz"}},
+		{`"name"`, map[string]string{"index": "1"}},
+	}
+
+	for _, tc := range tcs {
+		_, err = goflow.ReadModifiers(oa.SessionAssets(), []json.RawMessage{
+			[]byte(`{"type": "name", "name": "Bob"}`),
+			[]byte(tc.modifier),
+		}, goflow.ErrorOnMissing)
+
+		modErr, isModErr := err.(*goflow.ModifierError)
+		if assert.True(t, isModErr, "expected modifier error for %s", tc.modifier) {
+			assert.Equal(t, 1, modErr.Index)
+			assert.Equal(t, "invalid_modifier", modErr.Code())
+			assert.Equal(t, tc.extra, modErr.Extra(), "extra mismatch for %s", tc.modifier)
+		}
+	}
 }
@@ -278,7 +278,7 @@ func RunFlowAndApplyEvents(t *testing.T, ctx context.Context, rt *runtime.Runtim
 	tx, err := rt.DB.BeginTxx(ctx, nil)
 	require.NoError(t, err)
 
-	session, err := models.NewSession(ctx, tx, oa, fs, sprint)
+	session, err := models.NewSession(ctx, rt.Config, tx, oa, fs, sprint)
 	require.NoError(t, err)
 
 	err = tx.Commit()
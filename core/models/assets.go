@@ -30,9 +30,10 @@ type OrgAssets struct {
 
 	sessionAssets flows.SessionAssets
 
-	flowByUUID    map[assets.FlowUUID]assets.Flow
-	flowByID      map[FlowID]assets.Flow
-	flowCacheLock sync.RWMutex
+	flowByUUID         map[assets.FlowUUID]assets.Flow
+	flowByID           map[FlowID]assets.Flow
+	inactiveFlowByUUID map[assets.FlowUUID]*Flow
+	flowCacheLock      sync.RWMutex
 
 	channels       []assets.Channel
 	channelsByID   map[ChannelID]*Channel
@@ -305,9 +306,11 @@ func NewOrgAssets(ctx context.Context, rt *runtime.Runtime, orgID OrgID, prev *O
 	if prev == nil || refresh&RefreshFlows > 0 {
 		oa.flowByUUID = make(map[assets.FlowUUID]assets.Flow)
 		oa.flowByID = make(map[FlowID]assets.Flow)
+		oa.inactiveFlowByUUID = make(map[assets.FlowUUID]*Flow)
 	} else {
 		oa.flowByUUID = prev.flowByUUID
 		oa.flowByID = prev.flowByID
+		oa.inactiveFlowByUUID = prev.inactiveFlowByUUID
 	}
 
 	if prev == nil || refresh&RefreshTicketers > 0 {
@@ -6,9 +6,11 @@ import (
 	"database/sql/driver"
 	"fmt"
 	"net/url"
+	"sort"
 	"strconv"
 	"time"
 
+	"github.com/gomodule/redigo/redis"
 	"github.com/lib/pq"
 	"github.com/nyaruka/gocommon/dates"
 	"github.com/nyaruka/gocommon/dbutil"
@@ -18,10 +20,11 @@ import (
 	"github.com/nyaruka/goflow/envs"
 	"github.com/nyaruka/goflow/excellent/types"
 	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/correlation"
 	"github.com/nyaruka/null"
 	"github.com/nyaruka/redisx"
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
 )
 
 // URNID is our type for urn ids, which can be null
@@ -316,7 +319,7 @@ func LoadContacts(ctx context.Context, db Queryer, oa *OrgAssets, ids []ContactI
 		for _, u := range e.URNs {
 			urn, err := u.AsURN(oa)
 			if err != nil {
-				logrus.WithField("urn", u).WithField("org_id", oa.OrgID()).WithField("contact_id", contact.id).Warn("invalid URN, ignoring")
+				correlation.Logger(ctx).WithField("urn", u).WithField("org_id", oa.OrgID()).WithField("contact_id", contact.id).Warn("invalid URN, ignoring")
 				continue
 			}
 			contactURNs = append(contactURNs, urn)
@@ -336,7 +339,7 @@ func LoadContacts(ctx context.Context, db Queryer, oa *OrgAssets, ids []ContactI
 		contacts = append(contacts, contact)
 	}
 
-	logrus.WithField("elapsed", time.Since(start)).WithField("count", len(contacts)).Debug("loaded contacts")
+	correlation.Logger(ctx).WithField("elapsed", time.Since(start)).WithField("count", len(contacts)).Debug("loaded contacts")
 
 	return contacts, nil
 }
@@ -350,6 +353,24 @@ func LoadContactsByUUID(ctx context.Context, db Queryer, oa *OrgAssets, uuids []
 	return LoadContacts(ctx, db, oa, ids)
 }
 
+// LoadContactByURN loads the contact which owns the passed in URN, which will be normalized first. Returns nil if no
+// contact owns the URN.
+func LoadContactByURN(ctx context.Context, db Queryer, oa *OrgAssets, urn urns.URN) (*Contact, error) {
+	urn = urn.Normalize(string(oa.Env().DefaultCountry()))
+
+	owners, err := contactIDsFromURNs(ctx, db, oa.OrgID(), []urns.URN{urn})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up contact for URN")
+	}
+
+	contactID := owners[urn]
+	if contactID == NilContactID {
+		return nil, nil
+	}
+
+	return LoadContact(ctx, db, oa, contactID)
+}
+
 // GetNewestContactModifiedOn returns the newest modified_on for a contact in the passed in org
 func GetNewestContactModifiedOn(ctx context.Context, db Queryer, oa *OrgAssets) (*time.Time, error) {
 	rows, err := db.QueryxContext(ctx, "SELECT modified_on FROM contacts_contact WHERE org_id = $1 ORDER BY modified_on DESC LIMIT 1", oa.OrgID())
@@ -371,6 +392,33 @@ func GetNewestContactModifiedOn(ctx context.Context, db Queryer, oa *OrgAssets)
 	return nil, nil
 }
 
+// ContactModified is a contact id and when that contact was last modified
+type ContactModified struct {
+	ID         ContactID `db:"id"`
+	ModifiedOn time.Time `db:"modified_on"`
+}
+
+const sqlSelectContactsModifiedSince = `
+  SELECT id, modified_on
+    FROM contacts_contact
+   WHERE org_id = $1 AND is_active = TRUE AND (modified_on, id) > ($2, $3)
+ORDER BY modified_on ASC, id ASC
+   LIMIT $4`
+
+// ContactsModifiedSince returns up to limit active contacts in the given org modified after the given modified_on and
+// id, ordered by when they were modified and then by id, so that callers syncing incrementally can use the modified_on
+// and id of the last contact returned as their next cursor. Many contacts can share a modified_on, e.g. after a bulk
+// update, so the id is needed to page through them. Callers without a previous page should pass NilContactID.
+func ContactsModifiedSince(ctx context.Context, db Queryer, orgID OrgID, since time.Time, sinceID ContactID, limit int) ([]*ContactModified, error) {
+	modified := make([]*ContactModified, 0, limit)
+
+	if err := db.SelectContext(ctx, &modified, sqlSelectContactsModifiedSince, orgID, since, sinceID, limit); err != nil {
+		return nil, errors.Wrapf(err, "error selecting contacts modified since %s (#%d) for org: %d", since, sinceID, orgID)
+	}
+
+	return modified, nil
+}
+
 // GetContactIDsFromReferences gets the contact ids for the given org and set of references. Note that the order of the returned contacts
 // won't necessarily match the order of the references.
 func GetContactIDsFromReferences(ctx context.Context, db Queryer, orgID OrgID, refs []*flows.ContactReference) ([]ContactID, error) {
@@ -383,6 +431,35 @@ func GetContactIDsFromReferences(ctx context.Context, db Queryer, orgID OrgID, r
 	return getContactIDsFromUUIDs(ctx, db, orgID, uuids)
 }
 
+const sqlSelectContactIDsByExternalID = `
+SELECT u.path AS external_id, u.contact_id
+  FROM contacts_contacturn u
+  JOIN contacts_contact c ON c.id = u.contact_id
+ WHERE u.org_id = $1 AND u.identity = ANY($2) AND c.is_active = TRUE`
+
+// GetContactIDsByExternalIDs gets the ids of the contacts in the given org with ext URNs with the given external ids.
+// External ids without a matching contact are omitted from the returned map.
+func GetContactIDsByExternalIDs(ctx context.Context, db Queryer, orgID OrgID, externalIDs []string) (map[string]ContactID, error) {
+	identities := make([]string, len(externalIDs))
+	for i, externalID := range externalIDs {
+		identities[i] = string(urns.URN(fmt.Sprintf("%s:%s", urns.ExternalScheme, externalID)).Identity())
+	}
+
+	var rows []struct {
+		ExternalID string    `db:"external_id"`
+		ContactID  ContactID `db:"contact_id"`
+	}
+	if err := db.SelectContext(ctx, &rows, sqlSelectContactIDsByExternalID, orgID, pq.Array(identities)); err != nil {
+		return nil, errors.Wrapf(err, "error selecting contact ids by external id")
+	}
+
+	ids := make(map[string]ContactID, len(rows))
+	for _, r := range rows {
+		ids[r.ExternalID] = r.ContactID
+	}
+	return ids, nil
+}
+
 // gets the contact IDs for the passed in org and set of UUIDs
 func getContactIDsFromUUIDs(ctx context.Context, db Queryer, orgID OrgID, uuids []flows.ContactUUID) ([]ContactID, error) {
 	ids, err := queryContactIDs(ctx, db, `SELECT id FROM contacts_contact WHERE org_id = $1 AND uuid = ANY($2) AND is_active = TRUE`, orgID, pq.Array(uuids))
@@ -606,6 +683,160 @@ func CreateContact(ctx context.Context, db QueryerWithTx, oa *OrgAssets, userID
 	return contact, flowContact, nil
 }
 
+// CreateContacts creates new contacts for the passed in org from the passed in specs in a single transaction. Results
+// are returned per spec, so for each spec either the contact or the error will be non-nil. Specs with URNs which are
+// invalid or already in use, including by an earlier spec in the same batch, fail without affecting the other specs.
+// Like CreateContact, only the name, language and URNs of each spec are used.
+func CreateContacts(ctx context.Context, db QueryerWithTx, oa *OrgAssets, userID UserID, specs []*ContactSpec) ([]*flows.Contact, []error) {
+	contacts := make([]*flows.Contact, len(specs))
+	errs := make([]error, len(specs))
+
+	// normalize and validate all URNs and check for duplicates within the batch
+	specURNs := make([][]urns.URN, len(specs))
+	specLangs := make([]envs.Language, len(specs))
+	allURNs := make([]urns.URN, 0, len(specs))
+	batchOwners := make(map[urns.URN]int, len(specs))
+
+	for i, spec := range specs {
+		if spec.Language != nil {
+			lang, err := envs.ParseLanguage(*spec.Language)
+			if err != nil {
+				errs[i] = errors.Errorf("'%s' is not a valid language code", *spec.Language)
+				continue
+			}
+			specLangs[i] = lang
+		}
+
+		urnz := make([]urns.URN, len(spec.URNs))
+		for j, urn := range spec.URNs {
+			urnz[j] = urn.Normalize(string(oa.Env().DefaultCountry()))
+
+			if err := urnz[j].Validate(); err != nil {
+				errs[i] = errors.Wrapf(err, "can't insert invalid URN '%s'", urnz[j])
+				break
+			}
+			if _, taken := batchOwners[urnz[j].Identity()]; taken {
+				errs[i] = errors.New("URNs in use by other contacts")
+				break
+			}
+		}
+		if errs[i] != nil {
+			continue
+		}
+
+		for _, urn := range urnz {
+			batchOwners[urn.Identity()] = i
+			allURNs = append(allURNs, urn)
+		}
+		specURNs[i] = urnz
+	}
+
+	// find current owners of all these URNs in one query
+	owners, err := contactIDsFromURNs(ctx, db, oa.OrgID(), allURNs)
+	if err != nil {
+		return contacts, failAll(errs, errors.Wrapf(err, "error looking up contacts for URNs"))
+	}
+	for urn, contactID := range owners {
+		if contactID != NilContactID {
+			errs[batchOwners[urn.Identity()]] = errors.New("URNs in use by other contacts")
+		}
+	}
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return contacts, failAll(errs, errors.Wrapf(err, "error beginning transaction"))
+	}
+
+	// insert each contact inside a savepoint so that a conflict only fails that spec
+	contactIDs := make([]ContactID, len(specs))
+	for i, spec := range specs {
+		if errs[i] != nil {
+			continue
+		}
+
+		if _, err := tx.ExecContext(ctx, `SAVEPOINT create_contact`); err != nil {
+			tx.Rollback()
+			return contacts, failAll(errs, errors.Wrapf(err, "error creating savepoint"))
+		}
+
+		name := ""
+		if spec.Name != nil {
+			name = *spec.Name
+		}
+
+		contactIDs[i], err = insertContactAndURNs(ctx, tx, oa.OrgID(), userID, name, specLangs[i], specURNs[i], NilChannelID)
+		if err != nil {
+			if _, rerr := tx.ExecContext(ctx, `ROLLBACK TO SAVEPOINT create_contact`); rerr != nil {
+				tx.Rollback()
+				return contacts, failAll(errs, errors.Wrapf(rerr, "error rolling back to savepoint"))
+			}
+
+			// always possible that another thread created a contact with these URNs after we checked above
+			if dbutil.IsUniqueViolation(errors.Cause(err)) {
+				errs[i] = errors.New("URNs in use by other contacts")
+			} else {
+				errs[i] = err
+			}
+			continue
+		}
+
+		if _, err := tx.ExecContext(ctx, `RELEASE SAVEPOINT create_contact`); err != nil {
+			tx.Rollback()
+			return contacts, failAll(errs, errors.Wrapf(err, "error releasing savepoint"))
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return contacts, failAll(errs, errors.Wrapf(err, "error committing transaction"))
+	}
+
+	// load the full contacts so that we can calculate dynamic groups
+	created := make([]ContactID, 0, len(specs))
+	for i := range specs {
+		if errs[i] == nil {
+			created = append(created, contactIDs[i])
+		}
+	}
+
+	loaded, err := LoadContacts(ctx, db, oa, created)
+	if err != nil {
+		return contacts, failAll(errs, errors.Wrapf(err, "error loading new contacts"))
+	}
+
+	flowContactsByID := make(map[ContactID]*flows.Contact, len(loaded))
+	flowContacts := make([]*flows.Contact, 0, len(loaded))
+	for _, c := range loaded {
+		flowContact, err := c.FlowContact(oa)
+		if err != nil {
+			return contacts, failAll(errs, errors.Wrapf(err, "error creating flow contact"))
+		}
+		flowContactsByID[c.ID()] = flowContact
+		flowContacts = append(flowContacts, flowContact)
+	}
+
+	if err := CalculateDynamicGroups(ctx, db, oa, flowContacts); err != nil {
+		return contacts, failAll(errs, errors.Wrapf(err, "error calculating dynamic groups"))
+	}
+
+	for i := range specs {
+		if errs[i] == nil {
+			contacts[i] = flowContactsByID[contactIDs[i]]
+		}
+	}
+
+	return contacts, errs
+}
+
+// sets the passed in error for every item which hasn't already failed
+func failAll(errs []error, err error) []error {
+	for i := range errs {
+		if errs[i] == nil {
+			errs[i] = err
+		}
+	}
+	return errs
+}
+
 // GetOrCreateContact fetches or creates a new contact for the passed in org with the passed in URNs.
 //
 // * If none of the URNs exist, it creates a new contact with those URNs.
@@ -674,15 +905,25 @@ func GetOrCreateContactIDsFromURNs(ctx context.Context, db QueryerWithTx, oa *Or
 	return owners, nil
 }
 
+// GetURNOwners returns the unique ids of the contacts in the given org who own any of the given URNs, which should be
+// normalized by the caller
+func GetURNOwners(ctx context.Context, db Queryer, orgID OrgID, urnz []urns.URN) ([]ContactID, error) {
+	owners, err := contactIDsFromURNs(ctx, db, orgID, urnz)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up contacts for URNs")
+	}
+	return uniqueContactIDs(owners), nil
+}
+
 // looks up the contacts who own the given urns (which should be normalized by the caller) and returns that information as a map
 func contactIDsFromURNs(ctx context.Context, db Queryer, orgID OrgID, urnz []urns.URN) (map[urns.URN]ContactID, error) {
-	identityToOriginal := make(map[urns.URN]urns.URN, len(urnz))
+	identityToOriginals := make(map[urns.URN][]urns.URN, len(urnz))
 	identities := make([]urns.URN, len(urnz))
 	owners := make(map[urns.URN]ContactID, len(urnz))
 
 	for i, urn := range urnz {
 		identity := urn.Identity()
-		identityToOriginal[identity] = urn
+		identityToOriginals[identity] = append(identityToOriginals[identity], urn)
 		identities[i] = identity
 		owners[urn] = NilContactID
 	}
@@ -699,7 +940,10 @@ func contactIDsFromURNs(ctx context.Context, db Queryer, orgID OrgID, urnz []urn
 		if err := rows.Scan(&id, &urn); err != nil {
 			return nil, errors.Wrapf(err, "error scanning URN result")
 		}
-		owners[identityToOriginal[urn]] = id
+		// different URNs can have the same identity so make sure they all get the owner
+		for _, original := range identityToOriginals[urn] {
+			owners[original] = id
+		}
 	}
 
 	return owners, nil
@@ -896,6 +1140,120 @@ func GetOrCreateURN(ctx context.Context, db Queryer, oa *OrgAssets, contactID Co
 	return URNForURN(ctx, db, oa, u)
 }
 
+const sqlSelectURNOwnersForUpdate = `
+SELECT identity, contact_id
+  FROM contacts_contacturn
+ WHERE org_id = $1 AND identity = ANY($2)
+   FOR UPDATE`
+
+// only claims an existing URN if it's orphaned, so a URN claimed by another contact since we looked returns no rows
+const sqlAddContactURN = `
+INSERT INTO contacts_contacturn(contact_id, identity, path, display, auth, scheme, priority, org_id)
+     VALUES($1, $2, $3, $4, $5, $6, $7, $8)
+ON CONFLICT(identity, org_id) DO UPDATE
+        SET contact_id = $1, priority = $7
+      WHERE contacts_contacturn.contact_id IS NULL
+  RETURNING id`
+
+// AddContactURNs appends the given URNs to their contacts with the lowest priority, in a single transaction. URNs which
+// are already owned by another contact, or by an earlier contact in the same batch, are skipped and returned keyed by
+// the contact they would have been added to. URNs which the contact already owns are ignored. It's an error for any of
+// the contacts to not belong to the given org.
+func AddContactURNs(ctx context.Context, db QueryerWithTx, oa *OrgAssets, additions map[ContactID]urns.URN) (map[ContactID]urns.URN, error) {
+	contactIDs := make([]ContactID, 0, len(additions))
+	normalized := make(map[ContactID]urns.URN, len(additions))
+	identities := make([]urns.URN, 0, len(additions))
+
+	for contactID, u := range additions {
+		n := u.Normalize(string(oa.Env().DefaultCountry()))
+		if err := n.Validate(); err != nil {
+			return nil, errors.Wrapf(err, "invalid URN %s for contact #%d", u, contactID)
+		}
+		contactIDs = append(contactIDs, contactID)
+		normalized[contactID] = n
+		identities = append(identities, n.Identity())
+	}
+
+	// process in a consistent order so that conflicts within the batch are resolved the same way every time
+	sort.Slice(contactIDs, func(i, j int) bool { return contactIDs[i] < contactIDs[j] })
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error starting transaction")
+	}
+	defer tx.Rollback()
+
+	var orgContactIDs []ContactID
+	if err := tx.SelectContext(ctx, &orgContactIDs, `SELECT id FROM contacts_contact WHERE org_id = $1 AND id = ANY($2) AND is_active`, oa.OrgID(), pq.Array(contactIDs)); err != nil {
+		return nil, errors.Wrapf(err, "error checking contacts")
+	}
+	if len(orgContactIDs) != len(contactIDs) {
+		return nil, errors.Errorf("not all contacts belong to org #%d", oa.OrgID())
+	}
+
+	// lock any existing URNs so their owners can't change until we're done
+	owners := make(map[urns.URN]ContactID, len(identities))
+	rows, err := tx.QueryxContext(ctx, sqlSelectURNOwnersForUpdate, oa.OrgID(), pq.Array(identities))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up URN owners")
+	}
+	for rows.Next() {
+		var identity urns.URN
+		var owner ContactID
+		if err := rows.Scan(&identity, &owner); err != nil {
+			rows.Close()
+			return nil, errors.Wrapf(err, "error scanning URN owner")
+		}
+		owners[identity] = owner
+	}
+	rows.Close()
+
+	modified := make([]ContactID, 0, len(contactIDs))
+	conflicts := make(map[ContactID]urns.URN)
+
+	for _, contactID := range contactIDs {
+		u := normalized[contactID]
+		identity := u.Identity()
+
+		owner := owners[identity]
+		if owner == contactID {
+			continue
+		}
+		if owner != NilContactID {
+			conflicts[contactID] = additions[contactID]
+			continue
+		}
+
+		var urnID URNID
+		err := tx.GetContext(ctx, &urnID, sqlAddContactURN, contactID, identity.String(), u.Path(), null.String(u.Display()), GetURNAuth(u), u.Scheme(), defaultURNPriority, oa.OrgID())
+		if err == sql.ErrNoRows {
+			// claimed by another contact since we looked
+			conflicts[contactID] = additions[contactID]
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "error adding URN %s to contact #%d", u, contactID)
+		}
+
+		owners[identity] = contactID
+		modified = append(modified, contactID)
+	}
+
+	if len(modified) == 0 {
+		return conflicts, nil
+	}
+
+	if err := UpdateContactModifiedOn(ctx, tx, modified); err != nil {
+		return nil, errors.Wrapf(err, "error updating contacts modified_on")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrapf(err, "error committing contact urns")
+	}
+
+	return conflicts, nil
+}
+
 // URNForID will return a URN for the passed in ID including all the special query parameters
 // set that goflow and mailroom depend on. Generally this URN is built when loading a contact
 // but occasionally we need to load URNs one by one and this accomplishes that
@@ -1010,6 +1368,45 @@ func CalculateDynamicGroups(ctx context.Context, db Queryer, oa *OrgAssets, cont
 	return nil
 }
 
+// RecalculateDynamicGroups reloads the given contacts and recalculates their membership of all query based groups,
+// e.g. after a bulk update of field values which didn't go through a flow. Contacts are locked while this happens.
+func RecalculateDynamicGroups(ctx context.Context, db Queryer, rp *redis.Pool, oa *OrgAssets, contactIDs []ContactID) error {
+	// grab locks for all our contacts so nothing else modifies them while we're recalculating
+	locks := make(map[ContactID]string, len(contactIDs))
+	defer func() {
+		for contactID, lock := range locks {
+			GetContactLocker(oa.OrgID(), contactID).Release(rp, lock)
+		}
+	}()
+
+	for _, contactID := range contactIDs {
+		lock, err := GetContactLocker(oa.OrgID(), contactID).Grab(rp, time.Second*10)
+		if err != nil {
+			return errors.Wrapf(err, "error acquiring lock for contact %d", contactID)
+		}
+		if lock == "" {
+			return errors.Errorf("timed out waiting for lock for contact %d", contactID)
+		}
+		locks[contactID] = lock
+	}
+
+	contacts, err := LoadContacts(ctx, db, oa, contactIDs)
+	if err != nil {
+		return errors.Wrapf(err, "error loading contacts")
+	}
+
+	flowContacts := make([]*flows.Contact, 0, len(contacts))
+	for _, c := range contacts {
+		flowContact, err := c.FlowContact(oa)
+		if err != nil {
+			return errors.Wrapf(err, "error creating flow contact for contact %d", c.ID())
+		}
+		flowContacts = append(flowContacts, flowContact)
+	}
+
+	return CalculateDynamicGroups(ctx, db, oa, flowContacts)
+}
+
 // StopContact stops the contact with the passed in id, removing them from all groups and setting
 // their state to stopped.
 func StopContact(ctx context.Context, db Queryer, orgID OrgID, contactID ContactID) error {
@@ -1255,6 +1652,56 @@ func UpdateContactURNs(ctx context.Context, db Queryer, oa *OrgAssets, changes [
 	return nil
 }
 
+// ReorderContactURNs sets the priorities of a contact's URNs to match the order of the passed in URNs, so that the first
+// becomes the contact's preferred URN. The passed in URNs must be the contact's existing URNs in any order.
+func ReorderContactURNs(ctx context.Context, db Queryer, oa *OrgAssets, contactID ContactID, urnz []urns.URN) error {
+	contact, err := LoadContact(ctx, db, oa, contactID)
+	if err != nil {
+		return errors.Wrapf(err, "error loading contact")
+	}
+	if contact == nil {
+		return errors.Errorf("no such contact: %d", contactID)
+	}
+
+	existing := make(map[urns.URN]urns.URN, len(contact.URNs()))
+	for _, u := range contact.URNs() {
+		existing[u.Identity()] = u
+	}
+
+	updates := make([]interface{}, 0, len(urnz))
+	seen := make(map[urns.URN]bool, len(urnz))
+	priority := topURNPriority
+
+	for _, u := range urnz {
+		identity := u.Identity()
+		current, found := existing[identity]
+		if !found {
+			return errors.Errorf("URN %s doesn't belong to contact %d", identity, contactID)
+		}
+		if seen[identity] {
+			return errors.Errorf("URN %s is included more than once", identity)
+		}
+		seen[identity] = true
+
+		updates = append(updates, &urnUpdate{
+			URNID:     URNID(GetURNInt(current, "id")),
+			ChannelID: GetURNChannelID(oa, current),
+			Priority:  priority,
+		})
+		priority--
+	}
+
+	if len(updates) != len(existing) {
+		return errors.Errorf("expected all %d URNs of contact %d, got %d", len(existing), contactID, len(updates))
+	}
+
+	if err := BulkQuery(ctx, "reordering contact urns", db, sqlUpdateContactURNs, updates); err != nil {
+		return errors.Wrapf(err, "error updating urn priorities")
+	}
+
+	return UpdateContactModifiedOn(ctx, db, []ContactID{contactID})
+}
+
 // urnUpdate is our object that represents a single contact URN update
 type urnUpdate struct {
 	URNID     URNID     `db:"id"`
@@ -1416,3 +1863,100 @@ FROM (
 WHERE
 	c.id = r.id::int
 `
+
+const sqlUpdateContactLanguage = `
+UPDATE contacts_contact
+   SET language = $3, modified_on = NOW()
+ WHERE org_id = $1 AND id = ANY($2) AND is_active = TRUE`
+
+// SetContactLanguage sets the language of the passed in contacts with a single update, and then recalculates their
+// query based groups since those may depend on language. An empty language clears the language of the contacts.
+func SetContactLanguage(ctx context.Context, db QueryerWithTx, oa *OrgAssets, contactIDs []ContactID, lang envs.Language) error {
+	if lang != envs.NilLanguage {
+		if _, err := envs.ParseLanguage(string(lang)); err != nil {
+			return errors.Errorf("'%s' is not a valid language code", lang)
+		}
+	}
+
+	if len(contactIDs) == 0 {
+		return nil
+	}
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.Wrapf(err, "error starting transaction")
+	}
+
+	if _, err := tx.ExecContext(ctx, sqlUpdateContactLanguage, oa.OrgID(), pq.Array(contactIDs), null.String(string(lang))); err != nil {
+		tx.Rollback()
+		return errors.Wrapf(err, "error updating contact languages")
+	}
+
+	contacts, err := LoadContacts(ctx, tx, oa, contactIDs)
+	if err != nil {
+		tx.Rollback()
+		return errors.Wrapf(err, "error loading updated contacts")
+	}
+
+	flowContacts := make([]*flows.Contact, len(contacts))
+	for i, c := range contacts {
+		flowContacts[i], err = c.FlowContact(oa)
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "error creating flow contact for contact #%d", c.ID())
+		}
+	}
+
+	if err := CalculateDynamicGroups(ctx, tx, oa, flowContacts); err != nil {
+		tx.Rollback()
+		return errors.Wrapf(err, "error recalculating groups")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrapf(err, "error committing contact language changes")
+	}
+	return nil
+}
+
+// StopContacts sets the status of the passed in contacts to stopped and interrupts any waiting sessions
+func StopContacts(ctx context.Context, rt *runtime.Runtime, contactIDs []ContactID) error {
+	return changeContactsStatus(ctx, rt, contactIDs, flows.ContactStatusStopped)
+}
+
+// BlockContacts sets the status of the passed in contacts to blocked and interrupts any waiting sessions
+func BlockContacts(ctx context.Context, rt *runtime.Runtime, contactIDs []ContactID) error {
+	return changeContactsStatus(ctx, rt, contactIDs, flows.ContactStatusBlocked)
+}
+
+// ArchiveContacts sets the status of the passed in contacts to archived and interrupts any waiting sessions
+func ArchiveContacts(ctx context.Context, rt *runtime.Runtime, contactIDs []ContactID) error {
+	return changeContactsStatus(ctx, rt, contactIDs, flows.ContactStatusArchived)
+}
+
+// updates the status of the passed in contacts and interrupts their waiting sessions in a single transaction
+func changeContactsStatus(ctx context.Context, rt *runtime.Runtime, contactIDs []ContactID, status flows.ContactStatus) error {
+	changes := make([]*ContactStatusChange, len(contactIDs))
+	for i, id := range contactIDs {
+		changes[i] = &ContactStatusChange{ContactID: id, Status: status}
+	}
+
+	tx, err := rt.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.Wrapf(err, "error beginning transaction")
+	}
+
+	if err := UpdateContactStatus(ctx, tx, changes); err != nil {
+		tx.Rollback()
+		return errors.Wrapf(err, "error updating contact statuses")
+	}
+
+	if err := InterruptSessionsForContactsTx(ctx, rt, tx, contactIDs); err != nil {
+		tx.Rollback()
+		return errors.Wrapf(err, "error interrupting contact sessions")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrapf(err, "error committing transaction")
+	}
+	return nil
+}
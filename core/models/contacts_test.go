@@ -1,13 +1,18 @@
 package models_test
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
 	"sort"
 	"testing"
 	"time"
 
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"github.com/nyaruka/gocommon/dbutil/assertdb"
 	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/gocommon/uuids"
 	"github.com/nyaruka/goflow/assets"
 	"github.com/nyaruka/goflow/envs"
 	"github.com/nyaruka/goflow/flows"
@@ -165,6 +170,52 @@ func TestCreateContact(t *testing.T) {
 	assert.EqualError(t, err, "URNs in use by other contacts")
 }
 
+func TestCreateContacts(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	testdata.InsertContactGroup(db, testdata.Org1, "d636c966-79c1-4417-9f1c-82ad629773a2", "Kinyarwanda", "language = kin")
+
+	oa, err := models.GetOrgAssets(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	rich, kin, bad := "Rich", "kin", "xyz"
+
+	contacts, errs := models.CreateContacts(ctx, db, oa, models.UserID(1), []*models.ContactSpec{
+		{Name: &rich, Language: &kin, URNs: []urns.URN{"telegram:200001", "telegram:200002"}},
+		{URNs: []urns.URN{testdata.Cathy.URN}},   // URN owned by existing contact
+		{URNs: []urns.URN{"telegram:200002"}},    // URN owned by earlier spec in batch
+		{URNs: []urns.URN{"tel:(605) 574-9999"}}, // raw URN that will be normalized
+		{Language: &bad, URNs: []urns.URN{"telegram:200003"}},
+	})
+
+	require.Len(t, contacts, 5)
+	require.Len(t, errs, 5)
+
+	assert.NoError(t, errs[0])
+	assert.Equal(t, "Rich", contacts[0].Name())
+	assert.Equal(t, envs.Language(`kin`), contacts[0].Language())
+	assert.Len(t, contacts[0].URNs(), 2)
+	assert.Len(t, contacts[0].Groups().All(), 1)
+
+	assert.EqualError(t, errs[1], "URNs in use by other contacts")
+	assert.Nil(t, contacts[1])
+
+	assert.EqualError(t, errs[2], "URNs in use by other contacts")
+	assert.Nil(t, contacts[2])
+
+	assert.NoError(t, errs[3])
+	assert.Equal(t, urns.URN("tel:+16055749999"), contacts[3].URNs()[0].URN().Identity())
+
+	assert.EqualError(t, errs[4], "'xyz' is not a valid language code")
+	assert.Nil(t, contacts[4])
+
+	// successful contacts were committed even though others failed
+	assertdb.Query(t, db, `SELECT count(*) FROM contacts_contact WHERE id >= 30000`).Returns(2)
+	assertdb.Query(t, db, `SELECT count(*) FROM contacts_contacturn WHERE identity = 'telegram:200003'`).Returns(0)
+}
+
 func TestCreateContactRace(t *testing.T) {
 	ctx, rt, db, _ := testsuite.Get()
 
@@ -449,6 +500,47 @@ func TestGetContactIDsFromReferences(t *testing.T) {
 	assert.ElementsMatch(t, []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID}, ids)
 }
 
+func TestLoadContactByURN(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	// give Bob a second URN and add an orphaned URN
+	testdata.InsertContactURN(db, testdata.Org1, testdata.Bob, urns.URN("telegram:100002"), 999)
+	testdata.InsertContactURN(db, testdata.Org1, nil, urns.URN("telegram:200001"), 100)
+
+	oa, err := models.GetOrgAssets(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	tcs := []struct {
+		urn       urns.URN
+		contactID models.ContactID
+	}{
+		{testdata.Cathy.URN, testdata.Cathy.ID},
+		{urns.URN("tel:(605) 574-1111"), testdata.Cathy.ID}, // raw form normalized using org country
+		{testdata.Bob.URN, testdata.Bob.ID},
+		{urns.URN("telegram:100002"), testdata.Bob.ID},
+		{urns.URN("telegram:200001"), models.NilContactID}, // orphaned
+		{urns.URN("tel:+16055749999"), models.NilContactID},
+	}
+
+	for _, tc := range tcs {
+		contact, err := models.LoadContactByURN(ctx, db, oa, tc.urn)
+		require.NoError(t, err, "unexpected error for %s", tc.urn)
+
+		if tc.contactID == models.NilContactID {
+			assert.Nil(t, contact, "expected no contact for %s", tc.urn)
+		} else if assert.NotNil(t, contact, "expected contact for %s", tc.urn) {
+			assert.Equal(t, tc.contactID, contact.ID(), "contact mismatch for %s", tc.urn)
+		}
+	}
+
+	// contact is hydrated with all its URNs
+	contact, err := models.LoadContactByURN(ctx, db, oa, urns.URN("telegram:100002"))
+	require.NoError(t, err)
+	assert.Len(t, contact.URNs(), 2)
+}
+
 func TestStopContact(t *testing.T) {
 	ctx, _, db, _ := testsuite.Get()
 
@@ -509,6 +601,231 @@ func TestUpdateContactLastSeenAndModifiedOn(t *testing.T) {
 	assert.True(t, cathy.ModifiedOn().After(t2))
 }
 
+// wraps a database connection to count the queries made through it
+type countingDB struct {
+	*sqlx.DB
+	queries int
+}
+
+func (d *countingDB) QueryxContext(ctx context.Context, query string, args ...interface{}) (*sqlx.Rows, error) {
+	d.queries++
+	return d.DB.QueryxContext(ctx, query, args...)
+}
+
+func (d *countingDB) QueryRowxContext(ctx context.Context, query string, args ...interface{}) *sqlx.Row {
+	d.queries++
+	return d.DB.QueryRowxContext(ctx, query, args...)
+}
+
+func (d *countingDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	d.queries++
+	return d.DB.ExecContext(ctx, query, args...)
+}
+
+func (d *countingDB) NamedExecContext(ctx context.Context, query string, arg interface{}) (sql.Result, error) {
+	d.queries++
+	return d.DB.NamedExecContext(ctx, query, arg)
+}
+
+func (d *countingDB) SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	d.queries++
+	return d.DB.SelectContext(ctx, dest, query, args...)
+}
+
+func (d *countingDB) GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	d.queries++
+	return d.DB.GetContext(ctx, dest, query, args...)
+}
+
+// inserts the given number of contacts, each with a URN, a group and a field value
+func insertLoadableContacts(db *sqlx.DB, count int) []models.ContactID {
+	ids := make([]models.ContactID, count)
+	for i := 0; i < count; i++ {
+		c := testdata.InsertContact(db, testdata.Org1, flows.ContactUUID(uuids.New()), fmt.Sprintf("Contact %d", i), envs.NilLanguage, models.ContactStatusActive)
+		testdata.InsertContactURN(db, testdata.Org1, c, urns.URN(fmt.Sprintf("tel:+1605999%04d", i)), 1000)
+		db.MustExec(`INSERT INTO contacts_contactgroup_contacts(contact_id, contactgroup_id) VALUES($1, $2)`, c.ID, testdata.DoctorsGroup.ID)
+		db.MustExec(`UPDATE contacts_contact SET fields = $2 WHERE id = $1`, c.ID, fmt.Sprintf(`{"%s": {"text": "%d", "number": %d}}`, testdata.AgeField.UUID, i, i))
+		ids[i] = c.ID
+	}
+	return ids
+}
+
+func TestLoadContactsQueryCount(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshAll)
+	require.NoError(t, err)
+
+	ids := insertLoadableContacts(db, 50)
+
+	// URNs, groups and fields are all loaded together so batch size doesn't change the number of queries
+	for _, batch := range [][]models.ContactID{ids[:1], ids[:10], ids} {
+		cdb := &countingDB{DB: db}
+
+		contacts, err := models.LoadContacts(ctx, cdb, oa, batch)
+		require.NoError(t, err)
+		assert.Len(t, contacts, len(batch))
+		assert.Equal(t, 1, cdb.queries, "query count mismatch for batch of %d", len(batch))
+
+		for _, c := range contacts {
+			assert.Len(t, c.URNs(), 1)
+			assert.Len(t, c.Groups(), 1)
+			assert.NotNil(t, c.Fields()["age"])
+		}
+	}
+}
+
+func BenchmarkLoadContacts(b *testing.B) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshAll)
+	require.NoError(b, err)
+
+	ids := insertLoadableContacts(db, 100)
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, err := models.LoadContacts(ctx, db, oa, ids)
+		require.NoError(b, err)
+	}
+}
+
+func TestContactsModifiedSince(t *testing.T) {
+	ctx, _, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	t1 := time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC)
+	t2 := time.Date(2030, 1, 2, 12, 0, 0, 0, time.UTC)
+	t3 := time.Date(2030, 1, 3, 12, 0, 0, 0, time.UTC)
+
+	// put our contacts in the future so they're the only ones in our window
+	db.MustExec(`UPDATE contacts_contact SET modified_on = $2 WHERE id = $1`, testdata.Cathy.ID, t2)
+	db.MustExec(`UPDATE contacts_contact SET modified_on = $2 WHERE id = $1`, testdata.Bob.ID, t3)
+	db.MustExec(`UPDATE contacts_contact SET modified_on = $2 WHERE id = $1`, testdata.George.ID, t1)
+	db.MustExec(`UPDATE contacts_contact SET modified_on = $2 WHERE id = $1`, testdata.Org2Contact.ID, t2)
+	db.MustExec(`UPDATE contacts_contact SET modified_on = $2, is_active = FALSE WHERE id = $1`, testdata.Alexandria.ID, t2)
+
+	since := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	modified, err := models.ContactsModifiedSince(ctx, db, testdata.Org1.ID, since, models.NilContactID, 10)
+	require.NoError(t, err)
+	require.Len(t, modified, 3)
+	assert.Equal(t, testdata.George.ID, modified[0].ID)
+	assert.Equal(t, t1, modified[0].ModifiedOn.UTC())
+	assert.Equal(t, testdata.Cathy.ID, modified[1].ID)
+	assert.Equal(t, t2, modified[1].ModifiedOn.UTC())
+	assert.Equal(t, testdata.Bob.ID, modified[2].ID)
+	assert.Equal(t, t3, modified[2].ModifiedOn.UTC())
+
+	// limit is respected and the last modified_on and id can be used as the next cursor
+	modified, err = models.ContactsModifiedSince(ctx, db, testdata.Org1.ID, since, models.NilContactID, 2)
+	require.NoError(t, err)
+	require.Len(t, modified, 2)
+	assert.Equal(t, testdata.Cathy.ID, modified[1].ID)
+
+	modified, err = models.ContactsModifiedSince(ctx, db, testdata.Org1.ID, modified[1].ModifiedOn, modified[1].ID, 2)
+	require.NoError(t, err)
+	require.Len(t, modified, 1)
+	assert.Equal(t, testdata.Bob.ID, modified[0].ID)
+
+	// nothing after our last change
+	modified, err = models.ContactsModifiedSince(ctx, db, testdata.Org1.ID, t3, testdata.Bob.ID, 10)
+	require.NoError(t, err)
+	assert.Len(t, modified, 0)
+
+	// when more contacts than the limit share a modified_on, paging by id doesn't skip any of them
+	t4 := time.Date(2030, 1, 4, 12, 0, 0, 0, time.UTC)
+	db.MustExec(`UPDATE contacts_contact SET modified_on = $2 WHERE id = ANY($1)`, pq.Array([]models.ContactID{testdata.Cathy.ID, testdata.Bob.ID, testdata.George.ID}), t4)
+
+	modified, err = models.ContactsModifiedSince(ctx, db, testdata.Org1.ID, t3, testdata.Bob.ID, 2)
+	require.NoError(t, err)
+	require.Len(t, modified, 2)
+	assert.Equal(t, testdata.Cathy.ID, modified[0].ID)
+	assert.Equal(t, testdata.Bob.ID, modified[1].ID)
+	assert.Equal(t, t4, modified[1].ModifiedOn.UTC())
+
+	modified, err = models.ContactsModifiedSince(ctx, db, testdata.Org1.ID, modified[1].ModifiedOn, modified[1].ID, 2)
+	require.NoError(t, err)
+	require.Len(t, modified, 1)
+	assert.Equal(t, testdata.George.ID, modified[0].ID)
+
+	modified, err = models.ContactsModifiedSince(ctx, db, testdata.Org1.ID, modified[0].ModifiedOn, modified[0].ID, 2)
+	require.NoError(t, err)
+	assert.Len(t, modified, 0)
+}
+
+func TestGetContactIDsByExternalIDs(t *testing.T) {
+	ctx, _, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	testdata.InsertContactURN(db, testdata.Org1, testdata.Cathy, "ext:A1234", 1000)
+	testdata.InsertContactURN(db, testdata.Org1, testdata.Bob, "ext:B5678", 1000)
+	testdata.InsertContactURN(db, testdata.Org2, testdata.Org2Contact, "ext:C9012", 1000)
+
+	ids, err := models.GetContactIDsByExternalIDs(ctx, db, testdata.Org1.ID, []string{"A1234", "B5678", "C9012", "D3456"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]models.ContactID{"A1234": testdata.Cathy.ID, "B5678": testdata.Bob.ID}, ids)
+
+	// inactive contacts aren't matched
+	db.MustExec(`UPDATE contacts_contact SET is_active = FALSE WHERE id = $1`, testdata.Bob.ID)
+
+	ids, err = models.GetContactIDsByExternalIDs(ctx, db, testdata.Org1.ID, []string{"A1234", "B5678"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]models.ContactID{"A1234": testdata.Cathy.ID}, ids)
+}
+
+func TestRecalculateDynamicGroups(t *testing.T) {
+	ctx, rt, db, rp := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	olds := testdata.InsertContactGroup(db, testdata.Org1, "2cc0d3fd-2bf3-4a7f-8ad8-4ab6ac4bf3ac", "Olds", "age > 30")
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshGroups)
+	require.NoError(t, err)
+
+	setAge := func(contact *testdata.Contact, age int) {
+		db.MustExec(`UPDATE contacts_contact SET fields = $2 WHERE id = $1`, contact.ID, fmt.Sprintf(`{"%s": {"text": "%d", "number": %d}}`, testdata.AgeField.UUID, age, age))
+	}
+	assertInGroup := func(contact *testdata.Contact, expected int) {
+		assertdb.Query(t, db, `SELECT count(*) FROM contacts_contactgroup_contacts WHERE contact_id = $1 AND contactgroup_id = $2`, contact.ID, olds.ID).Returns(expected)
+	}
+
+	// update fields directly as a bulk update would
+	setAge(testdata.Cathy, 40)
+	setAge(testdata.Bob, 20)
+
+	err = models.RecalculateDynamicGroups(ctx, db, rp, oa, []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID})
+	require.NoError(t, err)
+
+	assertInGroup(testdata.Cathy, 1)
+	assertInGroup(testdata.Bob, 0)
+
+	// flip their ages and recalculate again
+	setAge(testdata.Cathy, 20)
+	setAge(testdata.Bob, 40)
+
+	err = models.RecalculateDynamicGroups(ctx, db, rp, oa, []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID})
+	require.NoError(t, err)
+
+	assertInGroup(testdata.Cathy, 0)
+	assertInGroup(testdata.Bob, 1)
+
+	// and their locks have been released
+	for _, c := range []*testdata.Contact{testdata.Cathy, testdata.Bob} {
+		lock, err := models.GetContactLocker(testdata.Org1.ID, c.ID).Grab(rp, time.Second)
+		require.NoError(t, err)
+		assert.NotEqual(t, "", lock)
+	}
+}
+
 func TestUpdateContactStatus(t *testing.T) {
 	ctx, _, db, _ := testsuite.Get()
 
@@ -540,6 +857,179 @@ func TestUpdateContactStatus(t *testing.T) {
 
 }
 
+func TestAddContactURNs(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	// add an orphaned URN
+	testdata.InsertContactURN(db, testdata.Org1, nil, urns.URN("telegram:200002"), 100)
+
+	oa, err := models.GetOrgAssets(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	conflicts, err := models.AddContactURNs(ctx, db, oa, map[models.ContactID]urns.URN{
+		testdata.Cathy.ID:      urns.URN("whatsapp:250788000001"),
+		testdata.Bob.ID:        testdata.Cathy.URN,          // owned by another contact
+		testdata.George.ID:     urns.URN("telegram:200002"), // orphaned so can be claimed
+		testdata.Alexandria.ID: urns.URN("telegram:200002"), // claimed by earlier contact in batch
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[models.ContactID]urns.URN{
+		testdata.Bob.ID:        testdata.Cathy.URN,
+		testdata.Alexandria.ID: urns.URN("telegram:200002"),
+	}, conflicts)
+
+	assertdb.Query(t, db, `SELECT contact_id FROM contacts_contacturn WHERE identity = 'whatsapp:250788000001'`).Returns(int64(testdata.Cathy.ID))
+	assertdb.Query(t, db, `SELECT contact_id FROM contacts_contacturn WHERE identity = 'telegram:200002'`).Returns(int64(testdata.George.ID))
+	assertdb.Query(t, db, `SELECT contact_id FROM contacts_contacturn WHERE identity = $1`, testdata.Cathy.URN.Identity()).Returns(int64(testdata.Cathy.ID))
+	assertdb.Query(t, db, `SELECT count(*) FROM contacts_contacturn WHERE contact_id = $1`, testdata.Bob.ID).Returns(1)
+
+	// new URNs come after existing ones
+	cathy, err := models.LoadContact(ctx, db, oa, testdata.Cathy.ID)
+	require.NoError(t, err)
+	require.Len(t, cathy.URNs(), 2)
+	assert.Equal(t, urns.URN("whatsapp:250788000001"), cathy.URNs()[1].Identity())
+
+	// URNs which the contact already has are ignored
+	conflicts, err = models.AddContactURNs(ctx, db, oa, map[models.ContactID]urns.URN{testdata.Cathy.ID: urns.URN("whatsapp:250788000001")})
+	require.NoError(t, err)
+	assert.Len(t, conflicts, 0)
+	assertdb.Query(t, db, `SELECT count(*) FROM contacts_contacturn WHERE contact_id = $1`, testdata.Cathy.ID).Returns(2)
+
+	// URNs with the same identity conflict even if they differ otherwise
+	conflicts, err = models.AddContactURNs(ctx, db, oa, map[models.ContactID]urns.URN{
+		testdata.George.ID:     urns.URN("telegram:300003"),
+		testdata.Alexandria.ID: urns.URN("telegram:300003#alex"),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[models.ContactID]urns.URN{testdata.Alexandria.ID: urns.URN("telegram:300003#alex")}, conflicts)
+	assertdb.Query(t, db, `SELECT contact_id FROM contacts_contacturn WHERE identity = 'telegram:300003'`).Returns(int64(testdata.George.ID))
+
+	// invalid URNs are errors
+	_, err = models.AddContactURNs(ctx, db, oa, map[models.ContactID]urns.URN{testdata.Bob.ID: urns.URN("xyz:123")})
+	assert.Error(t, err)
+
+	// as are contacts from other orgs, in which case nothing is added
+	_, err = models.AddContactURNs(ctx, db, oa, map[models.ContactID]urns.URN{
+		testdata.Bob.ID:         urns.URN("telegram:400004"),
+		testdata.Org2Contact.ID: urns.URN("telegram:400005"),
+	})
+	assert.EqualError(t, err, fmt.Sprintf("not all contacts belong to org #%d", testdata.Org1.ID))
+	assertdb.Query(t, db, `SELECT count(*) FROM contacts_contacturn WHERE identity IN ('telegram:400004', 'telegram:400005')`).Returns(0)
+}
+
+func TestSetContactLanguage(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	kinGroup := testdata.InsertContactGroup(db, testdata.Org1, "d636c966-79c1-4417-9f1c-82ad629773a2", "Kinyarwanda", "language = kin")
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshGroups)
+	require.NoError(t, err)
+
+	err = models.SetContactLanguage(ctx, db, oa, []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID}, envs.Language("xyz"))
+	assert.EqualError(t, err, "'xyz' is not a valid language code")
+
+	err = models.SetContactLanguage(ctx, db, oa, []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID, testdata.George.ID}, envs.Language("kin"))
+	require.NoError(t, err)
+
+	assertdb.Query(t, db, `SELECT count(*) FROM contacts_contact WHERE language = 'kin'`).Returns(3)
+	assertdb.Query(t, db, `SELECT count(*) FROM contacts_contactgroup_contacts WHERE contactgroup_id = $1`, kinGroup.ID).Returns(3)
+
+	// changing language again removes contacts from the group
+	err = models.SetContactLanguage(ctx, db, oa, []models.ContactID{testdata.Cathy.ID}, envs.Language("eng"))
+	require.NoError(t, err)
+
+	assertdb.Query(t, db, `SELECT language FROM contacts_contact WHERE id = $1`, testdata.Cathy.ID).Returns("eng")
+	assertdb.Query(t, db, `SELECT count(*) FROM contacts_contactgroup_contacts WHERE contactgroup_id = $1`, kinGroup.ID).Returns(2)
+
+	// as does clearing it
+	err = models.SetContactLanguage(ctx, db, oa, []models.ContactID{testdata.Bob.ID}, envs.NilLanguage)
+	require.NoError(t, err)
+
+	assertdb.Query(t, db, `SELECT count(*) FROM contacts_contact WHERE id = $1 AND language IS NULL`, testdata.Bob.ID).Returns(1)
+	assertdb.Query(t, db, `SELECT count(*) FROM contacts_contactgroup_contacts WHERE contactgroup_id = $1`, kinGroup.ID).Returns(1)
+}
+
+func TestStopBlockArchiveContacts(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	session1ID, _ := insertSessionAndRun(db, testdata.Cathy, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, models.NilCallID)
+	session2ID, _ := insertSessionAndRun(db, testdata.Bob, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, models.NilCallID)
+	session3ID, _ := insertSessionAndRun(db, testdata.George, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, models.NilCallID)
+	session4ID, _ := insertSessionAndRun(db, testdata.Alexandria, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, models.NilCallID)
+
+	err := models.StopContacts(ctx, rt, []models.ContactID{testdata.Cathy.ID})
+	require.NoError(t, err)
+
+	err = models.BlockContacts(ctx, rt, []models.ContactID{testdata.Bob.ID})
+	require.NoError(t, err)
+
+	err = models.ArchiveContacts(ctx, rt, []models.ContactID{testdata.George.ID})
+	require.NoError(t, err)
+
+	assertdb.Query(t, db, `SELECT status FROM contacts_contact WHERE id = $1`, testdata.Cathy.ID).Returns("S")
+	assertdb.Query(t, db, `SELECT status FROM contacts_contact WHERE id = $1`, testdata.Bob.ID).Returns("B")
+	assertdb.Query(t, db, `SELECT status FROM contacts_contact WHERE id = $1`, testdata.George.ID).Returns("V")
+	assertdb.Query(t, db, `SELECT status FROM contacts_contact WHERE id = $1`, testdata.Alexandria.ID).Returns("A")
+
+	assertSessionAndRunStatus(t, db, session1ID, models.SessionStatusInterrupted)
+	assertSessionAndRunStatus(t, db, session2ID, models.SessionStatusInterrupted)
+	assertSessionAndRunStatus(t, db, session3ID, models.SessionStatusInterrupted)
+	assertSessionAndRunStatus(t, db, session4ID, models.SessionStatusWaiting) // not included
+
+	assertdb.Query(t, db, `SELECT count(*) FROM contacts_contact WHERE id IN ($1, $2, $3) AND current_flow_id IS NULL`, testdata.Cathy.ID, testdata.Bob.ID, testdata.George.ID).Returns(3)
+}
+
+func TestReorderContactURNs(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	oa, err := models.GetOrgAssets(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	testdata.InsertContactURN(db, testdata.Org1, testdata.Cathy, "twitter:cathy", 500)
+	testdata.InsertContactURN(db, testdata.Org1, testdata.Cathy, "telegram:12345", 100)
+
+	assertContactURNs := func(expected []string) {
+		var actual []string
+		err = db.Select(&actual, `SELECT identity FROM contacts_contacturn WHERE contact_id = $1 ORDER BY priority DESC`, testdata.Cathy.ID)
+		require.NoError(t, err)
+		assert.Equal(t, expected, actual)
+	}
+
+	assertContactURNs([]string{"tel:+16055741111", "twitter:cathy", "telegram:12345"})
+
+	db.MustExec(`UPDATE contacts_contact SET modified_on = '2020-01-01T00:00:00Z' WHERE id = $1`, testdata.Cathy.ID)
+
+	err = models.ReorderContactURNs(ctx, db, oa, testdata.Cathy.ID, []urns.URN{"telegram:12345", "tel:+16055741111", "twitter:cathy"})
+	assert.NoError(t, err)
+
+	assertContactURNs([]string{"telegram:12345", "tel:+16055741111", "twitter:cathy"})
+	assertdb.Query(t, db, `SELECT count(*) FROM contacts_contacturn WHERE contact_id = $1 AND identity = 'telegram:12345' AND priority = 1000`, testdata.Cathy.ID).Returns(1)
+	assertdb.Query(t, db, `SELECT count(*) FROM contacts_contact WHERE id = $1 AND modified_on > '2020-01-01T00:00:00Z'`, testdata.Cathy.ID).Returns(1)
+
+	// URNs which don't belong to the contact are rejected
+	err = models.ReorderContactURNs(ctx, db, oa, testdata.Cathy.ID, []urns.URN{"tel:+16055742222", "tel:+16055741111", "twitter:cathy", "telegram:12345"})
+	assert.EqualError(t, err, "URN tel:+16055742222 doesn't belong to contact 10000")
+
+	// as are orderings which leave out some of the contact's URNs
+	err = models.ReorderContactURNs(ctx, db, oa, testdata.Cathy.ID, []urns.URN{"twitter:cathy", "tel:+16055741111"})
+	assert.EqualError(t, err, "expected all 3 URNs of contact 10000, got 2")
+
+	// or include them twice
+	err = models.ReorderContactURNs(ctx, db, oa, testdata.Cathy.ID, []urns.URN{"twitter:cathy", "twitter:cathy", "tel:+16055741111"})
+	assert.EqualError(t, err, "URN twitter:cathy is included more than once")
+
+	// and none of those changed anything
+	assertContactURNs([]string{"telegram:12345", "tel:+16055741111", "twitter:cathy"})
+}
+
 func TestUpdateContactURNs(t *testing.T) {
 	ctx, rt, db, _ := testsuite.Get()
 
@@ -2,6 +2,8 @@ package models
 
 import (
 	"context"
+	"sort"
+	"sync"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/nyaruka/goflow/flows"
@@ -9,9 +11,13 @@ import (
 	"github.com/nyaruka/goflow/flows/modifiers"
 	"github.com/nyaruka/mailroom/core/goflow"
 	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/correlation"
 	"github.com/pkg/errors"
 )
 
+// max number of goroutines used to apply modifiers to different contacts
+const modifierWorkers = 8
+
 // Scene represents the context that events are occurring in
 type Scene struct {
 	contact *flows.Contact
@@ -44,6 +50,37 @@ func NewSceneForContact(contact *flows.Contact, userID UserID) *Scene {
 	}
 }
 
+// NewScenesForContactIDs loads the contacts with the given ids and creates a new scene for each, in the same order as
+// the ids. Contacts which no longer exist or are inactive are skipped.
+func NewScenesForContactIDs(ctx context.Context, db Queryer, oa *OrgAssets, ids []ContactID, userID UserID) ([]*Scene, error) {
+	contacts, err := LoadContacts(ctx, db, oa, ids)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading contacts")
+	}
+
+	byID := make(map[ContactID]*Contact, len(contacts))
+	for _, c := range contacts {
+		byID[c.ID()] = c
+	}
+
+	scenes := make([]*Scene, 0, len(contacts))
+	for _, id := range ids {
+		contact := byID[id]
+		if contact == nil {
+			continue
+		}
+
+		flowContact, err := contact.FlowContact(oa)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error creating flow contact for contact #%d", id)
+		}
+
+		scenes = append(scenes, NewSceneForContact(flowContact, userID))
+	}
+
+	return scenes, nil
+}
+
 // SessionID returns the session id for this scene if any
 func (s *Scene) SessionID() SessionID {
 	if s.session == nil {
@@ -189,12 +226,34 @@ func ApplyEventPostCommitHooks(ctx context.Context, rt *runtime.Runtime, tx *sql
 // HandleAndCommitEvents takes a set of contacts and events, handles the events and applies any hooks, and commits everything
 func HandleAndCommitEvents(ctx context.Context, rt *runtime.Runtime, oa *OrgAssets, userID UserID, contactEvents map[*flows.Contact][]flows.Event) error {
 	// create scenes for each contact
-	scenes := make([]*Scene, 0, len(contactEvents))
-	for contact := range contactEvents {
-		scene := NewSceneForContact(contact, userID)
+	sceneEvents := make(map[*Scene][]flows.Event, len(contactEvents))
+	for contact, events := range contactEvents {
+		sceneEvents[NewSceneForContact(contact, userID)] = events
+	}
+
+	return ApplyScenes(ctx, rt, oa, sceneEvents)
+}
+
+// ApplyScenes handles the given events for each scene and applies the resulting pre commit hooks in one transaction
+// and post commit hooks in a second. If anything fails, the transaction in progress is rolled back.
+func ApplyScenes(ctx context.Context, rt *runtime.Runtime, oa *OrgAssets, sceneEvents map[*Scene][]flows.Event) error {
+	scenes := make([]*Scene, 0, len(sceneEvents))
+	for scene := range sceneEvents {
 		scenes = append(scenes, scene)
 	}
 
+	// handle scenes in a consistent order regardless of how they were computed
+	sort.Slice(scenes, func(i, j int) bool { return scenes[i].ContactID() < scenes[j].ContactID() })
+
+	if err := applyScenesPreCommit(ctx, rt, oa, scenes, sceneEvents); err != nil {
+		return err
+	}
+
+	return applyScenesPostCommit(ctx, rt, oa, scenes)
+}
+
+// handles the events for the given scenes and applies the resulting pre commit hooks in a single transaction
+func applyScenesPreCommit(ctx context.Context, rt *runtime.Runtime, oa *OrgAssets, scenes []*Scene, sceneEvents map[*Scene][]flows.Event) error {
 	// begin the transaction for pre-commit hooks
 	tx, err := rt.DB.BeginTxx(ctx, nil)
 	if err != nil {
@@ -203,8 +262,9 @@ func HandleAndCommitEvents(ctx context.Context, rt *runtime.Runtime, oa *OrgAsse
 
 	// handle the events to create the hooks on each scene
 	for _, scene := range scenes {
-		err := HandleEvents(ctx, rt, tx, oa, scene, contactEvents[scene.Contact()])
+		err := HandleEvents(ctx, rt, tx, oa, scene, sceneEvents[scene])
 		if err != nil {
+			tx.Rollback()
 			return errors.Wrapf(err, "error applying events")
 		}
 	}
@@ -212,6 +272,7 @@ func HandleAndCommitEvents(ctx context.Context, rt *runtime.Runtime, oa *OrgAsse
 	// gather all our pre commit events, group them by hook and apply them
 	err = ApplyEventPreCommitHooks(ctx, rt, tx, oa, scenes)
 	if err != nil {
+		tx.Rollback()
 		return errors.Wrapf(err, "error applying pre commit hooks")
 	}
 
@@ -219,9 +280,13 @@ func HandleAndCommitEvents(ctx context.Context, rt *runtime.Runtime, oa *OrgAsse
 	if err := tx.Commit(); err != nil {
 		return errors.Wrapf(err, "error committing pre commit hooks")
 	}
+	return nil
+}
 
+// applies the post commit hooks of the given scenes in a single transaction
+func applyScenesPostCommit(ctx context.Context, rt *runtime.Runtime, oa *OrgAssets, scenes []*Scene) error {
 	// begin the transaction for post-commit hooks
-	tx, err = rt.DB.BeginTxx(ctx, nil)
+	tx, err := rt.DB.BeginTxx(ctx, nil)
 	if err != nil {
 		return errors.Wrapf(err, "error beginning transaction for post commit")
 	}
@@ -229,6 +294,7 @@ func HandleAndCommitEvents(ctx context.Context, rt *runtime.Runtime, oa *OrgAsse
 	// apply the post commit hooks
 	err = ApplyEventPostCommitHooks(ctx, rt, tx, oa, scenes)
 	if err != nil {
+		tx.Rollback()
 		return errors.Wrapf(err, "error applying post commit hooks")
 	}
 
@@ -243,28 +309,129 @@ func HandleAndCommitEvents(ctx context.Context, rt *runtime.Runtime, oa *OrgAsse
 // Note that we don't load the user object from org assets because it's possible that the user isn't part
 // of the org, e.g. customer support.
 func ApplyModifiers(ctx context.Context, rt *runtime.Runtime, oa *OrgAssets, userID UserID, modifiersByContact map[*flows.Contact][]flows.Modifier) (map[*flows.Contact][]flows.Event, error) {
+	eventsByContact := ComputeModifierEvents(rt, oa, modifiersByContact)
+
+	err := HandleAndCommitEvents(ctx, rt, oa, userID, eventsByContact)
+	if err != nil {
+		return nil, errors.Wrap(err, "error commiting events")
+	}
+
+	return eventsByContact, nil
+}
+
+// ApplyModifiersForEach is like ApplyModifiers but if handling the events of all the contacts together fails, each
+// contact is retried in transactions of its own so that one failing contact doesn't prevent the others from being
+// modified. Errors for the contacts which still fail are returned by contact. Post commit hooks are only applied once
+// the contact's changes are committed, so failures applying those are logged rather than returned as the contact was
+// still modified.
+func ApplyModifiersForEach(ctx context.Context, rt *runtime.Runtime, oa *OrgAssets, userID UserID, modifiersByContact map[*flows.Contact][]flows.Modifier) (map[*flows.Contact][]flows.Event, map[*flows.Contact]error) {
+	eventsByContact := ComputeModifierEvents(rt, oa, modifiersByContact)
+	errs := make(map[*flows.Contact]error)
+
+	contacts := make([]*flows.Contact, 0, len(eventsByContact))
+	for contact := range eventsByContact {
+		contacts = append(contacts, contact)
+	}
+	sort.Slice(contacts, func(i, j int) bool { return contacts[i].ID() < contacts[j].ID() })
+
+	// scenes can't be reused after a failure as they may already have hooks added, so we create new ones for each attempt
+	newScenes := func(contacts []*flows.Contact) ([]*Scene, map[*Scene][]flows.Event) {
+		scenes := make([]*Scene, len(contacts))
+		sceneEvents := make(map[*Scene][]flows.Event, len(contacts))
+		for i, contact := range contacts {
+			scenes[i] = NewSceneForContact(contact, userID)
+			sceneEvents[scenes[i]] = eventsByContact[contact]
+		}
+		return scenes, sceneEvents
+	}
+
+	scenes, sceneEvents := newScenes(contacts)
+
+	if err := applyScenesPreCommit(ctx, rt, oa, scenes, sceneEvents); err != nil {
+		correlation.Logger(ctx).WithError(err).Debug("failed handling modifier events in bulk, retrying one contact at a time")
+
+		scenes = make([]*Scene, 0, len(contacts))
+
+		for _, contact := range contacts {
+			contactScenes, contactSceneEvents := newScenes([]*flows.Contact{contact})
+
+			if err := applyScenesPreCommit(ctx, rt, oa, contactScenes, contactSceneEvents); err != nil {
+				errs[contact] = err
+			} else {
+				scenes = append(scenes, contactScenes...)
+			}
+		}
+	}
+
+	if err := applyScenesPostCommit(ctx, rt, oa, scenes); err != nil {
+		correlation.Logger(ctx).WithError(err).Debug("failed applying modifier post commit hooks in bulk, retrying one contact at a time")
+
+		for _, scene := range scenes {
+			if err := applyScenesPostCommit(ctx, rt, oa, []*Scene{scene}); err != nil {
+				correlation.Logger(ctx).WithError(err).WithField("contact_uuid", scene.ContactUUID()).Error("error applying modifier post commit hooks")
+			}
+		}
+	}
+
+	return eventsByContact, errs
+}
+
+// ComputeModifierEvents applies the given modifiers to each contact and returns the resultant events without handling
+// or committing them. Contacts are independent of each other so are modified concurrently.
+func ComputeModifierEvents(rt *runtime.Runtime, oa *OrgAssets, modifiersByContact map[*flows.Contact][]flows.Modifier) map[*flows.Contact][]flows.Event {
 	// create an environment instance with location support
 	env := flows.NewEnvironment(oa.Env(), oa.SessionAssets().Locations())
 
 	svcs := goflow.Engine(rt.Config).Services()
 
-	eventsByContact := make(map[*flows.Contact][]flows.Event, len(modifiersByContact))
+	contacts := make([]*flows.Contact, 0, len(modifiersByContact))
+	for contact := range modifiersByContact {
+		contacts = append(contacts, contact)
+	}
+	contactEvents := make([][]flows.Event, len(contacts))
 
-	// apply the modifiers to get the events for each contact
-	for contact, mods := range modifiersByContact {
-		events := make([]flows.Event, 0)
-		for _, mod := range mods {
-			modifiers.Apply(env, svcs, oa.SessionAssets(), contact, mod, func(e flows.Event) { events = append(events, e) })
+	// applies the modifiers for the contact at the given index
+	apply := func(i int) {
+		evts := make([]flows.Event, 0)
+		for _, mod := range modifiersByContact[contacts[i]] {
+			modifiers.Apply(env, svcs, oa.SessionAssets(), contacts[i], mod, func(e flows.Event) { evts = append(evts, e) })
 		}
-		eventsByContact[contact] = events
+		contactEvents[i] = evts
 	}
 
-	err := HandleAndCommitEvents(ctx, rt, oa, userID, eventsByContact)
-	if err != nil {
-		return nil, errors.Wrap(err, "error commiting events")
+	// no point spinning up goroutines for a single contact
+	if len(contacts) == 1 {
+		apply(0)
+	} else {
+		indexes := make(chan int, len(contacts))
+		for i := range contacts {
+			indexes <- i
+		}
+		close(indexes)
+
+		workers := modifierWorkers
+		if len(contacts) < workers {
+			workers = len(contacts)
+		}
+
+		wg := &sync.WaitGroup{}
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range indexes {
+					apply(i)
+				}
+			}()
+		}
+		wg.Wait()
 	}
 
-	return eventsByContact, nil
+	eventsByContact := make(map[*flows.Contact][]flows.Event, len(contacts))
+	for i, contact := range contacts {
+		eventsByContact[contact] = contactEvents[i]
+	}
+	return eventsByContact
 }
 
 // TypeSprintEnded is a pseudo event that lets add hooks for changes to a contacts current flow or flow history
@@ -0,0 +1,263 @@
+package models_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/gocommon/dbutil/assertdb"
+	"github.com/nyaruka/goflow/envs"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/flows/events"
+	"github.com/nyaruka/goflow/flows/modifiers"
+	"github.com/nyaruka/mailroom/core/goflow"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testEventTypeRename = "test_rename"
+
+// event type whose handler renames the contact and then fails
+type testRenameEvent struct {
+	events.BaseEvent
+}
+
+func init() {
+	models.RegisterEventHandler(testEventTypeRename, func(ctx context.Context, rt *runtime.Runtime, tx *sqlx.Tx, oa *models.OrgAssets, scene *models.Scene, e flows.Event) error {
+		if _, err := tx.ExecContext(ctx, `UPDATE contacts_contact SET name = 'Handled' WHERE id = $1`, scene.ContactID()); err != nil {
+			return err
+		}
+		return errors.New("handler failed")
+	})
+}
+
+// hook which renames each contact and then optionally fails
+type testRenameHook struct {
+	name string
+	fail bool
+}
+
+func (h *testRenameHook) Apply(ctx context.Context, rt *runtime.Runtime, tx *sqlx.Tx, oa *models.OrgAssets, scenes map[*models.Scene][]interface{}) error {
+	for scene := range scenes {
+		if _, err := tx.ExecContext(ctx, `UPDATE contacts_contact SET name = $2 WHERE id = $1`, scene.ContactID(), h.name); err != nil {
+			return err
+		}
+	}
+	if h.fail {
+		return errors.New("hook failed")
+	}
+	return nil
+}
+
+func TestNewScenesForContactIDs(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	db.MustExec(`UPDATE contacts_contact SET is_active = FALSE WHERE id = $1`, testdata.George.ID)
+
+	oa, err := models.GetOrgAssets(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	scenes, err := models.NewScenesForContactIDs(ctx, db, oa, []models.ContactID{testdata.Bob.ID, testdata.George.ID, testdata.Alexandria.ID, testdata.Cathy.ID}, testdata.Admin.ID)
+	require.NoError(t, err)
+
+	// inactive contacts are skipped but order is otherwise preserved
+	require.Len(t, scenes, 3)
+	assert.Equal(t, testdata.Bob.ID, scenes[0].ContactID())
+	assert.Equal(t, testdata.Alexandria.ID, scenes[1].ContactID())
+	assert.Equal(t, testdata.Cathy.ID, scenes[2].ContactID())
+
+	assert.Equal(t, testdata.Bob.UUID, scenes[0].ContactUUID())
+	assert.Equal(t, "Bob", scenes[0].Contact().Name())
+	assert.Equal(t, testdata.Admin.ID, scenes[0].UserID())
+	assert.Equal(t, models.SessionID(0), scenes[0].SessionID())
+
+	// no ids, no scenes
+	scenes, err = models.NewScenesForContactIDs(ctx, db, oa, []models.ContactID{}, testdata.Admin.ID)
+	require.NoError(t, err)
+	assert.Len(t, scenes, 0)
+}
+
+func TestApplyScenes(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	oa, err := models.GetOrgAssets(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	_, cathy := testdata.Cathy.Load(db, oa)
+
+	// failure handling events rolls back anything the handlers did
+	scene := models.NewSceneForContact(cathy, models.NilUserID)
+	err = models.ApplyScenes(ctx, rt, oa, map[*models.Scene][]flows.Event{
+		scene: {&testRenameEvent{BaseEvent: events.NewBaseEvent(testEventTypeRename)}},
+	})
+	assert.EqualError(t, err, "error applying events: handler failed")
+	assertdb.Query(t, db, `SELECT name FROM contacts_contact WHERE id = $1`, testdata.Cathy.ID).Returns("Cathy")
+
+	// failure applying pre commit hooks rolls back everything
+	scene = models.NewSceneForContact(cathy, models.NilUserID)
+	scene.AppendToEventPreCommitHook(&testRenameHook{name: "Pre", fail: true}, nil)
+	scene.AppendToEventPostCommitHook(&testRenameHook{name: "Post"}, nil)
+
+	err = models.ApplyScenes(ctx, rt, oa, map[*models.Scene][]flows.Event{scene: {}})
+	assert.EqualError(t, err, "error applying pre commit hooks: error applying pre commit hook: *models_test.testRenameHook: hook failed")
+	assertdb.Query(t, db, `SELECT name FROM contacts_contact WHERE id = $1`, testdata.Cathy.ID).Returns("Cathy")
+
+	// failure applying post commit hooks only rolls back the post commit changes
+	scene = models.NewSceneForContact(cathy, models.NilUserID)
+	scene.AppendToEventPreCommitHook(&testRenameHook{name: "Pre"}, nil)
+	scene.AppendToEventPostCommitHook(&testRenameHook{name: "Post", fail: true}, nil)
+
+	err = models.ApplyScenes(ctx, rt, oa, map[*models.Scene][]flows.Event{scene: {}})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "error applying post commit hooks: ")
+	assertdb.Query(t, db, `SELECT name FROM contacts_contact WHERE id = $1`, testdata.Cathy.ID).Returns("Pre")
+
+	// and when nothing fails, both phases are committed
+	scene = models.NewSceneForContact(cathy, models.NilUserID)
+	scene.AppendToEventPreCommitHook(&testRenameHook{name: "Pre"}, nil)
+	scene.AppendToEventPostCommitHook(&testRenameHook{name: "Post"}, nil)
+
+	err = models.ApplyScenes(ctx, rt, oa, map[*models.Scene][]flows.Event{scene: {}})
+	assert.NoError(t, err)
+	assertdb.Query(t, db, `SELECT name FROM contacts_contact WHERE id = $1`, testdata.Cathy.ID).Returns("Post")
+}
+
+func TestApplyModifiersForEach(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	// add a trigger which fails any update to Bob
+	db.MustExec(`CREATE FUNCTION test_fail_bob() RETURNS trigger AS $$ BEGIN IF NEW.id = 10001 THEN RAISE EXCEPTION 'bob is read only'; END IF; RETURN NEW; END; $$ LANGUAGE plpgsql`)
+	db.MustExec(`CREATE TRIGGER test_fail_bob BEFORE UPDATE ON contacts_contact FOR EACH ROW EXECUTE PROCEDURE test_fail_bob()`)
+	defer db.MustExec(`DROP FUNCTION test_fail_bob() CASCADE`)
+
+	oa, err := models.GetOrgAssets(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	_, cathy := testdata.Cathy.Load(db, oa)
+	_, bob := testdata.Bob.Load(db, oa)
+	_, george := testdata.George.Load(db, oa)
+
+	eventsByContact, errs := models.ApplyModifiersForEach(ctx, rt, oa, testdata.Admin.ID, map[*flows.Contact][]flows.Modifier{
+		cathy:  {modifiers.NewName("Kathy")},
+		bob:    {modifiers.NewName("Robert")},
+		george: {modifiers.NewName("Jorge")},
+	})
+
+	assert.Len(t, eventsByContact, 3)
+	assert.Len(t, eventsByContact[cathy], 1)
+
+	// bob failed but that didn't stop the others being saved
+	assert.Len(t, errs, 1)
+	assert.Contains(t, errs[bob].Error(), "bob is read only")
+
+	assertdb.Query(t, db, `SELECT name FROM contacts_contact WHERE id = $1`, testdata.Cathy.ID).Returns("Kathy")
+	assertdb.Query(t, db, `SELECT name FROM contacts_contact WHERE id = $1`, testdata.Bob.ID).Returns("Bob")
+	assertdb.Query(t, db, `SELECT name FROM contacts_contact WHERE id = $1`, testdata.George.ID).Returns("Jorge")
+
+	// when nothing fails, there are no errors
+	_, cathy = testdata.Cathy.Load(db, oa)
+
+	_, errs = models.ApplyModifiersForEach(ctx, rt, oa, testdata.Admin.ID, map[*flows.Contact][]flows.Modifier{
+		cathy: {modifiers.NewName("Cathy")},
+	})
+	assert.Len(t, errs, 0)
+
+	assertdb.Query(t, db, `SELECT name FROM contacts_contact WHERE id = $1`, testdata.Cathy.ID).Returns("Cathy")
+}
+
+// builds a set of modifiers for each of the given contacts, loading new instances of the contacts
+func buildModifierBatch(oa *models.OrgAssets, db *sqlx.DB, contacts []*testdata.Contact) map[*flows.Contact][]flows.Modifier {
+	age := oa.SessionAssets().Fields().Get("age")
+
+	modifiersByContact := make(map[*flows.Contact][]flows.Modifier, len(contacts))
+	for i, c := range contacts {
+		_, contact := c.Load(db, oa)
+		modifiersByContact[contact] = []flows.Modifier{
+			modifiers.NewName(fmt.Sprintf("Contact %d", i)),
+			modifiers.NewLanguage(envs.Language("fra")),
+			modifiers.NewField(age, fmt.Sprint(20+i)),
+		}
+	}
+	return modifiersByContact
+}
+
+func TestComputeModifierEvents(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer dates.SetNowSource(dates.DefaultNowSource)
+	dates.SetNowSource(dates.NewFixedNowSource(time.Date(2022, 4, 20, 12, 30, 0, 0, time.UTC)))
+
+	oa, err := models.GetOrgAssets(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	contacts := []*testdata.Contact{testdata.Cathy, testdata.Bob, testdata.George, testdata.Alexandria}
+
+	// compute events concurrently
+	concurrent := models.ComputeModifierEvents(rt, oa, buildModifierBatch(oa, db, contacts))
+
+	// and serially on fresh copies of the same contacts
+	env := flows.NewEnvironment(oa.Env(), oa.SessionAssets().Locations())
+	svcs := goflow.Engine(rt.Config).Services()
+
+	serial := make(map[*flows.Contact][]flows.Event)
+	for contact, mods := range buildModifierBatch(oa, db, contacts) {
+		evts := make([]flows.Event, 0)
+		for _, mod := range mods {
+			modifiers.Apply(env, svcs, oa.SessionAssets(), contact, mod, func(e flows.Event) { evts = append(evts, e) })
+		}
+		serial[contact] = evts
+	}
+
+	// marshals events and the resulting contact state, keyed by contact id
+	byID := func(eventsByContact map[*flows.Contact][]flows.Event) map[flows.ContactID]string {
+		m := make(map[flows.ContactID]string, len(eventsByContact))
+		for contact, evts := range eventsByContact {
+			eventsJSON, err := json.Marshal(evts)
+			require.NoError(t, err)
+			contactJSON, err := json.Marshal(contact)
+			require.NoError(t, err)
+			m[contact.ID()] = string(eventsJSON) + string(contactJSON)
+		}
+		return m
+	}
+
+	assert.Len(t, concurrent, 4)
+	assert.Equal(t, byID(serial), byID(concurrent))
+}
+
+func BenchmarkComputeModifierEvents(b *testing.B) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	oa, err := models.GetOrgAssets(ctx, rt, testdata.Org1.ID)
+	require.NoError(b, err)
+
+	contacts := make([]*testdata.Contact, 0, 100)
+	for i := 0; i < 25; i++ {
+		contacts = append(contacts, testdata.Cathy, testdata.Bob, testdata.George, testdata.Alexandria)
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		modifiersByContact := buildModifierBatch(oa, db, contacts)
+		b.StartTimer()
+
+		models.ComputeModifierEvents(rt, oa, modifiersByContact)
+	}
+}
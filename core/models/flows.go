@@ -62,6 +62,7 @@ type Flow struct {
 		FlowType       FlowType        `json:"flow_type"`
 		Definition     json.RawMessage `json:"definition"`
 		IgnoreTriggers bool            `json:"ignore_triggers"`
+		IsActive       bool            `json:"is_active"`
 	}
 }
 
@@ -119,19 +120,63 @@ func (f *Flow) cloneWithNewDefinition(def []byte) *Flow {
 	return &c
 }
 
+// FlowIDForUUID returns the ID of the flow with the given UUID, which may be inactive, or sql.ErrNoRows if it doesn't exist
 func FlowIDForUUID(ctx context.Context, tx *sqlx.Tx, oa *OrgAssets, flowUUID assets.FlowUUID) (FlowID, error) {
-	// first try to look up in our assets
-	flow, _ := oa.FlowByUUID(flowUUID)
-	if flow != nil {
-		return flow.(*Flow).ID(), nil
+	flow, err := GetFlowByUUID(ctx, tx, oa, flowUUID)
+	if err == nil {
+		return flow.ID(), nil
+	}
+	if err != ErrNotFound {
+		return NilFlowID, err
 	}
 
-	// flow may be inactive, try to look up the ID only
+	// flow may have been released without any active revisions, try to look up the ID only
 	var flowID FlowID
-	err := tx.GetContext(ctx, &flowID, `SELECT id FROM flows_flow WHERE org_id = $1 AND uuid = $2;`, oa.OrgID(), flowUUID)
+	err = tx.GetContext(ctx, &flowID, `SELECT id FROM flows_flow WHERE org_id = $1 AND uuid = $2;`, oa.OrgID(), flowUUID)
 	return flowID, err
 }
 
+// GetFlowByUUID returns the flow with the given UUID, or ErrNotFound if it doesn't exist. Unlike OrgAssets.FlowByUUID
+// this also returns inactive and archived flows, which are loaded using the given db. Inactive flows can't become active
+// again so they are cached on the org assets so that writing many runs for the same flow doesn't require a query per
+// run. Archived flows and misses aren't cached as the flow may yet be unarchived or created.
+func GetFlowByUUID(ctx context.Context, db Queryer, oa *OrgAssets, flowUUID assets.FlowUUID) (*Flow, error) {
+	// look up in our assets first which will load the flow if it's active and not archived
+	flow, err := oa.FlowByUUID(flowUUID)
+	if err == nil {
+		return flow.(*Flow), nil
+	}
+	if err != ErrNotFound {
+		return nil, err
+	}
+
+	// then check our cache of inactive flows as these would otherwise be looked for in the database every time
+	oa.flowCacheLock.RLock()
+	inactive := oa.inactiveFlowByUUID[flowUUID]
+	oa.flowCacheLock.RUnlock()
+
+	if inactive != nil {
+		return inactive, nil
+	}
+
+	// flow may be inactive or archived
+	dbFlow, err := loadFlow(ctx, db, sqlSelectAnyFlowByUUID, oa.OrgID(), flowUUID)
+	if err != nil {
+		return nil, err
+	}
+	if dbFlow == nil {
+		return nil, ErrNotFound
+	}
+
+	if !dbFlow.f.IsActive {
+		oa.flowCacheLock.Lock()
+		oa.inactiveFlowByUUID[flowUUID] = dbFlow
+		oa.flowCacheLock.Unlock()
+	}
+
+	return dbFlow, nil
+}
+
 func LoadFlowByUUID(ctx context.Context, db Queryer, orgID OrgID, flowUUID assets.FlowUUID) (*Flow, error) {
 	return loadFlow(ctx, db, sqlSelectFlowByUUID, orgID, flowUUID)
 }
@@ -178,6 +223,7 @@ SELECT ROW_TO_JSON(r) FROM (
 		f.uuid, 
 		f.name,
 		f.ignore_triggers,
+		f.is_active,
 		f.flow_type,
 		fr.spec_version as version,
 		coalesce(f.metadata, '{}')::jsonb as config,
@@ -217,6 +263,7 @@ SELECT ROW_TO_JSON(r) FROM (
 ) r;`
 
 var sqlSelectFlowByUUID = fmt.Sprintf(baseSqlSelectFlow, `WHERE org_id = $1 AND uuid = $2 AND is_active = TRUE AND is_archived = FALSE`)
+var sqlSelectAnyFlowByUUID = fmt.Sprintf(baseSqlSelectFlow, `WHERE org_id = $1 AND uuid = $2`)
 var sqlSelectFlowByName = fmt.Sprintf(baseSqlSelectFlow,
 	`WHERE 
 	    org_id = $1 AND LOWER(name) = LOWER($2) AND is_active = TRUE AND is_archived = FALSE 
@@ -12,6 +12,7 @@ import (
 	"github.com/nyaruka/mailroom/testsuite"
 	"github.com/nyaruka/mailroom/testsuite/testdata"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestLoadFlows(t *testing.T) {
@@ -164,3 +165,71 @@ func TestFlowIDForUUID(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, testdata.Favorites.ID, id)
 }
+
+func TestGetFlowByUUID(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	oa, err := models.GetOrgAssets(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	flow1, err := models.GetFlowByUUID(ctx, db, oa, testdata.Favorites.UUID)
+	require.NoError(t, err)
+	assert.Equal(t, testdata.Favorites.ID, flow1.ID())
+
+	// rename the flow in the database.. repeated lookups should still come from the cache
+	db.MustExec(`UPDATE flows_flow SET name = 'Renamed' WHERE id = $1`, testdata.Favorites.ID)
+
+	flow2, err := models.GetFlowByUUID(ctx, db, oa, testdata.Favorites.UUID)
+	require.NoError(t, err)
+	assert.Same(t, flow1, flow2)
+	assert.Equal(t, "Favorites", flow2.Name())
+
+	// inactive flows can also be loaded and are cached separately
+	db.MustExec(`UPDATE flows_flow SET is_active = FALSE WHERE id = $1`, testdata.PickANumber.ID)
+
+	flow3, err := models.GetFlowByUUID(ctx, db, oa, testdata.PickANumber.UUID)
+	require.NoError(t, err)
+	assert.Equal(t, testdata.PickANumber.ID, flow3.ID())
+
+	db.MustExec(`UPDATE flows_flow SET name = 'Renamed' WHERE id = $1`, testdata.PickANumber.ID)
+
+	flow4, err := models.GetFlowByUUID(ctx, db, oa, testdata.PickANumber.UUID)
+	require.NoError(t, err)
+	assert.Same(t, flow3, flow4)
+	assert.Equal(t, "Pick a Number", flow4.Name())
+
+	// but aren't returned as assets usable by the engine
+	_, err = oa.FlowByUUID(testdata.PickANumber.UUID)
+	assert.Equal(t, models.ErrNotFound, err)
+
+	// archived flows can be loaded but aren't cached as they can be unarchived
+	db.MustExec(`UPDATE flows_flow SET is_archived = TRUE WHERE id = $1`, testdata.SingleMessage.ID)
+
+	flow5, err := models.GetFlowByUUID(ctx, db, oa, testdata.SingleMessage.UUID)
+	require.NoError(t, err)
+	assert.Equal(t, testdata.SingleMessage.ID, flow5.ID())
+
+	db.MustExec(`UPDATE flows_flow SET is_archived = FALSE WHERE id = $1`, testdata.SingleMessage.ID)
+
+	flow6, err := models.GetFlowByUUID(ctx, db, oa, testdata.SingleMessage.UUID)
+	require.NoError(t, err)
+	assert.NotSame(t, flow5, flow6)
+
+	// and once unarchived it's available as an asset
+	asset, err := oa.FlowByUUID(testdata.SingleMessage.UUID)
+	require.NoError(t, err)
+	assert.Same(t, flow6, asset)
+
+	// non-existent flows return not found
+	_, err = models.GetFlowByUUID(ctx, db, oa, "c85b0b7a-0e2b-4f0e-9b9e-2d5a6ee4e2c3")
+	assert.Equal(t, models.ErrNotFound, err)
+
+	// but that isn't cached so a flow created with that UUID is found
+	flow7 := testdata.InsertFlow(db, testdata.Org1, []byte(`{"uuid": "c85b0b7a-0e2b-4f0e-9b9e-2d5a6ee4e2c3", "name": "New Flow", "spec_version": "13.1.0", "language": "eng", "type": "messaging", "nodes": []}`))
+
+	flow8, err := models.GetFlowByUUID(ctx, db, oa, "c85b0b7a-0e2b-4f0e-9b9e-2d5a6ee4e2c3")
+	require.NoError(t, err)
+	assert.Equal(t, flow7.ID, flow8.ID())
+}
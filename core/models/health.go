@@ -0,0 +1,32 @@
+package models
+
+import (
+	"context"
+
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/pkg/errors"
+)
+
+// HealthCheck checks that the database and Redis are reachable and, if a health check org is configured, that its
+// assets can be loaded. The returned error identifies which dependency failed.
+func HealthCheck(ctx context.Context, rt *runtime.Runtime) error {
+	if err := rt.DB.PingContext(ctx); err != nil {
+		return errors.Wrap(err, "database unreachable")
+	}
+
+	rc := rt.RP.Get()
+	_, err := rc.Do("PING")
+	rc.Close()
+
+	if err != nil {
+		return errors.Wrap(err, "redis unreachable")
+	}
+
+	if rt.Config.HealthCheckOrgID != 0 {
+		if _, err := GetOrgAssets(ctx, rt, OrgID(rt.Config.HealthCheckOrgID)); err != nil {
+			return errors.Wrapf(err, "unable to load assets for org #%d", rt.Config.HealthCheckOrgID)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,43 @@
+package models_test
+
+import (
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthCheck(t *testing.T) {
+	ctx, rt, _, _ := testsuite.Get()
+
+	defer func() { rt.Config.HealthCheckOrgID = 0 }()
+
+	assert.NoError(t, models.HealthCheck(ctx, rt))
+
+	// with a canary org configured
+	rt.Config.HealthCheckOrgID = int(testdata.Org1.ID)
+	assert.NoError(t, models.HealthCheck(ctx, rt))
+
+	// with a canary org that doesn't exist
+	rt.Config.HealthCheckOrgID = 12345
+	err := models.HealthCheck(ctx, rt)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unable to load assets for org #12345")
+
+	rt.Config.HealthCheckOrgID = 0
+
+	// simulate the database being unavailable with a closed connection
+	closedDB, err := sqlx.Open("postgres", rt.Config.DB)
+	require.NoError(t, err)
+	closedDB.Close()
+
+	brokenRT := *rt
+	brokenRT.DB = closedDB
+
+	err = models.HealthCheck(ctx, &brokenRT)
+	assert.EqualError(t, err, "database unreachable: sql: database is closed")
+}
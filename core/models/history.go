@@ -0,0 +1,91 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/nyaruka/null"
+	"github.com/pkg/errors"
+)
+
+// HistoryItemType is the type of an item in a contact's history
+type HistoryItemType string
+
+const (
+	HistoryItemTypeMsgIn        HistoryItemType = "msg_in"
+	HistoryItemTypeMsgOut       HistoryItemType = "msg_out"
+	HistoryItemTypeRunStarted   HistoryItemType = "run_started"
+	HistoryItemTypeRunExited    HistoryItemType = "run_exited"
+	HistoryItemTypeChannelEvent HistoryItemType = "channel_event"
+)
+
+// HistoryItem is a single item in a contact's history. ItemID is the id of the message, run or channel event that the
+// item was created from.
+type HistoryItem struct {
+	Type      HistoryItemType `json:"type"                 db:"item_type"`
+	CreatedOn time.Time       `json:"created_on"           db:"created_on"`
+	ItemID    int64           `json:"item_id"              db:"item_id"`
+	FlowID    FlowID          `json:"flow_id,omitempty"    db:"flow_id"`
+	SessionID SessionID       `json:"session_id,omitempty" db:"session_id"`
+	Text      null.String     `json:"text,omitempty"       db:"text"`
+	Status    null.String     `json:"status,omitempty"     db:"status"`
+	EventType null.String     `json:"event_type,omitempty" db:"event_type"`
+}
+
+// Cursor returns the cursor for fetching the items which come after this one
+func (i *HistoryItem) Cursor() HistoryCursor {
+	return HistoryCursor{CreatedOn: i.CreatedOn, Type: i.Type, ItemID: i.ItemID}
+}
+
+// HistoryCursor is a position in a contact's history. Items are ordered by (created_on, type, item_id) rather than just
+// (created_on, item_id) because different kinds of item can share ids, e.g. the start and exit of the same run.
+type HistoryCursor struct {
+	CreatedOn time.Time
+	Type      HistoryItemType
+	ItemID    int64
+}
+
+// each part of the union is limited separately so that we never read more than limit rows of any one kind
+const sqlSelectContactHistory = `
+(
+	SELECT CASE WHEN direction = 'I' THEN 'msg_in' ELSE 'msg_out' END AS item_type, created_on, id AS item_id, flow_id, 0 AS session_id, text, status, NULL AS event_type
+	  FROM msgs_msg
+	 WHERE org_id = $1 AND contact_id = $2 AND visibility != 'D' AND
+	       (created_on, CASE WHEN direction = 'I' THEN 'msg_in' ELSE 'msg_out' END, id) < ($3, $4::text, $5::bigint)
+  ORDER BY created_on DESC, item_type DESC, id DESC
+	 LIMIT $6
+) UNION ALL (
+	SELECT 'run_started' AS item_type, created_on, id AS item_id, flow_id, COALESCE(session_id, 0) AS session_id, NULL AS text, NULL AS status, NULL AS event_type
+	  FROM flows_flowrun
+	 WHERE org_id = $1 AND contact_id = $2 AND (created_on, 'run_started', id) < ($3, $4::text, $5::bigint)
+  ORDER BY created_on DESC, id DESC
+	 LIMIT $6
+) UNION ALL (
+	SELECT 'run_exited' AS item_type, exited_on AS created_on, id AS item_id, flow_id, COALESCE(session_id, 0) AS session_id, NULL AS text, status, NULL AS event_type
+	  FROM flows_flowrun
+	 WHERE org_id = $1 AND contact_id = $2 AND exited_on IS NOT NULL AND (exited_on, 'run_exited', id) < ($3, $4::text, $5::bigint)
+  ORDER BY exited_on DESC, id DESC
+	 LIMIT $6
+) UNION ALL (
+	SELECT 'channel_event' AS item_type, created_on, id AS item_id, NULL AS flow_id, 0 AS session_id, NULL AS text, NULL AS status, event_type
+	  FROM channels_channelevent
+	 WHERE org_id = $1 AND contact_id = $2 AND (created_on, 'channel_event', id) < ($3, $4::text, $5::bigint)
+  ORDER BY created_on DESC, id DESC
+	 LIMIT $6
+)
+ORDER BY created_on DESC, item_type DESC, item_id DESC
+LIMIT $6`
+
+// ContactHistory returns up to limit items from the history of the given contact, i.e. their messages, the starts and
+// exits of their runs, and their channel events, merged and ordered newest first. Only items which come strictly before
+// the given cursor are included so the cursor of the last item returned can be used to fetch the next page. The first
+// page can be fetched with a cursor containing only a time.
+func ContactHistory(ctx context.Context, db Queryer, oa *OrgAssets, contactID ContactID, before HistoryCursor, limit int) ([]*HistoryItem, error) {
+	items := make([]*HistoryItem, 0, limit)
+
+	if err := db.SelectContext(ctx, &items, sqlSelectContactHistory, oa.OrgID(), contactID, before.CreatedOn, before.Type, before.ItemID, limit); err != nil {
+		return nil, errors.Wrapf(err, "error selecting history for contact #%d", contactID)
+	}
+
+	return items, nil
+}
@@ -0,0 +1,102 @@
+package models_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/uuids"
+	"github.com/nyaruka/goflow/envs"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContactHistory(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	oa, err := models.GetOrgAssets(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	// use a new contact so there's no existing history
+	dave := testdata.InsertContact(db, testdata.Org1, flows.ContactUUID(uuids.New()), "Dave", envs.NilLanguage, models.ContactStatusActive)
+
+	t0 := time.Date(2030, 1, 1, 10, 0, 0, 0, time.UTC)
+	at := func(m int) time.Time { return t0.Add(time.Duration(m) * time.Minute) }
+
+	// a completed session with an exchange of messages
+	session1ID := testdata.InsertFlowSession(db, testdata.Org1, dave, models.FlowTypeMessaging, models.SessionStatusCompleted, testdata.Favorites, models.NilCallID)
+	run1ID := testdata.InsertFlowRun(db, testdata.Org1, session1ID, dave, testdata.Favorites, models.RunStatusCompleted)
+	db.MustExec(`UPDATE flows_flowrun SET created_on = $2, exited_on = $3 WHERE id = $1`, run1ID, at(0), at(3))
+
+	in1 := testdata.InsertIncomingMsg(db, testdata.Org1, testdata.TwilioChannel, dave, "hi", models.MsgStatusHandled)
+	out1 := testdata.InsertOutgoingMsg(db, testdata.Org1, testdata.TwilioChannel, dave, "hello", nil, models.MsgStatusSent, false)
+	db.MustExec(`UPDATE msgs_msg SET created_on = $2 WHERE id = $1`, in1.ID(), at(1))
+	db.MustExec(`UPDATE msgs_msg SET created_on = $2 WHERE id = $1`, out1.ID(), at(2))
+
+	// including a message created at the same time as another
+	in2 := testdata.InsertIncomingMsg(db, testdata.Org1, testdata.TwilioChannel, dave, "thanks", models.MsgStatusHandled)
+	db.MustExec(`UPDATE msgs_msg SET created_on = $2 WHERE id = $1`, in2.ID(), at(2))
+
+	// and a later session which is still waiting
+	session2ID := testdata.InsertFlowSession(db, testdata.Org1, dave, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.PickANumber, models.NilCallID)
+	run2ID := testdata.InsertFlowRun(db, testdata.Org1, session2ID, dave, testdata.PickANumber, models.RunStatusWaiting)
+	db.MustExec(`UPDATE flows_flowrun SET created_on = $2 WHERE id = $1`, run2ID, at(60))
+
+	out2 := testdata.InsertOutgoingMsg(db, testdata.Org1, testdata.TwilioChannel, dave, "pick a number", nil, models.MsgStatusSent, false)
+	db.MustExec(`UPDATE msgs_msg SET created_on = $2 WHERE id = $1`, out2.ID(), at(61))
+
+	// other contacts' history isn't included
+	bobMsg := testdata.InsertIncomingMsg(db, testdata.Org1, testdata.TwilioChannel, testdata.Bob, "hi", models.MsgStatusHandled)
+	db.MustExec(`UPDATE msgs_msg SET created_on = $2 WHERE id = $1`, bobMsg.ID(), at(30))
+
+	type item struct {
+		Type      models.HistoryItemType
+		ItemID    int64
+		SessionID models.SessionID
+		CreatedOn time.Time
+	}
+	summarize := func(items []*models.HistoryItem) []item {
+		s := make([]item, len(items))
+		for i, h := range items {
+			s[i] = item{h.Type, h.ItemID, h.SessionID, h.CreatedOn.UTC()}
+		}
+		return s
+	}
+
+	page1, err := models.ContactHistory(ctx, db, oa, dave.ID, models.HistoryCursor{CreatedOn: at(1000)}, 4)
+	require.NoError(t, err)
+	assert.Equal(t, []item{
+		{models.HistoryItemTypeMsgOut, int64(out2.ID()), 0, at(61)},
+		{models.HistoryItemTypeRunStarted, int64(run2ID), session2ID, at(60)},
+		{models.HistoryItemTypeRunExited, int64(run1ID), session1ID, at(3)},
+		{models.HistoryItemTypeMsgOut, int64(out1.ID()), 0, at(2)},
+	}, summarize(page1))
+
+	assert.Equal(t, "pick a number", string(page1[0].Text))
+	assert.Equal(t, testdata.PickANumber.ID, page1[1].FlowID)
+	assert.Equal(t, "C", string(page1[2].Status))
+
+	// use the oldest item as the cursor for the next page, which includes the item created at the same time as it
+	page2, err := models.ContactHistory(ctx, db, oa, dave.ID, page1[3].Cursor(), 4)
+	require.NoError(t, err)
+	assert.Equal(t, []item{
+		{models.HistoryItemTypeMsgIn, int64(in2.ID()), 0, at(2)},
+		{models.HistoryItemTypeMsgIn, int64(in1.ID()), 0, at(1)},
+		{models.HistoryItemTypeRunStarted, int64(run1ID), session1ID, at(0)},
+	}, summarize(page2))
+
+	// and nothing before that
+	page3, err := models.ContactHistory(ctx, db, oa, dave.ID, page2[2].Cursor(), 4)
+	require.NoError(t, err)
+	assert.Len(t, page3, 0)
+
+	// items sharing a time are paged by type and then id
+	page4, err := models.ContactHistory(ctx, db, oa, dave.ID, models.HistoryCursor{CreatedOn: at(2), Type: models.HistoryItemTypeMsgIn, ItemID: int64(in2.ID()) + 1}, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []item{{models.HistoryItemTypeMsgIn, int64(in2.ID()), 0, at(2)}}, summarize(page4))
+}
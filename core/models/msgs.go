@@ -1281,6 +1281,22 @@ func FailChannelMessages(ctx context.Context, db Queryer, orgID OrgID, channelID
 	return nil
 }
 
+const sqlCancelPendingSessionMessages = `
+UPDATE msgs_msg m
+   SET status = 'F', modified_on = NOW()
+  FROM flows_flowsession s
+ WHERE s.id = ANY($1) AND m.contact_id = s.contact_id AND m.org_id = s.org_id AND m.direction = 'O' AND m.status IN ('P', 'E') AND 
+       m.created_on >= s.created_on AND m.flow_id IN (SELECT r.flow_id FROM flows_flowrun r WHERE r.session_id = s.id)`
+
+// CancelPendingMessagesForSessions fails any outgoing messages created by the flows of the given sessions which are still
+// waiting to be queued or retried, so that they aren't sent after the sessions have been interrupted. Messages already
+// queued to courier can't be recalled and are left alone, as are messages not sent by a flow, e.g. broadcasts and ticket
+// replies. There's no failed reason for interruption so these messages are failed without one.
+func CancelPendingMessagesForSessions(ctx context.Context, db Queryer, sessionIDs []SessionID) error {
+	_, err := db.ExecContext(ctx, sqlCancelPendingSessionMessages, pq.Array(sessionIDs))
+	return errors.Wrapf(err, "error cancelling pending messages for sessions")
+}
+
 // MarkBroadcastSent marks the passed in broadcast as sent
 func MarkBroadcastSent(ctx context.Context, db Queryer, id BroadcastID) error {
 	// noop if it is a nil id
@@ -144,9 +144,18 @@ func (o *Org) ConfigValue(key string, def string) string {
 	return o.o.Config.GetString(key, def)
 }
 
+// SMTPServer returns the SMTP connection URL configured for this org, or the given default if it has none
+func (o *Org) SMTPServer(def string) string { return o.ConfigValue(configSMTPServer, def) }
+
+// DTOneKey returns the DTOne API key configured for this org, if any
+func (o *Org) DTOneKey() string { return o.ConfigValue(configDTOneKey, "") }
+
+// DTOneSecret returns the DTOne API secret configured for this org, if any
+func (o *Org) DTOneSecret() string { return o.ConfigValue(configDTOneSecret, "") }
+
 // EmailService returns the email service for this org
 func (o *Org) EmailService(c *runtime.Config, retries *smtpx.RetryConfig) (flows.EmailService, error) {
-	connectionURL := o.ConfigValue(configSMTPServer, c.SMTPServer)
+	connectionURL := o.SMTPServer(c.SMTPServer)
 
 	if connectionURL == "" {
 		return nil, errors.New("missing SMTP configuration")
@@ -156,8 +165,7 @@ func (o *Org) EmailService(c *runtime.Config, retries *smtpx.RetryConfig) (flows
 
 // AirtimeService returns the airtime service for this org if one is configured
 func (o *Org) AirtimeService(httpClient *http.Client, httpRetries *httpx.RetryConfig) (flows.AirtimeService, error) {
-	key := o.ConfigValue(configDTOneKey, "")
-	secret := o.ConfigValue(configDTOneSecret, "")
+	key, secret := o.DTOneKey(), o.DTOneSecret()
 
 	if key == "" || secret == "" {
 		return nil, errors.Errorf("missing %s or %s on DTOne configuration for org: %d", configDTOneKey, configDTOneSecret, o.ID())
@@ -0,0 +1,51 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// postgres error codes for failures where retrying the same transaction is likely to succeed
+var transientErrorCodes = map[pq.ErrorCode]bool{
+	"40001": true, // serialization_failure
+	"40P01": true, // deadlock_detected
+}
+
+// maximum number of attempts and initial backoff when retrying transient failures
+var transientRetryAttempts = 3
+var transientRetryBackoff = 50 * time.Millisecond
+
+// returns whether the given error was caused by a transient database failure
+func isTransientError(err error) bool {
+	pqErr, isPqErr := errors.Cause(err).(*pq.Error)
+	return isPqErr && transientErrorCodes[pqErr.Code]
+}
+
+// calls fn, retrying with exponential backoff if it fails with a transient database error. Once retries are
+// exhausted, or for any other error, the last error is returned.
+func retryOnTransientError(ctx context.Context, fn func() error) error {
+	return retryOnTransientErrorN(ctx, transientRetryAttempts, fn)
+}
+
+// like retryOnTransientError but with the given maximum number of attempts
+func retryOnTransientErrorN(ctx context.Context, attempts int, fn func() error) error {
+	backoff := transientRetryBackoff
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !isTransientError(err) || attempt >= attempts {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+	}
+}
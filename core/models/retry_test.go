@@ -0,0 +1,91 @@
+package models_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExitSessionsRetriesTransientErrors(t *testing.T) {
+	ctx, _, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	tcs := []struct {
+		errCode        string
+		failures       int
+		expectedErr    string
+		expectedCalls  int
+		expectedStatus models.SessionStatus
+	}{
+		// deadlocks and serialization failures are retried until success
+		{errCode: "40P01", failures: 1, expectedCalls: 2, expectedStatus: models.SessionStatusInterrupted},
+		{errCode: "40001", failures: 2, expectedCalls: 3, expectedStatus: models.SessionStatusInterrupted},
+
+		// but only up to our maximum number of attempts
+		{errCode: "40P01", failures: 4, expectedErr: "40P01", expectedCalls: 3, expectedStatus: models.SessionStatusWaiting},
+
+		// and other errors aren't retried
+		{errCode: "23505", failures: 1, expectedErr: "23505", expectedCalls: 1, expectedStatus: models.SessionStatusWaiting},
+	}
+
+	for i, tc := range tcs {
+		sessionID, _ := insertSessionAndRun(db, testdata.Cathy, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, models.NilCallID)
+
+		removeFailures := failSessionUpdates(db, tc.errCode, tc.failures)
+
+		err := models.ExitSessions(ctx, db, []models.SessionID{sessionID}, models.SessionStatusInterrupted)
+
+		attempts := removeFailures()
+
+		if tc.expectedErr != "" {
+			pqErr, isPqErr := errors.Cause(err).(*pq.Error)
+			if assert.True(t, isPqErr, "%d: expected postgres error, got %v", i, err) {
+				assert.Equal(t, pq.ErrorCode(tc.expectedErr), pqErr.Code, "%d: error code mismatch", i)
+			}
+		} else {
+			assert.NoError(t, err, "%d: unexpected error", i)
+		}
+
+		assert.Equal(t, tc.expectedCalls, attempts, "%d: attempts mismatch", i)
+		assertSessionAndRunStatus(t, db, sessionID, tc.expectedStatus)
+
+		db.MustExec(`UPDATE flows_flowsession SET status = 'I' WHERE id = $1`, sessionID)
+		db.MustExec(`UPDATE flows_flowrun SET status = 'I' WHERE session_id = $1`, sessionID)
+	}
+}
+
+// makes the next n attempts to update sessions fail with the given postgres error code, and returns a function which
+// removes that and returns how many attempts were made. Attempts are counted with a sequence as that isn't rolled back
+// with the failed transaction.
+func failSessionUpdates(db *sqlx.DB, errCode string, n int) func() int {
+	db.MustExec(`CREATE SEQUENCE temp_session_update_attempts`)
+	db.MustExec(fmt.Sprintf(`CREATE FUNCTION temp_fail_session_update() RETURNS TRIGGER AS $$
+BEGIN
+	IF nextval('temp_session_update_attempts') <= %d THEN
+		RAISE EXCEPTION 'injected failure' USING ERRCODE = '%s';
+	END IF;
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql`, n, errCode))
+	db.MustExec(`CREATE TRIGGER temp_fail_session_updates BEFORE UPDATE ON flows_flowsession FOR EACH STATEMENT EXECUTE PROCEDURE temp_fail_session_update()`)
+
+	return func() int {
+		var attempts int
+		if err := db.Get(&attempts, `SELECT CASE WHEN is_called THEN last_value ELSE 0 END FROM temp_session_update_attempts`); err != nil {
+			panic(err)
+		}
+
+		db.MustExec(`DROP TRIGGER temp_fail_session_updates ON flows_flowsession`)
+		db.MustExec(`DROP FUNCTION temp_fail_session_update()`)
+		db.MustExec(`DROP SEQUENCE temp_session_update_attempts`)
+		return attempts
+	}
+}
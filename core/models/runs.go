@@ -2,6 +2,7 @@ package models
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"time"
 
@@ -10,6 +11,7 @@ import (
 	"github.com/nyaruka/gocommon/jsonx"
 	"github.com/nyaruka/goflow/flows"
 	"github.com/nyaruka/goflow/flows/events"
+	"github.com/nyaruka/mailroom/runtime"
 	"github.com/nyaruka/null"
 	"github.com/pkg/errors"
 )
@@ -54,6 +56,9 @@ var runStatusToExitType = map[RunStatus]ExitType{
 	RunStatusFailed:      ExitFailed,
 }
 
+// error returned when writing a run whose flow no longer exists
+var errMissingFlow = errors.New("flow no longer exists")
+
 // FlowRun is the mailroom type for a FlowRun
 type FlowRun struct {
 	r struct {
@@ -81,6 +86,8 @@ type FlowRun struct {
 func (r *FlowRun) SetSessionID(sessionID SessionID) { r.r.SessionID = sessionID }
 func (r *FlowRun) SetStartID(startID StartID)       { r.r.StartID = startID }
 func (r *FlowRun) UUID() flows.RunUUID              { return r.r.UUID }
+func (r *FlowRun) Status() RunStatus                { return r.r.Status }
+func (r *FlowRun) FlowID() FlowID                   { return r.r.FlowID }
 func (r *FlowRun) ModifiedOn() time.Time            { return r.r.ModifiedOn }
 
 // MarshalJSON is our custom marshaller so that our inner struct get output
@@ -123,6 +130,9 @@ func newRun(ctx context.Context, tx *sqlx.Tx, oa *OrgAssets, session *Session, f
 	}
 
 	flowID, err := FlowIDForUUID(ctx, tx, oa, fr.FlowReference().UUID)
+	if err == sql.ErrNoRows {
+		return nil, errors.Wrapf(errMissingFlow, "unable to load flow with uuid: %s", fr.FlowReference().UUID)
+	}
 	if err != nil {
 		return nil, errors.Wrapf(err, "unable to load flow with uuid: %s", fr.FlowReference().UUID)
 	}
@@ -159,12 +169,33 @@ func newRun(ctx context.Context, tx *sqlx.Tx, oa *OrgAssets, session *Session, f
 	return run, nil
 }
 
+// maximum number of contact ids we pass to a single overlap query
+const flowStartedOverlapBatchSize = 1000
+
 // FindFlowStartedOverlap returns the list of contact ids which overlap with those passed in and which
-// have been in the flow passed in.
-func FindFlowStartedOverlap(ctx context.Context, db *sqlx.DB, flowID FlowID, contacts []ContactID) ([]ContactID, error) {
-	var overlap []ContactID
-	err := db.SelectContext(ctx, &overlap, flowStartedOverlapSQL, pq.Array(contacts), flowID)
-	return overlap, err
+// have been in the flow passed in. The query is cancelled if it takes longer than the configured DB timeout.
+func FindFlowStartedOverlap(ctx context.Context, rt *runtime.Runtime, flowID FlowID, contacts []ContactID) ([]ContactID, error) {
+	ctx, cancel := withDBTimeout(ctx, rt)
+	defer cancel()
+
+	overlap := make([]ContactID, 0, 10)
+	seen := make(map[ContactID]bool)
+
+	for _, batch := range chunkSlice(contacts, flowStartedOverlapBatchSize) {
+		var batchOverlap []ContactID
+		if err := rt.DB.SelectContext(ctx, &batchOverlap, flowStartedOverlapSQL, pq.Array(batch), flowID); err != nil {
+			return nil, errors.Wrapf(err, "error selecting contacts started in flow #%d", flowID)
+		}
+
+		for _, id := range batchOverlap {
+			if !seen[id] {
+				overlap = append(overlap, id)
+				seen[id] = true
+			}
+		}
+	}
+
+	return overlap, nil
 }
 
 // TODO: no perfect index, will probably use contact index flows_flowrun_contact_id_985792a9
@@ -178,3 +209,39 @@ WHERE
 	contact_id = ANY($1) AND
 	flow_id = $2
 `
+
+// WaitingRunCountsByFlow returns the number of waiting runs in each flow of the given org
+func WaitingRunCountsByFlow(ctx context.Context, db Queryer, orgID OrgID) (map[FlowID]int64, error) {
+	rows, err := db.QueryxContext(ctx, sqlSelectWaitingRunCountsByFlow, orgID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error selecting waiting run counts for org #%d", orgID)
+	}
+	defer rows.Close()
+
+	counts := make(map[FlowID]int64)
+	for rows.Next() {
+		var flowID FlowID
+		var count int64
+		if err := rows.Scan(&flowID, &count); err != nil {
+			return nil, errors.Wrap(err, "error scanning waiting run count")
+		}
+		counts[flowID] = count
+	}
+
+	return counts, rows.Err()
+}
+
+// status = 'W' lets postgres use the partial index flows_flowrun_contacts_at_node which covers (org_id) for active
+// and waiting runs
+const sqlSelectWaitingRunCountsByFlow = `
+SELECT
+	flow_id,
+	count(*)
+FROM
+	flows_flowrun
+WHERE
+	org_id = $1 AND
+	status = 'W'
+GROUP BY
+	flow_id
+`
@@ -0,0 +1,97 @@
+package models_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindFlowStartedOverlap(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	sessionID := testdata.InsertFlowSession(db, testdata.Org1, testdata.Cathy, models.FlowTypeMessaging, models.SessionStatusCompleted, testdata.Favorites, models.NilCallID)
+	testdata.InsertFlowRun(db, testdata.Org1, sessionID, testdata.Cathy, testdata.Favorites, models.RunStatusCompleted)
+
+	sessionID = testdata.InsertFlowSession(db, testdata.Org1, testdata.Bob, models.FlowTypeMessaging, models.SessionStatusCompleted, testdata.PickANumber, models.NilCallID)
+	testdata.InsertFlowRun(db, testdata.Org1, sessionID, testdata.Bob, testdata.PickANumber, models.RunStatusCompleted)
+
+	started, err := models.FindFlowStartedOverlap(ctx, rt, testdata.Favorites.ID, []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID, testdata.George.ID})
+	assert.NoError(t, err)
+	assert.Equal(t, []models.ContactID{testdata.Cathy.ID}, started)
+
+	// more contacts than fit in a single batch, with overlapping contacts in different batches and repeated
+	contactIDs := make([]models.ContactID, 2500)
+	for i := range contactIDs {
+		contactIDs[i] = models.ContactID(50000 + i)
+	}
+	contactIDs[10] = testdata.Cathy.ID
+	contactIDs[1500] = testdata.Bob.ID
+	contactIDs[2499] = testdata.Cathy.ID
+
+	started, err = models.FindFlowStartedOverlap(ctx, rt, testdata.PickANumber.ID, contactIDs)
+	assert.NoError(t, err)
+	assert.Equal(t, []models.ContactID{testdata.Bob.ID}, started)
+
+	started, err = models.FindFlowStartedOverlap(ctx, rt, testdata.Favorites.ID, contactIDs)
+	assert.NoError(t, err)
+	assert.Equal(t, []models.ContactID{testdata.Cathy.ID}, started)
+
+	// no contacts means no overlap
+	started, err = models.FindFlowStartedOverlap(ctx, rt, testdata.Favorites.ID, nil)
+	assert.NoError(t, err)
+	assert.Len(t, started, 0)
+
+	// a context which has already expired should fail the query promptly
+	expiredCtx, cancel := context.WithTimeout(ctx, time.Nanosecond)
+	defer cancel()
+	time.Sleep(time.Millisecond)
+
+	queryStart := time.Now()
+
+	_, err = models.FindFlowStartedOverlap(expiredCtx, rt, testdata.Favorites.ID, []models.ContactID{testdata.Cathy.ID})
+	assert.Error(t, err)
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+	assert.Less(t, time.Since(queryStart), time.Second)
+}
+
+func TestWaitingRunCountsByFlow(t *testing.T) {
+	ctx, _, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	// no waiting runs
+	counts, err := models.WaitingRunCountsByFlow(ctx, db, testdata.Org1.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, map[models.FlowID]int64{}, counts)
+
+	sessionID := testdata.InsertWaitingSession(db, testdata.Org1, testdata.Cathy, models.FlowTypeMessaging, testdata.Favorites, models.NilCallID, time.Now(), time.Now(), false, nil)
+	testdata.InsertFlowRun(db, testdata.Org1, sessionID, testdata.Cathy, testdata.Favorites, models.RunStatusWaiting)
+
+	sessionID = testdata.InsertWaitingSession(db, testdata.Org1, testdata.Bob, models.FlowTypeMessaging, testdata.Favorites, models.NilCallID, time.Now(), time.Now(), false, nil)
+	testdata.InsertFlowRun(db, testdata.Org1, sessionID, testdata.Bob, testdata.PickANumber, models.RunStatusActive)
+	testdata.InsertFlowRun(db, testdata.Org1, sessionID, testdata.Bob, testdata.Favorites, models.RunStatusWaiting)
+
+	sessionID = testdata.InsertWaitingSession(db, testdata.Org1, testdata.George, models.FlowTypeMessaging, testdata.PickANumber, models.NilCallID, time.Now(), time.Now(), false, nil)
+	testdata.InsertFlowRun(db, testdata.Org1, sessionID, testdata.George, testdata.PickANumber, models.RunStatusWaiting)
+
+	// runs which aren't waiting aren't counted
+	sessionID = testdata.InsertFlowSession(db, testdata.Org1, testdata.Alexandria, models.FlowTypeMessaging, models.SessionStatusCompleted, testdata.Favorites, models.NilCallID)
+	testdata.InsertFlowRun(db, testdata.Org1, sessionID, testdata.Alexandria, testdata.Favorites, models.RunStatusCompleted)
+	testdata.InsertFlowRun(db, testdata.Org1, sessionID, testdata.Alexandria, testdata.IVRFlow, models.RunStatusExpired)
+
+	// nor are runs in other orgs
+	sessionID = testdata.InsertWaitingSession(db, testdata.Org2, testdata.Org2Contact, models.FlowTypeMessaging, testdata.Favorites, models.NilCallID, time.Now(), time.Now(), false, nil)
+	testdata.InsertFlowRun(db, testdata.Org2, sessionID, testdata.Org2Contact, testdata.Favorites, models.RunStatusWaiting)
+
+	counts, err = models.WaitingRunCountsByFlow(ctx, db, testdata.Org1.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, map[models.FlowID]int64{testdata.Favorites.ID: 2, testdata.PickANumber.ID: 1}, counts)
+}
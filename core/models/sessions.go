@@ -8,12 +8,16 @@ import (
 	"fmt"
 	"net/url"
 	"path"
+	"sync"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/gocommon/jsonx"
 	"github.com/nyaruka/gocommon/storage"
+	"github.com/nyaruka/gocommon/urns"
 	"github.com/nyaruka/gocommon/uuids"
 	"github.com/nyaruka/goflow/assets"
 	"github.com/nyaruka/goflow/envs"
@@ -37,6 +41,9 @@ const (
 	SessionStatusFailed      SessionStatus = "F"
 
 	storageTSFormat = "20060102T150405.999Z"
+
+	// max number of goroutines used to marshal session outputs when writing sessions in bulk
+	sessionMarshalWorkers = 8
 )
 
 var sessionStatusMap = map[flows.SessionStatus]SessionStatus{
@@ -45,6 +52,11 @@ var sessionStatusMap = map[flows.SessionStatus]SessionStatus{
 	flows.SessionStatusFailed:    SessionStatusFailed,
 }
 
+// ErrTooManyRuns is returned when writing a session which has more runs than the configured maximum
+var ErrTooManyRuns = errors.New("session has too many runs")
+
+// SessionCommitHook is called by InsertSessions and Session.Update within the caller's transaction. If it returns an
+// error, that error is returned and the caller must roll back the transaction as session writes may have been made.
 type SessionCommitHook func(context.Context, *sqlx.Tx, *redis.Pool, *OrgAssets, []*Session) error
 
 // Session is the mailroom type for a FlowSession
@@ -83,6 +95,10 @@ type Session struct {
 
 	seenRuns map[flows.RunUUID]time.Time
 
+	// the engine session last read from our output and the assets it was read with
+	flowSession       flows.Session
+	flowSessionAssets flows.SessionAssets
+
 	// we keep around a reference to the sprint associated with this session
 	sprint flows.Sprint
 
@@ -115,17 +131,22 @@ func (s *Session) Scene() *Scene                      { return s.scene }
 
 // StoragePath returns the path for the session
 func (s *Session) StoragePath(cfg *runtime.Config) string {
-	ts := s.CreatedOn().UTC().Format(storageTSFormat)
+	return sessionStoragePath(cfg, s.OrgID(), s.ContactUUID(), s.UUID(), s.CreatedOn(), s.OutputMD5())
+}
+
+// returns the storage path for a session with the given attributes
+func sessionStoragePath(cfg *runtime.Config, orgID OrgID, contactUUID flows.ContactUUID, uuid flows.SessionUUID, createdOn time.Time, outputMD5 string) string {
+	ts := createdOn.UTC().Format(storageTSFormat)
 
 	// example output: /orgs/1/c/20a5/20a5534c-b2ad-4f18-973a-f1aa3b4e6c74/20060102T150405.123Z_session_8a7fc501-177b-4567-a0aa-81c48e6de1c5_51df83ac21d3cf136d8341f0b11cb1a7.json"
 	return path.Join(
 		cfg.S3SessionPrefix,
 		"orgs",
-		fmt.Sprintf("%d", s.OrgID()),
+		fmt.Sprintf("%d", orgID),
 		"c",
-		string(s.ContactUUID()[:4]),
-		string(s.ContactUUID()),
-		fmt.Sprintf("%s_session_%s_%s.json", ts, s.UUID(), s.OutputMD5()),
+		string(contactUUID[:4]),
+		string(contactUUID),
+		fmt.Sprintf("%s_session_%s_%s.json", ts, uuid, outputMD5),
 	)
 }
 
@@ -139,11 +160,38 @@ func (s *Session) Contact() *flows.Contact {
 	return s.contact
 }
 
-// Runs returns our flow run
+// Runs returns our flow runs as of the last write of this session
 func (s *Session) Runs() []*FlowRun {
 	return s.runs
 }
 
+// CurrentNodeUUID returns the UUID of the node this session is waiting at, taken from the end of the path of the waiting
+// run in its output, or empty if the session isn't waiting or its output hasn't been loaded
+func (s *Session) CurrentNodeUUID() flows.NodeUUID {
+	if s.s.Status != SessionStatusWaiting || s.s.Output == "" {
+		return ""
+	}
+
+	output := &struct {
+		Runs []struct {
+			Status flows.RunStatus `json:"status"`
+			Path   []struct {
+				NodeUUID flows.NodeUUID `json:"node_uuid"`
+			} `json:"path"`
+		} `json:"runs"`
+	}{}
+	if err := json.Unmarshal([]byte(s.s.Output), output); err != nil {
+		return ""
+	}
+
+	for _, r := range output.Runs {
+		if r.Status == flows.RunStatusWaiting && len(r.Path) > 0 {
+			return r.Path[len(r.Path)-1].NodeUUID
+		}
+	}
+	return ""
+}
+
 // Sprint returns the sprint associated with this session
 func (s *Session) Sprint() flows.Sprint {
 	return s.sprint
@@ -172,17 +220,38 @@ func (s *Session) SetIncomingMsg(id MsgID, externalID null.String) {
 
 // SetCall sets the channel connection associated with this sprint
 func (s *Session) SetCall(c *Call) {
+	if c == nil || c.ID() == NilCallID {
+		s.s.CallID = nil
+		s.call = nil
+		return
+	}
+
 	connID := c.ID()
 	s.s.CallID = &connID
 	s.call = c
 }
 
+// HasCall returns whether this session is associated with a call, which is only the case for voice sessions
+func (s *Session) HasCall() bool {
+	return s.s.CallID != nil && *s.s.CallID != NilCallID
+}
+
 func (s *Session) Call() *Call {
 	return s.call
 }
 
-// FlowSession creates a flow session for the passed in session object. It also populates the runs we know about
+// FlowSession creates a flow session for the passed in session object. It also populates the runs we know about. The
+// flow session is cached so that repeat calls with the same assets don't re-read it until this session is updated.
 func (s *Session) FlowSession(cfg *runtime.Config, sa flows.SessionAssets, env envs.Environment) (flows.Session, error) {
+	if s.flowSession != nil && s.flowSessionAssets == sa {
+		return s.flowSession, nil
+	}
+
+	// don't try to unmarshal outputs so large that they're likely corrupt and could exhaust memory
+	if cfg.SessionMaxOutputSize > 0 && len(s.s.Output) > cfg.SessionMaxOutputSize {
+		return nil, errors.Errorf("session #%d output size of %d bytes exceeds maximum of %d", s.ID(), len(s.s.Output), cfg.SessionMaxOutputSize)
+	}
+
 	session, err := goflow.Engine(cfg).ReadSession(sa, json.RawMessage(s.s.Output), assets.IgnoreMissing)
 	if err != nil {
 		return nil, errors.Wrapf(err, "unable to unmarshal session")
@@ -194,11 +263,82 @@ func (s *Session) FlowSession(cfg *runtime.Config, sa flows.SessionAssets, env e
 		s.seenRuns[r.UUID()] = r.ModifiedOn()
 	}
 
+	s.flowSession = session
+	s.flowSessionAssets = sa
+
 	return session, nil
 }
 
-// looks for a wait event and updates wait fields if one exists
-func (s *Session) updateWait(evts []flows.Event) {
+// ClearFlowSession clears any cached flow session so that the next call to FlowSession re-reads it from our output. This
+// should be called before the returned flow session is modified, e.g. by resuming it.
+func (s *Session) ClearFlowSession() {
+	s.flowSession = nil
+	s.flowSessionAssets = nil
+}
+
+// builds and adds runs for each run in the passed in flow session. If skipMissingFlows is true then runs whose flows
+// no longer exist are logged and skipped rather than failing the entire session.
+func (s *Session) addRuns(ctx context.Context, tx *sqlx.Tx, oa *OrgAssets, fs flows.Session, skipMissingFlows bool) error {
+	for _, r := range fs.Runs() {
+		run, err := newRun(ctx, tx, oa, s, r)
+		if err != nil {
+			if skipMissingFlows && errors.Cause(err) == errMissingFlow {
+				logrus.WithField("session_uuid", fs.UUID()).WithField("run_uuid", r.UUID()).WithField("flow_uuid", r.FlowReference().UUID).Warn("skipping run for missing flow")
+				continue
+			}
+			return errors.Wrapf(err, "error creating run: %s", r.UUID())
+		}
+
+		s.runs = append(s.runs, run)
+	}
+	return nil
+}
+
+// returns the expiration to apply to waits which don't have one, or zero if there is none
+func defaultWaitExpiration(cfg *runtime.Config) time.Duration {
+	return time.Duration(cfg.DefaultWaitExpiration) * time.Minute
+}
+
+// checks that the passed in session doesn't have more runs than we're configured to allow, as can happen with runaway
+// subflow loops, returning ErrTooManyRuns if it does
+func checkRunCount(rt *runtime.Runtime, fs flows.Session) error {
+	numRuns := len(fs.Runs())
+	if rt.Config.MaxRunsPerSession <= 0 || numRuns <= rt.Config.MaxRunsPerSession {
+		return nil
+	}
+
+	logrus.WithField("session_uuid", fs.UUID()).WithField("contact_uuid", fs.Contact().UUID()).WithField("runs", numRuns).Error("session has too many runs")
+	RecordCount(rt, "session_too_many_runs", 1)
+
+	return errors.Wrapf(ErrTooManyRuns, "session %s has %d runs", fs.UUID(), numRuns)
+}
+
+// marks this unwritten session and its active or waiting runs as failed
+func (s *Session) fail() {
+	now := dates.Now()
+
+	s.s.Status = SessionStatusFailed
+	s.s.EndedOn = &now
+	s.s.CurrentFlowID = NilFlowID
+	s.s.WaitStartedOn = nil
+	s.s.WaitTimeoutOn = nil
+	s.s.WaitExpiresOn = nil
+	s.s.WaitResumeOnExpire = false
+	s.timeout = nil
+
+	for _, r := range s.runs {
+		if r.r.Status == RunStatusActive || r.r.Status == RunStatusWaiting {
+			r.r.Status = RunStatusFailed
+			r.r.ExitedOn = &now
+		}
+	}
+}
+
+// looks for a wait event and updates wait fields if one exists. Runs don't store their own expiration so the session's
+// wait_expires_on is the only expiration that the expirations cron and run expiration resumes look at. Msg waits without
+// an expiration are given the passed in default expiration, if non-zero, so that sessions don't wait forever. Dial waits
+// in voice flows keep whatever expiration the engine gave them.
+func (s *Session) updateWait(evts []flows.Event, defaultExpiration time.Duration) {
 	canResume := func(r flows.Run) bool {
 		// a session can be resumed on a wait expiration if there's a parent and it's a messaging flow
 		return r.ParentInSession() != nil && r.Flow().Type() == flows.FlowTypeMessaging
@@ -210,7 +350,15 @@ func (s *Session) updateWait(evts []flows.Event) {
 	s.s.WaitResumeOnExpire = false
 	s.timeout = nil
 
-	now := time.Now()
+	now := dates.Now()
+
+	expiresOn := func(e *time.Time) *time.Time {
+		if e == nil && defaultExpiration > 0 {
+			defaultExpiresOn := now.Add(defaultExpiration)
+			return &defaultExpiresOn
+		}
+		return e
+	}
 
 	for _, e := range evts {
 		switch typed := e.(type) {
@@ -218,7 +366,7 @@ func (s *Session) updateWait(evts []flows.Event) {
 			run, _ := s.findStep(e.StepUUID())
 
 			s.s.WaitStartedOn = &now
-			s.s.WaitExpiresOn = typed.ExpiresOn
+			s.s.WaitExpiresOn = expiresOn(typed.ExpiresOn)
 			s.s.WaitResumeOnExpire = canResume(run)
 
 			if typed.TimeoutSeconds != nil {
@@ -292,13 +440,28 @@ WHERE
 	fr.uuid = r.uuid::uuid
 `
 
-// Update updates the session based on the state passed in from our engine session, this also takes care of applying any event hooks
+// Update updates the session based on the state passed in from our engine session, this also takes care of applying any event hooks.
+// All queries honor the deadline of the passed in context, and if it has already expired then nothing is modified.
 func (s *Session) Update(ctx context.Context, rt *runtime.Runtime, tx *sqlx.Tx, oa *OrgAssets, fs flows.Session, sprint flows.Sprint, contact *Contact, hook SessionCommitHook) error {
+	start := time.Now()
+
+	// whether or not we succeed, any cached flow session will no longer match our output
+	s.ClearFlowSession()
+
+	// no point starting to modify this session if we won't be able to write it
+	if err := ctx.Err(); err != nil {
+		return errors.Wrapf(err, "unable to update session #%d", s.ID())
+	}
+
 	// make sure we have our seen runs
 	if s.seenRuns == nil {
 		return errors.Errorf("missing seen runs, cannot update session")
 	}
 
+	if err := checkRunCount(rt, fs); err != nil {
+		return err
+	}
+
 	output, err := json.Marshal(fs)
 	if err != nil {
 		return errors.Wrapf(err, "error marshalling flow session")
@@ -313,19 +476,14 @@ func (s *Session) Update(ctx context.Context, rt *runtime.Runtime, tx *sqlx.Tx,
 	s.s.Status = status
 
 	if s.s.Status != SessionStatusWaiting {
-		now := time.Now()
+		now := dates.Now()
 		s.s.EndedOn = &now
 	}
 
-	// now build up our runs
-	for _, r := range fs.Runs() {
-		run, err := newRun(ctx, tx, oa, s, r)
-		if err != nil {
-			return errors.Wrapf(err, "error creating run: %s", r.UUID())
-		}
-
-		// set the run on our session
-		s.runs = append(s.runs, run)
+	// now rebuild our runs from the updated flow session
+	s.runs = nil
+	if err := s.addRuns(ctx, tx, oa, fs, rt.Config.SessionMissingFlows == "skip"); err != nil {
+		return err
 	}
 
 	// set our sprint, wait and step finder
@@ -334,14 +492,14 @@ func (s *Session) Update(ctx context.Context, rt *runtime.Runtime, tx *sqlx.Tx,
 	s.s.CurrentFlowID = NilFlowID
 
 	// update wait related fields
-	s.updateWait(sprint.Events())
+	s.updateWait(sprint.Events(), defaultWaitExpiration(rt.Config))
 
 	// run through our runs to figure out our current flow
 	for _, r := range fs.Runs() {
 		// if this run is waiting, save it as the current flow
 		if r.Status() == flows.RunStatusWaiting {
 			flowID, err := FlowIDForUUID(ctx, tx, oa, r.FlowReference().UUID)
-			if err != nil {
+			if err != nil && !(err == sql.ErrNoRows && rt.Config.SessionMissingFlows == "skip") {
 				return errors.Wrapf(err, "error loading flow: %s", r.FlowReference().UUID)
 			}
 			s.s.CurrentFlowID = flowID
@@ -459,19 +617,63 @@ func (s *Session) Update(ctx context.Context, rt *runtime.Runtime, tx *sqlx.Tx,
 		return errors.Wrapf(err, "error applying pre commit hook: %T", hook)
 	}
 
+	// rows touched are the session itself plus any new or updated runs
+	recordMetrics(rt, "session_update", start, 1+len(newRuns)+len(updatedRuns))
+
 	return nil
 }
 
 // ClearWaitTimeout clears the timeout on the wait on this session and is used if the engine tells us
-// that the flow no longer has a timeout on that wait. It can be called without updating the session
-// in the database which is used when handling msg_created events before session is updated anyway.
-func (s *Session) ClearWaitTimeout(ctx context.Context, db *sqlx.DB) error {
+// that the flow no longer has a timeout on that wait, or by admin tooling to cancel a pending timeout.
+// It can be called without updating the session in the database which is used when handling msg_created
+// events before session is updated anyway, or with a transaction to clear it as part of a larger change.
+func (s *Session) ClearWaitTimeout(ctx context.Context, db Queryer) error {
 	s.s.WaitTimeoutOn = nil
 
 	if db != nil {
 		_, err := db.ExecContext(ctx, `UPDATE flows_flowsession SET timeout_on = NULL WHERE id = $1`, s.ID())
-		return errors.Wrap(err, "error clearing wait timeout")
+		return errors.Wrapf(err, "error clearing wait timeout for session #%d", s.ID())
+	}
+	return nil
+}
+
+// SetWaitResumeOnExpire overrides whether this session will resume its parent flow when its wait expires, rather than
+// ending, e.g. for admin tooling when the parent flow is broken. Only waiting sessions can be changed.
+func (s *Session) SetWaitResumeOnExpire(ctx context.Context, db Queryer, resume bool) error {
+	if s.s.Status != SessionStatusWaiting {
+		return errors.Errorf("can't change expiration of session #%d with status %s", s.ID(), s.s.Status)
+	}
+
+	if _, err := SetWaitResumeOnExpire(ctx, db, []SessionID{s.ID()}, resume); err != nil {
+		return err
+	}
+
+	s.s.WaitResumeOnExpire = resume
+	return nil
+}
+
+// Interrupt interrupts this session, and its runs, within the given transaction. This is equivalent to interrupting
+// it by ID with one of the bulk interrupt functions but also updates this session object.
+func (s *Session) Interrupt(ctx context.Context, tx *sqlx.Tx) error {
+	if s.s.Status != SessionStatusWaiting {
+		return errors.Errorf("can't interrupt session #%d with status %s", s.ID(), s.s.Status)
+	}
+
+	if _, err := exitSessionBatch(ctx, tx, []SessionID{s.ID()}, SessionStatusInterrupted); err != nil {
+		return errors.Wrapf(err, "error interrupting session #%d", s.ID())
 	}
+
+	now := dates.Now()
+
+	s.s.Status = SessionStatusInterrupted
+	s.s.EndedOn = &now
+	s.s.WaitStartedOn = nil
+	s.s.WaitTimeoutOn = nil
+	s.s.WaitExpiresOn = nil
+	s.s.WaitResumeOnExpire = false
+	s.s.CurrentFlowID = NilFlowID
+	s.timeout = nil
+
 	return nil
 }
 
@@ -487,12 +689,17 @@ func (s *Session) UnmarshalJSON(b []byte) error {
 
 // NewSession a session objects from the passed in flow session. It does NOT
 // commit said session to the database.
-func NewSession(ctx context.Context, tx *sqlx.Tx, oa *OrgAssets, fs flows.Session, sprint flows.Sprint) (*Session, error) {
+func NewSession(ctx context.Context, cfg *runtime.Config, tx *sqlx.Tx, oa *OrgAssets, fs flows.Session, sprint flows.Sprint) (*Session, error) {
 	output, err := json.Marshal(fs)
 	if err != nil {
 		return nil, errors.Wrapf(err, "error marshalling flow session")
 	}
 
+	return newSession(ctx, tx, oa, fs, sprint, output, false, defaultWaitExpiration(cfg))
+}
+
+// creates a new session object from the passed in flow session and its already marshalled output
+func newSession(ctx context.Context, tx *sqlx.Tx, oa *OrgAssets, fs flows.Session, sprint flows.Sprint, output []byte, skipMissingFlows bool, defaultWaitExpiration time.Duration) (*Session, error) {
 	// map our status over
 	sessionStatus, found := sessionStatusMap[fs.Status()]
 	if !found {
@@ -528,7 +735,7 @@ func NewSession(ctx context.Context, tx *sqlx.Tx, oa *OrgAssets, fs flows.Sessio
 	s.CreatedOn = fs.Runs()[0].CreatedOn()
 
 	if s.Status != SessionStatusWaiting {
-		now := time.Now()
+		now := dates.Now()
 		s.EndedOn = &now
 	}
 
@@ -539,19 +746,15 @@ func NewSession(ctx context.Context, tx *sqlx.Tx, oa *OrgAssets, fs flows.Sessio
 	session.findStep = fs.FindStep
 
 	// now build up our runs
-	for _, r := range fs.Runs() {
-		run, err := newRun(ctx, tx, oa, session, r)
-		if err != nil {
-			return nil, errors.Wrapf(err, "error creating run: %s", r.UUID())
-		}
-
-		// save the run to our session
-		session.runs = append(session.runs, run)
+	if err := session.addRuns(ctx, tx, oa, fs, skipMissingFlows); err != nil {
+		return nil, err
+	}
 
+	for _, r := range fs.Runs() {
 		// if this run is waiting, save it as the current flow
 		if r.Status() == flows.RunStatusWaiting {
 			flowID, err := FlowIDForUUID(ctx, tx, oa, r.FlowReference().UUID)
-			if err != nil {
+			if err != nil && !(err == sql.ErrNoRows && skipMissingFlows) {
 				return nil, errors.Wrapf(err, "error loading current flow for UUID: %s", r.FlowReference().UUID)
 			}
 			s.CurrentFlowID = flowID
@@ -559,7 +762,7 @@ func NewSession(ctx context.Context, tx *sqlx.Tx, oa *OrgAssets, fs flows.Sessio
 	}
 
 	// calculate our timeout if any
-	session.updateWait(sprint.Events())
+	session.updateWait(sprint.Events(), defaultWaitExpiration)
 
 	return session, nil
 }
@@ -589,23 +792,43 @@ INSERT INTO
 RETURNING id`
 
 // InsertSessions writes the passed in session to our database, writes any runs that need to be created
-// as well as appying any events created in the session
+// as well as appying any events created in the session. Sessions with more runs than we allow are written as failed
+// without applying their events.
 func InsertSessions(ctx context.Context, rt *runtime.Runtime, tx *sqlx.Tx, oa *OrgAssets, ss []flows.Session, sprints []flows.Sprint, contacts []*Contact, hook SessionCommitHook) ([]*Session, error) {
 	if len(ss) == 0 {
 		return nil, nil
 	}
 
+	start := time.Now()
+
 	// create all our session objects
 	sessions := make([]*Session, 0, len(ss))
 	waitingSessionsI := make([]interface{}, 0, len(ss))
 	endedSessionsI := make([]interface{}, 0, len(ss))
 	completedCallIDs := make([]CallID, 0, 1)
 
+	// sessions with too many runs are written as failed so they don't hold up the rest of the batch
+	tooManyRuns := make(map[int]bool)
+	for i, s := range ss {
+		if err := checkRunCount(rt, s); err != nil {
+			tooManyRuns[i] = true
+		}
+	}
+
+	// marshalling session outputs is the expensive pure part of writing sessions so do that in parallel
+	outputs, err := marshalSessions(ss)
+	if err != nil {
+		return nil, err
+	}
+
 	for i, s := range ss {
-		session, err := NewSession(ctx, tx, oa, s, sprints[i])
+		session, err := newSession(ctx, tx, oa, s, sprints[i], outputs[i], rt.Config.SessionMissingFlows == "skip", defaultWaitExpiration(rt.Config))
 		if err != nil {
 			return nil, errors.Wrapf(err, "error creating session objects")
 		}
+		if tooManyRuns[i] {
+			session.fail()
+		}
 		sessions = append(sessions, session)
 
 		if session.Status() == SessionStatusWaiting {
@@ -618,8 +841,11 @@ func InsertSessions(ctx context.Context, rt *runtime.Runtime, tx *sqlx.Tx, oa *O
 		}
 	}
 
-	// apply all our pre write events
+	// apply all our pre write events, except for failed sessions whose events shouldn't take effect
 	for i := range ss {
+		if tooManyRuns[i] {
+			continue
+		}
 		for _, e := range sprints[i].Events() {
 			err := ApplyPreWriteEvent(ctx, rt, tx, oa, sessions[i].scene, e)
 			if err != nil {
@@ -652,7 +878,7 @@ func InsertSessions(ctx context.Context, rt *runtime.Runtime, tx *sqlx.Tx, oa *O
 	}
 
 	// insert our ended sessions first
-	err := BulkQuery(ctx, "insert ended sessions", tx, insertEndedSQL, endedSessionsI)
+	err = BulkQuery(ctx, "insert ended sessions", tx, insertEndedSQL, endedSessionsI)
 	if err != nil {
 		return nil, errors.Wrapf(err, "error inserting ended sessions")
 	}
@@ -716,10 +942,98 @@ func InsertSessions(ctx context.Context, rt *runtime.Runtime, tx *sqlx.Tx, oa *O
 		return nil, errors.Wrapf(err, "error applying pre commit hook: %T", hook)
 	}
 
+	recordMetrics(rt, "sessions_insert", start, len(sessions))
+
 	// return our session
 	return sessions, nil
 }
 
+// WriteSessions inserts the given new sessions in a transaction of its own which it commits, first interrupting any
+// existing sessions of their contacts if interrupt is true. If that fails because of a transient database error such as
+// a deadlock, everything is retried in a fresh transaction up to the configured number of attempts. The hook is only
+// ever called with the transaction being attempted so its changes are never applied more than once.
+func WriteSessions(ctx context.Context, rt *runtime.Runtime, oa *OrgAssets, ss []flows.Session, sprints []flows.Sprint, contacts []*Contact, interrupt bool, hook SessionCommitHook) ([]*Session, error) {
+	var sessions []*Session
+
+	err := retryOnTransientErrorN(ctx, rt.Config.SessionWriteAttempts, func() error {
+		tx, err := rt.DB.BeginTxx(ctx, nil)
+		if err != nil {
+			return errors.Wrapf(err, "error starting transaction")
+		}
+
+		if interrupt {
+			contactIDs := make([]ContactID, len(contacts))
+			for i, c := range contacts {
+				contactIDs[i] = c.ID()
+			}
+
+			if err := InterruptSessionsForContactsTx(ctx, rt, tx, contactIDs); err != nil {
+				tx.Rollback()
+				return errors.Wrap(err, "error interrupting contacts")
+			}
+		}
+
+		sessions, err = InsertSessions(ctx, rt, tx, oa, ss, sprints, contacts, hook)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "error committing sessions")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// marshals the outputs of the passed in flow sessions using a bounded pool of goroutines, returning
+// outputs in the same order as the sessions
+func marshalSessions(ss []flows.Session) ([][]byte, error) {
+	outputs := make([][]byte, len(ss))
+	errs := make([]error, len(ss))
+
+	// no point spinning up goroutines for a single session
+	if len(ss) == 1 {
+		outputs[0], errs[0] = json.Marshal(ss[0])
+	} else {
+		indexes := make(chan int, len(ss))
+		for i := range ss {
+			indexes <- i
+		}
+		close(indexes)
+
+		workers := sessionMarshalWorkers
+		if len(ss) < workers {
+			workers = len(ss)
+		}
+
+		wg := &sync.WaitGroup{}
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range indexes {
+					outputs[i], errs[i] = json.Marshal(ss[i])
+				}
+			}()
+		}
+		wg.Wait()
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, errors.Wrapf(err, "error marshalling flow session")
+		}
+	}
+	return outputs, nil
+}
+
 const sqlSelectWaitingSessionForContact = `
 SELECT 
 	id,
@@ -773,28 +1087,84 @@ func FindWaitingSessionForContact(ctx context.Context, db *sqlx.DB, st storage.S
 		return nil, errors.Wrapf(err, "error scanning session")
 	}
 
-	// load our output from storage if necessary
-	if session.OutputURL() != "" {
-		// strip just the path out of our output URL
-		u, err := url.Parse(session.OutputURL())
-		if err != nil {
-			return nil, errors.Wrapf(err, "error parsing output URL: %s", session.OutputURL())
-		}
+	if err := session.loadOutput(ctx, st); err != nil {
+		return nil, err
+	}
 
-		start := time.Now()
+	return session, nil
+}
 
-		_, output, err := st.Get(ctx, u.Path)
-		if err != nil {
-			return nil, errors.Wrapf(err, "error reading session from storage: %s", session.OutputURL())
-		}
+const sqlSelectSessionByID = `
+SELECT 
+	id,
+	uuid,
+	session_type,
+	status,
+	responded,
+	output,
+	output_url,
+	contact_id,
+	org_id,
+	created_on,
+	ended_on,
+	timeout_on,
+	wait_started_on,
+	wait_expires_on,
+	wait_resume_on_expire,
+	current_flow_id,
+	call_id
+FROM 
+	flows_flowsession fs
+WHERE
+	id = $1 AND
+	org_id = $2
+`
+
+// GetSessionByID loads the session with the passed in id, in any status, returning nil if it doesn't exist in the
+// given org. The returned session doesn't have a contact so can only be used for reading.
+func GetSessionByID(ctx context.Context, db *sqlx.DB, st storage.Storage, oa *OrgAssets, sessionID SessionID) (*Session, error) {
+	session := &Session{}
+	session.scene = NewSceneForSession(session)
+
+	err := db.GetContext(ctx, &session.s, sqlSelectSessionByID, sessionID, oa.OrgID())
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error selecting session #%d", sessionID)
+	}
 
-		logrus.WithField("elapsed", time.Since(start)).WithField("output_url", session.OutputURL()).Debug("loaded session from storage")
-		session.s.Output = null.String(output)
+	if err := session.loadOutput(ctx, st); err != nil {
+		return nil, err
 	}
 
 	return session, nil
 }
 
+// loads our output from storage if it isn't stored in the database
+func (s *Session) loadOutput(ctx context.Context, st storage.Storage) error {
+	if s.OutputURL() == "" {
+		return nil
+	}
+
+	// strip just the path out of our output URL
+	u, err := url.Parse(s.OutputURL())
+	if err != nil {
+		return errors.Wrapf(err, "error parsing output URL: %s", s.OutputURL())
+	}
+
+	start := time.Now()
+
+	_, output, err := st.Get(ctx, u.Path)
+	if err != nil {
+		return errors.Wrapf(err, "error reading session from storage: %s", s.OutputURL())
+	}
+
+	logrus.WithField("elapsed", time.Since(start)).WithField("output_url", s.OutputURL()).Debug("loaded session from storage")
+	s.s.Output = null.String(output)
+	return nil
+}
+
 // WriteSessionsToStorage writes the outputs of the passed in sessions to our storage (S3), updating the
 // output_url for each on success. Failure of any will cause all to fail.
 func WriteSessionOutputsToStorage(ctx context.Context, rt *runtime.Runtime, sessions []*Session) error {
@@ -822,11 +1192,90 @@ func WriteSessionOutputsToStorage(ctx context.Context, rt *runtime.Runtime, sess
 	return nil
 }
 
-// FilterByWaitingSession takes contact ids and returns those who have waiting sessions
-func FilterByWaitingSession(ctx context.Context, db *sqlx.DB, contacts []ContactID) ([]ContactID, error) {
+const sqlSelectSessionOutputsToMigrate = `
+  SELECT s.id, s.uuid, s.org_id, c.uuid AS contact_uuid, s.created_on, s.output
+    FROM flows_flowsession s
+    JOIN contacts_contact c ON c.id = s.contact_id
+   WHERE s.org_id = $1 AND s.output IS NOT NULL AND s.output_url IS NULL
+ORDER BY s.id
+   LIMIT $2`
+
+// outputs are only cleared if they haven't changed since we uploaded them, e.g. by a waiting session being resumed
+const sqlUpdateMigratedSessionOutputs = `
+UPDATE flows_flowsession s
+   SET output_url = r.output_url, output = NULL
+  FROM unnest($1::bigint[], $2::text[], $3::text[]) AS r(id, output_url, output_md5)
+ WHERE s.id = r.id AND s.output IS NOT NULL AND md5(s.output) = r.output_md5`
+
+// MigrateSessionOutputToStorage moves the outputs of up to limit sessions in the given org which are stored in the
+// database to the given storage, in batches, returning the number of sessions migrated. Sessions whose outputs are
+// already in storage are skipped so this can be called repeatedly until it returns zero. Sessions whose outputs are
+// modified whilst being uploaded keep their new output in the database and will be picked up by a later call.
+func MigrateSessionOutputToStorage(ctx context.Context, db *sqlx.DB, st storage.Storage, cfg *runtime.Config, orgID OrgID, limit int) (int, error) {
+	type sessionOutput struct {
+		ID          SessionID         `db:"id"`
+		UUID        flows.SessionUUID `db:"uuid"`
+		OrgID       OrgID             `db:"org_id"`
+		ContactUUID flows.ContactUUID `db:"contact_uuid"`
+		CreatedOn   time.Time         `db:"created_on"`
+		Output      string            `db:"output"`
+	}
+
+	var outputs []*sessionOutput
+	if err := db.SelectContext(ctx, &outputs, sqlSelectSessionOutputsToMigrate, orgID, limit); err != nil {
+		return 0, errors.Wrapf(err, "error selecting session outputs to migrate")
+	}
+
+	migrated := 0
+
+	for _, batch := range chunkSlice(outputs, 100) {
+		uploads := make([]*storage.Upload, len(batch))
+		hashes := make([]string, len(batch))
+		for i, o := range batch {
+			hashes[i] = fmt.Sprintf("%x", md5.Sum([]byte(o.Output)))
+			uploads[i] = &storage.Upload{
+				Path:        sessionStoragePath(cfg, o.OrgID, o.ContactUUID, o.UUID, o.CreatedOn, hashes[i]),
+				Body:        []byte(o.Output),
+				ContentType: "application/json",
+			}
+		}
+
+		if err := st.BatchPut(ctx, uploads); err != nil {
+			return migrated, errors.Wrapf(err, "error writing session outputs to storage")
+		}
+
+		// only clear outputs once they're safely in storage
+		ids := make([]SessionID, len(batch))
+		urls := make([]string, len(batch))
+		for i, o := range batch {
+			ids[i] = o.ID
+			urls[i] = uploads[i].URL
+		}
+
+		res, err := db.ExecContext(ctx, sqlUpdateMigratedSessionOutputs, pq.Array(ids), pq.Array(urls), pq.Array(hashes))
+		if err != nil {
+			return migrated, errors.Wrapf(err, "error updating migrated sessions")
+		}
+
+		updated, _ := res.RowsAffected()
+		migrated += int(updated)
+	}
+
+	return migrated, nil
+}
+
+// FilterByWaitingSession takes contact ids and returns those who have waiting sessions. The query is cancelled if it
+// takes longer than the configured DB timeout.
+func FilterByWaitingSession(ctx context.Context, rt *runtime.Runtime, contacts []ContactID) ([]ContactID, error) {
+	ctx, cancel := withDBTimeout(ctx, rt)
+	defer cancel()
+
 	var overlap []ContactID
-	err := db.SelectContext(ctx, &overlap, `SELECT DISTINCT(contact_id) FROM flows_flowsession WHERE status = 'W' AND contact_id = ANY($1)`, pq.Array(contacts))
-	return overlap, err
+	err := rt.DB.SelectContext(ctx, &overlap, `SELECT DISTINCT(contact_id) FROM flows_flowsession WHERE status = 'W' AND contact_id = ANY($1)`, pq.Array(contacts))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error selecting contacts with waiting sessions")
+	}
+	return overlap, nil
 }
 
 // GetSessionWaitExpiresOn looks up the wait expiration for the passed in session and will return nil if the
@@ -843,34 +1292,179 @@ func GetSessionWaitExpiresOn(ctx context.Context, db *sqlx.DB, sessionID Session
 	return &expiresOn, nil
 }
 
-// ExitSessions exits sessions and their runs. It batches the given session ids and exits each batch in a transaction.
-func ExitSessions(ctx context.Context, db *sqlx.DB, sessionIDs []SessionID, status SessionStatus) error {
-	if len(sessionIDs) == 0 {
-		return nil
+// ContactSession is a summary of one of a contact's sessions which doesn't require loading the session's output
+type ContactSession struct {
+	ID            SessionID     `db:"id"`
+	SessionType   FlowType      `db:"session_type"`
+	Status        SessionStatus `db:"status"`
+	FlowID        FlowID        `db:"flow_id"`
+	CurrentFlowID FlowID        `db:"current_flow_id"`
+	CreatedOn     time.Time     `db:"created_on"`
+	EndedOn       *time.Time    `db:"ended_on"`
+}
+
+const sqlSelectContactSessions = `
+  SELECT s.id, s.session_type, s.status, s.current_flow_id, s.created_on, s.ended_on,
+         (SELECT r.flow_id FROM flows_flowrun r WHERE r.session_id = s.id ORDER BY r.id LIMIT 1) AS flow_id
+    FROM flows_flowsession s
+   WHERE s.org_id = $1 AND s.contact_id = $2
+ORDER BY s.created_on DESC, s.id DESC
+   LIMIT $3`
+
+// GetContactSessions returns up to limit of the most recent sessions of the given contact, newest first. The flow of
+// each session is the flow of its first run.
+func GetContactSessions(ctx context.Context, db Queryer, orgID OrgID, contactID ContactID, limit int) ([]*ContactSession, error) {
+	sessions := make([]*ContactSession, 0, limit)
+
+	if err := db.SelectContext(ctx, &sessions, sqlSelectContactSessions, orgID, contactID, limit); err != nil {
+		return nil, errors.Wrapf(err, "error selecting sessions for contact #%d", contactID)
 	}
 
-	// split into batches and exit each batch in a transaction
-	for _, idBatch := range chunkSlice(sessionIDs, 100) {
-		tx, err := db.BeginTxx(ctx, nil)
-		if err != nil {
-			return errors.Wrapf(err, "error starting transaction to exit sessions")
-		}
+	return sessions, nil
+}
+
+const sqlSelectTimedOutSessions = `
+  SELECT id, org_id, contact_id, timeout_on
+    FROM flows_flowsession
+   WHERE status = 'W' AND timeout_on < $1 AND call_id IS NULL
+ORDER BY timeout_on ASC
+   LIMIT $2`
+
+// SessionTimeout is a waiting session whose wait has timed out
+type SessionTimeout struct {
+	SessionID SessionID `db:"id"`
+	OrgID     OrgID     `db:"org_id"`
+	ContactID ContactID `db:"contact_id"`
+	TimeoutOn time.Time `db:"timeout_on"`
+}
+
+// FindTimedOutSessions returns up to limit waiting sessions whose wait timeout is before now, oldest timeouts first.
+// Voice sessions are excluded as their timeouts are handled by the IVR service.
+func FindTimedOutSessions(ctx context.Context, db Queryer, now time.Time, limit int) ([]*SessionTimeout, error) {
+	timeouts := make([]*SessionTimeout, 0, 10)
+
+	if err := db.SelectContext(ctx, &timeouts, sqlSelectTimedOutSessions, now, limit); err != nil {
+		return nil, errors.Wrapf(err, "error selecting timed out sessions")
+	}
+
+	return timeouts, nil
+}
 
-		if err := exitSessionBatch(ctx, tx, idBatch, status); err != nil {
-			return errors.Wrapf(err, "error exiting batch of sessions")
+const sqlSelectExpiredWaitSessions = `
+  SELECT id, wait_resume_on_expire
+    FROM flows_flowsession
+   WHERE session_type = 'M' AND status = 'W' AND wait_expires_on < $1
+ORDER BY wait_expires_on ASC
+   LIMIT $2`
+
+// the top-level run of each session is its first, as child runs are only ever created after their parents
+const sqlSelectTopLevelRunsForSessions = `
+  SELECT id FROM (
+      SELECT DISTINCT ON (session_id) id
+        FROM flows_flowrun
+       WHERE session_id = ANY($1)
+    ORDER BY session_id, id
+  ) r
+ORDER BY id`
+
+// FindExpiredWaits returns up to limit messaging sessions whose wait expired before now, oldest expirations first. The
+// sessions which should be ended are returned along with their top-level runs, and sessions whose waits resume on
+// expiration are returned separately as those must be resumed rather than ended.
+func FindExpiredWaits(ctx context.Context, db Queryer, now time.Time, limit int) ([]FlowRunID, []SessionID, []SessionID, error) {
+	expired := make([]struct {
+		ID                 SessionID `db:"id"`
+		WaitResumeOnExpire bool      `db:"wait_resume_on_expire"`
+	}, 0, limit)
+
+	if err := db.SelectContext(ctx, &expired, sqlSelectExpiredWaitSessions, now, limit); err != nil {
+		return nil, nil, nil, errors.Wrapf(err, "error selecting sessions with expired waits")
+	}
+
+	endIDs := make([]SessionID, 0, len(expired))
+	resumeIDs := make([]SessionID, 0, len(expired))
+
+	for _, s := range expired {
+		if s.WaitResumeOnExpire {
+			resumeIDs = append(resumeIDs, s.ID)
+		} else {
+			endIDs = append(endIDs, s.ID)
 		}
+	}
 
-		if err := tx.Commit(); err != nil {
-			return errors.Wrapf(err, "error committing session exits")
+	runIDs := make([]FlowRunID, 0, len(endIDs))
+
+	if len(endIDs) > 0 {
+		if err := db.SelectContext(ctx, &runIDs, sqlSelectTopLevelRunsForSessions, pq.Array(endIDs)); err != nil {
+			return nil, nil, nil, errors.Wrapf(err, "error selecting runs for sessions with expired waits")
 		}
 	}
 
-	return nil
+	return runIDs, endIDs, resumeIDs, nil
+}
+
+// ExitSessions exits sessions and their runs. It batches the given session ids and exits each batch in a transaction,
+// retrying batches which fail because of transient errors such as deadlocks.
+func ExitSessions(ctx context.Context, db *sqlx.DB, sessionIDs []SessionID, status SessionStatus) error {
+	if len(sessionIDs) == 0 {
+		return nil
+	}
+
+	// split into batches and exit each batch in a transaction, retrying batches which hit deadlocks etc
+	for _, idBatch := range chunkSlice(sessionIDs, 100) {
+		err := retryOnTransientError(ctx, func() error {
+			tx, err := db.BeginTxx(ctx, nil)
+			if err != nil {
+				return errors.Wrapf(err, "error starting transaction to exit sessions")
+			}
+
+			if _, err := exitSessionBatch(ctx, tx, idBatch, status); err != nil {
+				tx.Rollback()
+				return errors.Wrapf(err, "error exiting batch of sessions")
+			}
+
+			return errors.Wrapf(tx.Commit(), "error committing session exits")
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// FailSession fails the given waiting session and its runs, e.g. when it can no longer be resumed because of an engine
+// error, returning ErrNotFound if there's no such waiting session. The session table is owned by RapidPro and has no
+// column for a failure reason, so callers should log the reason for triage themselves.
+func FailSession(ctx context.Context, db *sqlx.DB, sessionID SessionID) error {
+	var failed int
+
+	err := retryOnTransientError(ctx, func() error {
+		tx, err := db.BeginTxx(ctx, nil)
+		if err != nil {
+			return errors.Wrapf(err, "error starting transaction to fail session")
+		}
+
+		failed, err = exitSessionBatch(ctx, tx, []SessionID{sessionID}, SessionStatusFailed)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		return errors.Wrapf(tx.Commit(), "error committing session failure")
+	})
+	if err != nil {
+		return errors.Wrapf(err, "error failing session #%d", sessionID)
+	}
+
+	if failed == 0 {
+		return ErrNotFound
+	}
+	return nil
 }
 
 const sqlExitSessions = `
    UPDATE flows_flowsession
-      SET status = $3, ended_on = $2, wait_started_on = NULL, wait_expires_on = NULL, timeout_on = NULL, current_flow_id = NULL
+      SET status = $3, ended_on = $2, wait_started_on = NULL, wait_expires_on = NULL, timeout_on = NULL, wait_resume_on_expire = FALSE, current_flow_id = NULL
     WHERE id = ANY ($1) AND status = 'W'
 RETURNING contact_id`
 
@@ -879,13 +1473,15 @@ UPDATE flows_flowrun
    SET exited_on = $2, status = $3, modified_on = NOW()
  WHERE session_id = ANY($1) AND status IN ('A', 'W')`
 
+// contacts which still have a waiting session, e.g. a messaging session when only a background session was exited,
+// keep their current flow
 const sqlExitSessionContacts = `
- UPDATE contacts_contact 
+ UPDATE contacts_contact c
     SET current_flow_id = NULL, modified_on = NOW() 
-  WHERE id = ANY($1)`
+  WHERE c.id = ANY($1) AND NOT EXISTS (SELECT 1 FROM flows_flowsession s WHERE s.contact_id = c.id AND s.status = 'W')`
 
-// exits sessions and their runs inside the given transaction
-func exitSessionBatch(ctx context.Context, tx *sqlx.Tx, sessionIDs []SessionID, status SessionStatus) error {
+// exits sessions and their runs inside the given transaction, returning the number of sessions which were exited
+func exitSessionBatch(ctx context.Context, tx *sqlx.Tx, sessionIDs []SessionID, status SessionStatus) (int, error) {
 	runStatus := RunStatus(status) // session status codes are subset of run status codes
 	contactIDs := make([]SessionID, 0, len(sessionIDs))
 
@@ -894,7 +1490,7 @@ func exitSessionBatch(ctx context.Context, tx *sqlx.Tx, sessionIDs []SessionID,
 
 	err := tx.SelectContext(ctx, &contactIDs, sqlExitSessions, pq.Array(sessionIDs), time.Now(), status)
 	if err != nil {
-		return errors.Wrapf(err, "error exiting sessions")
+		return 0, errors.Wrapf(err, "error exiting sessions")
 	}
 
 	logrus.WithField("count", len(contactIDs)).WithField("elapsed", time.Since(start)).Debug("exited session batch")
@@ -904,7 +1500,7 @@ func exitSessionBatch(ctx context.Context, tx *sqlx.Tx, sessionIDs []SessionID,
 
 	res, err := tx.ExecContext(ctx, sqlExitSessionRuns, pq.Array(sessionIDs), time.Now(), runStatus)
 	if err != nil {
-		return errors.Wrapf(err, "error exiting session runs")
+		return 0, errors.Wrapf(err, "error exiting session runs")
 	}
 
 	rows, _ := res.RowsAffected()
@@ -915,13 +1511,20 @@ func exitSessionBatch(ctx context.Context, tx *sqlx.Tx, sessionIDs []SessionID,
 
 	res, err = tx.ExecContext(ctx, sqlExitSessionContacts, pq.Array(contactIDs))
 	if err != nil {
-		return errors.Wrapf(err, "error exiting sessions")
+		return 0, errors.Wrapf(err, "error exiting sessions")
 	}
 
 	rows, _ = res.RowsAffected()
 	logrus.WithField("count", rows).WithField("elapsed", time.Since(start)).Debug("exited session batch contacts")
 
-	return nil
+	// interrupted sessions shouldn't go on to send any messages that are still pending
+	if status == SessionStatusInterrupted {
+		if err := CancelPendingMessagesForSessions(ctx, tx, sessionIDs); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(contactIDs), nil
 }
 
 func getWaitingSessionsForContacts(ctx context.Context, db Queryer, contactIDs []ContactID) ([]SessionID, error) {
@@ -936,42 +1539,229 @@ func getWaitingSessionsForContacts(ctx context.Context, db Queryer, contactIDs [
 }
 
 // InterruptSessionsForContacts interrupts any waiting sessions for the given contacts
-func InterruptSessionsForContacts(ctx context.Context, db *sqlx.DB, contactIDs []ContactID) (int, error) {
-	sessionIDs, err := getWaitingSessionsForContacts(ctx, db, contactIDs)
+func InterruptSessionsForContacts(ctx context.Context, rt *runtime.Runtime, contactIDs []ContactID) (int, error) {
+	start := time.Now()
+
+	sessionIDs, err := getWaitingSessionsForContacts(ctx, rt.DB, contactIDs)
 	if err != nil {
 		return 0, err
 	}
 
-	return len(sessionIDs), errors.Wrapf(ExitSessions(ctx, db, sessionIDs, SessionStatusInterrupted), "error exiting sessions")
+	if err := ExitSessions(ctx, rt.DB, sessionIDs, SessionStatusInterrupted); err != nil {
+		return 0, errors.Wrapf(err, "error exiting sessions")
+	}
+
+	recordMetrics(rt, "sessions_interrupt", start, len(sessionIDs))
+	return len(sessionIDs), nil
 }
 
 // InterruptSessionsForContactsTx interrupts any waiting sessions for the given contacts inside the given transaction.
 // This version is used for interrupting during flow starts where contacts are already batched and we have an open transaction.
-func InterruptSessionsForContactsTx(ctx context.Context, tx *sqlx.Tx, contactIDs []ContactID) error {
+func InterruptSessionsForContactsTx(ctx context.Context, rt *runtime.Runtime, tx *sqlx.Tx, contactIDs []ContactID) error {
+	start := time.Now()
+
 	sessionIDs, err := getWaitingSessionsForContacts(ctx, tx, contactIDs)
 	if err != nil {
 		return err
 	}
 
-	return errors.Wrapf(exitSessionBatch(ctx, tx, sessionIDs, SessionStatusInterrupted), "error exiting sessions")
+	if _, err := exitSessionBatch(ctx, tx, sessionIDs, SessionStatusInterrupted); err != nil {
+		return errors.Wrapf(err, "error exiting sessions")
+	}
+
+	recordMetrics(rt, "sessions_interrupt", start, len(sessionIDs))
+	return nil
+}
+
+const sqlWaitingSessionIDsOfTypeForContacts = `
+SELECT id
+  FROM flows_flowsession
+ WHERE status = 'W' AND contact_id = ANY($1) AND session_type = $2`
+
+// InterruptSessionsOfTypeForContacts interrupts any waiting sessions of the given type for the given contacts. Types are
+// matched exactly so interrupting background sessions won't touch messaging sessions, even though the engine considers
+// background flows to be a kind of messaging flow.
+func InterruptSessionsOfTypeForContacts(ctx context.Context, rt *runtime.Runtime, contactIDs []ContactID, sessionType FlowType) (int, error) {
+	start := time.Now()
+	sessionIDs := make([]SessionID, 0, len(contactIDs))
+
+	err := rt.DB.SelectContext(ctx, &sessionIDs, sqlWaitingSessionIDsOfTypeForContacts, pq.Array(contactIDs), sessionType)
+	if err != nil {
+		return 0, errors.Wrapf(err, "error selecting waiting sessions of type %s for contacts", sessionType)
+	}
+
+	if err := ExitSessions(ctx, rt.DB, sessionIDs, SessionStatusInterrupted); err != nil {
+		return 0, errors.Wrapf(err, "error exiting sessions")
+	}
+
+	recordMetrics(rt, "sessions_interrupt", start, len(sessionIDs))
+	return len(sessionIDs), nil
+}
+
+const sqlSelectSessionsForContacts = `
+SELECT id, output_url FROM flows_flowsession WHERE contact_id = ANY($1) ORDER BY id`
+
+const sqlDeleteSessionRuns = `DELETE FROM flows_flowrun WHERE session_id = ANY($1)`
+
+const sqlDeleteSessions = `DELETE FROM flows_flowsession WHERE id = ANY($1)`
+
+const sqlDeleteRunsForContacts = `DELETE FROM flows_flowrun WHERE contact_id = ANY($1)`
+
+const sqlClearCurrentFlowForContacts = `UPDATE contacts_contact SET current_flow_id = NULL WHERE id = ANY($1)`
+
+// DeleteSessionsForContacts deletes (rather than interrupts) all sessions and runs for the given contacts, e.g. for
+// data erasure requests. Sessions are deleted in batches of the configured size, each in its own transaction, so that
+// erasing a contact with many sessions doesn't hold locks on lots of rows. If sessions are stored externally their
+// stored outputs are first overwritten with empty content since our storage doesn't support deletion, and if that fails
+// nothing is deleted so that the request can be retried.
+func DeleteSessionsForContacts(ctx context.Context, rt *runtime.Runtime, contactIDs []ContactID) error {
+	start := time.Now()
+
+	var sessions []struct {
+		ID        SessionID   `db:"id"`
+		OutputURL null.String `db:"output_url"`
+	}
+	if err := rt.DB.SelectContext(ctx, &sessions, sqlSelectSessionsForContacts, pq.Array(contactIDs)); err != nil {
+		return errors.Wrapf(err, "error selecting sessions for contacts")
+	}
+
+	sessionIDs := make([]SessionID, len(sessions))
+	outputURLs := make([]string, 0, len(sessions))
+	for i, s := range sessions {
+		sessionIDs[i] = s.ID
+		if s.OutputURL != "" {
+			outputURLs = append(outputURLs, string(s.OutputURL))
+		}
+	}
+
+	// erase stored outputs first as once the rows are gone we no longer know where they are
+	if rt.Config.SessionStorage == "s3" && len(outputURLs) > 0 {
+		uploads := make([]*storage.Upload, 0, len(outputURLs))
+		for _, outputURL := range outputURLs {
+			u, err := url.Parse(outputURL)
+			if err != nil {
+				return errors.Wrapf(err, "error parsing output URL: %s", outputURL)
+			}
+			uploads = append(uploads, &storage.Upload{Path: u.Path, Body: []byte{}, ContentType: "application/json"})
+		}
+
+		if err := rt.SessionStorage.BatchPut(ctx, uploads); err != nil {
+			return errors.Wrapf(err, "error erasing session outputs from storage")
+		}
+	}
+
+	for _, idBatch := range chunkSlice(sessionIDs, rt.Config.SessionDeleteBatch) {
+		if err := deleteSessionBatch(ctx, rt.DB, idBatch); err != nil {
+			return err
+		}
+	}
+
+	// delete any runs that didn't belong to a session and take contacts out of their flows
+	tx, err := rt.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.Wrapf(err, "error starting transaction to delete runs")
+	}
+	if _, err := tx.ExecContext(ctx, sqlDeleteRunsForContacts, pq.Array(contactIDs)); err != nil {
+		tx.Rollback()
+		return errors.Wrapf(err, "error deleting runs for contacts")
+	}
+	if _, err := tx.ExecContext(ctx, sqlClearCurrentFlowForContacts, pq.Array(contactIDs)); err != nil {
+		tx.Rollback()
+		return errors.Wrapf(err, "error clearing current flow for contacts")
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrapf(err, "error committing run deletion")
+	}
+
+	recordMetrics(rt, "sessions_delete", start, len(sessionIDs))
+	return nil
+}
+
+// deletes the given sessions and their runs in a single transaction
+func deleteSessionBatch(ctx context.Context, db *sqlx.DB, sessionIDs []SessionID) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.Wrapf(err, "error starting transaction to delete sessions")
+	}
+
+	// runs reference sessions so must be deleted first
+	if _, err := tx.ExecContext(ctx, sqlDeleteSessionRuns, pq.Array(sessionIDs)); err != nil {
+		tx.Rollback()
+		return errors.Wrapf(err, "error deleting session runs")
+	}
+
+	if _, err := tx.ExecContext(ctx, sqlDeleteSessions, pq.Array(sessionIDs)); err != nil {
+		tx.Rollback()
+		return errors.Wrapf(err, "error deleting sessions")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrapf(err, "error committing session deletion")
+	}
+	return nil
 }
 
 const sqlWaitingSessionIDsForChannel = `
 SELECT fs.id
   FROM flows_flowsession fs
   JOIN ivr_call cc ON fs.call_id = cc.id
- WHERE fs.status = 'W' AND cc.channel_id = $1;`
+ WHERE fs.status = 'W' AND cc.channel_id = $1
+ ORDER BY fs.id;`
 
-// InterruptSessionsForChannel interrupts any waiting sessions with calls on the given channel
-func InterruptSessionsForChannel(ctx context.Context, db *sqlx.DB, channelID ChannelID) error {
+// WaitingSessionsForChannel returns the ids of the waiting sessions with calls on the given channel, i.e. the sessions
+// which would be interrupted by InterruptSessionsForChannel
+func WaitingSessionsForChannel(ctx context.Context, db Queryer, channelID ChannelID) ([]SessionID, error) {
 	sessionIDs := make([]SessionID, 0, 10)
 
 	err := db.SelectContext(ctx, &sessionIDs, sqlWaitingSessionIDsForChannel, channelID)
 	if err != nil {
-		return errors.Wrapf(err, "error selecting waiting sessions for channel %d", channelID)
+		return nil, errors.Wrapf(err, "error selecting waiting sessions for channel %d", channelID)
+	}
+	return sessionIDs, nil
+}
+
+// InterruptSessionsForChannel interrupts any waiting sessions with calls on the given channel
+func InterruptSessionsForChannel(ctx context.Context, rt *runtime.Runtime, channelID ChannelID) error {
+	start := time.Now()
+
+	sessionIDs, err := WaitingSessionsForChannel(ctx, rt.DB, channelID)
+	if err != nil {
+		return err
 	}
 
-	return errors.Wrapf(ExitSessions(ctx, db, sessionIDs, SessionStatusInterrupted), "error exiting sessions")
+	if err := ExitSessions(ctx, rt.DB, sessionIDs, SessionStatusInterrupted); err != nil {
+		return errors.Wrapf(err, "error exiting sessions")
+	}
+
+	recordMetrics(rt, "sessions_interrupt", start, len(sessionIDs))
+	return nil
+}
+
+const sqlWaitingSessionIDsForStart = `
+SELECT DISTINCT fs.id
+  FROM flows_flowsession fs
+  JOIN flows_flowrun fr ON fr.session_id = fs.id
+ WHERE fs.status = 'W' AND fr.start_id = $1;`
+
+// InterruptSessionsForStart interrupts any waiting sessions which were created by the given flow start
+func InterruptSessionsForStart(ctx context.Context, rt *runtime.Runtime, startID StartID) error {
+	start := time.Now()
+	sessionIDs := make([]SessionID, 0, 10)
+
+	selectCtx, cancel := withDBTimeout(ctx, rt)
+	defer cancel()
+
+	err := rt.DB.SelectContext(selectCtx, &sessionIDs, sqlWaitingSessionIDsForStart, startID)
+	if err != nil {
+		return errors.Wrapf(err, "error selecting waiting sessions for start %d", startID)
+	}
+
+	if err := ExitSessions(ctx, rt.DB, sessionIDs, SessionStatusInterrupted); err != nil {
+		return errors.Wrapf(err, "error exiting sessions")
+	}
+
+	recordMetrics(rt, "sessions_interrupt", start, len(sessionIDs))
+	return nil
 }
 
 const sqlWaitingSessionIDsForFlows = `
@@ -980,17 +1770,424 @@ SELECT id
  WHERE status = 'W' AND current_flow_id = ANY($1);`
 
 // InterruptSessionsForFlows interrupts any waiting sessions currently in the given flows
-func InterruptSessionsForFlows(ctx context.Context, db *sqlx.DB, flowIDs []FlowID) error {
+func InterruptSessionsForFlows(ctx context.Context, rt *runtime.Runtime, flowIDs []FlowID) error {
 	if len(flowIDs) == 0 {
 		return nil
 	}
 
+	start := time.Now()
 	sessionIDs := make([]SessionID, 0, len(flowIDs))
 
-	err := db.SelectContext(ctx, &sessionIDs, sqlWaitingSessionIDsForFlows, pq.Array(flowIDs))
+	selectCtx, cancel := withDBTimeout(ctx, rt)
+	defer cancel()
+
+	err := rt.DB.SelectContext(selectCtx, &sessionIDs, sqlWaitingSessionIDsForFlows, pq.Array(flowIDs))
 	if err != nil {
 		return errors.Wrapf(err, "error selecting waiting sessions for flows")
 	}
 
-	return errors.Wrapf(ExitSessions(ctx, db, sessionIDs, SessionStatusInterrupted), "error exiting sessions")
+	if err := ExitSessions(ctx, rt.DB, sessionIDs, SessionStatusInterrupted); err != nil {
+		return errors.Wrapf(err, "error exiting sessions")
+	}
+
+	recordMetrics(rt, "sessions_interrupt", start, len(sessionIDs))
+	return nil
+}
+
+const sqlWaitingSessionIDsOfTypeForOrg = `
+SELECT id
+  FROM flows_flowsession
+ WHERE status = 'W' AND org_id = $1 AND session_type = $2;`
+
+// InterruptSessionsOfTypeForOrg interrupts all waiting sessions of the given type across an entire org, e.g. when an
+// org's voice channels are being removed. Given how many sessions this can affect, it's not exposed via the web API.
+func InterruptSessionsOfTypeForOrg(ctx context.Context, rt *runtime.Runtime, orgID OrgID, sessionType FlowType) (int, error) {
+	start := time.Now()
+	sessionIDs := make([]SessionID, 0, 10)
+
+	selectCtx, cancel := withDBTimeout(ctx, rt)
+	defer cancel()
+
+	err := rt.DB.SelectContext(selectCtx, &sessionIDs, sqlWaitingSessionIDsOfTypeForOrg, orgID, sessionType)
+	if err != nil {
+		return 0, errors.Wrapf(err, "error selecting waiting sessions of type %s for org %d", sessionType, orgID)
+	}
+
+	if err := ExitSessions(ctx, rt.DB, sessionIDs, SessionStatusInterrupted); err != nil {
+		return 0, errors.Wrapf(err, "error exiting sessions")
+	}
+
+	recordMetrics(rt, "sessions_interrupt", start, len(sessionIDs))
+	return len(sessionIDs), nil
+}
+
+const sqlCountActiveContactsForFlow = `
+SELECT count(DISTINCT contact_id)
+  FROM flows_flowsession
+ WHERE status = 'W' AND current_flow_id = $1`
+
+// ActiveContactCountForFlow returns the number of distinct contacts currently waiting in the given flow
+func ActiveContactCountForFlow(ctx context.Context, db Queryer, flowID FlowID) (int64, error) {
+	var count int64
+	if err := db.GetContext(ctx, &count, sqlCountActiveContactsForFlow, flowID); err != nil {
+		return 0, errors.Wrapf(err, "error counting active contacts for flow #%d", flowID)
+	}
+	return count, nil
+}
+
+const sqlUpdateWaitResumeOnExpire = `
+UPDATE flows_flowsession
+   SET wait_resume_on_expire = $2
+ WHERE id = ANY($1) AND status = 'W'`
+
+// SetWaitResumeOnExpire overrides whether the given sessions will resume their parent flows when their waits expire,
+// returning the number of sessions updated. Sessions which aren't waiting are ignored.
+func SetWaitResumeOnExpire(ctx context.Context, db Queryer, sessionIDs []SessionID, resume bool) (int, error) {
+	res, err := db.ExecContext(ctx, sqlUpdateWaitResumeOnExpire, pq.Array(sessionIDs), resume)
+	if err != nil {
+		return 0, errors.Wrapf(err, "error updating wait resume on expire for sessions")
+	}
+
+	updated, _ := res.RowsAffected()
+	return int(updated), nil
+}
+
+const sqlSelectSessionForReopen = `
+SELECT status, session_type, output, output_url, contact_id, org_id
+  FROM flows_flowsession
+ WHERE id = $1
+   FOR UPDATE`
+
+// the state of a session we need to decide whether it can be reopened
+type reopenableSession struct {
+	Status      SessionStatus `db:"status"`
+	SessionType FlowType      `db:"session_type"`
+	Output      null.String   `db:"output"`
+	OutputURL   null.String   `db:"output_url"`
+	ContactID   ContactID     `db:"contact_id"`
+	OrgID       OrgID         `db:"org_id"`
+}
+
+// selects the given session, locking it until the given transaction ends
+func selectSessionForReopen(ctx context.Context, tx *sqlx.Tx, sessionID SessionID) (*reopenableSession, error) {
+	s := &reopenableSession{}
+	if err := tx.GetContext(ctx, s, sqlSelectSessionForReopen, sessionID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorf("no session with id #%d", sessionID)
+		}
+		return nil, errors.Wrapf(err, "error selecting session #%d", sessionID)
+	}
+	return s, nil
+}
+
+var (
+	errReopenContactWaiting = errors.New("contact already has a waiting session")
+	errReopenFlowMissing    = errors.New("its flow no longer exists")
+)
+
+const sqlReopenSession = `
+UPDATE flows_flowsession fs
+   SET status = 'W', output = COALESCE($2, fs.output), ended_on = NULL, timeout_on = NULL, current_flow_id = f.id, wait_started_on = NOW(),
+       wait_expires_on = NOW() + (f.expires_after_minutes * INTERVAL '1 minute'), wait_resume_on_expire = $4
+  FROM flows_flow f
+ WHERE fs.id = $1 AND f.uuid = $3 AND f.org_id = fs.org_id
+RETURNING f.id`
+
+const sqlReopenSessionRun = `
+UPDATE flows_flowrun
+   SET status = $2, exited_on = NULL, modified_on = NOW()
+ WHERE uuid = $1`
+
+// puts the given session back into a waiting state inside the given transaction, with the given run waiting and the
+// given runs active, and sets it as its contact's current flow. If newOutput is non-empty it replaces the session's
+// output. Errors with errReopenContactWaiting or errReopenFlowMissing if the session can't be reopened.
+func reopenSession(ctx context.Context, tx *sqlx.Tx, sessionID SessionID, s *reopenableSession, newOutput null.String, waitingRun *reopenRun, activeRuns []flows.RunUUID) error {
+	var waiting int
+	if err := tx.GetContext(ctx, &waiting, `SELECT count(*) FROM flows_flowsession WHERE contact_id = $1 AND status = 'W'`, s.ContactID); err != nil {
+		return errors.Wrapf(err, "error checking for waiting sessions")
+	}
+	if waiting > 0 {
+		return errReopenContactWaiting
+	}
+
+	// as when a wait is written, only messaging subflows resume their parents when they expire
+	resumeOnExpire := waitingRun.ParentUUID != "" && s.SessionType == FlowTypeMessaging
+
+	var flowID FlowID
+	if err := tx.GetContext(ctx, &flowID, sqlReopenSession, sessionID, newOutput, waitingRun.Flow.UUID, resumeOnExpire); err != nil {
+		if err == sql.ErrNoRows {
+			return errReopenFlowMissing
+		}
+		return errors.Wrapf(err, "error updating session #%d", sessionID)
+	}
+
+	if _, err := tx.ExecContext(ctx, sqlReopenSessionRun, waitingRun.UUID, RunStatusWaiting); err != nil {
+		return errors.Wrapf(err, "error updating waiting run")
+	}
+	for _, runUUID := range activeRuns {
+		if _, err := tx.ExecContext(ctx, sqlReopenSessionRun, runUUID, RunStatusActive); err != nil {
+			return errors.Wrapf(err, "error updating parent run")
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE contacts_contact SET current_flow_id = $2, modified_on = NOW() WHERE id = $1`, s.ContactID, flowID); err != nil {
+		return errors.Wrapf(err, "error updating contact current flow")
+	}
+	return nil
+}
+
+// ReopenSession reopens a completed session whose final step was at a wait, e.g. because the flow had been missing a
+// destination for one of the wait's exits. The session and the run with that wait are put back into a waiting state
+// so that the contact's next input resumes the flow from that wait. Sessions that didn't end at a wait are left alone
+// and an error is returned.
+func ReopenSession(ctx context.Context, db *sqlx.DB, sessionID SessionID) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.Wrapf(err, "error starting transaction to reopen session #%d", sessionID)
+	}
+	defer tx.Rollback()
+
+	s, err := selectSessionForReopen(ctx, tx, sessionID)
+	if err != nil {
+		return err
+	}
+	if s.Status != SessionStatusCompleted {
+		return errors.Errorf("can't reopen session #%d with status %s", sessionID, s.Status)
+	}
+	if s.Output == "" {
+		return errors.Errorf("can't reopen session #%d whose output isn't stored in the database", sessionID)
+	}
+
+	newOutput, waitingRun, activeRuns, err := reopenSessionOutput([]byte(s.Output))
+	if err != nil {
+		return errors.Wrapf(err, "can't reopen session #%d", sessionID)
+	}
+
+	if err := reopenSession(ctx, tx, sessionID, s, null.String(newOutput), waitingRun, activeRuns); err != nil {
+		return errors.Wrapf(err, "can't reopen session #%d", sessionID)
+	}
+
+	return errors.Wrapf(tx.Commit(), "error committing reopened session #%d", sessionID)
+}
+
+// the parts of a run in session output that we need to decide if a session can be reopened
+type reopenRun struct {
+	UUID flows.RunUUID `json:"uuid"`
+	Flow struct {
+		UUID assets.FlowUUID `json:"uuid"`
+	} `json:"flow"`
+	Status     flows.RunStatus `json:"status"`
+	ParentUUID flows.RunUUID   `json:"parent_uuid"`
+	Path       []struct {
+		UUID      flows.StepUUID `json:"uuid"`
+		ArrivedOn time.Time      `json:"arrived_on"`
+	} `json:"path"`
+	Events []struct {
+		Type     string         `json:"type"`
+		StepUUID flows.StepUUID `json:"step_uuid"`
+	} `json:"events"`
+}
+
+// returns when this run arrived at its current step, i.e. when it started waiting if it's waiting
+func (r *reopenRun) waitedOn() time.Time {
+	if len(r.Path) == 0 {
+		return time.Time{}
+	}
+	return r.Path[len(r.Path)-1].ArrivedOn
+}
+
+// checks that the given session output ended at a wait, and if so returns a modified output with that wait's run
+// waiting and its ancestors active, as well as that run and the UUIDs of its ancestors
+func reopenSessionOutput(output []byte) ([]byte, *reopenRun, []flows.RunUUID, error) {
+	session := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(output, &session); err != nil {
+		return nil, nil, nil, errors.Wrap(err, "error unmarshaling session output")
+	}
+
+	var rawRuns []map[string]json.RawMessage
+	if err := json.Unmarshal(session["runs"], &rawRuns); err != nil {
+		return nil, nil, nil, errors.Wrap(err, "error unmarshaling session runs")
+	}
+
+	var runs []*reopenRun
+	if err := json.Unmarshal(session["runs"], &runs); err != nil {
+		return nil, nil, nil, errors.Wrap(err, "error unmarshaling session runs")
+	}
+
+	runsByUUID := make(map[flows.RunUUID]int, len(runs))
+	var last *reopenRun
+	var lastStep flows.StepUUID
+	var lastArrivedOn time.Time
+
+	for i := range runs {
+		runsByUUID[runs[i].UUID] = i
+
+		// find the final step across all runs
+		for _, step := range runs[i].Path {
+			if last == nil || !step.ArrivedOn.Before(lastArrivedOn) {
+				last, lastStep, lastArrivedOn = runs[i], step.UUID, step.ArrivedOn
+			}
+		}
+	}
+
+	if last == nil || last.Status != flows.RunStatusCompleted {
+		return nil, nil, nil, errors.New("session didn't end with a completed run")
+	}
+
+	endedAtWait := false
+	for _, e := range last.Events {
+		if e.StepUUID == lastStep && (e.Type == events.TypeMsgWait || e.Type == events.TypeDialWait) {
+			endedAtWait = true
+		}
+	}
+	if !endedAtWait {
+		return nil, nil, nil, errors.New("session didn't end at a wait")
+	}
+
+	setStatus := func(run *reopenRun, status flows.RunStatus) {
+		raw := rawRuns[runsByUUID[run.UUID]]
+		raw["status"] = jsonx.MustMarshal(status)
+		delete(raw, "exited_on")
+	}
+
+	setStatus(last, flows.RunStatusWaiting)
+
+	activeRuns := make([]flows.RunUUID, 0, 1)
+	for parentUUID := last.ParentUUID; parentUUID != ""; {
+		i, found := runsByUUID[parentUUID]
+		if !found {
+			break
+		}
+		setStatus(runs[i], flows.RunStatusActive)
+		activeRuns = append(activeRuns, parentUUID)
+		parentUUID = runs[i].ParentUUID
+	}
+
+	session["runs"] = jsonx.MustMarshal(rawRuns)
+	session["status"] = jsonx.MustMarshal(flows.SessionStatusWaiting)
+
+	return jsonx.MustMarshal(session), last, activeRuns, nil
+}
+
+// RetryMsg is an incoming message which a failed session may have been resumed with
+type RetryMsg struct {
+	ID          MsgID          `db:"id"`
+	UUID        flows.MsgUUID  `db:"uuid"`
+	Text        string         `db:"text"`
+	Attachments pq.StringArray `db:"attachments"`
+	ExternalID  null.String    `db:"external_id"`
+	ChannelID   ChannelID      `db:"channel_id"`
+	URN         urns.URN       `db:"urn"`
+}
+
+// the first message from the contact since the session started waiting which was never handled, i.e. the one that
+// it was being resumed with when it failed
+const sqlSelectUnhandledMsgForRetry = `
+  SELECT m.id, m.uuid, m.text, m.attachments, m.external_id, m.channel_id, u.identity AS urn
+    FROM msgs_msg m
+    JOIN contacts_contacturn u ON u.id = m.contact_urn_id
+   WHERE m.contact_id = $1 AND m.direction = 'I' AND m.status = 'P' AND m.created_on > $2
+ORDER BY m.created_on, m.id
+   LIMIT 1`
+
+// ReopenedSession is a failed session which has been put back into waiting so that it can be retried
+type ReopenedSession struct {
+	OrgID       OrgID
+	ContactID   ContactID
+	SessionType FlowType
+
+	// the unhandled message the session was being resumed with when it failed, if any
+	Msg *RetryMsg
+}
+
+// ReopenFailedSession puts a session which was failed by mailroom rather than by the engine, e.g. because a webhook
+// was down whilst it was being resumed, back into waiting at the last wait it was written at. It returns nil if the
+// session isn't one which can be retried, i.e. it hasn't failed, it was failed by the engine itself so would just
+// fail again, or the contact has since moved on.
+func ReopenFailedSession(ctx context.Context, rt *runtime.Runtime, sessionID SessionID) (*ReopenedSession, error) {
+	log := logrus.WithField("session_id", sessionID)
+
+	tx, err := rt.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error starting transaction to reopen session #%d", sessionID)
+	}
+	defer tx.Rollback()
+
+	s, err := selectSessionForReopen(ctx, tx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if s.Status != SessionStatusFailed {
+		log.WithField("status", s.Status).Info("skipping reopen of session which hasn't failed")
+		return nil, nil
+	}
+
+	// load our output from storage if it isn't stored in the database
+	output := s.Output
+	if s.OutputURL != "" {
+		session := &Session{}
+		session.s.OutputURL = s.OutputURL
+		if err := session.loadOutput(ctx, rt.SessionStorage); err != nil {
+			return nil, err
+		}
+		output = session.s.Output
+	}
+
+	waitingRun, activeRuns, err := retrySessionRuns([]byte(output))
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't reopen session #%d", sessionID)
+	}
+	if waitingRun == nil {
+		log.Info("skipping reopen of session which was failed by the engine")
+		return nil, nil
+	}
+
+	if err := reopenSession(ctx, tx, sessionID, s, "", waitingRun, activeRuns); err != nil {
+		if err == errReopenContactWaiting || err == errReopenFlowMissing {
+			log.WithField("reason", err.Error()).Info("skipping reopen of session which can't be reopened")
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "error reopening session #%d", sessionID)
+	}
+
+	msg := &RetryMsg{}
+	if err := tx.GetContext(ctx, msg, sqlSelectUnhandledMsgForRetry, s.ContactID, waitingRun.waitedOn()); err != nil {
+		if err != sql.ErrNoRows {
+			return nil, errors.Wrapf(err, "error selecting unhandled message for session #%d", sessionID)
+		}
+		msg = nil
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrapf(err, "error committing reopened session #%d", sessionID)
+	}
+
+	return &ReopenedSession{OrgID: s.OrgID, ContactID: s.ContactID, SessionType: s.SessionType, Msg: msg}, nil
+}
+
+// if the given session output is still waiting, returns its waiting run and the UUIDs of its active runs, otherwise nil
+func retrySessionRuns(output []byte) (*reopenRun, []flows.RunUUID, error) {
+	session := &struct {
+		Status flows.SessionStatus `json:"status"`
+		Runs   []*reopenRun        `json:"runs"`
+	}{}
+	if err := json.Unmarshal(output, session); err != nil {
+		return nil, nil, errors.Wrap(err, "error unmarshaling session output")
+	}
+	if session.Status != flows.SessionStatusWaiting {
+		return nil, nil, nil
+	}
+
+	var waitingRun *reopenRun
+	activeRuns := make([]flows.RunUUID, 0, 1)
+
+	for _, run := range session.Runs {
+		switch run.Status {
+		case flows.RunStatusWaiting:
+			waitingRun = run
+		case flows.RunStatusActive:
+			activeRuns = append(activeRuns, run.UUID)
+		}
+	}
+	return waitingRun, activeRuns, nil
 }
@@ -2,17 +2,25 @@ package models_test
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"testing"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/nyaruka/gocommon/dates"
 	"github.com/nyaruka/gocommon/dbutil/assertdb"
+	"github.com/nyaruka/gocommon/storage"
 	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/flows/events"
 	"github.com/nyaruka/goflow/test"
 	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
 	"github.com/nyaruka/mailroom/testsuite"
 	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -66,6 +74,7 @@ func TestSessionCreationAndUpdating(t *testing.T) {
 		Columns(map[string]interface{}{
 			"status": "W", "session_type": "M", "current_flow_id": int64(flow.ID), "responded": false, "ended_on": nil, "wait_resume_on_expire": false,
 		})
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowsession WHERE timeout_on IS NOT NULL`).Returns(1)
 
 	// reload contact and check current flow is set
 	modelContact, _ = testdata.Bob.Load(db, oa)
@@ -92,6 +101,7 @@ func TestSessionCreationAndUpdating(t *testing.T) {
 	assert.NotNil(t, session.WaitExpiresOn())
 	assert.False(t, session.WaitResumeOnExpire())
 	assert.Nil(t, session.Timeout()) // this wait doesn't have a timeout
+	assertdb.Query(t, db, `SELECT timeout_on FROM flows_flowsession WHERE id = $1`, session.ID()).Returns(nil)
 
 	flowSession, err = session.FlowSession(rt.Config, oa.SessionAssets(), oa.Env())
 	require.NoError(t, err)
@@ -128,6 +138,286 @@ func TestSessionCreationAndUpdating(t *testing.T) {
 	assert.Equal(t, models.NilFlowID, modelContact.CurrentFlowID())
 }
 
+func TestSessionCurrentNodeUUID(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	testFlows := testdata.ImportFlows(db, testdata.Org1, "testdata/session_test_flows.json")
+	flow := testFlows[0]
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshFlows)
+	require.NoError(t, err)
+
+	modelContact, _ := testdata.Bob.Load(db, oa)
+
+	sa, flowSession, sprint1 := test.NewSessionBuilder().WithAssets(oa.SessionAssets()).WithFlow(flow.UUID).
+		WithContact(testdata.Bob.UUID, flows.ContactID(testdata.Bob.ID), "Bob", "eng", "").MustBuild()
+
+	tx := db.MustBegin()
+	modelSessions, err := models.InsertSessions(ctx, rt, tx, oa, []flows.Session{flowSession}, []flows.Sprint{sprint1}, []*models.Contact{modelContact}, nil)
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+
+	session := modelSessions[0]
+
+	// waiting at the first question's wait node
+	assert.Equal(t, models.SessionStatusWaiting, session.Status())
+	assert.Equal(t, flows.NodeUUID("cbff02b0-cd93-481d-a430-b335ab66779e"), session.CurrentNodeUUID())
+	assertdb.Query(t, db, `SELECT current_node_uuid::text FROM flows_flowrun WHERE session_id = $1`, session.ID()).Returns("cbff02b0-cd93-481d-a430-b335ab66779e")
+
+	resume := func(input string) {
+		flowSession, err := session.FlowSession(rt.Config, oa.SessionAssets(), oa.Env())
+		require.NoError(t, err)
+
+		flowSession, sprint, err := test.ResumeSession(flowSession, sa, input)
+		require.NoError(t, err)
+
+		tx := db.MustBegin()
+		require.NoError(t, session.Update(ctx, rt, tx, oa, flowSession, sprint, modelContact, nil))
+		require.NoError(t, tx.Commit())
+	}
+
+	// now waiting at the second question's wait node
+	resume("no")
+	assert.Equal(t, flows.NodeUUID("bd8de388-811e-4116-ab41-8c2260d5514e"), session.CurrentNodeUUID())
+
+	// and the same is true of the session when it's loaded from the database
+	loaded, err := models.FindWaitingSessionForContact(ctx, db, rt.SessionStorage, oa, models.FlowTypeMessaging, flowSession.Contact())
+	require.NoError(t, err)
+	assert.Equal(t, flows.NodeUUID("bd8de388-811e-4116-ab41-8c2260d5514e"), loaded.CurrentNodeUUID())
+
+	// and once the session completes, there's no current node
+	resume("yes")
+	assert.Equal(t, models.SessionStatusCompleted, session.Status())
+	assert.Equal(t, flows.NodeUUID(""), session.CurrentNodeUUID())
+}
+
+func TestSessionUpdateTouchesRuns(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	testFlows := testdata.ImportFlows(db, testdata.Org1, "testdata/session_test_flows.json")
+	flow := testFlows[0]
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshFlows)
+	require.NoError(t, err)
+
+	modelContact, _ := testdata.Bob.Load(db, oa)
+
+	sa, flowSession, sprint1 := test.NewSessionBuilder().WithAssets(oa.SessionAssets()).WithFlow(flow.UUID).
+		WithContact(testdata.Bob.UUID, flows.ContactID(testdata.Bob.ID), "Bob", "eng", "").MustBuild()
+
+	tx := db.MustBegin()
+	modelSessions, err := models.InsertSessions(ctx, rt, tx, oa, []flows.Session{flowSession}, []flows.Sprint{sprint1}, []*models.Contact{modelContact}, nil)
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+
+	session := modelSessions[0]
+
+	runModifiedOn := func() time.Time {
+		var modifiedOn time.Time
+		require.NoError(t, db.Get(&modifiedOn, `SELECT modified_on FROM flows_flowrun WHERE session_id = $1`, session.ID()))
+		return modifiedOn
+	}
+
+	modifiedOn1 := runModifiedOn()
+
+	// resume the session twice, checking the run's modified_on advances each time
+	for _, input := range []string{"no", "yes"} {
+		flowSession, err = session.FlowSession(rt.Config, oa.SessionAssets(), oa.Env())
+		require.NoError(t, err)
+
+		var sprint flows.Sprint
+		flowSession, sprint, err = test.ResumeSession(flowSession, sa, input)
+		require.NoError(t, err)
+
+		tx = db.MustBegin()
+		require.NoError(t, session.Update(ctx, rt, tx, oa, flowSession, sprint, modelContact, nil))
+		require.NoError(t, tx.Commit())
+
+		modifiedOn2 := runModifiedOn()
+		assert.True(t, modifiedOn2.After(modifiedOn1), "run modified_on didn't advance after resuming with '%s'", input)
+		modifiedOn1 = modifiedOn2
+	}
+}
+
+func TestSessionDefaultWaitExpiration(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	testFlows := testdata.ImportFlows(db, testdata.Org1, "testdata/session_test_flows.json")
+	flow := testFlows[0]
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshFlows)
+	require.NoError(t, err)
+
+	// builds a session whose wait has no expiration
+	buildSession := func(contact *testdata.Contact) (flows.Session, flows.Sprint, *models.Contact) {
+		modelContact, _ := contact.Load(db, oa)
+
+		_, flowSession, sprint := test.NewSessionBuilder().WithAssets(oa.SessionAssets()).WithFlow(flow.UUID).
+			WithContact(contact.UUID, flows.ContactID(contact.ID), "", "eng", "").MustBuild()
+
+		for _, e := range sprint.Events() {
+			if wait, isWait := e.(*events.MsgWaitEvent); isWait {
+				wait.ExpiresOn = nil
+			}
+		}
+		return flowSession, sprint, modelContact
+	}
+
+	rt.Config.DefaultWaitExpiration = 60
+
+	flowSession, sprint, modelContact := buildSession(testdata.Cathy)
+
+	tx := db.MustBegin()
+	modelSessions, err := models.InsertSessions(ctx, rt, tx, oa, []flows.Session{flowSession}, []flows.Sprint{sprint}, []*models.Contact{modelContact}, nil)
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+
+	// default expiration is applied to the wait
+	session := modelSessions[0]
+	require.NotNil(t, session.WaitExpiresOn())
+	assert.WithinDuration(t, time.Now().Add(time.Hour), *session.WaitExpiresOn(), time.Minute)
+
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowsession WHERE id = $1 AND wait_expires_on > NOW() + INTERVAL '59 minutes' AND wait_expires_on < NOW() + INTERVAL '61 minutes'`, session.ID()).Returns(1)
+
+	// unless there is no default
+	rt.Config.DefaultWaitExpiration = 0
+
+	flowSession, sprint, modelContact = buildSession(testdata.Bob)
+
+	tx = db.MustBegin()
+	modelSessions, err = models.InsertSessions(ctx, rt, tx, oa, []flows.Session{flowSession}, []flows.Sprint{sprint}, []*models.Contact{modelContact}, nil)
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+
+	assert.Nil(t, modelSessions[0].WaitExpiresOn())
+	assertdb.Query(t, db, `SELECT wait_expires_on FROM flows_flowsession WHERE id = $1`, modelSessions[0].ID()).Returns(nil)
+}
+
+func TestSessionWaitTimesWithFrozenClock(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+	defer dates.SetNowSource(dates.DefaultNowSource)
+
+	now := time.Date(2022, 4, 20, 12, 30, 0, 0, time.UTC)
+	dates.SetNowSource(dates.NewFixedNowSource(now))
+
+	testFlows := testdata.ImportFlows(db, testdata.Org1, "testdata/session_test_flows.json")
+	flow := testFlows[0]
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshFlows)
+	require.NoError(t, err)
+
+	modelContact, _ := testdata.Cathy.Load(db, oa)
+
+	_, flowSession, sprint := test.NewSessionBuilder().WithAssets(oa.SessionAssets()).WithFlow(flow.UUID).
+		WithContact(testdata.Cathy.UUID, flows.ContactID(testdata.Cathy.ID), "Cathy", "eng", "").MustBuild()
+
+	// remove the flow's expiration from the wait so that our default is used
+	for _, e := range sprint.Events() {
+		if wait, isWait := e.(*events.MsgWaitEvent); isWait {
+			wait.ExpiresOn = nil
+		}
+	}
+
+	rt.Config.DefaultWaitExpiration = 90
+
+	tx := db.MustBegin()
+	modelSessions, err := models.InsertSessions(ctx, rt, tx, oa, []flows.Session{flowSession}, []flows.Sprint{sprint}, []*models.Contact{modelContact}, nil)
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+
+	session := modelSessions[0]
+	require.NotNil(t, session.WaitStartedOn())
+	require.NotNil(t, session.WaitExpiresOn())
+	require.NotNil(t, session.Timeout())
+
+	// with time frozen we can check exact wait times
+	assert.Equal(t, now, *session.WaitStartedOn())
+	assert.Equal(t, now.Add(90*time.Minute), *session.WaitExpiresOn())
+	assert.Equal(t, now.Add(*session.Timeout()), *session.WaitTimeoutOn())
+
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowsession WHERE id = $1 AND wait_started_on = $2 AND wait_expires_on = $3`, session.ID(), now, now.Add(90*time.Minute)).Returns(1)
+}
+
+func TestWriteSessions(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	testFlows := testdata.ImportFlows(db, testdata.Org1, "testdata/session_test_flows.json")
+	flow := testFlows[0]
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshFlows)
+	require.NoError(t, err)
+
+	buildSession := func(contact *testdata.Contact) (flows.Session, flows.Sprint, *models.Contact) {
+		modelContact, _ := contact.Load(db, oa)
+
+		_, flowSession, sprint := test.NewSessionBuilder().WithAssets(oa.SessionAssets()).WithFlow(flow.UUID).
+			WithContact(contact.UUID, flows.ContactID(contact.ID), "", "eng", "").MustBuild()
+
+		return flowSession, sprint, modelContact
+	}
+
+	// hook which makes a change in the transaction and then fails with the given errors in turn
+	hookCalls := 0
+	newHook := func(contact *testdata.Contact, errs ...error) models.SessionCommitHook {
+		hookCalls = 0
+		return func(ctx context.Context, tx *sqlx.Tx, rp *redis.Pool, oa *models.OrgAssets, sessions []*models.Session) error {
+			hookCalls++
+			if _, err := tx.ExecContext(ctx, `UPDATE contacts_contact SET name = name || '!' WHERE id = $1`, contact.ID); err != nil {
+				return err
+			}
+			if hookCalls <= len(errs) {
+				return errs[hookCalls-1]
+			}
+			return nil
+		}
+	}
+
+	deadlock := &pq.Error{Code: "40P01", Message: "deadlock detected"}
+
+	// give cathy an existing session to be interrupted
+	existingID := testdata.InsertWaitingSession(db, testdata.Org1, testdata.Cathy, models.FlowTypeMessaging, testdata.Favorites, models.NilCallID, time.Now(), time.Now().Add(time.Hour), false, nil)
+
+	// a deadlock is retried in a fresh transaction so the hook's change is only committed once
+	flowSession, sprint, modelContact := buildSession(testdata.Cathy)
+
+	sessions, err := models.WriteSessions(ctx, rt, oa, []flows.Session{flowSession}, []flows.Sprint{sprint}, []*models.Contact{modelContact}, true, newHook(testdata.Cathy, deadlock))
+	require.NoError(t, err)
+	assert.Len(t, sessions, 1)
+	assert.Equal(t, 2, hookCalls)
+
+	assertdb.Query(t, db, `SELECT name FROM contacts_contact WHERE id = $1`, testdata.Cathy.ID).Returns("Cathy!")
+	assertdb.Query(t, db, `SELECT status FROM flows_flowsession WHERE id = $1`, existingID).Returns("I")
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowsession WHERE contact_id = $1 AND status = 'W'`, testdata.Cathy.ID).Returns(1)
+
+	// once we run out of attempts, the error is returned and nothing is written
+	rt.Config.SessionWriteAttempts = 2
+	defer func() { rt.Config.SessionWriteAttempts = 3 }()
+
+	flowSession, sprint, modelContact = buildSession(testdata.Bob)
+
+	_, err = models.WriteSessions(ctx, rt, oa, []flows.Session{flowSession}, []flows.Sprint{sprint}, []*models.Contact{modelContact}, false, newHook(testdata.Bob, deadlock, deadlock))
+	assert.Contains(t, err.Error(), "deadlock detected")
+	assert.Equal(t, 2, hookCalls)
+
+	// and other errors aren't retried at all
+	_, err = models.WriteSessions(ctx, rt, oa, []flows.Session{flowSession}, []flows.Sprint{sprint}, []*models.Contact{modelContact}, false, newHook(testdata.Bob, errors.New("boom")))
+	assert.Error(t, err)
+	assert.Equal(t, 1, hookCalls)
+
+	assertdb.Query(t, db, `SELECT name FROM contacts_contact WHERE id = $1`, testdata.Bob.ID).Returns("Bob")
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowsession WHERE contact_id = $1`, testdata.Bob.ID).Returns(0)
+}
+
 func TestSingleSprintSession(t *testing.T) {
 	ctx, rt, db, _ := testsuite.Get()
 
@@ -220,6 +510,13 @@ func TestSessionWithSubflows(t *testing.T) {
 	assert.True(t, session.WaitResumeOnExpire()) // because we have a parent
 	assert.Nil(t, session.Timeout())
 
+	// session has runs for both the parent and child flows
+	require.Len(t, session.Runs(), 2)
+	assert.Equal(t, parent.ID, session.Runs()[0].FlowID())
+	assert.Equal(t, models.RunStatusActive, session.Runs()[0].Status())
+	assert.Equal(t, child.ID, session.Runs()[1].FlowID())
+	assert.Equal(t, models.RunStatusWaiting, session.Runs()[1].Status())
+
 	// check that matches what is in the db
 	assertdb.Query(t, db, `SELECT status, session_type, current_flow_id, responded, ended_on, wait_resume_on_expire FROM flows_flowsession`).
 		Columns(map[string]interface{}{
@@ -247,197 +544,1324 @@ func TestSessionWithSubflows(t *testing.T) {
 	assert.Nil(t, session.WaitExpiresOn())
 	assert.False(t, session.WaitResumeOnExpire())
 	assert.Nil(t, session.Timeout())
+
+	require.Len(t, session.Runs(), 2)
+	assert.Equal(t, parent.ID, session.Runs()[0].FlowID())
+	assert.Equal(t, models.RunStatusCompleted, session.Runs()[0].Status())
+	assert.Equal(t, child.ID, session.Runs()[1].FlowID())
+	assert.Equal(t, models.RunStatusCompleted, session.Runs()[1].Status())
 }
 
-func TestSessionFailedStart(t *testing.T) {
+func TestSessionFlowSessionCaching(t *testing.T) {
 	ctx, rt, db, _ := testsuite.Get()
 
 	defer testsuite.Reset(testsuite.ResetData)
 
-	testFlows := testdata.ImportFlows(db, testdata.Org1, "testdata/ping_pong.json")
-	ping, pong := testFlows[0], testFlows[1]
+	testFlows := testdata.ImportFlows(db, testdata.Org1, "testdata/session_test_flows.json")
+	parent := testFlows[2]
 
 	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshFlows)
 	require.NoError(t, err)
 
 	modelContact, _ := testdata.Cathy.Load(db, oa)
 
-	_, flowSession, sprint1 := test.NewSessionBuilder().WithAssets(oa.SessionAssets()).WithFlow(ping.UUID).
+	sa, flowSession, sprint1 := test.NewSessionBuilder().WithAssets(oa.SessionAssets()).WithFlow(parent.UUID).
 		WithContact(testdata.Cathy.UUID, flows.ContactID(testdata.Cathy.ID), "Cathy", "eng", "").MustBuild()
 
 	tx := db.MustBegin()
-
-	hookCalls := 0
-	hook := func(context.Context, *sqlx.Tx, *redis.Pool, *models.OrgAssets, []*models.Session) error {
-		hookCalls++
-		return nil
-	}
-
-	modelSessions, err := models.InsertSessions(ctx, rt, tx, oa, []flows.Session{flowSession}, []flows.Sprint{sprint1}, []*models.Contact{modelContact}, hook)
+	modelSessions, err := models.InsertSessions(ctx, rt, tx, oa, []flows.Session{flowSession}, []flows.Sprint{sprint1}, []*models.Contact{modelContact}, nil)
 	require.NoError(t, err)
-	assert.Equal(t, 1, hookCalls)
-
 	require.NoError(t, tx.Commit())
 
 	session := modelSessions[0]
 
-	assert.Equal(t, models.FlowTypeMessaging, session.SessionType())
-	assert.Equal(t, testdata.Cathy.ID, session.ContactID())
-	assert.Equal(t, models.SessionStatusFailed, session.Status())
-	assert.Equal(t, models.NilFlowID, session.CurrentFlowID())
-	assert.Nil(t, session.WaitExpiresOn())
-	assert.NotNil(t, session.EndedOn())
-
-	// check that matches what is in the db
-	assertdb.Query(t, db, `SELECT status, session_type, current_flow_id, responded FROM flows_flowsession`).
-		Columns(map[string]interface{}{"status": "F", "session_type": "M", "current_flow_id": nil, "responded": false})
-	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowsession WHERE ended_on IS NOT NULL`).Returns(1)
+	// second read with the same assets returns the cached session rather than re-reading it
+	fs1, err := session.FlowSession(rt.Config, oa.SessionAssets(), oa.Env())
+	require.NoError(t, err)
+	fs2, err := session.FlowSession(rt.Config, oa.SessionAssets(), oa.Env())
+	require.NoError(t, err)
+	assert.Same(t, fs1, fs2)
 
-	// check the state of all the created runs
-	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowrun`).Returns(101)
-	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowrun WHERE flow_id = $1`, ping.ID).Returns(51)
-	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowrun WHERE flow_id = $1`, pong.ID).Returns(50)
-	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowrun WHERE status = 'F' AND exited_on IS NOT NULL`).Returns(101)
-}
+	// but not if different assets are used
+	fs3, err := session.FlowSession(rt.Config, sa, oa.Env())
+	require.NoError(t, err)
+	assert.NotSame(t, fs2, fs3)
 
-func TestInterruptSessionsForContacts(t *testing.T) {
-	ctx, _, db, _ := testsuite.Get()
+	fs3, sprint2, err := test.ResumeSession(fs3, sa, "yes")
+	require.NoError(t, err)
 
-	defer testsuite.Reset(testsuite.ResetData)
+	tx = db.MustBegin()
+	require.NoError(t, session.Update(ctx, rt, tx, oa, fs3, sprint2, modelContact, nil))
+	require.NoError(t, tx.Commit())
 
-	session1ID, _ := insertSessionAndRun(db, testdata.Cathy, models.FlowTypeMessaging, models.SessionStatusCompleted, testdata.Favorites, models.NilCallID)
-	session2ID, run2ID := insertSessionAndRun(db, testdata.Cathy, models.FlowTypeVoice, models.SessionStatusWaiting, testdata.Favorites, models.NilCallID)
-	session3ID, _ := insertSessionAndRun(db, testdata.Bob, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, models.NilCallID)
-	session4ID, _ := insertSessionAndRun(db, testdata.George, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, models.NilCallID)
+	// updating invalidates the cache so we get a session read from the new output
+	fs4, err := session.FlowSession(rt.Config, sa, oa.Env())
+	require.NoError(t, err)
+	assert.NotSame(t, fs3, fs4)
+	assert.Equal(t, flows.SessionStatusCompleted, fs4.Status())
 
-	// noop if no contacts
-	_, err := models.InterruptSessionsForContacts(ctx, db, []models.ContactID{})
-	assert.NoError(t, err)
+	// and so does a failed update, e.g. because our context has expired
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancel()
 
-	assertSessionAndRunStatus(t, db, session1ID, models.SessionStatusCompleted)
-	assertSessionAndRunStatus(t, db, session2ID, models.SessionStatusWaiting)
-	assertSessionAndRunStatus(t, db, session3ID, models.SessionStatusWaiting)
-	assertSessionAndRunStatus(t, db, session4ID, models.SessionStatusWaiting)
+	tx = db.MustBegin()
+	assert.Error(t, session.Update(cancelledCtx, rt, tx, oa, fs4, sprint2, modelContact, nil))
+	tx.Rollback()
 
-	count, err := models.InterruptSessionsForContacts(ctx, db, []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID, testdata.Alexandria.ID})
-	assert.Equal(t, 2, count)
-	assert.NoError(t, err)
+	fs5, err := session.FlowSession(rt.Config, sa, oa.Env())
+	require.NoError(t, err)
+	assert.NotSame(t, fs4, fs5)
 
-	assertSessionAndRunStatus(t, db, session1ID, models.SessionStatusCompleted) // wasn't waiting
-	assertSessionAndRunStatus(t, db, session2ID, models.SessionStatusInterrupted)
-	assertSessionAndRunStatus(t, db, session3ID, models.SessionStatusInterrupted)
-	assertSessionAndRunStatus(t, db, session4ID, models.SessionStatusWaiting) // contact not included
+	// as does explicitly clearing it
+	session.ClearFlowSession()
 
-	// check other columns are correct on interrupted session, run and contact
-	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowsession WHERE ended_on IS NOT NULL AND wait_started_on IS NULL AND wait_expires_on IS NULL AND timeout_on IS NULL AND current_flow_id IS NULL AND id = $1`, session2ID).Returns(1)
-	assertdb.Query(t, db, `SELECT status FROM flows_flowrun WHERE id = $1`, run2ID).Columns(map[string]interface{}{"status": "I"})
-	assertdb.Query(t, db, `SELECT current_flow_id FROM contacts_contact WHERE id = $1`, testdata.Cathy.ID).Returns(nil)
+	fs6, err := session.FlowSession(rt.Config, sa, oa.Env())
+	require.NoError(t, err)
+	assert.NotSame(t, fs5, fs6)
 }
 
-func TestInterruptSessionsForContactsTx(t *testing.T) {
-	ctx, _, db, _ := testsuite.Get()
+func TestSessionMaxOutputSize(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
 
 	defer testsuite.Reset(testsuite.ResetData)
 
-	session1ID, _ := insertSessionAndRun(db, testdata.Cathy, models.FlowTypeMessaging, models.SessionStatusCompleted, testdata.Favorites, models.NilCallID)
-	session2ID, run2ID := insertSessionAndRun(db, testdata.Cathy, models.FlowTypeVoice, models.SessionStatusWaiting, testdata.Favorites, models.NilCallID)
-	session3ID, _ := insertSessionAndRun(db, testdata.Bob, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, models.NilCallID)
-	session4ID, _ := insertSessionAndRun(db, testdata.George, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, models.NilCallID)
-
-	tx := db.MustBegin()
+	testFlows := testdata.ImportFlows(db, testdata.Org1, "testdata/session_test_flows.json")
+	flow := testFlows[0]
 
-	// noop if no contacts
-	err := models.InterruptSessionsForContactsTx(ctx, tx, []models.ContactID{})
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshFlows)
 	require.NoError(t, err)
 
+	modelContact, flowContact := testdata.Cathy.Load(db, oa)
+
+	_, flowSession, sprint := test.NewSessionBuilder().WithAssets(oa.SessionAssets()).WithFlow(flow.UUID).
+		WithContact(testdata.Cathy.UUID, flows.ContactID(testdata.Cathy.ID), "Cathy", "eng", "").MustBuild()
+
+	tx := db.MustBegin()
+	modelSessions, err := models.InsertSessions(ctx, rt, tx, oa, []flows.Session{flowSession}, []flows.Sprint{sprint}, []*models.Contact{modelContact}, nil)
+	require.NoError(t, err)
 	require.NoError(t, tx.Commit())
 
-	assertSessionAndRunStatus(t, db, session1ID, models.SessionStatusCompleted)
-	assertSessionAndRunStatus(t, db, session2ID, models.SessionStatusWaiting)
-	assertSessionAndRunStatus(t, db, session3ID, models.SessionStatusWaiting)
-	assertSessionAndRunStatus(t, db, session4ID, models.SessionStatusWaiting)
+	outputSize := len(modelSessions[0].Output())
 
-	tx = db.MustBegin()
+	// an output larger than the maximum isn't unmarshaled
+	rt.Config.SessionMaxOutputSize = outputSize - 1
 
-	err = models.InterruptSessionsForContactsTx(ctx, tx, []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID})
+	session, err := models.FindWaitingSessionForContact(ctx, db, rt.SessionStorage, oa, models.FlowTypeMessaging, flowContact)
 	require.NoError(t, err)
 
-	require.NoError(t, tx.Commit())
+	_, err = session.FlowSession(rt.Config, oa.SessionAssets(), oa.Env())
+	assert.EqualError(t, err, fmt.Sprintf("session #%d output size of %d bytes exceeds maximum of %d", session.ID(), outputSize, outputSize-1))
 
-	assertSessionAndRunStatus(t, db, session1ID, models.SessionStatusCompleted) // wasn't waiting
-	assertSessionAndRunStatus(t, db, session2ID, models.SessionStatusInterrupted)
-	assertSessionAndRunStatus(t, db, session3ID, models.SessionStatusInterrupted)
-	assertSessionAndRunStatus(t, db, session4ID, models.SessionStatusWaiting) // contact not included
+	// but one at the maximum is
+	rt.Config.SessionMaxOutputSize = outputSize
 
-	// check other columns are correct on interrupted session, run and contact
-	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowsession WHERE ended_on IS NOT NULL AND wait_started_on IS NULL AND wait_expires_on IS NULL AND timeout_on IS NULL AND current_flow_id IS NULL AND id = $1`, session2ID).Returns(1)
-	assertdb.Query(t, db, `SELECT status FROM flows_flowrun WHERE id = $1`, run2ID).Columns(map[string]interface{}{"status": "I"})
-	assertdb.Query(t, db, `SELECT current_flow_id FROM contacts_contact WHERE id = $1`, testdata.Cathy.ID).Returns(nil)
+	_, err = session.FlowSession(rt.Config, oa.SessionAssets(), oa.Env())
+	assert.NoError(t, err)
 }
 
-func TestInterruptSessionsForChannels(t *testing.T) {
+func TestSessionWithMissingFlow(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+	defer func() { rt.Config.SessionMissingFlows = "error" }()
+
+	testFlows := testdata.ImportFlows(db, testdata.Org1, "testdata/session_test_flows.json")
+	parent, child := testFlows[2], testFlows[3]
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshFlows)
+	require.NoError(t, err)
+
+	modelContact, _ := testdata.Cathy.Load(db, oa)
+
+	_, flowSession, sprint := test.NewSessionBuilder().WithAssets(oa.SessionAssets()).WithFlow(parent.UUID).
+		WithContact(testdata.Cathy.UUID, flows.ContactID(testdata.Cathy.ID), "Cathy", "eng", "").MustBuild()
+
+	// child flow disappears before we get to write the session
+	db.MustExec(`UPDATE flows_flow SET uuid = 'e2a1a5a6-bd2b-43e5-a0a8-4a7bd5b3ea0f' WHERE id = $1`, child.ID)
+
+	oa, err = models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshFlows)
+	require.NoError(t, err)
+
+	// by default that's an error
+	tx := db.MustBegin()
+	_, err = models.InsertSessions(ctx, rt, tx, oa, []flows.Session{flowSession}, []flows.Sprint{sprint}, []*models.Contact{modelContact}, nil)
+	assert.EqualError(t, err, fmt.Sprintf("error creating session objects: error creating run: %s: unable to load flow with uuid: %s: flow no longer exists", flowSession.Runs()[1].UUID(), child.UUID))
+	require.NoError(t, tx.Rollback())
+
+	// but we can be configured to skip that run
+	rt.Config.SessionMissingFlows = "skip"
+
+	tx = db.MustBegin()
+	modelSessions, err := models.InsertSessions(ctx, rt, tx, oa, []flows.Session{flowSession}, []flows.Sprint{sprint}, []*models.Contact{modelContact}, nil)
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+
+	assert.Equal(t, models.NilFlowID, modelSessions[0].CurrentFlowID())
+
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowsession WHERE contact_id = $1`, testdata.Cathy.ID).Returns(1)
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowrun WHERE contact_id = $1 AND flow_id = $2`, testdata.Cathy.ID, parent.ID).Returns(1)
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowrun WHERE contact_id = $1 AND flow_id = $2`, testdata.Cathy.ID, child.ID).Returns(0)
+}
+
+func TestSessionWithTooManyRuns(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	metrics := &testMetrics{timings: make(map[string][]time.Duration), counts: make(map[string][]int)}
+	rt.Metrics = metrics
+	rt.Config.MaxRunsPerSession = 1
+
+	defer func() {
+		rt.Metrics = runtime.NoopMetrics
+		rt.Config.MaxRunsPerSession = 500
+	}()
+
+	testFlows := testdata.ImportFlows(db, testdata.Org1, "testdata/session_test_flows.json")
+	singleMessage, parent := testFlows[1], testFlows[2]
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshFlows)
+	require.NoError(t, err)
+
+	cathy, _ := testdata.Cathy.Load(db, oa)
+	bob, _ := testdata.Bob.Load(db, oa)
+
+	// Cathy's session has a parent and a child run
+	_, cathySession, cathySprint := test.NewSessionBuilder().WithAssets(oa.SessionAssets()).WithFlow(parent.UUID).
+		WithContact(testdata.Cathy.UUID, flows.ContactID(testdata.Cathy.ID), "Cathy", "eng", "").MustBuild()
+	require.Len(t, cathySession.Runs(), 2)
+
+	// Bob's session just has the one
+	_, bobSession, bobSprint := test.NewSessionBuilder().WithAssets(oa.SessionAssets()).WithFlow(singleMessage.UUID).
+		WithContact(testdata.Bob.UUID, flows.ContactID(testdata.Bob.ID), "Bob", "eng", "").MustBuild()
+
+	tx := db.MustBegin()
+
+	sessions, err := models.InsertSessions(ctx, rt, tx, oa, []flows.Session{cathySession, bobSession}, []flows.Sprint{cathySprint, bobSprint}, []*models.Contact{cathy, bob}, nil)
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+
+	assert.Equal(t, []int{1}, metrics.counts["session_too_many_runs"])
+
+	// Cathy's session was written as failed, without any of its events being applied
+	assert.Equal(t, models.SessionStatusFailed, sessions[0].Status())
+	assertdb.Query(t, db, `SELECT status, current_flow_id FROM flows_flowsession WHERE contact_id = $1`, testdata.Cathy.ID).
+		Columns(map[string]interface{}{"status": "F", "current_flow_id": nil})
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowrun WHERE contact_id = $1 AND status = 'F' AND exited_on IS NOT NULL`, testdata.Cathy.ID).Returns(2)
+	assertdb.Query(t, db, `SELECT count(*) FROM msgs_msg WHERE contact_id = $1`, testdata.Cathy.ID).Returns(0)
+
+	// but Bob's was written as normal
+	assert.Equal(t, models.SessionStatusCompleted, sessions[1].Status())
+	assertdb.Query(t, db, `SELECT status FROM flows_flowsession WHERE contact_id = $1`, testdata.Bob.ID).Returns("C")
+	assertdb.Query(t, db, `SELECT status FROM flows_flowrun WHERE contact_id = $1`, testdata.Bob.ID).Returns("C")
+
+	// updating a session to have too many runs is still an error
+	tx = db.MustBegin()
+	err = sessions[1].Update(ctx, rt, tx, oa, cathySession, cathySprint, cathy, nil)
+	assert.Equal(t, models.ErrTooManyRuns, errors.Cause(err))
+	tx.Rollback()
+}
+
+func TestSessionCommitHookFailure(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	testFlows := testdata.ImportFlows(db, testdata.Org1, "testdata/session_test_flows.json")
+	flow := testFlows[0]
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshFlows)
+	require.NoError(t, err)
+
+	modelContact, _ := testdata.Bob.Load(db, oa)
+
+	sa, flowSession, sprint1 := test.NewSessionBuilder().WithAssets(oa.SessionAssets()).WithFlow(flow.UUID).
+		WithContact(testdata.Bob.UUID, flows.ContactID(testdata.Bob.ID), "Bob", "eng", "").MustBuild()
+
+	failingHook := func(context.Context, *sqlx.Tx, *redis.Pool, *models.OrgAssets, []*models.Session) error {
+		return errors.New("hook failed")
+	}
+
+	// a failing hook on insert is returned so that the caller can roll back
+	tx := db.MustBegin()
+
+	_, err = models.InsertSessions(ctx, rt, tx, oa, []flows.Session{flowSession}, []flows.Sprint{sprint1}, []*models.Contact{modelContact}, failingHook)
+	assert.EqualError(t, errors.Cause(err), "hook failed")
+
+	require.NoError(t, tx.Rollback())
+
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowsession WHERE contact_id = $1`, testdata.Bob.ID).Returns(0)
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowrun WHERE contact_id = $1`, testdata.Bob.ID).Returns(0)
+
+	// write the session for real
+	tx = db.MustBegin()
+
+	modelSessions, err := models.InsertSessions(ctx, rt, tx, oa, []flows.Session{flowSession}, []flows.Sprint{sprint1}, []*models.Contact{modelContact}, nil)
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+
+	session := modelSessions[0]
+
+	flowSession, sprint2, err := test.ResumeSession(flowSession, sa, "no")
+	require.NoError(t, err)
+
+	// a failing hook on update happens after the session row has been updated, so rolling back must undo that
+	tx = db.MustBegin()
+
+	err = session.Update(ctx, rt, tx, oa, flowSession, sprint2, modelContact, failingHook)
+	assert.EqualError(t, errors.Cause(err), "hook failed")
+
+	require.NoError(t, tx.Rollback())
+
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowsession WHERE contact_id = $1`, testdata.Bob.ID).Returns(1)
+	assertdb.Query(t, db, `SELECT responded FROM flows_flowsession WHERE id = $1`, session.ID()).Returns(false)
+	assertdb.Query(t, db, `SELECT responded FROM flows_flowrun WHERE session_id = $1`, session.ID()).Returns(false)
+}
+
+func TestSessionUpdateWithExpiredContext(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	testFlows := testdata.ImportFlows(db, testdata.Org1, "testdata/session_test_flows.json")
+	flow := testFlows[0]
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshFlows)
+	require.NoError(t, err)
+
+	modelContact, _ := testdata.Bob.Load(db, oa)
+
+	sa, flowSession, sprint1 := test.NewSessionBuilder().WithAssets(oa.SessionAssets()).WithFlow(flow.UUID).
+		WithContact(testdata.Bob.UUID, flows.ContactID(testdata.Bob.ID), "Bob", "eng", "").MustBuild()
+
+	tx := db.MustBegin()
+
+	modelSessions, err := models.InsertSessions(ctx, rt, tx, oa, []flows.Session{flowSession}, []flows.Sprint{sprint1}, []*models.Contact{modelContact}, nil)
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+
+	session := modelSessions[0]
+	output := session.Output()
+
+	flowSession, sprint2, err := test.ResumeSession(flowSession, sa, "no")
+	require.NoError(t, err)
+
+	expiredCtx, cancel := context.WithDeadline(ctx, time.Now().Add(-time.Second))
+	defer cancel()
+
+	tx = db.MustBegin()
+
+	err = session.Update(expiredCtx, rt, tx, oa, flowSession, sprint2, modelContact, nil)
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+
+	require.NoError(t, tx.Rollback())
+
+	// session is unchanged in memory and in the database
+	assert.Equal(t, output, session.Output())
+	assert.False(t, session.Responded())
+
+	assertdb.Query(t, db, `SELECT responded FROM flows_flowsession WHERE id = $1`, session.ID()).Returns(false)
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowrun WHERE session_id = $1`, session.ID()).Returns(1)
+}
+
+func TestSessionHasCall(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	testFlows := testdata.ImportFlows(db, testdata.Org1, "testdata/session_test_flows.json")
+	flow := testFlows[1]
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshFlows)
+	require.NoError(t, err)
+
+	modelContact, _ := testdata.Cathy.Load(db, oa)
+
+	_, flowSession, sprint := test.NewSessionBuilder().WithAssets(oa.SessionAssets()).WithFlow(flow.UUID).
+		WithContact(testdata.Cathy.UUID, flows.ContactID(testdata.Cathy.ID), "Cathy", "eng", "").MustBuild()
+
+	tx := db.MustBegin()
+
+	modelSessions, err := models.InsertSessions(ctx, rt, tx, oa, []flows.Session{flowSession}, []flows.Sprint{sprint}, []*models.Contact{modelContact}, nil)
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+
+	// messaging sessions never have a call
+	session := modelSessions[0]
+	assert.False(t, session.HasCall())
+	assert.Nil(t, session.CallID())
+
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowsession WHERE id = $1 AND call_id IS NULL`, session.ID()).Returns(1)
+
+	// setting a nil call is the same as no call
+	session.SetCall(nil)
+	assert.False(t, session.HasCall())
+	assert.Nil(t, session.CallID())
+
+	callID := testdata.InsertCall(db, testdata.Org1, testdata.TwilioChannel, testdata.Cathy)
+	call, err := models.GetCallByID(ctx, db, testdata.Org1.ID, callID)
+	require.NoError(t, err)
+
+	session.SetCall(call)
+	assert.True(t, session.HasCall())
+	assert.Equal(t, callID, *session.CallID())
+}
+
+func TestSessionFailedStart(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	testFlows := testdata.ImportFlows(db, testdata.Org1, "testdata/ping_pong.json")
+	ping, pong := testFlows[0], testFlows[1]
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshFlows)
+	require.NoError(t, err)
+
+	modelContact, _ := testdata.Cathy.Load(db, oa)
+
+	_, flowSession, sprint1 := test.NewSessionBuilder().WithAssets(oa.SessionAssets()).WithFlow(ping.UUID).
+		WithContact(testdata.Cathy.UUID, flows.ContactID(testdata.Cathy.ID), "Cathy", "eng", "").MustBuild()
+
+	tx := db.MustBegin()
+
+	hookCalls := 0
+	hook := func(context.Context, *sqlx.Tx, *redis.Pool, *models.OrgAssets, []*models.Session) error {
+		hookCalls++
+		return nil
+	}
+
+	modelSessions, err := models.InsertSessions(ctx, rt, tx, oa, []flows.Session{flowSession}, []flows.Sprint{sprint1}, []*models.Contact{modelContact}, hook)
+	require.NoError(t, err)
+	assert.Equal(t, 1, hookCalls)
+
+	require.NoError(t, tx.Commit())
+
+	session := modelSessions[0]
+
+	assert.Equal(t, models.FlowTypeMessaging, session.SessionType())
+	assert.Equal(t, testdata.Cathy.ID, session.ContactID())
+	assert.Equal(t, models.SessionStatusFailed, session.Status())
+	assert.Equal(t, models.NilFlowID, session.CurrentFlowID())
+	assert.Nil(t, session.WaitExpiresOn())
+	assert.NotNil(t, session.EndedOn())
+
+	// check that matches what is in the db
+	assertdb.Query(t, db, `SELECT status, session_type, current_flow_id, responded FROM flows_flowsession`).
+		Columns(map[string]interface{}{"status": "F", "session_type": "M", "current_flow_id": nil, "responded": false})
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowsession WHERE ended_on IS NOT NULL`).Returns(1)
+
+	// check the state of all the created runs
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowrun`).Returns(101)
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowrun WHERE flow_id = $1`, ping.ID).Returns(51)
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowrun WHERE flow_id = $1`, pong.ID).Returns(50)
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowrun WHERE status = 'F' AND exited_on IS NOT NULL`).Returns(101)
+}
+
+func TestInsertSessionsBatch(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	testFlows := testdata.ImportFlows(db, testdata.Org1, "testdata/session_test_flows.json")
+	flow := testFlows[0]
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshFlows)
+	require.NoError(t, err)
+
+	flowSessions, sprints, modelContacts := buildSessionBatch(db, oa, flow, []*testdata.Contact{testdata.Cathy, testdata.Bob, testdata.George, testdata.Alexandria})
+
+	tx := db.MustBegin()
+
+	modelSessions, err := models.InsertSessions(ctx, rt, tx, oa, flowSessions, sprints, modelContacts, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, tx.Commit())
+
+	// outputs marshalled in parallel should be identical to marshalling each session serially and in the same order
+	require.Len(t, modelSessions, 4)
+	for i, session := range modelSessions {
+		expected, err := json.Marshal(flowSessions[i])
+		require.NoError(t, err)
+
+		assert.Equal(t, string(expected), session.Output())
+		assert.Equal(t, models.ContactID(flowSessions[i].Contact().ID()), session.ContactID())
+	}
+
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowsession WHERE status = 'W'`).Returns(4)
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowrun WHERE flow_id = $1`, flow.ID).Returns(4)
+}
+
+func BenchmarkInsertSessions(b *testing.B) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	testFlows := testdata.ImportFlows(db, testdata.Org1, "testdata/session_test_flows.json")
+	flow := testFlows[0]
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshFlows)
+	require.NoError(b, err)
+
+	contacts := make([]*testdata.Contact, 0, 100)
+	for i := 0; i < 25; i++ {
+		contacts = append(contacts, testdata.Cathy, testdata.Bob, testdata.George, testdata.Alexandria)
+	}
+
+	flowSessions, sprints, modelContacts := buildSessionBatch(db, oa, flow, contacts)
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		tx := db.MustBegin()
+
+		_, err := models.InsertSessions(ctx, rt, tx, oa, flowSessions, sprints, modelContacts, nil)
+		require.NoError(b, err)
+
+		require.NoError(b, tx.Rollback())
+	}
+}
+
+type testMetrics struct {
+	timings map[string][]time.Duration
+	counts  map[string][]int
+}
+
+func (m *testMetrics) Timing(name string, elapsed time.Duration) {
+	m.timings[name] = append(m.timings[name], elapsed)
+}
+
+func (m *testMetrics) Count(name string, count int) { m.counts[name] = append(m.counts[name], count) }
+
+func TestSessionWriteMetrics(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	metrics := &testMetrics{timings: make(map[string][]time.Duration), counts: make(map[string][]int)}
+	rt.Metrics = metrics
+	defer func() { rt.Metrics = runtime.NoopMetrics }()
+
+	testFlows := testdata.ImportFlows(db, testdata.Org1, "testdata/session_test_flows.json")
+	flow := testFlows[0]
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshFlows)
+	require.NoError(t, err)
+
+	flowSessions, sprints, modelContacts := buildSessionBatch(db, oa, flow, []*testdata.Contact{testdata.Cathy, testdata.Bob})
+
+	tx := db.MustBegin()
+
+	_, err = models.InsertSessions(ctx, rt, tx, oa, flowSessions, sprints, modelContacts, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, tx.Commit())
+
+	assert.Len(t, metrics.timings["sessions_insert"], 1)
+	assert.Equal(t, []int{2}, metrics.counts["sessions_insert"])
+
+	count, err := models.InterruptSessionsForContacts(ctx, rt, []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID})
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	assert.Len(t, metrics.timings["sessions_interrupt"], 1)
+	assert.Equal(t, []int{2}, metrics.counts["sessions_interrupt"])
+}
+
+func TestInterruptSessionsForContacts(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	session1ID, _ := insertSessionAndRun(db, testdata.Cathy, models.FlowTypeMessaging, models.SessionStatusCompleted, testdata.Favorites, models.NilCallID)
+	session2ID, run2ID := insertSessionAndRun(db, testdata.Cathy, models.FlowTypeVoice, models.SessionStatusWaiting, testdata.Favorites, models.NilCallID)
+	session3ID, _ := insertSessionAndRun(db, testdata.Bob, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, models.NilCallID)
+	session4ID, _ := insertSessionAndRun(db, testdata.George, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, models.NilCallID)
+
+	// noop if no contacts
+	_, err := models.InterruptSessionsForContacts(ctx, rt, []models.ContactID{})
+	assert.NoError(t, err)
+
+	assertSessionAndRunStatus(t, db, session1ID, models.SessionStatusCompleted)
+	assertSessionAndRunStatus(t, db, session2ID, models.SessionStatusWaiting)
+	assertSessionAndRunStatus(t, db, session3ID, models.SessionStatusWaiting)
+	assertSessionAndRunStatus(t, db, session4ID, models.SessionStatusWaiting)
+
+	count, err := models.InterruptSessionsForContacts(ctx, rt, []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID, testdata.Alexandria.ID})
+	assert.Equal(t, 2, count)
+	assert.NoError(t, err)
+
+	assertSessionAndRunStatus(t, db, session1ID, models.SessionStatusCompleted) // wasn't waiting
+	assertSessionAndRunStatus(t, db, session2ID, models.SessionStatusInterrupted)
+	assertSessionAndRunStatus(t, db, session3ID, models.SessionStatusInterrupted)
+	assertSessionAndRunStatus(t, db, session4ID, models.SessionStatusWaiting) // contact not included
+
+	// check other columns are correct on interrupted session, run and contact
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowsession WHERE ended_on IS NOT NULL AND wait_started_on IS NULL AND wait_expires_on IS NULL AND timeout_on IS NULL AND current_flow_id IS NULL AND id = $1`, session2ID).Returns(1)
+	assertdb.Query(t, db, `SELECT status FROM flows_flowrun WHERE id = $1`, run2ID).Columns(map[string]interface{}{"status": "I"})
+	assertdb.Query(t, db, `SELECT current_flow_id FROM contacts_contact WHERE id = $1`, testdata.Cathy.ID).Returns(nil)
+}
+
+func TestInterruptSessionsOfTypeForContacts(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	// Cathy has both a messaging and a background session, Bob just a background session, George just a messaging session
+	session1ID, _ := insertSessionAndRun(db, testdata.Cathy, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, models.NilCallID)
+	session2ID, _ := insertSessionAndRun(db, testdata.Cathy, models.FlowTypeBackground, models.SessionStatusWaiting, testdata.PickANumber, models.NilCallID)
+	session3ID, _ := insertSessionAndRun(db, testdata.Bob, models.FlowTypeBackground, models.SessionStatusWaiting, testdata.PickANumber, models.NilCallID)
+	session4ID, _ := insertSessionAndRun(db, testdata.George, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, models.NilCallID)
+
+	// Cathy's current flow should be her messaging session's flow
+	db.MustExec(`UPDATE contacts_contact SET current_flow_id = $2 WHERE id = $1`, testdata.Cathy.ID, testdata.Favorites.ID)
+
+	count, err := models.InterruptSessionsOfTypeForContacts(ctx, rt, []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID, testdata.George.ID}, models.FlowTypeBackground)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	assertSessionAndRunStatus(t, db, session1ID, models.SessionStatusWaiting)
+	assertSessionAndRunStatus(t, db, session2ID, models.SessionStatusInterrupted)
+	assertSessionAndRunStatus(t, db, session3ID, models.SessionStatusInterrupted)
+	assertSessionAndRunStatus(t, db, session4ID, models.SessionStatusWaiting)
+
+	// Cathy is still in her messaging flow
+	assertdb.Query(t, db, `SELECT current_flow_id FROM contacts_contact WHERE id = $1`, testdata.Cathy.ID).Returns(int64(testdata.Favorites.ID))
+	assertdb.Query(t, db, `SELECT current_flow_id FROM contacts_contact WHERE id = $1`, testdata.Bob.ID).Returns(nil)
+
+	// interrupting messaging sessions only affects the remaining messaging sessions
+	count, err = models.InterruptSessionsOfTypeForContacts(ctx, rt, []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID}, models.FlowTypeMessaging)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	assertSessionAndRunStatus(t, db, session1ID, models.SessionStatusInterrupted)
+	assertSessionAndRunStatus(t, db, session4ID, models.SessionStatusWaiting)
+	assertdb.Query(t, db, `SELECT current_flow_id FROM contacts_contact WHERE id = $1`, testdata.Cathy.ID).Returns(nil)
+}
+
+func TestInterruptSessionsCancelsPendingMessages(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	started := time.Now().Add(-time.Hour)
+	expires := time.Now().Add(time.Hour)
+
+	// a waiting session for cathy which has a pending message, an errored message and a message already queued to courier
+	cathySessionID := testdata.InsertWaitingSession(db, testdata.Org1, testdata.Cathy, models.FlowTypeMessaging, testdata.Favorites, models.NilCallID, started, expires, false, nil)
+	testdata.InsertFlowRun(db, testdata.Org1, cathySessionID, testdata.Cathy, testdata.Favorites, models.RunStatusWaiting)
+	pending := testdata.InsertOutgoingMsg(db, testdata.Org1, testdata.TwilioChannel, testdata.Cathy, "Pending", nil, models.MsgStatusPending, false)
+	errored := testdata.InsertErroredOutgoingMsg(db, testdata.Org1, testdata.TwilioChannel, testdata.Cathy, "Errored", 1, time.Now(), false)
+	queued := testdata.InsertOutgoingMsg(db, testdata.Org1, testdata.TwilioChannel, testdata.Cathy, "Queued", nil, models.MsgStatusQueued, false)
+	db.MustExec(`UPDATE msgs_msg SET flow_id = $2 WHERE id = ANY($1)`, pq.Array([]int64{int64(pending.ID()), int64(errored.ID()), int64(queued.ID())}), testdata.Favorites.ID)
+
+	// and a pending message for cathy that wasn't sent by a flow, e.g. a broadcast
+	broadcast := testdata.InsertOutgoingMsg(db, testdata.Org1, testdata.TwilioChannel, testdata.Cathy, "Broadcast", nil, models.MsgStatusPending, false)
+
+	// and a pending message for bob who isn't being interrupted
+	bobSessionID := testdata.InsertWaitingSession(db, testdata.Org1, testdata.Bob, models.FlowTypeMessaging, testdata.Favorites, models.NilCallID, started, expires, false, nil)
+	testdata.InsertFlowRun(db, testdata.Org1, bobSessionID, testdata.Bob, testdata.Favorites, models.RunStatusWaiting)
+	bobPending := testdata.InsertOutgoingMsg(db, testdata.Org1, testdata.TwilioChannel, testdata.Bob, "Pending", nil, models.MsgStatusPending, false)
+	db.MustExec(`UPDATE msgs_msg SET flow_id = $2 WHERE id = $1`, bobPending.ID(), testdata.Favorites.ID)
+
+	count, err := models.InterruptSessionsForContacts(ctx, rt, []models.ContactID{testdata.Cathy.ID})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	assertdb.Query(t, db, `SELECT status, failed_reason FROM msgs_msg WHERE id = $1`, pending.ID()).Columns(map[string]interface{}{"status": "F", "failed_reason": nil})
+	assertdb.Query(t, db, `SELECT status, failed_reason FROM msgs_msg WHERE id = $1`, errored.ID()).Columns(map[string]interface{}{"status": "F", "failed_reason": nil})
+	assertdb.Query(t, db, `SELECT status FROM msgs_msg WHERE id = $1`, queued.ID()).Returns("Q")
+	assertdb.Query(t, db, `SELECT status FROM msgs_msg WHERE id = $1`, broadcast.ID()).Returns("P")
+	assertdb.Query(t, db, `SELECT status FROM msgs_msg WHERE id = $1`, bobPending.ID()).Returns("P")
+}
+
+func TestInterruptSessionsForContactsTx(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	session1ID, _ := insertSessionAndRun(db, testdata.Cathy, models.FlowTypeMessaging, models.SessionStatusCompleted, testdata.Favorites, models.NilCallID)
+	session2ID, run2ID := insertSessionAndRun(db, testdata.Cathy, models.FlowTypeVoice, models.SessionStatusWaiting, testdata.Favorites, models.NilCallID)
+	session3ID, _ := insertSessionAndRun(db, testdata.Bob, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, models.NilCallID)
+	session4ID, _ := insertSessionAndRun(db, testdata.George, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, models.NilCallID)
+
+	tx := db.MustBegin()
+
+	// noop if no contacts
+	err := models.InterruptSessionsForContactsTx(ctx, rt, tx, []models.ContactID{})
+	require.NoError(t, err)
+
+	require.NoError(t, tx.Commit())
+
+	assertSessionAndRunStatus(t, db, session1ID, models.SessionStatusCompleted)
+	assertSessionAndRunStatus(t, db, session2ID, models.SessionStatusWaiting)
+	assertSessionAndRunStatus(t, db, session3ID, models.SessionStatusWaiting)
+	assertSessionAndRunStatus(t, db, session4ID, models.SessionStatusWaiting)
+
+	tx = db.MustBegin()
+
+	err = models.InterruptSessionsForContactsTx(ctx, rt, tx, []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID})
+	require.NoError(t, err)
+
+	require.NoError(t, tx.Commit())
+
+	assertSessionAndRunStatus(t, db, session1ID, models.SessionStatusCompleted) // wasn't waiting
+	assertSessionAndRunStatus(t, db, session2ID, models.SessionStatusInterrupted)
+	assertSessionAndRunStatus(t, db, session3ID, models.SessionStatusInterrupted)
+	assertSessionAndRunStatus(t, db, session4ID, models.SessionStatusWaiting) // contact not included
+
+	// check other columns are correct on interrupted session, run and contact
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowsession WHERE ended_on IS NOT NULL AND wait_started_on IS NULL AND wait_expires_on IS NULL AND timeout_on IS NULL AND current_flow_id IS NULL AND id = $1`, session2ID).Returns(1)
+	assertdb.Query(t, db, `SELECT status FROM flows_flowrun WHERE id = $1`, run2ID).Columns(map[string]interface{}{"status": "I"})
+	assertdb.Query(t, db, `SELECT current_flow_id FROM contacts_contact WHERE id = $1`, testdata.Cathy.ID).Returns(nil)
+}
+
+func TestDeleteSessionsForContacts(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData | testsuite.ResetStorage)
+
+	// write new sessions to s3 storage
+	rt.Config.SessionStorage = "s3"
+
+	testFlows := testdata.ImportFlows(db, testdata.Org1, "testdata/session_test_flows.json")
+	flow := testFlows[0]
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshFlows)
+	require.NoError(t, err)
+
+	modelContact, _ := testdata.Cathy.Load(db, oa)
+
+	_, flowSession, sprint := test.NewSessionBuilder().WithAssets(oa.SessionAssets()).WithFlow(flow.UUID).
+		WithContact(testdata.Cathy.UUID, flows.ContactID(testdata.Cathy.ID), "Cathy", "eng", "").MustBuild()
+
+	tx := db.MustBegin()
+	modelSessions, err := models.InsertSessions(ctx, rt, tx, oa, []flows.Session{flowSession}, []flows.Sprint{sprint}, []*models.Contact{modelContact}, nil)
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+
+	outputURL := modelSessions[0].OutputURL()
+	require.NotEqual(t, "", outputURL)
+
+	_, stored, err := rt.SessionStorage.Get(ctx, outputURL)
+	require.NoError(t, err)
+	assert.NotEmpty(t, stored)
+
+	insertSessionAndRun(db, testdata.Cathy, models.FlowTypeMessaging, models.SessionStatusCompleted, testdata.Favorites, models.NilCallID)
+	insertSessionAndRun(db, testdata.Bob, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, models.NilCallID)
+	insertSessionAndRun(db, testdata.George, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, models.NilCallID)
+
+	// noop if no contacts
+	err = models.DeleteSessionsForContacts(ctx, rt, []models.ContactID{})
+	assert.NoError(t, err)
+
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowsession`).Returns(4)
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowrun`).Returns(4)
+
+	// if stored outputs can't be erased then nothing is deleted so we can try again
+	sessionStorage := rt.SessionStorage
+	rt.SessionStorage = &hookedStorage{Storage: sessionStorage, beforePut: func() error { return errors.New("boom") }}
+
+	err = models.DeleteSessionsForContacts(ctx, rt, []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID})
+	assert.EqualError(t, err, "error erasing session outputs from storage: boom")
+
+	rt.SessionStorage = sessionStorage
+
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowsession`).Returns(4)
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowrun`).Returns(4)
+
+	err = models.DeleteSessionsForContacts(ctx, rt, []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID})
+	assert.NoError(t, err)
+
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowsession WHERE contact_id IN ($1, $2)`, testdata.Cathy.ID, testdata.Bob.ID).Returns(0)
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowrun WHERE contact_id IN ($1, $2)`, testdata.Cathy.ID, testdata.Bob.ID).Returns(0)
+	assertdb.Query(t, db, `SELECT count(*) FROM contacts_contact WHERE id IN ($1, $2) AND current_flow_id IS NOT NULL`, testdata.Cathy.ID, testdata.Bob.ID).Returns(0)
+
+	// other contacts are untouched
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowsession WHERE contact_id = $1`, testdata.George.ID).Returns(1)
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowrun WHERE contact_id = $1`, testdata.George.ID).Returns(1)
+
+	// and the stored output has been erased
+	_, stored, err = rt.SessionStorage.Get(ctx, outputURL)
+	require.NoError(t, err)
+	assert.Empty(t, stored)
+}
+
+func TestMigrateSessionOutputToStorage(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData | testsuite.ResetStorage)
+
+	testFlows := testdata.ImportFlows(db, testdata.Org1, "testdata/session_test_flows.json")
+	flow := testFlows[0]
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshFlows)
+	require.NoError(t, err)
+
+	// write sessions for cathy and bob with their outputs in the database
+	sessionIDs := make([]models.SessionID, 0, 2)
+	for _, c := range []*testdata.Contact{testdata.Cathy, testdata.Bob} {
+		modelContact, _ := c.Load(db, oa)
+
+		_, flowSession, sprint := test.NewSessionBuilder().WithAssets(oa.SessionAssets()).WithFlow(flow.UUID).
+			WithContact(c.UUID, flows.ContactID(c.ID), "", "eng", "").MustBuild()
+
+		tx := db.MustBegin()
+		modelSessions, err := models.InsertSessions(ctx, rt, tx, oa, []flows.Session{flowSession}, []flows.Sprint{sprint}, []*models.Contact{modelContact}, nil)
+		require.NoError(t, err)
+		require.NoError(t, tx.Commit())
+
+		sessionIDs = append(sessionIDs, modelSessions[0].ID())
+	}
+
+	var cathyOutput string
+	require.NoError(t, db.Get(&cathyOutput, `SELECT output FROM flows_flowsession WHERE id = $1`, sessionIDs[0]))
+
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowsession WHERE output IS NOT NULL AND output_url IS NULL`).Returns(2)
+
+	// migrate in two goes to check the limit is respected
+	migrated, err := models.MigrateSessionOutputToStorage(ctx, rt.DB, rt.SessionStorage, rt.Config, testdata.Org1.ID, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, migrated)
+
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowsession WHERE id = $1 AND output IS NULL AND output_url IS NOT NULL`, sessionIDs[0]).Returns(1)
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowsession WHERE id = $1 AND output IS NOT NULL AND output_url IS NULL`, sessionIDs[1]).Returns(1)
+
+	// the migrated output can be read back from storage
+	var outputURL string
+	require.NoError(t, db.Get(&outputURL, `SELECT output_url FROM flows_flowsession WHERE id = $1`, sessionIDs[0]))
+
+	_, stored, err := rt.SessionStorage.Get(ctx, outputURL)
+	require.NoError(t, err)
+	assert.Equal(t, cathyOutput, string(stored))
+
+	migrated, err = models.MigrateSessionOutputToStorage(ctx, rt.DB, rt.SessionStorage, rt.Config, testdata.Org1.ID, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, migrated)
+
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowsession WHERE output IS NULL AND output_url IS NOT NULL`).Returns(2)
+
+	// nothing left to migrate
+	migrated, err = models.MigrateSessionOutputToStorage(ctx, rt.DB, rt.SessionStorage, rt.Config, testdata.Org1.ID, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, migrated)
+
+	// a session whose output changes whilst it's being uploaded keeps its new output
+	db.MustExec(`UPDATE flows_flowsession SET output = '{"status": "waiting"}', output_url = NULL WHERE id = $1`, sessionIDs[1])
+
+	racingStorage := &hookedStorage{Storage: rt.SessionStorage, beforePut: func() error {
+		db.MustExec(`UPDATE flows_flowsession SET output = '{"status": "completed"}' WHERE id = $1`, sessionIDs[1])
+		return nil
+	}}
+
+	migrated, err = models.MigrateSessionOutputToStorage(ctx, rt.DB, racingStorage, rt.Config, testdata.Org1.ID, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, migrated)
+
+	assertdb.Query(t, db, `SELECT output FROM flows_flowsession WHERE id = $1`, sessionIDs[1]).Returns(`{"status": "completed"}`)
+	assertdb.Query(t, db, `SELECT output_url FROM flows_flowsession WHERE id = $1`, sessionIDs[1]).Returns(nil)
+}
+
+// storage which calls a function before each batch put, e.g. to simulate concurrent writes or failures
+type hookedStorage struct {
+	storage.Storage
+	beforePut func() error
+}
+
+func (s *hookedStorage) BatchPut(ctx context.Context, uploads []*storage.Upload) error {
+	if err := s.beforePut(); err != nil {
+		return err
+	}
+	return s.Storage.BatchPut(ctx, uploads)
+}
+
+func TestDeleteSessionsForContactsInBatches(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	rt.Config.SessionDeleteBatch = 2
+
+	for i := 0; i < 5; i++ {
+		insertSessionAndRun(db, testdata.Cathy, models.FlowTypeMessaging, models.SessionStatusCompleted, testdata.Favorites, models.NilCallID)
+	}
+	insertSessionAndRun(db, testdata.Bob, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, models.NilCallID)
+
+	err := models.DeleteSessionsForContacts(ctx, rt, []models.ContactID{testdata.Cathy.ID})
+	assert.NoError(t, err)
+
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowsession WHERE contact_id = $1`, testdata.Cathy.ID).Returns(0)
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowrun WHERE contact_id = $1`, testdata.Cathy.ID).Returns(0)
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowsession WHERE contact_id = $1`, testdata.Bob.ID).Returns(1)
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowrun WHERE contact_id = $1`, testdata.Bob.ID).Returns(1)
+}
+
+func TestInterruptSessionsForChannels(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	cathy1CallID := testdata.InsertCall(db, testdata.Org1, testdata.TwilioChannel, testdata.Cathy)
+	cathy2CallID := testdata.InsertCall(db, testdata.Org1, testdata.TwilioChannel, testdata.Cathy)
+	bobCallID := testdata.InsertCall(db, testdata.Org1, testdata.TwilioChannel, testdata.Bob)
+	georgeCallID := testdata.InsertCall(db, testdata.Org1, testdata.VonageChannel, testdata.George)
+
+	session1ID, _ := insertSessionAndRun(db, testdata.Cathy, models.FlowTypeMessaging, models.SessionStatusCompleted, testdata.Favorites, cathy1CallID)
+	session2ID, _ := insertSessionAndRun(db, testdata.Cathy, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, cathy2CallID)
+	session3ID, _ := insertSessionAndRun(db, testdata.Bob, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, bobCallID)
+	session4ID, _ := insertSessionAndRun(db, testdata.George, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, georgeCallID)
+
+	err := models.InterruptSessionsForChannel(ctx, rt, testdata.TwilioChannel.ID)
+	require.NoError(t, err)
+
+	assertSessionAndRunStatus(t, db, session1ID, models.SessionStatusCompleted) // wasn't waiting
+	assertSessionAndRunStatus(t, db, session2ID, models.SessionStatusInterrupted)
+	assertSessionAndRunStatus(t, db, session3ID, models.SessionStatusInterrupted)
+	assertSessionAndRunStatus(t, db, session4ID, models.SessionStatusWaiting) // channel not included
+
+	// check other columns are correct on interrupted session and contact
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowsession WHERE ended_on IS NOT NULL AND wait_started_on IS NULL AND wait_expires_on IS NULL AND timeout_on IS NULL AND current_flow_id IS NULL AND id = $1`, session2ID).Returns(1)
+	assertdb.Query(t, db, `SELECT current_flow_id FROM contacts_contact WHERE id = $1`, testdata.Cathy.ID).Returns(nil)
+}
+
+func TestWaitingSessionsForChannel(t *testing.T) {
+	ctx, _, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	cathy1CallID := testdata.InsertCall(db, testdata.Org1, testdata.TwilioChannel, testdata.Cathy)
+	cathy2CallID := testdata.InsertCall(db, testdata.Org1, testdata.TwilioChannel, testdata.Cathy)
+	bobCallID := testdata.InsertCall(db, testdata.Org1, testdata.TwilioChannel, testdata.Bob)
+	georgeCallID := testdata.InsertCall(db, testdata.Org1, testdata.VonageChannel, testdata.George)
+
+	insertSessionAndRun(db, testdata.Cathy, models.FlowTypeMessaging, models.SessionStatusCompleted, testdata.Favorites, cathy1CallID)
+	session2ID, _ := insertSessionAndRun(db, testdata.Cathy, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, cathy2CallID)
+	session3ID, _ := insertSessionAndRun(db, testdata.Bob, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, bobCallID)
+	session4ID, _ := insertSessionAndRun(db, testdata.George, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, georgeCallID)
+
+	sessionIDs, err := models.WaitingSessionsForChannel(ctx, db, testdata.TwilioChannel.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []models.SessionID{session2ID, session3ID}, sessionIDs)
+
+	sessionIDs, err = models.WaitingSessionsForChannel(ctx, db, testdata.VonageChannel.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []models.SessionID{session4ID}, sessionIDs)
+
+	// listing sessions doesn't change them
+	assertSessionAndRunStatus(t, db, session2ID, models.SessionStatusWaiting)
+
+	sessionIDs, err = models.WaitingSessionsForChannel(ctx, db, testdata.TwitterChannel.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []models.SessionID{}, sessionIDs)
+}
+
+func TestInterruptSessionsForFlows(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	cathy1CallID := testdata.InsertCall(db, testdata.Org1, testdata.TwilioChannel, testdata.Cathy)
+	cathy2CallID := testdata.InsertCall(db, testdata.Org1, testdata.TwilioChannel, testdata.Cathy)
+	bobCallID := testdata.InsertCall(db, testdata.Org1, testdata.TwilioChannel, testdata.Bob)
+	georgeCallID := testdata.InsertCall(db, testdata.Org1, testdata.VonageChannel, testdata.George)
+
+	session1ID, _ := insertSessionAndRun(db, testdata.Cathy, models.FlowTypeMessaging, models.SessionStatusCompleted, testdata.Favorites, cathy1CallID)
+	session2ID, _ := insertSessionAndRun(db, testdata.Cathy, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, cathy2CallID)
+	session3ID, _ := insertSessionAndRun(db, testdata.Bob, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, bobCallID)
+	session4ID, _ := insertSessionAndRun(db, testdata.George, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.PickANumber, georgeCallID)
+
+	// noop if no flows
+	err := models.InterruptSessionsForFlows(ctx, rt, []models.FlowID{})
+	require.NoError(t, err)
+
+	assertSessionAndRunStatus(t, db, session1ID, models.SessionStatusCompleted)
+	assertSessionAndRunStatus(t, db, session2ID, models.SessionStatusWaiting)
+	assertSessionAndRunStatus(t, db, session3ID, models.SessionStatusWaiting)
+	assertSessionAndRunStatus(t, db, session4ID, models.SessionStatusWaiting)
+
+	err = models.InterruptSessionsForFlows(ctx, rt, []models.FlowID{testdata.Favorites.ID})
+	require.NoError(t, err)
+
+	assertSessionAndRunStatus(t, db, session1ID, models.SessionStatusCompleted) // wasn't waiting
+	assertSessionAndRunStatus(t, db, session2ID, models.SessionStatusInterrupted)
+	assertSessionAndRunStatus(t, db, session3ID, models.SessionStatusInterrupted)
+	assertSessionAndRunStatus(t, db, session4ID, models.SessionStatusWaiting) // flow not included
+
+	// check other columns are correct on interrupted session and contact
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowsession WHERE ended_on IS NOT NULL AND wait_started_on IS NULL AND wait_expires_on IS NULL AND timeout_on IS NULL AND current_flow_id IS NULL AND id = $1`, session2ID).Returns(1)
+	assertdb.Query(t, db, `SELECT current_flow_id FROM contacts_contact WHERE id = $1`, testdata.Cathy.ID).Returns(nil)
+}
+
+func TestFailSession(t *testing.T) {
 	ctx, _, db, _ := testsuite.Get()
 
 	defer testsuite.Reset(testsuite.ResetData)
 
-	cathy1CallID := testdata.InsertCall(db, testdata.Org1, testdata.TwilioChannel, testdata.Cathy)
-	cathy2CallID := testdata.InsertCall(db, testdata.Org1, testdata.TwilioChannel, testdata.Cathy)
-	bobCallID := testdata.InsertCall(db, testdata.Org1, testdata.TwilioChannel, testdata.Bob)
-	georgeCallID := testdata.InsertCall(db, testdata.Org1, testdata.VonageChannel, testdata.George)
+	sessionID, _ := insertSessionAndRun(db, testdata.Cathy, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, models.NilCallID)
+
+	err := models.FailSession(ctx, db, sessionID)
+	require.NoError(t, err)
+
+	assertSessionAndRunStatus(t, db, sessionID, models.SessionStatusFailed)
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowsession WHERE id = $1 AND ended_on IS NOT NULL AND wait_started_on IS NULL AND wait_expires_on IS NULL AND timeout_on IS NULL`, sessionID).Returns(1)
+	assertdb.Query(t, db, `SELECT current_flow_id FROM contacts_contact WHERE id = $1`, testdata.Cathy.ID).Returns(nil)
+
+	// a session which is no longer waiting can't be failed
+	err = models.FailSession(ctx, db, sessionID)
+	assert.Equal(t, models.ErrNotFound, err)
+
+	// and nor can a session which doesn't exist
+	err = models.FailSession(ctx, db, models.SessionID(123456789))
+	assert.Equal(t, models.ErrNotFound, err)
+}
+
+func TestInterruptSessionsOfTypeForOrg(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	cathyCallID := testdata.InsertCall(db, testdata.Org1, testdata.TwilioChannel, testdata.Cathy)
+	bobCallID := testdata.InsertCall(db, testdata.Org1, testdata.TwilioChannel, testdata.Bob)
+
+	session1ID, _ := insertSessionAndRun(db, testdata.Cathy, models.FlowTypeVoice, models.SessionStatusWaiting, testdata.IVRFlow, cathyCallID)
+	session2ID, _ := insertSessionAndRun(db, testdata.Bob, models.FlowTypeVoice, models.SessionStatusCompleted, testdata.IVRFlow, bobCallID)
+	session3ID, _ := insertSessionAndRun(db, testdata.George, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, models.NilCallID)
+	session4ID := testdata.InsertFlowSession(db, testdata.Org2, testdata.Org2Contact, models.FlowTypeVoice, models.SessionStatusWaiting, testdata.Org2Favorites, models.NilCallID)
+
+	count, err := models.InterruptSessionsOfTypeForOrg(ctx, rt, testdata.Org1.ID, models.FlowTypeVoice)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	assertSessionAndRunStatus(t, db, session1ID, models.SessionStatusInterrupted)
+	assertSessionAndRunStatus(t, db, session2ID, models.SessionStatusCompleted) // wasn't waiting
+	assertSessionAndRunStatus(t, db, session3ID, models.SessionStatusWaiting)   // different type
+
+	// sessions in other orgs aren't affected
+	assertdb.Query(t, db, `SELECT status FROM flows_flowsession WHERE id = $1`, session4ID).Returns("W")
+
+	// calling again is a noop
+	count, err = models.InterruptSessionsOfTypeForOrg(ctx, rt, testdata.Org1.ID, models.FlowTypeVoice)
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestInterruptSessionsForStart(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	start1ID := testdata.InsertFlowStart(db, testdata.Org1, testdata.Favorites, []*testdata.Contact{testdata.Cathy, testdata.Bob})
+	start2ID := testdata.InsertFlowStart(db, testdata.Org1, testdata.Favorites, []*testdata.Contact{testdata.George})
 
-	session1ID, _ := insertSessionAndRun(db, testdata.Cathy, models.FlowTypeMessaging, models.SessionStatusCompleted, testdata.Favorites, cathy1CallID)
-	session2ID, _ := insertSessionAndRun(db, testdata.Cathy, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, cathy2CallID)
-	session3ID, _ := insertSessionAndRun(db, testdata.Bob, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, bobCallID)
-	session4ID, _ := insertSessionAndRun(db, testdata.George, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, georgeCallID)
+	session1ID, run1ID := insertSessionAndRun(db, testdata.Cathy, models.FlowTypeMessaging, models.SessionStatusCompleted, testdata.Favorites, models.NilCallID)
+	session2ID, run2ID := insertSessionAndRun(db, testdata.Cathy, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, models.NilCallID)
+	session3ID, run3ID := insertSessionAndRun(db, testdata.Bob, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, models.NilCallID)
+	session4ID, run4ID := insertSessionAndRun(db, testdata.George, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, models.NilCallID)
+	session5ID, _ := insertSessionAndRun(db, testdata.Alexandria, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, models.NilCallID)
+
+	db.MustExec(`UPDATE flows_flowrun SET start_id = $2 WHERE id = ANY($1)`, pq.Array([]models.FlowRunID{run1ID, run2ID, run3ID}), start1ID)
+	db.MustExec(`UPDATE flows_flowrun SET start_id = $2 WHERE id = $1`, run4ID, start2ID)
 
-	err := models.InterruptSessionsForChannel(ctx, db, testdata.TwilioChannel.ID)
+	err := models.InterruptSessionsForStart(ctx, rt, start1ID)
 	require.NoError(t, err)
 
 	assertSessionAndRunStatus(t, db, session1ID, models.SessionStatusCompleted) // wasn't waiting
 	assertSessionAndRunStatus(t, db, session2ID, models.SessionStatusInterrupted)
 	assertSessionAndRunStatus(t, db, session3ID, models.SessionStatusInterrupted)
-	assertSessionAndRunStatus(t, db, session4ID, models.SessionStatusWaiting) // channel not included
+	assertSessionAndRunStatus(t, db, session4ID, models.SessionStatusWaiting) // different start
+	assertSessionAndRunStatus(t, db, session5ID, models.SessionStatusWaiting) // no start
+}
 
-	// check other columns are correct on interrupted session and contact
-	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowsession WHERE ended_on IS NOT NULL AND wait_started_on IS NULL AND wait_expires_on IS NULL AND timeout_on IS NULL AND current_flow_id IS NULL AND id = $1`, session2ID).Returns(1)
-	assertdb.Query(t, db, `SELECT current_flow_id FROM contacts_contact WHERE id = $1`, testdata.Cathy.ID).Returns(nil)
+func TestSessionWaitExpirationAfterUpdate(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	testFlows := testdata.ImportFlows(db, testdata.Org1, "testdata/session_test_flows.json")
+	flow := testFlows[0]
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshFlows)
+	require.NoError(t, err)
+
+	modelContact, _ := testdata.Bob.Load(db, oa)
+
+	sa, flowSession, sprint1 := test.NewSessionBuilder().WithAssets(oa.SessionAssets()).WithFlow(flow.UUID).
+		WithContact(testdata.Bob.UUID, flows.ContactID(testdata.Bob.ID), "Bob", "eng", "").MustBuild()
+
+	// reads the expiration of the last wait event in a sprint
+	waitExpiresOn := func(sprint flows.Sprint) *time.Time {
+		var expiresOn *time.Time
+		for _, e := range sprint.Events() {
+			if typed, ok := e.(*events.MsgWaitEvent); ok {
+				expiresOn = typed.ExpiresOn
+			}
+		}
+		return expiresOn
+	}
+
+	// checks the session's expiration matches the wait and what's in the database
+	assertExpiration := func(session *models.Session, sprint flows.Sprint) {
+		expected := waitExpiresOn(sprint)
+		require.NotNil(t, expected)
+		require.NotNil(t, session.WaitExpiresOn())
+		assert.Equal(t, *expected, *session.WaitExpiresOn())
+
+		dbExpiresOn, err := models.GetSessionWaitExpiresOn(ctx, db, session.ID())
+		require.NoError(t, err)
+		require.NotNil(t, dbExpiresOn)
+		assert.WithinDuration(t, *expected, *dbExpiresOn, time.Millisecond)
+	}
+
+	tx := db.MustBegin()
+	modelSessions, err := models.InsertSessions(ctx, rt, tx, oa, []flows.Session{flowSession}, []flows.Sprint{sprint1}, []*models.Contact{modelContact}, nil)
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+
+	session := modelSessions[0]
+	assertExpiration(session, sprint1)
+
+	firstExpiresOn := *session.WaitExpiresOn()
+
+	flowSession, err = session.FlowSession(rt.Config, oa.SessionAssets(), oa.Env())
+	require.NoError(t, err)
+
+	// resume into a new wait which will have a new expiration
+	flowSession, sprint2, err := test.ResumeSession(flowSession, sa, "no")
+	require.NoError(t, err)
+
+	tx = db.MustBegin()
+	err = session.Update(ctx, rt, tx, oa, flowSession, sprint2, modelContact, nil)
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+
+	assertExpiration(session, sprint2)
+	assert.True(t, session.WaitExpiresOn().After(firstExpiresOn))
+
+	// and the session's waiting run is still waiting so won't be expired before the session
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowrun WHERE session_id = $1 AND status = 'W'`, session.ID()).Returns(1)
 }
 
-func TestInterruptSessionsForFlows(t *testing.T) {
-	ctx, _, db, _ := testsuite.Get()
+func TestReopenSession(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
 
 	defer testsuite.Reset(testsuite.ResetData)
 
-	cathy1CallID := testdata.InsertCall(db, testdata.Org1, testdata.TwilioChannel, testdata.Cathy)
-	cathy2CallID := testdata.InsertCall(db, testdata.Org1, testdata.TwilioChannel, testdata.Cathy)
-	bobCallID := testdata.InsertCall(db, testdata.Org1, testdata.TwilioChannel, testdata.Bob)
-	georgeCallID := testdata.InsertCall(db, testdata.Org1, testdata.VonageChannel, testdata.George)
+	testFlows := testdata.ImportFlows(db, testdata.Org1, "testdata/session_test_flows.json")
+	singleMessage, childFlow := testFlows[1], testFlows[3]
 
-	session1ID, _ := insertSessionAndRun(db, testdata.Cathy, models.FlowTypeMessaging, models.SessionStatusCompleted, testdata.Favorites, cathy1CallID)
-	session2ID, _ := insertSessionAndRun(db, testdata.Cathy, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, cathy2CallID)
-	session3ID, _ := insertSessionAndRun(db, testdata.Bob, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, bobCallID)
-	session4ID, _ := insertSessionAndRun(db, testdata.George, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.PickANumber, georgeCallID)
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshFlows)
+	require.NoError(t, err)
 
-	// noop if no flows
-	err := models.InterruptSessionsForFlows(ctx, db, []models.FlowID{})
+	// a session for Bob which waits and then completes because the wait's exit has no destination
+	bobContact, _ := testdata.Bob.Load(db, oa)
+
+	sa, flowSession, sprint1 := test.NewSessionBuilder().WithAssets(oa.SessionAssets()).WithFlow(childFlow.UUID).
+		WithContact(testdata.Bob.UUID, flows.ContactID(testdata.Bob.ID), "Bob", "eng", "").MustBuild()
+
+	tx := db.MustBegin()
+	modelSessions, err := models.InsertSessions(ctx, rt, tx, oa, []flows.Session{flowSession}, []flows.Sprint{sprint1}, []*models.Contact{bobContact}, nil)
 	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
 
-	assertSessionAndRunStatus(t, db, session1ID, models.SessionStatusCompleted)
-	assertSessionAndRunStatus(t, db, session2ID, models.SessionStatusWaiting)
-	assertSessionAndRunStatus(t, db, session3ID, models.SessionStatusWaiting)
-	assertSessionAndRunStatus(t, db, session4ID, models.SessionStatusWaiting)
+	bobSession := modelSessions[0]
 
-	err = models.InterruptSessionsForFlows(ctx, db, []models.FlowID{testdata.Favorites.ID})
+	flowSession, sprint2, err := test.ResumeSession(flowSession, sa, "hello")
 	require.NoError(t, err)
 
-	assertSessionAndRunStatus(t, db, session1ID, models.SessionStatusCompleted) // wasn't waiting
-	assertSessionAndRunStatus(t, db, session2ID, models.SessionStatusInterrupted)
-	assertSessionAndRunStatus(t, db, session3ID, models.SessionStatusInterrupted)
-	assertSessionAndRunStatus(t, db, session4ID, models.SessionStatusWaiting) // flow not included
+	tx = db.MustBegin()
+	require.NoError(t, bobSession.Update(ctx, rt, tx, oa, flowSession, sprint2, bobContact, nil))
+	require.NoError(t, tx.Commit())
 
-	// check other columns are correct on interrupted session and contact
-	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowsession WHERE ended_on IS NOT NULL AND wait_started_on IS NULL AND wait_expires_on IS NULL AND timeout_on IS NULL AND current_flow_id IS NULL AND id = $1`, session2ID).Returns(1)
+	assert.Equal(t, models.SessionStatusCompleted, bobSession.Status())
+
+	// a session for Cathy which completes without ever waiting
+	cathyContact, _ := testdata.Cathy.Load(db, oa)
+
+	_, flowSession, sprint1 = test.NewSessionBuilder().WithAssets(oa.SessionAssets()).WithFlow(singleMessage.UUID).
+		WithContact(testdata.Cathy.UUID, flows.ContactID(testdata.Cathy.ID), "Cathy", "eng", "").MustBuild()
+
+	tx = db.MustBegin()
+	modelSessions, err = models.InsertSessions(ctx, rt, tx, oa, []flows.Session{flowSession}, []flows.Sprint{sprint1}, []*models.Contact{cathyContact}, nil)
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+
+	cathySession := modelSessions[0]
+
+	// Bob's session can be reopened
+	err = models.ReopenSession(ctx, db, bobSession.ID())
+	assert.NoError(t, err)
+
+	assertdb.Query(t, db, `SELECT status, current_flow_id, ended_on, wait_resume_on_expire, output::jsonb->>'status' AS output_status FROM flows_flowsession WHERE id = $1`, bobSession.ID()).
+		Columns(map[string]interface{}{"status": "W", "current_flow_id": int64(childFlow.ID), "ended_on": nil, "wait_resume_on_expire": false, "output_status": "waiting"})
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowsession WHERE id = $1 AND wait_started_on IS NOT NULL AND wait_expires_on > NOW()`, bobSession.ID()).Returns(1)
+	assertdb.Query(t, db, `SELECT status, exited_on FROM flows_flowrun WHERE session_id = $1`, bobSession.ID()).
+		Columns(map[string]interface{}{"status": "W", "exited_on": nil})
+	assertdb.Query(t, db, `SELECT current_flow_id FROM contacts_contact WHERE id = $1`, testdata.Bob.ID).Returns(int64(childFlow.ID))
+
+	// but not twice
+	err = models.ReopenSession(ctx, db, bobSession.ID())
+	assert.EqualError(t, err, fmt.Sprintf("can't reopen session #%d with status W", bobSession.ID()))
+
+	// Cathy's session never waited so can't be reopened
+	err = models.ReopenSession(ctx, db, cathySession.ID())
+	assert.EqualError(t, err, fmt.Sprintf("can't reopen session #%d: session didn't end at a wait", cathySession.ID()))
+
+	assertdb.Query(t, db, `SELECT status FROM flows_flowsession WHERE id = $1`, cathySession.ID()).Returns("C")
+	assertdb.Query(t, db, `SELECT status FROM flows_flowrun WHERE session_id = $1`, cathySession.ID()).Returns("C")
+}
+
+func TestReopenFailedSession(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	testFlows := testdata.ImportFlows(db, testdata.Org1, "testdata/webhook_after_wait.json")
+	flow := testFlows[0]
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshFlows)
+	require.NoError(t, err)
+
+	startSession := func(contact *testdata.Contact) models.SessionID {
+		mc, fc := contact.Load(db, oa)
+
+		_, flowSession, sprint := test.NewSessionBuilder().WithAssets(oa.SessionAssets()).WithFlow(flow.UUID).
+			WithContact(fc.UUID(), fc.ID(), fc.Name(), "eng", "").MustBuild()
+
+		tx := db.MustBegin()
+		modelSessions, err := models.InsertSessions(ctx, rt, tx, oa, []flows.Session{flowSession}, []flows.Sprint{sprint}, []*models.Contact{mc}, nil)
+		require.NoError(t, err)
+		require.NoError(t, tx.Commit())
+
+		return modelSessions[0].ID()
+	}
+
+	// Bob replies with his order number but his session is failed
+	bobSessionID := startSession(testdata.Bob)
+	bobMsg := testdata.InsertIncomingMsg(db, testdata.Org1, testdata.TwilioChannel, testdata.Bob, "12345", models.MsgStatusPending)
+
+	err = models.FailSession(ctx, db, bobSessionID)
+	require.NoError(t, err)
+
+	// Alexandria's session is failed whilst she's still at the wait
+	alexSessionID := startSession(testdata.Alexandria)
+
+	err = models.FailSession(ctx, db, alexSessionID)
+	require.NoError(t, err)
+
+	// Cathy has a session failed by the engine whose output says as much, and George has a session that's still waiting
+	cathySessionID, _ := insertSessionAndRun(db, testdata.Cathy, models.FlowTypeMessaging, models.SessionStatusFailed, testdata.Favorites, models.NilCallID)
+	db.MustExec(`UPDATE flows_flowsession SET output = '{"status": "failed"}' WHERE id = $1`, cathySessionID)
+	georgeSessionID, _ := insertSessionAndRun(db, testdata.George, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, models.NilCallID)
+
+	// Bob's session is reopened and returned with the message it was being resumed with
+	reopened, err := models.ReopenFailedSession(ctx, rt, bobSessionID)
+	require.NoError(t, err)
+	require.NotNil(t, reopened)
+	assert.Equal(t, testdata.Org1.ID, reopened.OrgID)
+	assert.Equal(t, testdata.Bob.ID, reopened.ContactID)
+	assert.Equal(t, models.FlowTypeMessaging, reopened.SessionType)
+	require.NotNil(t, reopened.Msg)
+	assert.Equal(t, bobMsg.ID(), reopened.Msg.ID)
+	assert.Equal(t, "12345", reopened.Msg.Text)
+
+	assertSessionAndRunStatus(t, db, bobSessionID, models.SessionStatusWaiting)
+	assertdb.Query(t, db, `SELECT status FROM msgs_msg WHERE id = $1`, bobMsg.ID()).Returns("P")
+
+	// Alexandria's session is reopened but has no message to be resumed with
+	reopened, err = models.ReopenFailedSession(ctx, rt, alexSessionID)
+	require.NoError(t, err)
+	require.NotNil(t, reopened)
+	assert.Nil(t, reopened.Msg)
+
+	assertSessionAndRunStatus(t, db, alexSessionID, models.SessionStatusWaiting)
+
+	// sessions failed by the engine or which haven't failed are skipped
+	reopened, err = models.ReopenFailedSession(ctx, rt, cathySessionID)
+	assert.NoError(t, err)
+	assert.Nil(t, reopened)
+	assertSessionAndRunStatus(t, db, cathySessionID, models.SessionStatusFailed)
+
+	reopened, err = models.ReopenFailedSession(ctx, rt, georgeSessionID)
+	assert.NoError(t, err)
+	assert.Nil(t, reopened)
+	assertSessionAndRunStatus(t, db, georgeSessionID, models.SessionStatusWaiting)
+
+	// and sessions which don't exist are an error
+	_, err = models.ReopenFailedSession(ctx, rt, models.SessionID(123456789))
+	assert.Error(t, err)
+}
+
+func TestFilterByWaitingSession(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	testdata.InsertWaitingSession(db, testdata.Org1, testdata.Cathy, models.FlowTypeMessaging, testdata.Favorites, models.NilCallID, time.Now(), time.Now().Add(time.Hour), true, nil)
+	testdata.InsertFlowSession(db, testdata.Org1, testdata.Bob, models.FlowTypeMessaging, models.SessionStatusCompleted, testdata.Favorites, models.NilCallID)
+
+	waiting, err := models.FilterByWaitingSession(ctx, rt, []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID, testdata.George.ID})
+	assert.NoError(t, err)
+	assert.Equal(t, []models.ContactID{testdata.Cathy.ID}, waiting)
+
+	// a context which has already expired should fail the query promptly
+	expiredCtx, cancel := context.WithTimeout(ctx, time.Nanosecond)
+	defer cancel()
+	time.Sleep(time.Millisecond)
+
+	_, err = models.FilterByWaitingSession(expiredCtx, rt, []models.ContactID{testdata.Cathy.ID})
+	assert.Error(t, err)
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+}
+
+func TestSessionInterrupt(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	oa, err := models.GetOrgAssets(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	_, cathy := testdata.Cathy.Load(db, oa)
+	_, bob := testdata.Bob.Load(db, oa)
+
+	// Cathy's session would resume a parent when its wait expires
+	cathySessionID := testdata.InsertWaitingSession(db, testdata.Org1, testdata.Cathy, models.FlowTypeMessaging, testdata.Favorites, models.NilCallID, time.Now(), time.Now().Add(time.Hour), true, nil)
+	testdata.InsertFlowRun(db, testdata.Org1, cathySessionID, testdata.Cathy, testdata.Favorites, models.RunStatusWaiting)
+	bobSessionID, _ := insertSessionAndRun(db, testdata.Bob, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, models.NilCallID)
+
+	session, err := models.FindWaitingSessionForContact(ctx, db, nil, oa, models.FlowTypeMessaging, cathy)
+	require.NoError(t, err)
+	require.Equal(t, cathySessionID, session.ID())
+	require.True(t, session.WaitResumeOnExpire())
+
+	tx := db.MustBegin()
+	require.NoError(t, session.Interrupt(ctx, tx))
+	require.NoError(t, tx.Commit())
+
+	assert.Equal(t, models.SessionStatusInterrupted, session.Status())
+	assert.NotNil(t, session.EndedOn())
+	assert.Nil(t, session.WaitStartedOn())
+	assert.Nil(t, session.WaitExpiresOn())
+	assert.Nil(t, session.WaitTimeoutOn())
+	assert.False(t, session.WaitResumeOnExpire())
+	assert.Equal(t, models.NilFlowID, session.CurrentFlowID())
+
+	assertSessionAndRunStatus(t, db, cathySessionID, models.SessionStatusInterrupted)
+	assertdb.Query(t, db, `SELECT wait_started_on, wait_expires_on, timeout_on, wait_resume_on_expire FROM flows_flowsession WHERE id = $1`, cathySessionID).
+		Columns(map[string]interface{}{"wait_started_on": nil, "wait_expires_on": nil, "timeout_on": nil, "wait_resume_on_expire": false})
 	assertdb.Query(t, db, `SELECT current_flow_id FROM contacts_contact WHERE id = $1`, testdata.Cathy.ID).Returns(nil)
+
+	// Bob's session is untouched
+	assertSessionAndRunStatus(t, db, bobSessionID, models.SessionStatusWaiting)
+
+	bobSession, err := models.FindWaitingSessionForContact(ctx, db, nil, oa, models.FlowTypeMessaging, bob)
+	require.NoError(t, err)
+	require.NotNil(t, bobSession)
+
+	// can't interrupt a session that's already been interrupted
+	tx = db.MustBegin()
+	assert.EqualError(t, session.Interrupt(ctx, tx), fmt.Sprintf("can't interrupt session #%d with status I", cathySessionID))
+	require.NoError(t, tx.Rollback())
 }
 
 func TestGetSessionWaitExpiresOn(t *testing.T) {
@@ -460,6 +1884,190 @@ func TestGetSessionWaitExpiresOn(t *testing.T) {
 	assert.Nil(t, s2Actual)
 }
 
+func TestFindTimedOutSessions(t *testing.T) {
+	ctx, _, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	now := time.Date(2022, 1, 26, 13, 0, 0, 0, time.UTC)
+	past1 := now.Add(-time.Hour)
+	past2 := now.Add(-time.Minute)
+	future := now.Add(time.Minute)
+	expires := now.Add(time.Hour * 24)
+
+	s1ID := testdata.InsertWaitingSession(db, testdata.Org1, testdata.Cathy, models.FlowTypeMessaging, testdata.Favorites, models.NilCallID, past1, expires, true, &past2)
+	s2ID := testdata.InsertWaitingSession(db, testdata.Org1, testdata.Bob, models.FlowTypeMessaging, testdata.Favorites, models.NilCallID, past1, expires, true, &past1)
+	testdata.InsertWaitingSession(db, testdata.Org1, testdata.George, models.FlowTypeMessaging, testdata.Favorites, models.NilCallID, past1, expires, true, &future)
+	testdata.InsertWaitingSession(db, testdata.Org1, testdata.Alexandria, models.FlowTypeMessaging, testdata.Favorites, models.NilCallID, past1, expires, true, nil)
+
+	// voice sessions are ignored
+	callID := testdata.InsertCall(db, testdata.Org1, testdata.TwilioChannel, testdata.Cathy)
+	testdata.InsertWaitingSession(db, testdata.Org1, testdata.Cathy, models.FlowTypeVoice, testdata.IVRFlow, callID, past1, expires, true, &past1)
+
+	timeouts, err := models.FindTimedOutSessions(ctx, db, now, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []models.SessionID{s2ID, s1ID}, timeoutSessionIDs(timeouts))
+	assert.Equal(t, testdata.Bob.ID, timeouts[0].ContactID)
+	assert.Equal(t, testdata.Org1.ID, timeouts[0].OrgID)
+	assert.True(t, past1.Equal(timeouts[0].TimeoutOn))
+
+	timeouts, err = models.FindTimedOutSessions(ctx, db, now, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []models.SessionID{s2ID}, timeoutSessionIDs(timeouts))
+
+	timeouts, err = models.FindTimedOutSessions(ctx, db, past1, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []models.SessionID{}, timeoutSessionIDs(timeouts))
+}
+
+func timeoutSessionIDs(timeouts []*models.SessionTimeout) []models.SessionID {
+	ids := make([]models.SessionID, len(timeouts))
+	for i, t := range timeouts {
+		ids[i] = t.SessionID
+	}
+	return ids
+}
+
+func TestFindExpiredWaits(t *testing.T) {
+	ctx, _, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	now := time.Date(2022, 1, 26, 13, 0, 0, 0, time.UTC)
+	past1 := now.Add(-time.Hour)
+	past2 := now.Add(-time.Minute)
+	future := now.Add(time.Minute)
+	started := now.Add(-time.Hour * 24)
+
+	// sessions which should be ended, the second with a child run and a completed child run
+	s1ID := testdata.InsertWaitingSession(db, testdata.Org1, testdata.Cathy, models.FlowTypeMessaging, testdata.Favorites, models.NilCallID, started, past2, false, nil)
+	r1ID := testdata.InsertFlowRun(db, testdata.Org1, s1ID, testdata.Cathy, testdata.Favorites, models.RunStatusWaiting)
+	s2ID := testdata.InsertWaitingSession(db, testdata.Org1, testdata.Bob, models.FlowTypeMessaging, testdata.Favorites, models.NilCallID, started, past1, false, nil)
+	r2ID := testdata.InsertFlowRun(db, testdata.Org1, s2ID, testdata.Bob, testdata.Favorites, models.RunStatusActive)
+	testdata.InsertFlowRun(db, testdata.Org1, s2ID, testdata.Bob, testdata.PickANumber, models.RunStatusCompleted)
+	testdata.InsertFlowRun(db, testdata.Org1, s2ID, testdata.Bob, testdata.PickANumber, models.RunStatusWaiting)
+
+	// a session which should be resumed rather than ended
+	s3ID := testdata.InsertWaitingSession(db, testdata.Org1, testdata.George, models.FlowTypeMessaging, testdata.Favorites, models.NilCallID, started, past1.Add(time.Second), true, nil)
+	testdata.InsertFlowRun(db, testdata.Org1, s3ID, testdata.George, testdata.Favorites, models.RunStatusActive)
+	testdata.InsertFlowRun(db, testdata.Org1, s3ID, testdata.George, testdata.PickANumber, models.RunStatusWaiting)
+
+	// a session which hasn't expired yet
+	s4ID := testdata.InsertWaitingSession(db, testdata.Org1, testdata.Alexandria, models.FlowTypeMessaging, testdata.Favorites, models.NilCallID, started, future, false, nil)
+	testdata.InsertFlowRun(db, testdata.Org1, s4ID, testdata.Alexandria, testdata.Favorites, models.RunStatusWaiting)
+
+	// voice sessions are ignored
+	callID := testdata.InsertCall(db, testdata.Org1, testdata.TwilioChannel, testdata.Cathy)
+	testdata.InsertWaitingSession(db, testdata.Org1, testdata.Cathy, models.FlowTypeVoice, testdata.IVRFlow, callID, started, past1, false, nil)
+
+	tcs := []struct {
+		now               time.Time
+		limit             int
+		expectedRunIDs    []models.FlowRunID
+		expectedEndIDs    []models.SessionID
+		expectedResumeIDs []models.SessionID
+	}{
+		{now: now, limit: 10, expectedRunIDs: []models.FlowRunID{r1ID, r2ID}, expectedEndIDs: []models.SessionID{s2ID, s1ID}, expectedResumeIDs: []models.SessionID{s3ID}},
+		{now: now, limit: 2, expectedRunIDs: []models.FlowRunID{r2ID}, expectedEndIDs: []models.SessionID{s2ID}, expectedResumeIDs: []models.SessionID{s3ID}},
+		{now: now, limit: 1, expectedRunIDs: []models.FlowRunID{r2ID}, expectedEndIDs: []models.SessionID{s2ID}, expectedResumeIDs: []models.SessionID{}},
+		{now: past1, limit: 10, expectedRunIDs: []models.FlowRunID{}, expectedEndIDs: []models.SessionID{}, expectedResumeIDs: []models.SessionID{}},
+	}
+
+	for i, tc := range tcs {
+		runIDs, endIDs, resumeIDs, err := models.FindExpiredWaits(ctx, db, tc.now, tc.limit)
+		assert.NoError(t, err, "%d: unexpected error", i)
+		assert.Equal(t, tc.expectedRunIDs, runIDs, "%d: run ids mismatch", i)
+		assert.Equal(t, tc.expectedEndIDs, endIDs, "%d: end session ids mismatch", i)
+		assert.Equal(t, tc.expectedResumeIDs, resumeIDs, "%d: resume session ids mismatch", i)
+	}
+}
+
+func TestActiveContactCountForFlow(t *testing.T) {
+	ctx, _, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	// cathy and bob are waiting in favorites, george is waiting in another flow
+	insertSessionAndRun(db, testdata.Cathy, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, models.NilCallID)
+	insertSessionAndRun(db, testdata.Bob, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, models.NilCallID)
+	insertSessionAndRun(db, testdata.George, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.PickANumber, models.NilCallID)
+
+	// and alexandria has been through favorites but isn't there anymore
+	insertSessionAndRun(db, testdata.Alexandria, models.FlowTypeMessaging, models.SessionStatusCompleted, testdata.Favorites, models.NilCallID)
+
+	count, err := models.ActiveContactCountForFlow(ctx, db, testdata.Favorites.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), count)
+
+	count, err = models.ActiveContactCountForFlow(ctx, db, testdata.PickANumber.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+
+	count, err = models.ActiveContactCountForFlow(ctx, db, testdata.SingleMessage.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), count)
+}
+
+func TestSetWaitResumeOnExpire(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	oa := testdata.Org1.Load(rt)
+
+	_, cathy := testdata.Cathy.Load(db, oa)
+
+	now := time.Now()
+	started := now.Add(-time.Hour * 24)
+	expired := now.Add(-time.Minute)
+
+	// a subflow session which would resume its parent when it expires
+	s1ID := testdata.InsertWaitingSession(db, testdata.Org1, testdata.Cathy, models.FlowTypeMessaging, testdata.Favorites, models.NilCallID, started, expired, true, nil)
+	testdata.InsertFlowRun(db, testdata.Org1, s1ID, testdata.Cathy, testdata.Favorites, models.RunStatusWaiting)
+
+	// and a completed session which can't be changed
+	s2ID := testdata.InsertFlowSession(db, testdata.Org1, testdata.Bob, models.FlowTypeMessaging, models.SessionStatusCompleted, testdata.Favorites, models.NilCallID)
+
+	// expiring it would resume it
+	_, endIDs, resumeIDs, err := models.FindExpiredWaits(ctx, db, now, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []models.SessionID{}, endIDs)
+	assert.Equal(t, []models.SessionID{s1ID}, resumeIDs)
+
+	session, err := models.FindWaitingSessionForContact(ctx, db, nil, oa, models.FlowTypeMessaging, cathy)
+	require.NoError(t, err)
+	assert.True(t, session.WaitResumeOnExpire())
+
+	err = session.SetWaitResumeOnExpire(ctx, db, false)
+	assert.NoError(t, err)
+	assert.False(t, session.WaitResumeOnExpire())
+
+	assertdb.Query(t, db, `SELECT wait_resume_on_expire FROM flows_flowsession WHERE id = $1`, s1ID).Returns(false)
+
+	// so now expiring it will end it
+	_, endIDs, resumeIDs, err = models.FindExpiredWaits(ctx, db, now, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []models.SessionID{s1ID}, endIDs)
+	assert.Equal(t, []models.SessionID{}, resumeIDs)
+
+	// sessions which aren't waiting are ignored
+	updated, err := models.SetWaitResumeOnExpire(ctx, db, []models.SessionID{s1ID, s2ID}, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, updated)
+
+	assertdb.Query(t, db, `SELECT wait_resume_on_expire FROM flows_flowsession WHERE id = $1`, s1ID).Returns(true)
+	assertdb.Query(t, db, `SELECT wait_resume_on_expire FROM flows_flowsession WHERE id = $1`, s2ID).Returns(false)
+
+	// and can't be changed individually once they've ended
+	tx := db.MustBegin()
+	require.NoError(t, session.Interrupt(ctx, tx))
+	require.NoError(t, tx.Commit())
+
+	err = session.SetWaitResumeOnExpire(ctx, db, false)
+	assert.EqualError(t, err, fmt.Sprintf("can't change expiration of session #%d with status I", s1ID))
+	assert.True(t, session.WaitResumeOnExpire())
+}
+
 func TestClearWaitTimeout(t *testing.T) {
 	ctx, rt, db, _ := testsuite.Get()
 
@@ -482,10 +2090,48 @@ func TestClearWaitTimeout(t *testing.T) {
 	assert.NotNil(t, session.WaitExpiresOn()) // unaffected
 
 	// and called with one to clear in the database as well
-	session.ClearWaitTimeout(ctx, db)
+	err = session.ClearWaitTimeout(ctx, db)
+	require.NoError(t, err)
+	assert.Nil(t, session.WaitTimeoutOn())
+
+	assertdb.Query(t, db, `SELECT timeout_on FROM flows_flowsession WHERE id = $1`, session.ID()).Returns(nil)
+
+	// or with a transaction, e.g. by admin tooling cancelling a pending timeout
+	timeoutOn = time.Now().Add(time.Minute)
+	db.MustExec(`UPDATE flows_flowsession SET timeout_on = $2 WHERE id = $1`, session.ID(), timeoutOn)
+
+	session, err = models.FindWaitingSessionForContact(ctx, db, nil, oa, models.FlowTypeMessaging, cathy)
+	require.NoError(t, err)
+	assert.NotNil(t, session.WaitTimeoutOn())
+
+	tx := db.MustBegin()
+	require.NoError(t, session.ClearWaitTimeout(ctx, tx))
+	require.NoError(t, tx.Commit())
+
 	assert.Nil(t, session.WaitTimeoutOn())
+	assert.NotNil(t, session.WaitExpiresOn()) // unaffected
 
 	assertdb.Query(t, db, `SELECT timeout_on FROM flows_flowsession WHERE id = $1`, session.ID()).Returns(nil)
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowsession WHERE id = $1 AND status = 'W' AND wait_expires_on IS NOT NULL`, session.ID()).Returns(1)
+}
+
+func buildSessionBatch(db *sqlx.DB, oa *models.OrgAssets, flow *testdata.Flow, contacts []*testdata.Contact) ([]flows.Session, []flows.Sprint, []*models.Contact) {
+	flowSessions := make([]flows.Session, len(contacts))
+	sprints := make([]flows.Sprint, len(contacts))
+	modelContacts := make([]*models.Contact, len(contacts))
+
+	for i, c := range contacts {
+		modelContact, _ := c.Load(db, oa)
+
+		_, flowSession, sprint := test.NewSessionBuilder().WithAssets(oa.SessionAssets()).WithFlow(flow.UUID).
+			WithContact(c.UUID, flows.ContactID(c.ID), "", "eng", "").MustBuild()
+
+		flowSessions[i] = flowSession
+		sprints[i] = sprint
+		modelContacts[i] = modelContact
+	}
+
+	return flowSessions, sprints, modelContacts
 }
 
 func insertSessionAndRun(db *sqlx.DB, contact *testdata.Contact, sessionType models.FlowType, status models.SessionStatus, flow *testdata.Flow, connID models.CallID) (models.SessionID, models.FlowRunID) {
@@ -9,6 +9,7 @@ import (
 	"github.com/nyaruka/gocommon/urns"
 	"github.com/nyaruka/gocommon/uuids"
 	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/runtime"
 	"github.com/nyaruka/null"
 	"github.com/pkg/errors"
 )
@@ -379,3 +380,45 @@ func ReadSessionHistory(data []byte) (*flows.SessionHistory, error) {
 	h := &flows.SessionHistory{}
 	return h, jsonx.Unmarshal(data, h)
 }
+
+// StartFilter controls which contacts are excluded when starting a flow
+type StartFilter struct {
+	RestartParticipants bool // whether to include contacts who have been in the flow before
+	IncludeActive       bool // whether to include contacts who are currently waiting in a flow
+}
+
+// FilterStartContacts returns those of the given contacts that should be started in the given flow according to
+// the given filter, preserving their order
+func FilterStartContacts(ctx context.Context, rt *runtime.Runtime, flowID FlowID, contactIDs []ContactID, filter StartFilter) ([]ContactID, error) {
+	exclude := make(map[ContactID]bool, 5)
+
+	// filter out anybody who has has a flow run in this flow if appropriate
+	if !filter.RestartParticipants {
+		started, err := FindFlowStartedOverlap(ctx, rt, flowID, contactIDs)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error finding others started flow: %d", flowID)
+		}
+		for _, c := range started {
+			exclude[c] = true
+		}
+	}
+
+	// filter out anybody who is currently waiting in any flow if appropriate
+	if !filter.IncludeActive {
+		active, err := FilterByWaitingSession(ctx, rt, contactIDs)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error finding other active flow: %d", flowID)
+		}
+		for _, c := range active {
+			exclude[c] = true
+		}
+	}
+
+	included := make([]ContactID, 0, len(contactIDs))
+	for _, c := range contactIDs {
+		if !exclude[c] {
+			included = append(included, c)
+		}
+	}
+	return included, nil
+}
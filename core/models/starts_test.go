@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/nyaruka/gocommon/dbutil/assertdb"
 	"github.com/nyaruka/gocommon/jsonx"
@@ -127,3 +128,49 @@ func TestStartsBuilding(t *testing.T) {
 		"start_type": "M"
 	}`, testdata.Cathy.ID, testdata.Bob.ID, testdata.TestersGroup.ID, testdata.Favorites.ID, testdata.DoctorsGroup.ID)), marshalled)
 }
+
+func TestFilterStartContacts(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	// Cathy has previously been in Favorites, Bob is currently waiting in another flow, George is waiting in Favorites
+	sessionID := testdata.InsertFlowSession(db, testdata.Org1, testdata.Cathy, models.FlowTypeMessaging, models.SessionStatusCompleted, testdata.Favorites, models.NilCallID)
+	testdata.InsertFlowRun(db, testdata.Org1, sessionID, testdata.Cathy, testdata.Favorites, models.RunStatusCompleted)
+
+	sessionID = testdata.InsertWaitingSession(db, testdata.Org1, testdata.Bob, models.FlowTypeMessaging, testdata.PickANumber, models.NilCallID, time.Now(), time.Now(), false, nil)
+	testdata.InsertFlowRun(db, testdata.Org1, sessionID, testdata.Bob, testdata.PickANumber, models.RunStatusWaiting)
+
+	sessionID = testdata.InsertWaitingSession(db, testdata.Org1, testdata.George, models.FlowTypeMessaging, testdata.Favorites, models.NilCallID, time.Now(), time.Now(), false, nil)
+	testdata.InsertFlowRun(db, testdata.Org1, sessionID, testdata.George, testdata.Favorites, models.RunStatusWaiting)
+
+	contactIDs := []models.ContactID{testdata.Alexandria.ID, testdata.George.ID, testdata.Bob.ID, testdata.Cathy.ID}
+
+	tcs := []struct {
+		filter   models.StartFilter
+		expected []models.ContactID
+	}{
+		{
+			filter:   models.StartFilter{},
+			expected: []models.ContactID{testdata.Alexandria.ID},
+		},
+		{
+			filter:   models.StartFilter{RestartParticipants: true},
+			expected: []models.ContactID{testdata.Alexandria.ID, testdata.Cathy.ID},
+		},
+		{
+			filter:   models.StartFilter{IncludeActive: true},
+			expected: []models.ContactID{testdata.Alexandria.ID, testdata.Bob.ID},
+		},
+		{
+			filter:   models.StartFilter{RestartParticipants: true, IncludeActive: true},
+			expected: contactIDs,
+		},
+	}
+
+	for _, tc := range tcs {
+		actual, err := models.FilterStartContacts(ctx, rt, testdata.Favorites.ID, contactIDs, tc.filter)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, actual, "contacts mismatch for filter %+v", tc.filter)
+	}
+}
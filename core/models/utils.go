@@ -8,8 +8,9 @@ import (
 
 	"github.com/jmoiron/sqlx"
 	"github.com/nyaruka/gocommon/dbutil"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/correlation"
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
 )
 
 // Queryer contains functionality common to sqlx.Tx and sqlx.DB so we can write code that works with either
@@ -38,7 +39,7 @@ func Exec(ctx context.Context, label string, tx Queryer, sql string, args ...int
 	}
 	rows, _ := res.RowsAffected()
 	if rows > 0 {
-		logrus.WithField("count", rows).WithField("elapsed", time.Since(start)).Debug(label)
+		correlation.Logger(ctx).WithField("count", rows).WithField("elapsed", time.Since(start)).Debug(label)
 	}
 	return nil
 }
@@ -57,7 +58,7 @@ func BulkQuery[T any](ctx context.Context, label string, tx Queryer, sql string,
 		return errors.Wrap(err, "error making bulk query")
 	}
 
-	logrus.WithField("elapsed", time.Since(start)).WithField("rows", len(structs)).Infof("%s bulk sql complete", label)
+	correlation.Logger(ctx).WithField("elapsed", time.Since(start)).WithField("rows", len(structs)).Infof("%s bulk sql complete", label)
 
 	return nil
 }
@@ -73,12 +74,22 @@ func BulkQueryBatches(ctx context.Context, label string, tx Queryer, sql string,
 			return errors.Wrap(err, "error making bulk batch query")
 		}
 
-		logrus.WithField("elapsed", time.Since(start)).WithField("rows", len(batch)).WithField("batch", i+1).Infof("%s bulk sql batch complete", label)
+		correlation.Logger(ctx).WithField("elapsed", time.Since(start)).WithField("rows", len(batch)).WithField("batch", i+1).Infof("%s bulk sql batch complete", label)
 	}
 
 	return nil
 }
 
+// records a timing and count sample for the named operation with the runtime's metrics collector if it has one
+func recordMetrics(rt *runtime.Runtime, name string, start time.Time, count int) {
+	if rt.Metrics == nil {
+		return
+	}
+
+	rt.Metrics.Timing(name, time.Since(start))
+	rt.Metrics.Count(name, count)
+}
+
 func chunkSlice[T any](slice []T, size int) [][]T {
 	chunks := make([][]T, 0, len(slice)/size+1)
 
@@ -91,3 +102,20 @@ func chunkSlice[T any](slice []T, size int) [][]T {
 	}
 	return chunks
 }
+
+// RecordCount records a count sample for the named event with the runtime's metrics collector if it has one
+func RecordCount(rt *runtime.Runtime, name string, count int) {
+	if rt.Metrics == nil {
+		return
+	}
+
+	rt.Metrics.Count(name, count)
+}
+
+// derives a context for a potentially slow query which is cancelled after the configured DB timeout
+func withDBTimeout(ctx context.Context, rt *runtime.Runtime) (context.Context, context.CancelFunc) {
+	if rt.Config.DBTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(rt.Config.DBTimeout)*time.Millisecond)
+}
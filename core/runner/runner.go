@@ -10,7 +10,9 @@ import (
 	"github.com/nyaruka/goflow/assets"
 	"github.com/nyaruka/goflow/excellent/types"
 	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/flows/resumes"
 	"github.com/nyaruka/goflow/flows/triggers"
+	"github.com/nyaruka/goflow/utils"
 	"github.com/nyaruka/mailroom/core/goflow"
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/core/queue"
@@ -83,6 +85,14 @@ func ResumeFlow(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets,
 		return nil, errors.Wrapf(err, "unable to create session from output")
 	}
 
+	// the engine doesn't take a context so check ours hasn't expired before resuming
+	if err := ctx.Err(); err != nil {
+		return nil, errors.Wrapf(err, "unable to resume session #%d", session.ID())
+	}
+
+	// resuming modifies the flow session so it can no longer be cached
+	session.ClearFlowSession()
+
 	// resume our session
 	sprint, err := fs.Resume(resume)
 
@@ -104,6 +114,14 @@ func ResumeFlow(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets,
 	err = session.Update(txCTX, rt, tx, oa, fs, sprint, contact, hook)
 	if err != nil {
 		tx.Rollback()
+
+		// if this session has grown too many runs, fail it rather than let it keep growing
+		if errors.Cause(err) == models.ErrTooManyRuns {
+			if err := models.ExitSessions(ctx, rt.DB, []models.SessionID{session.ID()}, models.SessionStatusFailed); err != nil {
+				return nil, errors.Wrapf(err, "error failing session with too many runs")
+			}
+		}
+
 		return nil, errors.Wrapf(err, "error updating session for resume")
 	}
 
@@ -137,6 +155,87 @@ func ResumeFlow(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets,
 	return session, nil
 }
 
+// RetryFailedSessions retries sessions which were failed by mailroom rather than by the engine, e.g. because a webhook
+// was down whilst it was being resumed. Each session is reopened at the last wait it was written at, and if the contact
+// has a message since then which was never handled, the session is resumed from that wait with that message. Errors
+// retrying one session are logged and don't prevent the others being retried.
+func RetryFailedSessions(ctx context.Context, rt *runtime.Runtime, sessionIDs []models.SessionID) error {
+	numErrored := 0
+
+	for _, sessionID := range sessionIDs {
+		if err := retryFailedSession(ctx, rt, sessionID); err != nil {
+			logrus.WithError(err).WithField("session_id", sessionID).Error("error retrying failed session")
+			numErrored++
+		}
+	}
+
+	if numErrored > 0 {
+		return errors.Errorf("error retrying %d of %d sessions", numErrored, len(sessionIDs))
+	}
+	return nil
+}
+
+func retryFailedSession(ctx context.Context, rt *runtime.Runtime, sessionID models.SessionID) error {
+	reopened, err := models.ReopenFailedSession(ctx, rt, sessionID)
+	if err != nil {
+		return err
+	}
+
+	// if the session wasn't reopened or was failed at its wait, we're done, it'll be resumed by the contact's next message
+	if reopened == nil || reopened.Msg == nil {
+		return nil
+	}
+
+	oa, err := models.GetOrgAssets(ctx, rt, reopened.OrgID)
+	if err != nil {
+		return errors.Wrapf(err, "error loading org assets")
+	}
+
+	contact, err := models.LoadContact(ctx, rt.DB, oa, reopened.ContactID)
+	if err != nil {
+		return errors.Wrapf(err, "error loading contact")
+	}
+	flowContact, err := contact.FlowContact(oa)
+	if err != nil {
+		return errors.Wrapf(err, "error creating flow contact")
+	}
+
+	session, err := models.FindWaitingSessionForContact(ctx, rt.DB, rt.SessionStorage, oa, reopened.SessionType, flowContact)
+	if err != nil {
+		return errors.Wrapf(err, "error loading reopened session #%d", sessionID)
+	}
+	if session == nil {
+		return errors.Errorf("reopened session #%d is no longer waiting", sessionID)
+	}
+
+	msg := reopened.Msg
+
+	var channelRef *assets.ChannelReference
+	if channel := oa.ChannelByID(msg.ChannelID); channel != nil {
+		channelRef = channel.ChannelReference()
+	}
+
+	attachments := make([]utils.Attachment, len(msg.Attachments))
+	for i := range msg.Attachments {
+		attachments[i] = utils.Attachment(msg.Attachments[i])
+	}
+
+	msgIn := flows.NewMsgIn(msg.UUID, msg.URN, channelRef, msg.Text, attachments)
+	msgIn.SetExternalID(string(msg.ExternalID))
+	msgIn.SetID(flows.MsgID(msg.ID))
+
+	// mark the message as handled by the flow it was resumed in
+	flowID := session.CurrentFlowID()
+	hook := func(ctx context.Context, tx *sqlx.Tx, rp *redis.Pool, oa *models.OrgAssets, sessions []*models.Session) error {
+		sessions[0].SetIncomingMsg(msg.ID, msg.ExternalID)
+
+		return models.UpdateMessage(ctx, tx, msg.ID, models.MsgStatusHandled, models.VisibilityVisible, models.MsgTypeFlow, flowID, attachments, nil)
+	}
+
+	_, err = ResumeFlow(ctx, rt, oa, session, contact, resumes.NewMsg(oa.Env(), flowContact, msgIn), hook)
+	return errors.Wrapf(err, "error resuming retried session #%d", sessionID)
+}
+
 // StartFlowBatch starts the flow for the passed in org, contacts and flow
 func StartFlowBatch(
 	ctx context.Context, rt *runtime.Runtime,
@@ -413,39 +512,13 @@ func StartFlow(
 		return nil, nil
 	}
 
-	// figures out which contacts need to be excluded if any
-	exclude := make(map[models.ContactID]bool, 5)
-
-	// filter out anybody who has has a flow run in this flow if appropriate
-	if options.ExcludeStartedPreviously {
-		// find all participants that have been in this flow
-		started, err := models.FindFlowStartedOverlap(ctx, rt.DB, flow.ID(), contactIDs)
-		if err != nil {
-			return nil, errors.Wrapf(err, "error finding others started flow: %d", flow.ID())
-		}
-		for _, c := range started {
-			exclude[c] = true
-		}
-	}
-
-	// filter out our list of contacts to only include those that should be started
-	if options.ExcludeInAFlow {
-		// find all participants active in any flow
-		active, err := models.FilterByWaitingSession(ctx, rt.DB, contactIDs)
-		if err != nil {
-			return nil, errors.Wrapf(err, "error finding other active flow: %d", flow.ID())
-		}
-		for _, c := range active {
-			exclude[c] = true
-		}
-	}
-
 	// filter into our final list of contacts
-	includedContacts := make([]models.ContactID, 0, len(contactIDs))
-	for _, c := range contactIDs {
-		if !exclude[c] {
-			includedContacts = append(includedContacts, c)
-		}
+	includedContacts, err := models.FilterStartContacts(ctx, rt, flow.ID(), contactIDs, models.StartFilter{
+		RestartParticipants: !options.ExcludeStartedPreviously,
+		IncludeActive:       !options.ExcludeInAFlow,
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	// no contacts left? we are done
@@ -573,44 +646,17 @@ func StartFlowForContacts(
 	txCTX, cancel := context.WithTimeout(ctx, commitTimeout*time.Duration(len(sessions)))
 	defer cancel()
 
-	tx, err := rt.DB.BeginTxx(txCTX, nil)
-	if err != nil {
-		return nil, errors.Wrapf(err, "error starting transaction")
-	}
-
-	// build our list of contact ids
-	contactIDs := make([]models.ContactID, len(triggers))
-	for i := range triggers {
-		contactIDs[i] = models.ContactID(triggers[i].Contact().ID())
-	}
-
-	// interrupt all our contacts if desired
-	if interrupt {
-		err = models.InterruptSessionsForContactsTx(txCTX, tx, contactIDs)
-		if err != nil {
-			tx.Rollback()
-			return nil, errors.Wrap(err, "error interrupting contacts")
-		}
-	}
-
-	// write our session to the db
-	dbSessions, err := models.InsertSessions(txCTX, rt, tx, oa, sessions, sprints, contacts, hook)
+	// write our sessions to the db, retrying the whole batch if we hit a deadlock
+	commitStart := time.Now()
+	dbSessions, err := models.WriteSessions(txCTX, rt, oa, sessions, sprints, contacts, interrupt, hook)
 	if err == nil {
-		// commit it at once
-		commitStart := time.Now()
-		err = tx.Commit()
-
-		if err == nil {
-			logrus.WithField("elapsed", time.Since(commitStart)).WithField("count", len(sessions)).Debug("sessions committed")
-		}
+		logrus.WithField("elapsed", time.Since(commitStart)).WithField("count", len(sessions)).Debug("sessions committed")
 	}
 
 	// retry committing our sessions one at a time
 	if err != nil {
 		logrus.WithError(err).Debug("failed committing bulk transaction, retrying one at a time")
 
-		tx.Rollback()
-
 		// we failed writing our sessions in one go, try one at a time
 		for i := range sessions {
 			session := sessions[i]
@@ -627,7 +673,7 @@ func StartFlowForContacts(
 
 			// interrupt this contact if appropriate
 			if interrupt {
-				err = models.InterruptSessionsForContactsTx(txCTX, tx, []models.ContactID{models.ContactID(session.Contact().ID())})
+				err = models.InterruptSessionsForContactsTx(txCTX, rt, tx, []models.ContactID{models.ContactID(session.Contact().ID())})
 				if err != nil {
 					tx.Rollback()
 					log.WithField("contact_uuid", session.Contact().UUID()).WithError(err).Errorf("error interrupting contact")
@@ -657,7 +703,7 @@ func StartFlowForContacts(
 	txCTX, cancel = context.WithTimeout(ctx, postCommitTimeout*time.Duration(len(sessions)))
 	defer cancel()
 
-	tx, err = rt.DB.BeginTxx(txCTX, nil)
+	tx, err := rt.DB.BeginTxx(txCTX, nil)
 	if err != nil {
 		return nil, errors.Wrapf(err, "error starting transaction for post commit hooks")
 	}
@@ -10,6 +10,7 @@ import (
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
 	"github.com/nyaruka/gocommon/dbutil/assertdb"
+	"github.com/nyaruka/gocommon/httpx"
 	"github.com/nyaruka/gocommon/uuids"
 	"github.com/nyaruka/goflow/envs"
 	"github.com/nyaruka/goflow/flows"
@@ -321,6 +322,56 @@ func TestResume(t *testing.T) {
 	}
 }
 
+func TestResumeVoiceSession(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	testFlows := testdata.ImportFlows(db, testdata.Org1, "testdata/dial_flow.json")
+	db.MustExec(`UPDATE flows_flow SET flow_type = 'V' WHERE id = $1`, testFlows[0].ID)
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshFlows)
+	require.NoError(t, err)
+
+	flow, err := oa.FlowByID(testFlows[0].ID)
+	require.NoError(t, err)
+
+	channel := oa.ChannelByID(testdata.TwilioChannel.ID)
+	modelContact, flowContact := testdata.Cathy.Load(db, oa)
+
+	trigger := triggers.NewBuilder(oa.Env(), flow.Reference(), flowContact).Manual().WithCall(channel.ChannelReference(), testdata.Cathy.URN).Build()
+	sessions, err := runner.StartFlowForContacts(ctx, rt, oa, flow, []*models.Contact{modelContact}, []flows.Trigger{trigger}, nil, true)
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+
+	session := sessions[0]
+	assert.Equal(t, models.FlowTypeVoice, session.SessionType())
+	assert.Equal(t, models.SessionStatusWaiting, session.Status())
+
+	tcs := []struct {
+		resume        flows.Resume
+		sessionStatus models.SessionStatus
+		runStatus     models.RunStatus
+		result        string
+	}{
+		{test.NewDialResume(oa.Env(), flowContact, flows.DialStatusAnswered, 15), models.SessionStatusWaiting, models.RunStatusWaiting, "forward"},
+		{test.NewDigitsResume(oa.Env(), flowContact, testdata.Cathy.URN, "1"), models.SessionStatusCompleted, models.RunStatusCompleted, "pressed"},
+	}
+
+	for i, tc := range tcs {
+		session, err = runner.ResumeFlow(ctx, rt, oa, session, modelContact, tc.resume, nil)
+		require.NoError(t, err, "%d: error resuming", i)
+		require.NotNil(t, session)
+
+		assert.Equal(t, tc.sessionStatus, session.Status(), "%d: session status mismatch", i)
+
+		assertdb.Query(t, db, `SELECT count(*) FROM flows_flowsession WHERE contact_id = $1 AND session_type = 'V' AND status = $2`, modelContact.ID(), tc.sessionStatus).
+			Returns(1, "%d: didn't find expected session", i)
+		assertdb.Query(t, db, `SELECT count(*) FROM flows_flowrun WHERE contact_id = $1 AND flow_id = $2 AND status = $3 AND results::jsonb ? $4`, modelContact.ID(), flow.ID(), tc.runStatus, tc.result).
+			Returns(1, "%d: didn't find expected run", i)
+	}
+}
+
 func TestStartFlowConcurrency(t *testing.T) {
 	ctx, rt, db, _ := testsuite.Get()
 
@@ -366,3 +417,84 @@ func TestStartFlowConcurrency(t *testing.T) {
 	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowrun`).Returns(len(contacts))
 	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowsession`).Returns(len(contacts))
 }
+
+func TestRetryFailedSessions(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+	defer httpx.SetRequestor(httpx.DefaultRequestor)
+
+	testFlows := testdata.ImportFlows(db, testdata.Org1, "testdata/webhook_after_wait.json")
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshFlows)
+	require.NoError(t, err)
+
+	flow, err := oa.FlowByID(testFlows[0].ID)
+	require.NoError(t, err)
+
+	startSession := func(contact *testdata.Contact) models.SessionID {
+		mc, fc := contact.Load(db, oa)
+
+		trigger := triggers.NewBuilder(oa.Env(), flow.Reference(), fc).Manual().Build()
+		sessions, err := runner.StartFlowForContacts(ctx, rt, oa, flow, []*models.Contact{mc}, []flows.Trigger{trigger}, nil, true)
+		require.NoError(t, err)
+
+		return sessions[0].ID()
+	}
+
+	assertStatus := func(sessionID models.SessionID, status models.SessionStatus) {
+		assertdb.Query(t, db, `SELECT status FROM flows_flowsession WHERE id = $1`, sessionID).Returns(string(status))
+		assertdb.Query(t, db, `SELECT DISTINCT status FROM flows_flowrun WHERE session_id = $1`, sessionID).Returns(string(status))
+	}
+
+	// Bob replies with his order number but his session is failed because the webhook it calls is down
+	bobSessionID := startSession(testdata.Bob)
+	bobMsg := testdata.InsertIncomingMsg(db, testdata.Org1, testdata.TwilioChannel, testdata.Bob, "12345", models.MsgStatusPending)
+
+	err = models.FailSession(ctx, db, bobSessionID)
+	require.NoError(t, err)
+
+	assertStatus(bobSessionID, models.SessionStatusFailed)
+
+	// Alexandria's session is failed whilst she's still at the wait
+	alexSessionID := startSession(testdata.Alexandria)
+
+	err = models.FailSession(ctx, db, alexSessionID)
+	require.NoError(t, err)
+
+	// Cathy has a session failed by the engine whose output says as much, and George has a session that's still waiting
+	cathySessionID := testdata.InsertFlowSession(db, testdata.Org1, testdata.Cathy, models.FlowTypeMessaging, models.SessionStatusFailed, testdata.Favorites, models.NilCallID)
+	db.MustExec(`UPDATE flows_flowsession SET output = '{"status": "failed"}' WHERE id = $1`, cathySessionID)
+	georgeSessionID := testdata.InsertFlowSession(db, testdata.Org1, testdata.George, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, models.NilCallID)
+
+	// the webhook is back up
+	httpx.SetRequestor(httpx.NewMockRequestor(map[string][]*httpx.MockResponse{
+		"http://example.com/orders?number=12345": {
+			httpx.NewMockResponse(200, nil, []byte(`{"status": "shipped"}`)),
+		},
+	}))
+
+	// include a session which doesn't exist to check that it doesn't stop the others from being retried
+	err = runner.RetryFailedSessions(ctx, rt, []models.SessionID{models.SessionID(123456789), bobSessionID, alexSessionID, cathySessionID, georgeSessionID})
+	assert.EqualError(t, err, "error retrying 1 of 5 sessions")
+
+	// Bob's session was resumed from the wait with his message and this time the webhook call succeeded
+	assertStatus(bobSessionID, models.SessionStatusCompleted)
+	assertdb.Query(t, db, `SELECT results::jsonb->'order'->>'category' FROM flows_flowrun WHERE session_id = $1`, bobSessionID).Returns("Success")
+	assertdb.Query(t, db, `SELECT status, msg_type, flow_id FROM msgs_msg WHERE id = $1`, bobMsg.ID()).
+		Columns(map[string]interface{}{"status": "H", "msg_type": "F", "flow_id": int64(flow.ID())})
+	assertdb.Query(t, db, `SELECT count(*) FROM msgs_msg WHERE contact_id = $1 AND direction = 'O' AND text = 'Your order is on its way'`, testdata.Bob.ID).Returns(1)
+	assertdb.Query(t, db, `SELECT current_flow_id FROM contacts_contact WHERE id = $1`, testdata.Bob.ID).Returns(nil)
+
+	// Alexandria's session is back to waiting at the wait it failed at
+	assertStatus(alexSessionID, models.SessionStatusWaiting)
+	assertdb.Query(t, db, `SELECT current_flow_id, ended_on, wait_resume_on_expire FROM flows_flowsession WHERE id = $1`, alexSessionID).
+		Columns(map[string]interface{}{"current_flow_id": int64(flow.ID()), "ended_on": nil, "wait_resume_on_expire": false})
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowsession WHERE id = $1 AND wait_started_on IS NOT NULL AND wait_expires_on > NOW()`, alexSessionID).Returns(1)
+	assertdb.Query(t, db, `SELECT exited_on FROM flows_flowrun WHERE session_id = $1`, alexSessionID).Returns(nil)
+	assertdb.Query(t, db, `SELECT current_flow_id FROM contacts_contact WHERE id = $1`, testdata.Alexandria.ID).Returns(int64(flow.ID()))
+
+	// other sessions are left alone
+	assertdb.Query(t, db, `SELECT status FROM flows_flowsession WHERE id = $1`, cathySessionID).Returns("F")
+	assertdb.Query(t, db, `SELECT status FROM flows_flowsession WHERE id = $1`, georgeSessionID).Returns("W")
+}
@@ -2,9 +2,11 @@ package search
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/nyaruka/goflow/assets"
@@ -30,6 +32,73 @@ func (m *AssetMapper) Group(g assets.Group) int64 {
 
 var assetMapper = &AssetMapper{}
 
+// QueryError is returned when a search fails because of a problem with the query itself rather than an internal
+// failure. Its cause is the underlying contactql error so it can still be rendered as a rich error.
+type QueryError struct {
+	msg string
+	err *contactql.QueryError
+}
+
+// returns a *QueryError if the passed in error was caused by the query, otherwise the wrapped original error
+func newQueryError(err error, format string, args ...interface{}) error {
+	if isQueryError, qerr := contactql.IsQueryError(err); isQueryError {
+		return &QueryError{msg: fmt.Sprintf(format, args...), err: qerr.(*contactql.QueryError)}
+	}
+	return errors.Wrapf(err, format, args...)
+}
+
+func (e *QueryError) Error() string { return e.msg + ": " + e.err.Error() }
+func (e *QueryError) Cause() error  { return e.err }
+
+// QueryCostError is returned when a query is estimated to be too expensive to run
+type QueryCostError struct {
+	Cost    int
+	MaxCost int
+}
+
+func (e *QueryCostError) Error() string {
+	return fmt.Sprintf("query is too expensive to run (cost %d exceeds maximum of %d)", e.Cost, e.MaxCost)
+}
+
+func (e *QueryCostError) Code() string { return "query_too_expensive" }
+
+func (e *QueryCostError) Extra() map[string]string {
+	return map[string]string{"cost": fmt.Sprint(e.Cost), "max_cost": fmt.Sprint(e.MaxCost)}
+}
+
+// relative costs of the different kinds of condition in a query
+const (
+	conditionCost      = 1  // simple term condition on an attribute or URN scheme
+	fieldConditionCost = 2  // condition on a field which requires a nested query
+	containsCost       = 10 // contains condition which requires a match against ngram tokens
+)
+
+// EstimateQueryCost estimates how expensive the given query will be for elastic to execute. This is a heuristic where
+// each condition adds to the cost, with contains and field conditions costing more than simple term conditions.
+func EstimateQueryCost(query *contactql.ContactQuery) int {
+	return estimateNodeCost(query.Root())
+}
+
+func estimateNodeCost(node contactql.QueryNode) int {
+	switch n := node.(type) {
+	case *contactql.BoolCombination:
+		cost := 0
+		for _, child := range n.Children() {
+			cost += estimateNodeCost(child)
+		}
+		return cost
+	case *contactql.Condition:
+		if n.Operator() == contactql.OpContains {
+			return containsCost
+		}
+		if n.PropertyType() == contactql.PropertyTypeField {
+			return fieldConditionCost
+		}
+		return conditionCost
+	}
+	return 0
+}
+
 // BuildElasticQuery turns the passed in contact ql query into an elastic query
 func BuildElasticQuery(oa *models.OrgAssets, group *models.Group, status models.ContactStatus, excludeIDs []models.ContactID, query *contactql.ContactQuery) elastic.Query {
 	// filter by org and active contacts
@@ -59,61 +128,210 @@ func BuildElasticQuery(oa *models.OrgAssets, group *models.Group, status models.
 
 	// and by our query if present
 	if query != nil {
-		q := es.ToElasticQuery(oa.Env(), assetMapper, query)
+		q := toElasticGroupsQuery(query)
+		if q == nil {
+			q = es.ToElasticQuery(oa.Env(), assetMapper, query)
+		}
 		eq = eq.Must(q)
 	}
 
 	return eq
 }
 
-// GetContactIDsForQueryPage returns a page of contact ids for the given query and sort
+// if the query is only a disjunction of group equalities, e.g. group = "A" OR group = "B", returns a single terms
+// query over the group ids rather than the separate term queries that the generic translation would produce
+func toElasticGroupsQuery(query *contactql.ContactQuery) elastic.Query {
+	combo, isCombo := query.Root().(*contactql.BoolCombination)
+	if !isCombo || combo.Operator() != contactql.BoolOperatorOr {
+		return nil
+	}
+
+	groupIDs := make([]interface{}, 0, len(combo.Children()))
+	for _, child := range combo.Children() {
+		cond, isCond := child.(*contactql.Condition)
+		if !isCond || cond.PropertyType() != contactql.PropertyTypeAttribute || cond.PropertyKey() != contactql.AttributeGroup || cond.Operator() != contactql.OpEqual {
+			return nil
+		}
+
+		group := query.Resolver().ResolveGroup(cond.Value())
+		if group == nil {
+			return nil
+		}
+		groupIDs = append(groupIDs, assetMapper.Group(group))
+	}
+
+	return elastic.NewTermsQuery("group_ids", groupIDs...)
+}
+
+// BuildElasticSource is like BuildElasticQuery but returns the source of the query, i.e. the JSON that would be sent
+// to elastic. This doesn't require a connection to elastic and is what we return when parsing queries.
+func BuildElasticSource(oa *models.OrgAssets, group *models.Group, status models.ContactStatus, excludeIDs []models.ContactID, query *contactql.ContactQuery) (interface{}, error) {
+	source, err := BuildElasticQuery(oa, group, status, excludeIDs, query).Source()
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting elastic source")
+	}
+	return source, nil
+}
+
+// GetContactIDsForQueryPage returns a page of contact ids for the given query and sort. If the query or sort are invalid
+// the returned error will be a *QueryError.
 func GetContactIDsForQueryPage(ctx context.Context, client *elastic.Client, oa *models.OrgAssets, group *models.Group, excludeIDs []models.ContactID, query string, sort string, offset int, pageSize int) (*contactql.ContactQuery, []models.ContactID, int64, error) {
-	env := oa.Env()
 	start := time.Now()
+
+	parsed, results, err := searchPage(ctx, client, oa, group, excludeIDs, query, sort, offset, pageSize, elastic.NewFetchSourceContext(false))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	ids := make([]models.ContactID, 0, pageSize)
+	ids, err = appendIDsFromHits(ids, results.Hits.Hits)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	logrus.WithFields(logrus.Fields{"org_id": oa.OrgID(), "query": query, "elapsed": time.Since(start), "page_count": len(ids), "total_count": results.Hits.TotalHits.Value}).Debug("paged contact query complete")
+
+	return parsed, ids, results.Hits.TotalHits.Value, nil
+}
+
+// ContactSummary is a contact's id, name and selected field values as read from the index
+type ContactSummary struct {
+	ID     models.ContactID  `json:"id"`
+	Name   string            `json:"name"`
+	Fields map[string]string `json:"fields"`
+}
+
+// GetContactSummariesForQueryPage is like GetContactIDsForQueryPage but returns summaries of the matching contacts which
+// include the values of the given fields, read from the index rather than the database.
+func GetContactSummariesForQueryPage(ctx context.Context, client *elastic.Client, oa *models.OrgAssets, group *models.Group, excludeIDs []models.ContactID, query string, sort string, offset int, pageSize int, fields []*models.Field) (*contactql.ContactQuery, []*ContactSummary, int64, error) {
+	start := time.Now()
+
+	source := elastic.NewFetchSourceContext(true).Include("name", "fields")
+
+	parsed, results, err := searchPage(ctx, client, oa, group, excludeIDs, query, sort, offset, pageSize, source)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	ids := make([]models.ContactID, 0, pageSize)
+	ids, err = appendIDsFromHits(ids, results.Hits.Hits)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	keysByUUID := make(map[assets.FieldUUID]string, len(fields))
+	for _, f := range fields {
+		keysByUUID[f.UUID()] = f.Key()
+	}
+
+	summaries := make([]*ContactSummary, len(ids))
+	for i, hit := range results.Hits.Hits {
+		doc := &struct {
+			Name   string `json:"name"`
+			Fields []struct {
+				Field assets.FieldUUID `json:"field"`
+				Text  string           `json:"text"`
+			} `json:"fields"`
+		}{}
+
+		if hit.Source != nil {
+			if err := json.Unmarshal(hit.Source, doc); err != nil {
+				return nil, nil, 0, errors.Wrapf(err, "error unmarshaling source of contact #%s", hit.Id)
+			}
+		}
+
+		summary := &ContactSummary{ID: ids[i], Name: doc.Name, Fields: make(map[string]string, len(fields))}
+		for _, f := range doc.Fields {
+			if key, requested := keysByUUID[f.Field]; requested {
+				summary.Fields[key] = f.Text
+			}
+		}
+		summaries[i] = summary
+	}
+
+	logrus.WithFields(logrus.Fields{"org_id": oa.OrgID(), "query": query, "elapsed": time.Since(start), "page_count": len(summaries), "total_count": results.Hits.TotalHits.Value}).Debug("paged contact summary query complete")
+
+	return parsed, summaries, results.Hits.TotalHits.Value, nil
+}
+
+// performs a paged search, returning the parsed query and the raw results
+func searchPage(ctx context.Context, client *elastic.Client, oa *models.OrgAssets, group *models.Group, excludeIDs []models.ContactID, query string, sort string, offset int, pageSize int, source *elastic.FetchSourceContext) (*contactql.ContactQuery, *elastic.SearchResult, error) {
+	env := oa.Env()
 	var parsed *contactql.ContactQuery
 	var err error
 
 	if client == nil {
-		return nil, nil, 0, errors.Errorf("no elastic client available, check your configuration")
+		return nil, nil, errors.Errorf("no elastic client available, check your configuration")
 	}
 
 	if query != "" {
 		parsed, err = contactql.ParseQuery(env, query, oa.SessionAssets())
 		if err != nil {
-			return nil, nil, 0, errors.Wrapf(err, "error parsing query: %s", query)
+			return nil, nil, newQueryError(err, "error parsing query: %s", query)
 		}
 	}
 
 	eq := BuildElasticQuery(oa, group, models.NilContactStatus, excludeIDs, parsed)
 
-	fieldSort, err := es.ToElasticFieldSort(sort, oa.SessionAssets())
+	fieldSort, err := toElasticFieldSort(sort, oa)
 	if err != nil {
-		return nil, nil, 0, errors.Wrapf(err, "error parsing sort")
+		return nil, nil, newQueryError(err, "error parsing sort")
 	}
 
 	s := client.Search("contacts").TrackTotalHits(true).Routing(strconv.FormatInt(int64(oa.OrgID()), 10))
-	s = s.Size(pageSize).From(offset).Query(eq).SortBy(fieldSort).FetchSource(false)
+	s = s.Size(pageSize).From(offset).Query(eq).SortBy(fieldSort).FetchSourceContext(source)
 
 	results, err := s.Do(ctx)
 	if err != nil {
 		// Get *elastic.Error which contains additional information
 		ee, ok := err.(*elastic.Error)
 		if !ok {
-			return nil, nil, 0, errors.Wrapf(err, "error performing query")
+			return nil, nil, errors.Wrapf(err, "error performing query")
 		}
 
-		return nil, nil, 0, errors.Wrapf(err, "error performing query: %s", ee.Details.Reason)
+		return nil, nil, errors.Wrapf(err, "error performing query: %s", ee.Details.Reason)
 	}
 
-	ids := make([]models.ContactID, 0, pageSize)
-	ids, err = appendIDsFromHits(ids, results.Hits.Hits)
-	if err != nil {
-		return nil, nil, 0, err
+	return parsed, results, nil
+}
+
+// attributes which are sorted on directly by their indexed value, so that clients can ask for creation order
+// explicitly rather than relying on id order which can diverge from it
+var attributeSorts = map[string]string{
+	"id":         "id",
+	"created_on": "created_on",
+}
+
+// converts a sort like -age or -fields.age to an elastic sort, with fields resolved by key to nested sorts on the
+// value for that field's type
+func toElasticFieldSort(sort string, oa *models.OrgAssets) (*elastic.FieldSort, error) {
+	prefix, property := "", sort
+	if strings.HasPrefix(property, "-") {
+		prefix, property = "-", property[1:]
 	}
 
-	logrus.WithFields(logrus.Fields{"org_id": oa.OrgID(), "query": query, "elapsed": time.Since(start), "page_count": len(ids), "total_count": results.Hits.TotalHits.Value}).Debug("paged contact query complete")
+	if esField, isAttribute := attributeSorts[property]; isAttribute {
+		return elastic.NewFieldSort(esField).Order(prefix == ""), nil
+	}
 
-	return parsed, ids, results.Hits.TotalHits.Value, nil
+	if strings.HasPrefix(property, "fields.") {
+		key := strings.TrimPrefix(property, "fields.")
+		if oa.FieldByKey(key) == nil {
+			return nil, contactql.NewQueryError(contactql.ErrUnknownProperty, "no such contact field with key: %s", key)
+		}
+		property = key
+	}
+
+	// anything else that isn't an attribute the engine knows how to sort by must be a field
+	switch strings.ToLower(property) {
+	case "", contactql.AttributeName, contactql.AttributeID, contactql.AttributeCreatedOn, contactql.AttributeLastSeenOn, contactql.AttributeLanguage:
+	default:
+		if oa.FieldByKey(strings.ToLower(property)) == nil {
+			return nil, contactql.NewQueryError(contactql.ErrUnknownProperty, "no such contact field with key: %s", property)
+		}
+	}
+
+	return es.ToElasticFieldSort(prefix+property, oa.SessionAssets())
 }
 
 // GetContactIDsForQuery returns up to limit the contact ids that match the given query without sorting. Limit of -1 means return all.
@@ -128,7 +346,7 @@ func GetContactIDsForQuery(ctx context.Context, client *elastic.Client, oa *mode
 	// turn into elastic query
 	parsed, err := contactql.ParseQuery(env, query, oa.SessionAssets())
 	if err != nil {
-		return nil, errors.Wrapf(err, "error parsing query: %s", query)
+		return nil, newQueryError(err, "error parsing query: %s", query)
 	}
 
 	routing := strconv.FormatInt(int64(oa.OrgID()), 10)
@@ -170,6 +388,47 @@ func GetContactIDsForQuery(ctx context.Context, client *elastic.Client, oa *mode
 	}
 }
 
+// ScrollContactIDsForQuery scrolls through the IDs of active contacts matching the given query, calling fn with each
+// page of at most pageSize IDs. The query is parsed before anything is fetched so a query error is always returned
+// before fn is first called. If fn returns an error, scrolling stops and that error is returned.
+func ScrollContactIDsForQuery(ctx context.Context, client *elastic.Client, oa *models.OrgAssets, query string, pageSize int, fn func([]models.ContactID) error) error {
+	if client == nil {
+		return errors.Errorf("no elastic client available, check your configuration")
+	}
+
+	parsed, err := contactql.ParseQuery(oa.Env(), query, oa.SessionAssets())
+	if err != nil {
+		return newQueryError(err, "error parsing query: %s", query)
+	}
+
+	routing := strconv.FormatInt(int64(oa.OrgID()), 10)
+	eq := BuildElasticQuery(oa, nil, models.ContactStatusActive, nil, parsed)
+
+	scroll := client.Scroll("contacts").Routing(routing).KeepAlive("15m").Size(pageSize).Query(eq).FetchSource(false)
+
+	// always clear our scroll context, even if we're stopping early, rather than leaving it to expire, and use a new
+	// context as ours may have been cancelled
+	defer scroll.Clear(context.Background())
+
+	for {
+		results, err := scroll.Do(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "error scrolling through results for search: %s", query)
+		}
+
+		ids, err := appendIDsFromHits(make([]models.ContactID, 0, len(results.Hits.Hits)), results.Hits.Hits)
+		if err != nil {
+			return err
+		}
+		if err := fn(ids); err != nil {
+			return err
+		}
+	}
+}
+
 // utility to convert search hits to contact IDs and append them to the given slice
 func appendIDsFromHits(ids []models.ContactID, hits []*elastic.SearchHit) ([]models.ContactID, error) {
 	for _, hit := range hits {
@@ -1,8 +1,14 @@
 package search_test
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
 
+	"github.com/nyaruka/gocommon/jsonx"
+	"github.com/nyaruka/goflow/contactql"
 	"github.com/nyaruka/goflow/test"
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/core/search"
@@ -13,12 +19,167 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+func TestBuildElasticSource(t *testing.T) {
+	ctx, rt, _, _ := testsuite.Get()
+
+	oa, err := models.GetOrgAssets(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	orgAndActive := `{"term": {"org_id": 1}}, {"term": {"is_active": true}}`
+
+	tcs := []struct {
+		group      *testdata.Group
+		status     models.ContactStatus
+		excludeIDs []models.ContactID
+		query      string
+		expected   string
+	}{
+		{
+			expected: `{"bool": {"must": [` + orgAndActive + `]}}`,
+		},
+		{
+			group:      testdata.ActiveGroup,
+			status:     models.ContactStatusActive,
+			excludeIDs: []models.ContactID{testdata.Bob.ID},
+			expected: `{"bool": {
+				"must": [` + orgAndActive + `, {"term": {"group_ids": 1}}, {"term": {"status": "A"}}],
+				"must_not": {"ids": {"type": "_doc", "values": ["10001"]}}
+			}}`,
+		},
+		{
+			query: "age > 32",
+			expected: `{"bool": {"must": [` + orgAndActive + `, {
+				"nested": {
+					"path": "fields",
+					"query": {"bool": {"must": [
+						{"term": {"fields.field": "903f51da-2717-47c7-a0d3-f2f32877013d"}},
+						{"range": {"fields.number": {"from": 32, "include_lower": false, "include_upper": true, "to": null}}}
+					]}}
+				}
+			}]}}`,
+		},
+		{
+			query: "gender = M",
+			expected: `{"bool": {"must": [` + orgAndActive + `, {
+				"nested": {
+					"path": "fields",
+					"query": {"bool": {"must": [
+						{"term": {"fields.field": "3a5891e4-756e-4dc9-8e12-b7a766168824"}},
+						{"term": {"fields.text": "m"}}
+					]}}
+				}
+			}]}}`,
+		},
+		{
+			query:    `group = "Testers"`,
+			expected: `{"bool": {"must": [` + orgAndActive + `, {"term": {"group_ids": 10001}}]}}`,
+		},
+		{
+			query:    `group = "Doctors" OR group = "Testers"`,
+			expected: `{"bool": {"must": [` + orgAndActive + `, {"terms": {"group_ids": [10000, 10001]}}]}}`,
+		},
+		{
+			query: `group = "Doctors" OR age > 32`,
+			expected: `{"bool": {"must": [` + orgAndActive + `, {"bool": {"should": [
+				{"term": {"group_ids": 10000}},
+				{
+					"nested": {
+						"path": "fields",
+						"query": {"bool": {"must": [
+							{"term": {"fields.field": "903f51da-2717-47c7-a0d3-f2f32877013d"}},
+							{"range": {"fields.number": {"from": 32, "include_lower": false, "include_upper": true, "to": null}}}
+						]}}
+					}
+				}
+			]}}]}}`,
+		},
+		{
+			query:    `history = "Favorites"`,
+			expected: `{"bool": {"must": [` + orgAndActive + `, {"term": {"flow_history_ids": 10000}}]}}`,
+		},
+		{
+			query:    `history != "Favorites"`,
+			expected: `{"bool": {"must": [` + orgAndActive + `, {"bool": {"must_not": {"term": {"flow_history_ids": 10000}}}}]}}`,
+		},
+		{
+			query: "tel = +16055741111",
+			expected: `{"bool": {"must": [` + orgAndActive + `, {
+				"nested": {
+					"path": "urns",
+					"query": {"bool": {"must": [
+						{"term": {"urns.path.keyword": "+16055741111"}},
+						{"term": {"urns.scheme": "tel"}}
+					]}}
+				}
+			}]}}`,
+		},
+	}
+
+	for _, tc := range tcs {
+		var group *models.Group
+		if tc.group != nil {
+			group = oa.GroupByID(tc.group.ID)
+		}
+
+		var parsed *contactql.ContactQuery
+		if tc.query != "" {
+			parsed, err = contactql.ParseQuery(oa.Env(), tc.query, oa.SessionAssets())
+			require.NoError(t, err, "error parsing query '%s'", tc.query)
+		}
+
+		source, err := search.BuildElasticSource(oa, group, tc.status, tc.excludeIDs, parsed)
+		assert.NoError(t, err)
+		test.AssertEqualJSON(t, []byte(tc.expected), jsonx.MustMarshal(source), "elastic source mismatch for query '%s'", tc.query)
+	}
+}
+
+func TestEstimateQueryCost(t *testing.T) {
+	ctx, rt, _, _ := testsuite.Get()
+
+	oa, err := models.GetOrgAssets(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	tcs := []struct {
+		query string
+		cost  int
+	}{
+		{`uuid = "c7a2dd87-a80e-420b-8431-ca48d422e924"`, 1},
+		{`tel = +12065551212`, 1},
+		{`age > 10`, 2},
+		{`name ~ "bob"`, 10},
+		{`name = "Bob" OR name = "Jim" OR name = "Ann"`, 3},
+		{`age > 10 AND (name ~ "bob" OR tel ~ 2065)`, 22},
+	}
+
+	for _, tc := range tcs {
+		parsed, err := contactql.ParseQuery(oa.Env(), tc.query, oa.SessionAssets())
+		require.NoError(t, err, "error parsing query: %s", tc.query)
+
+		assert.Equal(t, tc.cost, search.EstimateQueryCost(parsed), "cost mismatch for query: %s", tc.query)
+	}
+
+	// a large OR list costs more than a handful of wildcards
+	names := make([]string, 100)
+	for i := range names {
+		names[i] = fmt.Sprintf(`name = "Contact %d"`, i)
+	}
+	orList, err := contactql.ParseQuery(oa.Env(), strings.Join(names, " OR "), oa.SessionAssets())
+	require.NoError(t, err)
+
+	wildcards, err := contactql.ParseQuery(oa.Env(), `name ~ "bob" OR name ~ "jim"`, oa.SessionAssets())
+	require.NoError(t, err)
+
+	assert.Greater(t, search.EstimateQueryCost(orList), search.EstimateQueryCost(wildcards))
+}
+
 func TestGetContactIDsForQueryPage(t *testing.T) {
 	ctx, rt, _, _ := testsuite.Get()
 
 	mockES := testsuite.NewMockElasticServer()
 	defer mockES.Close()
 
+	mockES.AddResponse(testdata.George.ID)
+	mockES.AddResponse(testdata.George.ID)
 	mockES.AddResponse(testdata.George.ID)
 	mockES.AddResponse(testdata.George.ID)
 
@@ -169,11 +330,117 @@ func TestGetContactIDsForQueryPage(t *testing.T) {
 			ExpectedContacts: []models.ContactID{testdata.George.ID},
 			ExpectedTotal:    1,
 		},
+		{
+			Group: testdata.ActiveGroup,
+			Sort:  "fields.joined", // fields can also be referenced with a prefix
+			ExpectedESRequest: `{
+				"_source": false,
+				"from": 0,
+				"query": {
+					"bool": {
+						"must": [
+							{
+								"term": {
+									"org_id": 1
+								}
+							},
+							{
+								"term": {
+									"is_active": true
+								}
+							},
+							{
+								"term": {
+									"group_ids": 1
+								}
+							}
+						]
+					}
+				},
+				"size": 50,
+				"sort": [
+					{
+						"fields.datetime": {
+							"nested": {
+								"filter": {
+									"term": {
+										"fields.field": "d83aae24-4bbf-49d0-ab85-6bfd201eac6d"
+									}
+								},
+								"path": "fields"
+							},
+							"order": "asc"
+						}
+					}
+				],
+				"track_total_hits": true
+			}`,
+			ExpectedContacts: []models.ContactID{testdata.George.ID},
+			ExpectedTotal:    1,
+		},
+		{
+			Group: testdata.ActiveGroup,
+			Sort:  "-fields.age",
+			ExpectedESRequest: `{
+				"_source": false,
+				"from": 0,
+				"query": {
+					"bool": {
+						"must": [
+							{
+								"term": {
+									"org_id": 1
+								}
+							},
+							{
+								"term": {
+									"is_active": true
+								}
+							},
+							{
+								"term": {
+									"group_ids": 1
+								}
+							}
+						]
+					}
+				},
+				"size": 50,
+				"sort": [
+					{
+						"fields.number": {
+							"nested": {
+								"filter": {
+									"term": {
+										"fields.field": "903f51da-2717-47c7-a0d3-f2f32877013d"
+									}
+								},
+								"path": "fields"
+							},
+							"order": "desc"
+						}
+					}
+				],
+				"track_total_hits": true
+			}`,
+			ExpectedContacts: []models.ContactID{testdata.George.ID},
+			ExpectedTotal:    1,
+		},
 		{
 			Group:         testdata.ActiveGroup,
 			Query:         "goats > 2", // no such contact field
 			ExpectedError: "error parsing query: goats > 2: can't resolve 'goats' to attribute, scheme or field",
 		},
+		{
+			Group:         testdata.ActiveGroup,
+			Sort:          "-fields.goats", // no such contact field
+			ExpectedError: "error parsing sort: no such contact field with key: goats",
+		},
+		{
+			Group:         testdata.ActiveGroup,
+			Sort:          "goats", // no such contact field or attribute
+			ExpectedError: "error parsing sort: no such contact field with key: goats",
+		},
 	}
 
 	for i, tc := range tcs {
@@ -183,6 +450,7 @@ func TestGetContactIDsForQueryPage(t *testing.T) {
 
 		if tc.ExpectedError != "" {
 			assert.EqualError(t, err, tc.ExpectedError)
+			assert.IsType(t, &search.QueryError{}, err, "%d: expected query error", i)
 		} else {
 			assert.NoError(t, err, "%d: error encountered performing query", i)
 			assert.Equal(t, tc.ExpectedContacts, ids, "%d: ids mismatch", i)
@@ -191,6 +459,52 @@ func TestGetContactIDsForQueryPage(t *testing.T) {
 			test.AssertEqualJSON(t, []byte(tc.ExpectedESRequest), []byte(mockES.LastRequestBody), "%d: ES request mismatch", i)
 		}
 	}
+
+	// an elastic failure is not a query error
+	mockES.Close()
+
+	_, _, _, err = search.GetContactIDsForQueryPage(ctx, es, oa, nil, nil, "george", "", 0, 50)
+	assert.Error(t, err)
+
+	_, isQueryError := err.(*search.QueryError)
+	assert.False(t, isQueryError)
+}
+
+func TestGetContactIDsForQueryPageSort(t *testing.T) {
+	ctx, rt, _, _ := testsuite.Get()
+
+	mockES := testsuite.NewMockElasticServer()
+	defer mockES.Close()
+
+	es := mockES.Client()
+
+	oa, err := models.GetOrgAssets(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	tcs := []struct {
+		sort         string
+		expectedSort string
+	}{
+		{"", `[{"id": {"order": "desc"}}]`},
+		{"id", `[{"id": {"order": "asc"}}]`},
+		{"-id", `[{"id": {"order": "desc"}}]`},
+		{"created_on", `[{"created_on": {"order": "asc"}}]`},
+		{"-created_on", `[{"created_on": {"order": "desc"}}]`},
+	}
+
+	for _, tc := range tcs {
+		mockES.AddResponse(testdata.George.ID)
+
+		_, _, _, err := search.GetContactIDsForQueryPage(ctx, es, oa, nil, nil, "george", tc.sort, 0, 50)
+		require.NoError(t, err, "error searching with sort '%s'", tc.sort)
+
+		request := &struct {
+			Sort json.RawMessage `json:"sort"`
+		}{}
+		jsonx.MustUnmarshal([]byte(mockES.LastRequestBody), request)
+
+		test.AssertEqualJSON(t, []byte(tc.expectedSort), request.Sort, "sort mismatch for '%s'", tc.sort)
+	}
 }
 
 func TestGetContactIDsForQuery(t *testing.T) {
@@ -353,3 +667,46 @@ func TestGetContactIDsForQuery(t *testing.T) {
 		}
 	}
 }
+
+func TestScrollContactIDsForQuery(t *testing.T) {
+	ctx, rt, _, _ := testsuite.Get()
+
+	mockES := testsuite.NewMockElasticServer()
+	defer mockES.Close()
+
+	oa, err := models.GetOrgAssets(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	// all pages are passed to our callback and the scroll is cleared once we're done
+	mockES.AddResponse(testdata.Cathy.ID, testdata.George.ID)
+
+	pages := make([][]models.ContactID, 0)
+	err = search.ScrollContactIDsForQuery(ctx, mockES.Client(), oa, "george", 2, func(ids []models.ContactID) error {
+		pages = append(pages, ids)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]models.ContactID{{testdata.Cathy.ID, testdata.George.ID}}, pages)
+	assert.Equal(t, "DELETE", mockES.LastRequestMethod)
+	assert.Equal(t, "/_search/scroll", mockES.LastRequestURL)
+
+	// if our callback errors, that error is returned and the scroll is still cleared
+	mockES.AddResponse(testdata.Bob.ID)
+	mockES.LastRequestMethod = ""
+
+	err = search.ScrollContactIDsForQuery(ctx, mockES.Client(), oa, "george", 2, func(ids []models.ContactID) error {
+		return errors.New("boom")
+	})
+	assert.EqualError(t, err, "boom")
+	assert.Equal(t, "DELETE", mockES.LastRequestMethod)
+	assert.Equal(t, "/_search/scroll", mockES.LastRequestURL)
+
+	// query errors are returned before anything is fetched
+	mockES.LastRequestMethod = ""
+
+	err = search.ScrollContactIDsForQuery(ctx, mockES.Client(), oa, "xyz = 123", 2, func(ids []models.ContactID) error {
+		return nil
+	})
+	assert.EqualError(t, err, "error parsing query: xyz = 123: can't resolve 'xyz' to attribute, scheme or field")
+	assert.Equal(t, "", mockES.LastRequestMethod)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/gomodule/redigo/redis"
 	"github.com/nyaruka/mailroom"
 	"github.com/nyaruka/mailroom/core/ivr"
 	"github.com/nyaruka/mailroom/core/models"
@@ -21,13 +22,19 @@ const (
 
 var expirationsMarker = redisx.NewIntervalSet("run_expirations", time.Hour*24, 2)
 
+// redis key which when set pauses all expiration processing
+const pausedKey = "expirations_paused"
+
 func init() {
 	mailroom.RegisterCron("run_expirations", time.Minute, false, HandleWaitExpirations)
 	mailroom.RegisterCron("expire_ivr_calls", time.Minute, false, ExpireVoiceSessions)
 }
 
 // HandleWaitExpirations handles waiting messaging sessions whose waits have expired, resuming those that can be resumed,
-// and expiring those that can't
+// and expiring those that can't. The session table is owned by RapidPro and has no column for an ended reason, so the
+// outcome is recorded by status: sessions which are ended are exited with their runs as expired, whereas sessions which
+// resume into a parent stay waiting until the queued task expires only the child run and continues the session. How many
+// sessions were ended vs queued to resume are recorded as the sessions_expired_ended and sessions_expired_queued counts.
 func HandleWaitExpirations(ctx context.Context, rt *runtime.Runtime) error {
 	log := logrus.WithField("comp", "expirer")
 	start := time.Now()
@@ -35,6 +42,13 @@ func HandleWaitExpirations(ctx context.Context, rt *runtime.Runtime) error {
 	rc := rt.RP.Get()
 	defer rc.Close()
 
+	if paused, err := IsPaused(rc); err != nil {
+		return err
+	} else if paused {
+		log.Info("session expirations paused, skipping")
+		return nil
+	}
+
 	// we expire sessions that can't be resumed in batches
 	expiredSessions := make([]models.SessionID, 0, expireBatchSize)
 
@@ -108,6 +122,9 @@ func HandleWaitExpirations(ctx context.Context, rt *runtime.Runtime) error {
 		}
 	}
 
+	models.RecordCount(rt, "sessions_expired_ended", numExpired)
+	models.RecordCount(rt, "sessions_expired_queued", numQueued)
+
 	log.WithField("expired", numExpired).WithField("dupes", numDupes).WithField("queued", numQueued).WithField("elapsed", time.Since(start)).Info("session expirations queued")
 	return nil
 }
@@ -132,6 +149,17 @@ func ExpireVoiceSessions(ctx context.Context, rt *runtime.Runtime) error {
 	log := logrus.WithField("comp", "ivr_cron_expirer")
 	start := time.Now()
 
+	rc := rt.RP.Get()
+	paused, err := IsPaused(rc)
+	rc.Close()
+
+	if err != nil {
+		return err
+	} else if paused {
+		log.Info("voice session expirations paused, skipping")
+		return nil
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, time.Minute*5)
 	defer cancel()
 
@@ -203,3 +231,21 @@ type ExpiredVoiceWait struct {
 	CallID    models.CallID    `db:"call_id"`
 	ExpiresOn time.Time        `db:"wait_expires_on"`
 }
+
+// Pause pauses expiration processing until Resume is called, e.g. during maintenance
+func Pause(rc redis.Conn) error {
+	_, err := rc.Do("SET", pausedKey, "1")
+	return errors.Wrap(err, "error setting expirations paused flag")
+}
+
+// Resume resumes expiration processing after a call to Pause
+func Resume(rc redis.Conn) error {
+	_, err := rc.Do("DEL", pausedKey)
+	return errors.Wrap(err, "error clearing expirations paused flag")
+}
+
+// IsPaused returns whether expiration processing is currently paused
+func IsPaused(rc redis.Conn) (bool, error) {
+	paused, err := redis.Bool(rc.Do("EXISTS", pausedKey))
+	return paused, errors.Wrap(err, "error checking expirations paused flag")
+}
@@ -4,6 +4,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/lib/pq"
 	"github.com/nyaruka/gocommon/dbutil/assertdb"
 	"github.com/nyaruka/gocommon/jsonx"
 	"github.com/nyaruka/goflow/envs"
@@ -12,6 +13,7 @@ import (
 	"github.com/nyaruka/mailroom/core/queue"
 	"github.com/nyaruka/mailroom/core/tasks/expirations"
 	"github.com/nyaruka/mailroom/core/tasks/handler"
+	"github.com/nyaruka/mailroom/runtime"
 	"github.com/nyaruka/mailroom/testsuite"
 	"github.com/nyaruka/mailroom/testsuite/testdata"
 	"github.com/stretchr/testify/assert"
@@ -103,6 +105,106 @@ func TestExpirations(t *testing.T) {
 	assert.Nil(t, task)
 }
 
+func TestExpirationMetrics(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData | testsuite.ResetRedis)
+
+	metrics := &testMetrics{counts: make(map[string][]int)}
+	rt.Metrics = metrics
+	defer func() { rt.Metrics = runtime.NoopMetrics }()
+
+	// Cathy and Bob have sessions with no parent to resume, so these will be ended
+	s1ID := testdata.InsertWaitingSession(db, testdata.Org1, testdata.Cathy, models.FlowTypeMessaging, testdata.Favorites, models.NilCallID, time.Now(), time.Now(), false, nil)
+	testdata.InsertFlowRun(db, testdata.Org1, s1ID, testdata.Cathy, testdata.Favorites, models.RunStatusWaiting)
+	s2ID := testdata.InsertWaitingSession(db, testdata.Org1, testdata.Bob, models.FlowTypeMessaging, testdata.Favorites, models.NilCallID, time.Now(), time.Now(), false, nil)
+	testdata.InsertFlowRun(db, testdata.Org1, s2ID, testdata.Bob, testdata.Favorites, models.RunStatusWaiting)
+
+	// George has a session with a parent run so it will be resumed
+	s3ID := testdata.InsertWaitingSession(db, testdata.Org1, testdata.George, models.FlowTypeMessaging, testdata.Favorites, models.NilCallID, time.Now(), time.Now(), true, nil)
+	testdata.InsertFlowRun(db, testdata.Org1, s3ID, testdata.George, testdata.Favorites, models.RunStatusActive)
+	testdata.InsertFlowRun(db, testdata.Org1, s3ID, testdata.George, testdata.Favorites, models.RunStatusWaiting)
+
+	time.Sleep(5 * time.Millisecond)
+
+	err := expirations.HandleWaitExpirations(ctx, rt)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []int{2}, metrics.counts["sessions_expired_ended"])
+	assert.Equal(t, []int{1}, metrics.counts["sessions_expired_queued"])
+
+	// sessions which were ended are recorded as expired, and the session to be resumed is still waiting
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowsession WHERE id = ANY($1) AND status = 'X' AND ended_on IS NOT NULL`, pq.Array([]models.SessionID{s1ID, s2ID})).Returns(2)
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowrun WHERE session_id = ANY($1) AND status = 'X'`, pq.Array([]models.SessionID{s1ID, s2ID})).Returns(2)
+	assertdb.Query(t, db, `SELECT status FROM flows_flowsession WHERE id = $1`, s3ID).Returns("W")
+
+	// running again is a noop as ended sessions are no longer waiting and the resume is already queued
+	err = expirations.HandleWaitExpirations(ctx, rt)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []int{2, 0}, metrics.counts["sessions_expired_ended"])
+	assert.Equal(t, []int{1, 0}, metrics.counts["sessions_expired_queued"])
+}
+
+func TestExpirationsPaused(t *testing.T) {
+	ctx, rt, db, rp := testsuite.Get()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetData | testsuite.ResetRedis)
+
+	// create expired messaging session for Cathy and expired voice session for Bob
+	s1ID := testdata.InsertWaitingSession(db, testdata.Org1, testdata.Cathy, models.FlowTypeMessaging, testdata.Favorites, models.NilCallID, time.Now(), time.Now(), false, nil)
+	testdata.InsertFlowRun(db, testdata.Org1, s1ID, testdata.Cathy, testdata.Favorites, models.RunStatusWaiting)
+	callID := testdata.InsertCall(db, testdata.Org1, testdata.TwilioChannel, testdata.Bob)
+	s2ID := testdata.InsertWaitingSession(db, testdata.Org1, testdata.Bob, models.FlowTypeVoice, testdata.IVRFlow, callID, time.Now(), time.Now(), false, nil)
+	testdata.InsertFlowRun(db, testdata.Org1, s2ID, testdata.Bob, testdata.IVRFlow, models.RunStatusWaiting)
+
+	time.Sleep(5 * time.Millisecond)
+
+	paused, err := expirations.IsPaused(rc)
+	assert.NoError(t, err)
+	assert.False(t, paused)
+
+	err = expirations.Pause(rc)
+	assert.NoError(t, err)
+
+	paused, err = expirations.IsPaused(rc)
+	assert.NoError(t, err)
+	assert.True(t, paused)
+
+	// while paused, neither cron does anything
+	assert.NoError(t, expirations.HandleWaitExpirations(ctx, rt))
+	assert.NoError(t, expirations.ExpireVoiceSessions(ctx, rt))
+
+	assertdb.Query(t, db, `SELECT status FROM flows_flowsession WHERE id = $1`, s1ID).Columns(map[string]interface{}{"status": "W"})
+	assertdb.Query(t, db, `SELECT status FROM flows_flowsession WHERE id = $1`, s2ID).Columns(map[string]interface{}{"status": "W"})
+
+	err = expirations.Resume(rc)
+	assert.NoError(t, err)
+
+	paused, err = expirations.IsPaused(rc)
+	assert.NoError(t, err)
+	assert.False(t, paused)
+
+	// once resumed, sessions are expired as normal
+	assert.NoError(t, expirations.HandleWaitExpirations(ctx, rt))
+	assert.NoError(t, expirations.ExpireVoiceSessions(ctx, rt))
+
+	assertdb.Query(t, db, `SELECT status FROM flows_flowsession WHERE id = $1`, s1ID).Columns(map[string]interface{}{"status": "X"})
+	assertdb.Query(t, db, `SELECT status FROM flows_flowsession WHERE id = $1`, s2ID).Columns(map[string]interface{}{"status": "X"})
+}
+
+type testMetrics struct {
+	counts map[string][]int
+}
+
+func (m *testMetrics) Timing(string, time.Duration) {}
+
+func (m *testMetrics) Count(name string, count int) {
+	m.counts[name] = append(m.counts[name], count)
+}
+
 func TestExpireVoiceSessions(t *testing.T) {
 	ctx, rt, db, rp := testsuite.Get()
 	rc := rp.Get()
@@ -36,7 +36,7 @@ func (t *InterruptChannelTask) Perform(ctx context.Context, rt *runtime.Runtime,
 
 	channel := channels[0]
 
-	if err := models.InterruptSessionsForChannel(ctx, db, t.ChannelID); err != nil {
+	if err := models.InterruptSessionsForChannel(ctx, rt, t.ChannelID); err != nil {
 		return errors.Wrapf(err, "error interrupting sessions")
 	}
 
@@ -33,12 +33,12 @@ func (t *InterruptSessionsTask) Perform(ctx context.Context, rt *runtime.Runtime
 	db := rt.DB
 
 	if len(t.ContactIDs) > 0 {
-		if _, err := models.InterruptSessionsForContacts(ctx, db, t.ContactIDs); err != nil {
+		if _, err := models.InterruptSessionsForContacts(ctx, rt, t.ContactIDs); err != nil {
 			return err
 		}
 	}
 	if len(t.FlowIDs) > 0 {
-		if err := models.InterruptSessionsForFlows(ctx, db, t.FlowIDs); err != nil {
+		if err := models.InterruptSessionsForFlows(ctx, rt, t.FlowIDs); err != nil {
 			return err
 		}
 	}
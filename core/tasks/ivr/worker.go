@@ -37,39 +37,13 @@ func HandleFlowStartBatch(bg context.Context, rt *runtime.Runtime, batch *models
 	ctx, cancel := context.WithTimeout(bg, time.Minute*5)
 	defer cancel()
 
-	// contacts we will exclude either because they are in a flow or have already been in this one
-	exclude := make(map[models.ContactID]bool, 5)
-
-	// filter out anybody who has has a flow run in this flow if appropriate
-	if batch.ExcludeStartedPreviously() {
-		// find all participants that have been in this flow
-		started, err := models.FindFlowStartedOverlap(ctx, rt.DB, batch.FlowID(), batch.ContactIDs())
-		if err != nil {
-			return errors.Wrapf(err, "error finding others started flow: %d", batch.FlowID())
-		}
-		for _, c := range started {
-			exclude[c] = true
-		}
-	}
-
-	// filter out our list of contacts to only include those that should be started
-	if batch.ExcludeInAFlow() {
-		// find all participants active in other sessions
-		active, err := models.FilterByWaitingSession(ctx, rt.DB, batch.ContactIDs())
-		if err != nil {
-			return errors.Wrapf(err, "error finding other active sessions: %d", batch.FlowID())
-		}
-		for _, c := range active {
-			exclude[c] = true
-		}
-	}
-
-	// filter into our final list of contacts
-	contactIDs := make([]models.ContactID, 0, len(batch.ContactIDs()))
-	for _, c := range batch.ContactIDs() {
-		if !exclude[c] {
-			contactIDs = append(contactIDs, c)
-		}
+	// filter out contacts who shouldn't be started according to the start's options
+	contactIDs, err := models.FilterStartContacts(ctx, rt, batch.FlowID(), batch.ContactIDs(), models.StartFilter{
+		RestartParticipants: !batch.ExcludeStartedPreviously(),
+		IncludeActive:       !batch.ExcludeInAFlow(),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "error filtering contacts for flow start")
 	}
 
 	// load our org assets
@@ -26,26 +26,19 @@ func timeoutSessions(ctx context.Context, rt *runtime.Runtime) error {
 	log := logrus.WithField("comp", "timeout")
 	start := time.Now()
 
-	// find all sessions that need to be expired (we exclude IVR runs)
-	rows, err := rt.DB.QueryxContext(ctx, timedoutSessionsSQL)
+	// find all sessions that need to be timed out (we exclude IVR runs)
+	timeouts, err := models.FindTimedOutSessions(ctx, rt.DB, time.Now(), 25000)
 	if err != nil {
-		return errors.Wrapf(err, "error selecting timed out sessions")
+		return err
 	}
-	defer rows.Close()
 
 	rc := rt.RP.Get()
 	defer rc.Close()
 
 	numQueued, numDupes := 0, 0
 
-	// add a timeout task for each run
-	timeout := &Timeout{}
-	for rows.Next() {
-		err := rows.StructScan(timeout)
-		if err != nil {
-			return errors.Wrapf(err, "error scanning timeout")
-		}
-
+	// add a timeout task for each session
+	for _, timeout := range timeouts {
 		// check whether we've already queued this
 		taskID := fmt.Sprintf("%d:%s", timeout.SessionID, timeout.TimeoutOn.Format(time.RFC3339))
 		queued, err := marker.Contains(rc, taskID)
@@ -78,17 +71,3 @@ func timeoutSessions(ctx context.Context, rt *runtime.Runtime) error {
 	log.WithField("dupes", numDupes).WithField("queued", numQueued).WithField("elapsed", time.Since(start)).Info("session timeouts queued")
 	return nil
 }
-
-const timedoutSessionsSQL = `
-  SELECT id as session_id, org_id, contact_id, timeout_on
-    FROM flows_flowsession
-   WHERE status = 'W' AND timeout_on < NOW() AND call_id IS NULL
-ORDER BY timeout_on ASC
-   LIMIT 25000`
-
-type Timeout struct {
-	SessionID models.SessionID `db:"session_id"`
-	OrgID     models.OrgID     `db:"org_id"`
-	ContactID models.ContactID `db:"contact_id"`
-	TimeoutOn time.Time        `db:"timeout_on"`
-}
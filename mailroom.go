@@ -67,7 +67,7 @@ type Mailroom struct {
 // NewMailroom creates and returns a new mailroom instance
 func NewMailroom(config *runtime.Config) *Mailroom {
 	mr := &Mailroom{
-		rt:   &runtime.Runtime{Config: config},
+		rt:   &runtime.Runtime{Config: config, Metrics: runtime.NoopMetrics},
 		quit: make(chan bool),
 		wg:   &sync.WaitGroup{},
 	}
@@ -165,6 +165,15 @@ func (mr *Mailroom) Start() error {
 		log.Info("elastic ok")
 	}
 
+	// fail now rather than on first use if any of our services aren't usable
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second*10)
+	err = mr.rt.Validate(ctx)
+	cancel()
+
+	if err != nil {
+		return errors.Wrap(err, "runtime validation failed")
+	}
+
 	// warn if we won't be doing FCM syncing
 	if c.FCMKey == "" {
 		logrus.Warn("fcm not configured, no syncing of android channels")
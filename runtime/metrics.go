@@ -0,0 +1,17 @@
+package runtime
+
+import "time"
+
+// Metrics is implemented by collectors of timing and count samples from model operations
+type Metrics interface {
+	Timing(name string, elapsed time.Duration)
+	Count(name string, count int)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) Timing(string, time.Duration) {}
+func (noopMetrics) Count(string, int)            {}
+
+// NoopMetrics is a metrics collector which discards all samples
+var NoopMetrics Metrics = noopMetrics{}
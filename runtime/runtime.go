@@ -1,10 +1,15 @@
 package runtime
 
 import (
+	"context"
+	"fmt"
+	"strings"
+
 	"github.com/gomodule/redigo/redis"
 	"github.com/jmoiron/sqlx"
 	"github.com/nyaruka/gocommon/storage"
 	"github.com/olivere/elastic/v7"
+	"github.com/pkg/errors"
 )
 
 // Runtime represents the set of services required to run many Mailroom functions. Used as a wrapper for
@@ -16,5 +21,51 @@ type Runtime struct {
 	ES                *elastic.Client
 	AttachmentStorage storage.Storage
 	SessionStorage    storage.Storage
+	Metrics           Metrics
 	Config            *Config
 }
+
+// Validate checks that the database, the readonly database, the Redis pool and, if we have a client, Elastic are all
+// usable. The returned error identifies every service which failed.
+func (r *Runtime) Validate(ctx context.Context) error {
+	problems := make([]string, 0, 4)
+	fail := func(service string, err error) {
+		problems = append(problems, fmt.Sprintf("%s: %s", service, err))
+	}
+
+	if r.DB == nil {
+		fail("db", errors.New("no connection"))
+	} else if err := r.DB.PingContext(ctx); err != nil {
+		fail("db", err)
+	}
+
+	if r.ReadonlyDB != nil && r.ReadonlyDB != r.DB {
+		if err := r.ReadonlyDB.PingContext(ctx); err != nil {
+			fail("readonly db", err)
+		}
+	}
+
+	if r.RP == nil {
+		fail("redis", errors.New("no pool"))
+	} else {
+		rc, err := r.RP.GetContext(ctx)
+		if err == nil {
+			_, err = rc.Do("PING")
+			rc.Close()
+		}
+		if err != nil {
+			fail("redis", err)
+		}
+	}
+
+	if r.ES != nil {
+		if _, err := r.ES.ClusterHealth().Do(ctx); err != nil {
+			fail("elastic", err)
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, ", "))
+	}
+	return nil
+}
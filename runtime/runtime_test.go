@@ -0,0 +1,31 @@
+package runtime_test
+
+import (
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/mailroom/testsuite"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuntimeValidate(t *testing.T) {
+	ctx, rt, _, _ := testsuite.Get()
+
+	assert.NoError(t, rt.Validate(ctx))
+
+	// a pool which can't connect to anything
+	brokenRT := *rt
+	brokenRT.RP = &redis.Pool{
+		Dial: func() (redis.Conn, error) { return redis.Dial("tcp", "localhost:1") },
+	}
+
+	err := brokenRT.Validate(ctx)
+	require.Error(t, err)
+	assert.Regexp(t, `^redis: dial tcp .*:1: connect: connection refused$`, err.Error())
+
+	// no pool at all
+	brokenRT.RP = nil
+	assert.EqualError(t, brokenRT.Validate(ctx), "redis: no pool")
+}
@@ -5,6 +5,7 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"time"
 
 	"github.com/nyaruka/gocommon/jsonx"
 	"github.com/nyaruka/mailroom/core/models"
@@ -13,18 +14,25 @@ import (
 
 // MockElasticServer is a mock HTTP server/endpoint that can be used to test elastic queries
 type MockElasticServer struct {
-	Server          *httptest.Server
-	LastRequestURL  string
-	LastRequestBody string
-	Responses       [][]byte
+	Server            *httptest.Server
+	LastRequestMethod string
+	LastRequestURL    string
+	LastRequestBody   string
+	Responses         [][]byte
+	Delay             time.Duration // optional delay before each response to simulate slow searches
 }
 
 // NewMockElasticServer creates a new mock elastic server
 func NewMockElasticServer() *MockElasticServer {
 	m := &MockElasticServer{}
 	m.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.LastRequestMethod = r.Method
 		m.LastRequestURL = r.URL.String()
 
+		if m.Delay > 0 {
+			time.Sleep(m.Delay)
+		}
+
 		// scrolling of results, we are always one page, so return empty hits
 		if r.URL.String() == "/_search/scroll" {
 			w.WriteHeader(200)
@@ -83,6 +91,11 @@ func (m *MockElasticServer) URL() string {
 
 // AddResponse adds a mock response to the server's queue
 func (m *MockElasticServer) AddResponse(ids ...models.ContactID) {
+	m.AddResponseWithSources(ids, nil)
+}
+
+// AddResponseWithSources adds a mock response to the server's queue where each hit includes the given source document
+func (m *MockElasticServer) AddResponseWithSources(ids []models.ContactID, sources []map[string]interface{}) {
 	hits := make([]map[string]interface{}, len(ids))
 	for i := range ids {
 		hits[i] = map[string]interface{}{
@@ -93,6 +106,9 @@ func (m *MockElasticServer) AddResponse(ids ...models.ContactID) {
 			"_routing": "1",
 			"sort":     []int{15124352},
 		}
+		if sources != nil {
+			hits[i]["_source"] = sources[i]
+		}
 	}
 
 	response := jsonx.MustMarshal(map[string]interface{}{
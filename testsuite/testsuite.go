@@ -73,6 +73,7 @@ func Get() (context.Context, *runtime.Runtime, *sqlx.DB, *redis.Pool) {
 		ES:                nil,
 		AttachmentStorage: storage.NewFS(AttachmentStorageDir, 0766),
 		SessionStorage:    storage.NewFS(SessionStorageDir, 0766),
+		Metrics:           runtime.NoopMetrics,
 		Config:            runtime.NewDefaultConfig(),
 	}
 
@@ -237,11 +238,27 @@ func resetData() {
 
 // utility function for running a command panicking if there is any error
 func mustExec(command string, args ...string) {
-	cmd := exec.Command(command, args...)
-	output, err := cmd.CombinedOutput()
+	if err := execCommand(command, args...); err != nil {
+		panic(fmt.Sprintf("error restoring database: %s", err))
+	}
+}
+
+// runs a command, returning an error which includes the exact command attempted if it can't be found or fails
+func execCommand(command string, args ...string) error {
+	attempted := strings.Join(append([]string{command}, args...), " ")
+
+	if _, err := exec.LookPath(command); err != nil {
+		return fmt.Errorf("%s isn't installed or isn't on PATH, attempted: %s", command, attempted)
+	}
+
+	output, err := exec.Command(command, args...).CombinedOutput()
 	if err != nil {
-		panic(fmt.Sprintf("error restoring database: %s: %s", err, string(output)))
+		if len(output) > 0 {
+			return fmt.Errorf("%s, attempted: %s: %s", err, attempted, strings.TrimSpace(string(output)))
+		}
+		return fmt.Errorf("%s, attempted: %s", err, attempted)
 	}
+	return nil
 }
 
 // convenience way to call a func and panic if it errors, e.g. must(foo())
@@ -0,0 +1,23 @@
+package testsuite
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExecCommand(t *testing.T) {
+	err := execCommand("mailroom-missing-command", "-d", "mailroom_test", "mailroom_test.dump")
+	assert.EqualError(t, err, "mailroom-missing-command isn't installed or isn't on PATH, attempted: mailroom-missing-command -d mailroom_test mailroom_test.dump")
+
+	// the remaining checks need the standard true and false commands
+	if _, err := exec.LookPath("false"); err != nil {
+		t.Skip("false command not available")
+	}
+
+	err = execCommand("false", "-x")
+	assert.EqualError(t, err, "exit status 1, attempted: false -x")
+
+	assert.NoError(t, execCommand("true"))
+}
@@ -0,0 +1,37 @@
+package correlation
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Header is the HTTP header used to pass correlation ids between services
+const Header = "X-Correlation-ID"
+
+// LogField is the field name used for correlation ids in structured logs
+const LogField = "correlation_id"
+
+type contextKey int
+
+const idKey contextKey = 0
+
+// NewContext returns a copy of the given context which carries the given correlation id
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, idKey, id)
+}
+
+// FromContext returns the correlation id carried by the given context, or empty string if there isn't one
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(idKey).(string)
+	return id
+}
+
+// Logger returns a log entry which includes the correlation id carried by the given context, if there is one
+func Logger(ctx context.Context) *logrus.Entry {
+	entry := logrus.NewEntry(logrus.StandardLogger())
+	if id := FromContext(ctx); id != "" {
+		entry = entry.WithField(LogField, id)
+	}
+	return entry
+}
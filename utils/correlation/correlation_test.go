@@ -0,0 +1,28 @@
+package correlation_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nyaruka/mailroom/utils/correlation"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCorrelation(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	ctx := context.Background()
+	assert.Equal(t, "", correlation.FromContext(ctx))
+
+	correlation.Logger(ctx).Info("no id")
+	assert.NotContains(t, hook.LastEntry().Data, correlation.LogField)
+
+	ctx = correlation.NewContext(ctx, "1234-abcd")
+	assert.Equal(t, "1234-abcd", correlation.FromContext(ctx))
+
+	correlation.Logger(ctx).WithField("count", 3).Info("with id")
+	assert.Equal(t, logrus.Fields{"correlation_id": "1234-abcd", "count": 3}, hook.LastEntry().Data)
+}
@@ -0,0 +1,82 @@
+package counters
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/pkg/errors"
+)
+
+// Series is a set of named counters stored in Redis as buckets of a fixed interval, e.g. per-minute counts of
+// messages sent. Each bucket is a hash keyed by the start of its interval and expires once it falls out of the window
+// of the most recent size buckets.
+type Series struct {
+	keyBase  string
+	interval time.Duration
+	size     int
+}
+
+// NewSeries creates a new series with the given key base, bucket interval and number of buckets to keep
+func NewSeries(keyBase string, interval time.Duration, size int) *Series {
+	return &Series{keyBase: keyBase, interval: interval, size: size}
+}
+
+var incrScript = redis.NewScript(1, `
+local key, field, value, ttl = KEYS[1], ARGV[1], ARGV[2], ARGV[3]
+
+redis.call("HINCRBY", key, field, value)
+redis.call("EXPIRE", key, ttl)
+`)
+
+// Incr increments the given field in the current bucket by the given value
+func (s *Series) Incr(rc redis.Conn, field string, value int64) error {
+	ttl := int64((s.interval * time.Duration(s.size)) / time.Second)
+
+	_, err := incrScript.Do(rc, s.key(dates.Now()), field, value, ttl)
+	return errors.Wrapf(err, "error incrementing %s in series %s", field, s.keyBase)
+}
+
+// Get returns the values of the given field in each bucket of the window, most recent first
+func (s *Series) Get(rc redis.Conn, field string) ([]int64, error) {
+	now := dates.Now()
+
+	for i := 0; i < s.size; i++ {
+		rc.Send("HGET", s.key(now.Add(-s.interval*time.Duration(i))), field)
+	}
+
+	values, err := redis.Values(rc.Do(""))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading %s from series %s", field, s.keyBase)
+	}
+
+	counts := make([]int64, len(values))
+	for i, v := range values {
+		if v != nil {
+			if counts[i], err = redis.Int64(v, nil); err != nil {
+				return nil, errors.Wrapf(err, "error parsing %s from series %s", field, s.keyBase)
+			}
+		}
+	}
+	return counts, nil
+}
+
+// Total returns the sum of the values of the given field across the window
+func (s *Series) Total(rc redis.Conn, field string) (int64, error) {
+	counts, err := s.Get(rc, field)
+	if err != nil {
+		return 0, err
+	}
+
+	total := int64(0)
+	for _, c := range counts {
+		total += c
+	}
+	return total, nil
+}
+
+// gets the key of the bucket containing the given time
+func (s *Series) key(t time.Time) string {
+	return fmt.Sprintf("%s:%d", s.keyBase, t.UTC().Truncate(s.interval).Unix())
+}
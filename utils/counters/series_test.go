@@ -0,0 +1,75 @@
+package counters_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/utils/counters"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeries(t *testing.T) {
+	_, _, _, rp := testsuite.Get()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetRedis)
+	defer dates.SetNowSource(dates.DefaultNowSource)
+
+	setNow := func(t time.Time) { dates.SetNowSource(dates.NewFixedNowSource(t)) }
+
+	s := counters.NewSeries("msgs_sent", time.Minute, 3)
+
+	assertGet := func(field string, expected []int64, expectedTotal int64) {
+		counts, err := s.Get(rc, field)
+		require.NoError(t, err)
+		assert.Equal(t, expected, counts)
+
+		total, err := s.Total(rc, field)
+		require.NoError(t, err)
+		assert.Equal(t, expectedTotal, total)
+	}
+
+	setNow(time.Date(2022, 11, 3, 10, 15, 5, 0, time.UTC))
+
+	assertGet("org1", []int64{0, 0, 0}, 0)
+
+	assert.NoError(t, s.Incr(rc, "org1", 1))
+	assert.NoError(t, s.Incr(rc, "org1", 2))
+	assert.NoError(t, s.Incr(rc, "org2", 5))
+
+	assertGet("org1", []int64{3, 0, 0}, 3)
+	assertGet("org2", []int64{5, 0, 0}, 5)
+
+	// still in the same minute bucket
+	setNow(time.Date(2022, 11, 3, 10, 15, 59, 0, time.UTC))
+
+	assert.NoError(t, s.Incr(rc, "org1", 1))
+
+	assertGet("org1", []int64{4, 0, 0}, 4)
+
+	// into the next bucket
+	setNow(time.Date(2022, 11, 3, 10, 16, 10, 0, time.UTC))
+
+	assert.NoError(t, s.Incr(rc, "org1", 2))
+
+	assertGet("org1", []int64{2, 4, 0}, 6)
+	assertGet("org2", []int64{0, 5, 0}, 5)
+
+	// skip a bucket
+	setNow(time.Date(2022, 11, 3, 10, 18, 0, 0, time.UTC))
+
+	assert.NoError(t, s.Incr(rc, "org1", 7))
+
+	assertGet("org1", []int64{7, 0, 2}, 9)
+	assertGet("org2", []int64{0, 0, 0}, 0)
+
+	// buckets expire once they're out of the window
+	ttl, err := redis.Int(rc.Do("TTL", "msgs_sent:1667470680"))
+	require.NoError(t, err)
+	assert.Equal(t, 180, ttl)
+}
@@ -0,0 +1,20 @@
+package test
+
+import (
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/gocommon/uuids"
+	"github.com/nyaruka/goflow/envs"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/flows/resumes"
+)
+
+// NewDialResume creates a resume for a voice session waiting on a dial, with the given dial status and duration
+func NewDialResume(env envs.Environment, contact *flows.Contact, status flows.DialStatus, duration int) flows.Resume {
+	return resumes.NewDial(env, contact, flows.NewDial(status, duration))
+}
+
+// NewDigitsResume creates a resume for a voice session waiting on input, with the given DTMF digits as that input
+func NewDigitsResume(env envs.Environment, contact *flows.Contact, urn urns.URN, digits string) flows.Resume {
+	msg := flows.NewMsgIn(flows.MsgUUID(uuids.New()), urn, nil, digits, nil)
+	return resumes.NewMsg(env, contact, msg)
+}
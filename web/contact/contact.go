@@ -3,16 +3,24 @@ package contact
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/gomodule/redigo/redis"
 	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/goflow/envs"
 	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/flows/modifiers"
 	"github.com/nyaruka/mailroom/core/goflow"
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/runtime"
 	"github.com/nyaruka/mailroom/web"
 
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
 func init() {
@@ -20,6 +28,8 @@ func init() {
 	web.RegisterJSONRoute(http.MethodPost, "/mr/contact/modify", web.RequireAuthToken(handleModify))
 	web.RegisterJSONRoute(http.MethodPost, "/mr/contact/resolve", web.RequireAuthToken(handleResolve))
 	web.RegisterJSONRoute(http.MethodPost, "/mr/contact/interrupt", web.RequireAuthToken(handleInterrupt))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/contact/parse_urns", web.RequireAuthToken(handleParseURNs))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/contact/sessions", web.RequireAuthToken(handleSessions))
 }
 
 // Request to create a new contact.
@@ -33,19 +43,54 @@ func init() {
 //	    "urns": ["tel:+250788123123"],
 //	    "fields": {"age": "39"},
 //	    "groups": ["b0b778db-6657-430b-9272-989ad43a10db"]
-//	  }
+//	  },
+//	  "idempotency_key": "5c4ab2d1-6b6a-4b8f-9e5e-0d3f6e2c1a7b",
+//	  "merge_on_urn": true,
+//	  "response_fields": ["age"]
 //	}
+//
+// By default the full contact is returned. If response_fields is provided, the contact in the response is trimmed to its
+// id, UUID and the values of the given fields, so passing an empty list returns only the id and UUID.
+//
+// If merge_on_urn is set, the request is an upsert. Matching is done in this order:
+//
+//  1. if the idempotency key matches a previous request, the contact created by that request is returned unchanged
+//  2. if any of the URNs belong to an existing contact, that contact is updated with the name, language, fields and
+//     groups of the spec and any URNs it doesn't already have are added to it
+//  3. if the URNs belong to more than one existing contact, the match is ambiguous and the request fails
+//  4. otherwise a new contact is created
 type createRequest struct {
-	OrgID   models.OrgID        `json:"org_id"   validate:"required"`
-	UserID  models.UserID       `json:"user_id"  validate:"required"`
-	Contact *models.ContactSpec `json:"contact"  validate:"required"`
+	OrgID          models.OrgID        `json:"org_id"          validate:"required"`
+	UserID         models.UserID       `json:"user_id"         validate:"required"`
+	Contact        *models.ContactSpec `json:"contact"         validate:"required"`
+	IdempotencyKey string              `json:"idempotency_key" validate:"omitempty,max=64"`
+	MergeOnURN     bool                `json:"merge_on_urn"`
+	ResponseFields []string            `json:"response_fields"`
 }
 
+// trimmed version of a contact returned when response fields are requested
+type trimmedContact struct {
+	UUID   flows.ContactUUID          `json:"uuid"`
+	ID     flows.ContactID            `json:"id"`
+	Fields map[string]json.RawMessage `json:"fields,omitempty"`
+}
+
+// how long we remember the contact created for an idempotency key
+const createIdempotencyTTL = 24 * time.Hour
+
+// how long an idempotency key stays reserved by a request which hasn't yet created its contact
+const createIdempotencyPendingTTL = 5 * time.Minute
+
+// what we store against an idempotency key whilst its request is creating its contact
+const idempotencyPending = "pending"
+
+var errIdempotencyKeyInUse = errors.New("a request with this idempotency key is already in progress")
+
 // handles a request to create the given contact
 func handleCreate(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
 	request := &createRequest{}
 	if err := web.ReadAndValidateJSON(r, request); err != nil {
-		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+		return web.NewValidationError(err), http.StatusBadRequest, nil
 	}
 
 	// grab our org
@@ -54,23 +99,201 @@ func handleCreate(ctx context.Context, rt *runtime.Runtime, r *http.Request) (in
 		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
 	}
 
+	for _, key := range request.ResponseFields {
+		if oa.FieldByKey(key) == nil {
+			return errors.Errorf("unknown contact field '%s'", key), http.StatusBadRequest, nil
+		}
+	}
+
+	// if this is a retry of a previous request, return the contact that request created, otherwise reserve the key
+	// so that concurrent retries of this request can't also create contacts
+	recorded := false
+	if request.IdempotencyKey != "" {
+		existing, err := reserveIdempotencyKey(ctx, rt, oa, request.IdempotencyKey)
+		if err == errIdempotencyKeyInUse {
+			return err, http.StatusConflict, nil
+		}
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		if existing != nil {
+			return createResponse(existing, request.ResponseFields)
+		}
+
+		// if we fail before recording our contact, release the key so the request can be retried
+		defer func() {
+			if !recorded {
+				releaseIdempotencyKey(rt, oa, request.IdempotencyKey)
+			}
+		}()
+	}
+
 	c, err := SpecToCreation(request.Contact, oa.Env(), oa.SessionAssets())
 	if err != nil {
 		return err, http.StatusBadRequest, nil
 	}
 
-	_, contact, err := models.CreateContact(ctx, rt.DB, oa, request.UserID, c.Name, c.Language, c.URNs)
-	if err != nil {
-		return err, http.StatusBadRequest, nil
+	var contact *flows.Contact
+	mods := c.Mods
+
+	if request.MergeOnURN && len(c.URNs) > 0 {
+		ownerIDs, err := models.GetURNOwners(ctx, rt.DB, oa.OrgID(), c.URNs)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		if len(ownerIDs) > 1 {
+			return errors.New("URNs belong to different contacts"), http.StatusBadRequest, nil
+		}
+		if len(ownerIDs) == 1 {
+			existing, err := models.LoadContact(ctx, rt.DB, oa, ownerIDs[0])
+			if err != nil {
+				return nil, http.StatusInternalServerError, errors.Wrapf(err, "error loading contact to merge into")
+			}
+			if existing != nil {
+				contact, err = existing.FlowContact(oa)
+				if err != nil {
+					return nil, http.StatusInternalServerError, errors.Wrapf(err, "error creating flow contact")
+				}
+			}
+		}
+	}
+
+	if contact != nil {
+		// the matched contact gets any URNs it doesn't have and whichever of name and language were provided
+		merges := []flows.Modifier{modifiers.NewURNs(c.URNs, modifiers.URNsAppend)}
+		if request.Contact.Name != nil {
+			merges = append(merges, modifiers.NewName(c.Name))
+		}
+		if request.Contact.Language != nil {
+			merges = append(merges, modifiers.NewLanguage(c.Language))
+		}
+		mods = append(merges, mods...)
+	} else {
+		spec := &models.ContactSpec{Name: &c.Name, URNs: c.URNs}
+		if c.Language != envs.NilLanguage {
+			lang := string(c.Language)
+			spec.Language = &lang
+		}
+
+		created, errs := models.CreateContacts(ctx, rt.DB, oa, request.UserID, []*models.ContactSpec{spec})
+		if errs[0] != nil {
+			return errs[0], http.StatusBadRequest, nil
+		}
+		contact = created[0]
 	}
 
-	modifiersByContact := map[*flows.Contact][]flows.Modifier{contact: c.Mods}
+	modifiersByContact := map[*flows.Contact][]flows.Modifier{contact: mods}
 	_, err = models.ApplyModifiers(ctx, rt, oa, request.UserID, modifiersByContact)
 	if err != nil {
-		return nil, http.StatusInternalServerError, errors.Wrap(err, "error modifying new contact")
+		return nil, http.StatusInternalServerError, errors.Wrap(err, "error modifying contact")
+	}
+
+	if request.IdempotencyKey != "" {
+		if err := recordIdempotentContact(rt, oa, request.IdempotencyKey, contact); err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		recorded = true
+	}
+
+	return createResponse(contact, request.ResponseFields)
+}
+
+// builds the response for a create request, trimming the contact if response fields were requested
+func createResponse(contact *flows.Contact, responseFields []string) (interface{}, int, error) {
+	if responseFields == nil {
+		return map[string]interface{}{"contact": contact}, http.StatusOK, nil
+	}
+
+	// go via the contact's JSON so field values are serialized exactly as they would be in a full response
+	marshaled, err := json.Marshal(contact)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrap(err, "error marshaling contact")
+	}
+	full := &trimmedContact{}
+	if err := json.Unmarshal(marshaled, full); err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrap(err, "error unmarshaling contact")
+	}
+
+	trimmed := &trimmedContact{UUID: full.UUID, ID: full.ID, Fields: make(map[string]json.RawMessage, len(responseFields))}
+	for _, key := range responseFields {
+		if value, ok := full.Fields[key]; ok {
+			trimmed.Fields[key] = value
+		}
+	}
+
+	return map[string]interface{}{"contact": trimmed}, http.StatusOK, nil
+}
+
+func idempotencyRedisKey(oa *models.OrgAssets, key string) string {
+	return fmt.Sprintf("contact_create:%d:%s", oa.OrgID(), key)
+}
+
+// reserves the given idempotency key for a request which will create a contact, unless a previous request with that
+// key created a contact, in which case that contact is returned. If another request has reserved the key but hasn't
+// yet created its contact, errIdempotencyKeyInUse is returned.
+func reserveIdempotencyKey(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, key string) (*flows.Contact, error) {
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	redisKey := idempotencyRedisKey(oa, key)
+	pendingTTL := int(createIdempotencyPendingTTL / time.Second)
+
+	_, err := redis.String(rc.Do("SET", redisKey, idempotencyPending, "NX", "EX", pendingTTL))
+	if err == nil {
+		return nil, nil // key is ours
+	} else if err != redis.ErrNil {
+		return nil, errors.Wrapf(err, "error reserving idempotency key")
+	}
+
+	value, err := redis.String(rc.Do("GET", redisKey))
+	if err == redis.ErrNil || value == idempotencyPending {
+		return nil, errIdempotencyKeyInUse // reserved by another request which either hasn't finished or just has
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "error looking up idempotency key")
+	}
+
+	contactID, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid contact id for idempotency key: %s", value)
+	}
+
+	contact, err := models.LoadContact(ctx, rt.DB, oa, models.ContactID(contactID))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading contact for idempotency key")
+	}
+
+	// contact has since been deleted so take over the key to create a new one
+	if contact == nil {
+		if _, err := rc.Do("SET", redisKey, idempotencyPending, "EX", pendingTTL); err != nil {
+			return nil, errors.Wrapf(err, "error reserving idempotency key")
+		}
+		return nil, nil
+	}
+
+	flowContact, err := contact.FlowContact(oa)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating flow contact")
 	}
+	return flowContact, nil
+}
+
+// releases a reserved idempotency key whose request failed to create a contact
+func releaseIdempotencyKey(rt *runtime.Runtime, oa *models.OrgAssets, key string) {
+	rc := rt.RP.Get()
+	defer rc.Close()
 
-	return map[string]interface{}{"contact": contact}, http.StatusOK, nil
+	if _, err := rc.Do("DEL", idempotencyRedisKey(oa, key)); err != nil {
+		logrus.WithError(err).WithField("idempotency_key", key).Error("error releasing idempotency key")
+	}
+}
+
+// records that the given idempotency key created the given contact
+func recordIdempotentContact(rt *runtime.Runtime, oa *models.OrgAssets, key string, contact *flows.Contact) error {
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	_, err := rc.Do("SET", idempotencyRedisKey(oa, key), int64(contact.ID()), "EX", int(createIdempotencyTTL/time.Second))
+	return errors.Wrapf(err, "error recording idempotency key")
 }
 
 // Request that a set of contacts is modified.
@@ -88,16 +311,39 @@ func handleCreate(ctx context.Context, rt *runtime.Runtime, r *http.Request) (in
 //	     }]
 //	  }]
 //	}
+//
+// Simple attribute changes can instead be provided as a patch which is converted to modifiers, e.g.
+//
+//	{
+//	  "org_id": 1,
+//	  "user_id": 1,
+//	  "contact_ids": [15,235],
+//	  "patch": {"name": "Joe", "language": "eng"}
+//	}
+//
+// Contacts can also be identified by the paths of their ext URNs using external_ids, e.g.
+//
+//	{
+//	  "org_id": 1,
+//	  "user_id": 1,
+//	  "external_ids": ["A1234"],
+//	  "patch": {"name": "Joe"}
+//	}
 type modifyRequest struct {
-	OrgID      models.OrgID       `json:"org_id"      validate:"required"`
-	UserID     models.UserID      `json:"user_id"     validate:"required"`
-	ContactIDs []models.ContactID `json:"contact_ids" validate:"required"`
-	Modifiers  []json.RawMessage  `json:"modifiers"   validate:"required"`
+	OrgID       models.OrgID       `json:"org_id"       validate:"required"`
+	UserID      models.UserID      `json:"user_id"      validate:"required"`
+	ContactIDs  []models.ContactID `json:"contact_ids"  validate:"required_without=ExternalIDs"`
+	ExternalIDs []string           `json:"external_ids"`
+	Modifiers   []json.RawMessage  `json:"modifiers"`
+	Patch       *ContactPatch      `json:"patch"`
 }
 
-// Response for a contact update. Will return the full contact state and any errors
+// Response for a contact update. Will return the full contact state and any errors. Contacts whose changes couldn't be
+// saved are included as errors, as are external ids which don't match a contact, keyed by their ext URN.
 //
 //	{
+//	  "ext:B5678": {"error": "no contact with external id: B5678"},
+//	  "1001": {"error": "error applying events: ..."},
 //	  "1000": {
 //		   "contact": {
 //	      "id": 123,
@@ -116,11 +362,15 @@ type modifyResult struct {
 	Events  []flows.Event  `json:"events"`
 }
 
+type modifyError struct {
+	Error string `json:"error"`
+}
+
 // handles a request to apply the passed in actions
 func handleModify(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
 	request := &modifyRequest{}
 	if err := web.ReadAndValidateJSON(r, request); err != nil {
-		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+		return web.NewValidationError(err), http.StatusBadRequest, nil
 	}
 
 	// grab our org assets
@@ -129,42 +379,73 @@ func handleModify(ctx context.Context, rt *runtime.Runtime, r *http.Request) (in
 		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
 	}
 
-	// read the modifiers from the request
-	mods, err := goflow.ReadModifiers(oa.SessionAssets(), request.Modifiers, goflow.ErrorOnMissing)
+	if request.Modifiers == nil && request.Patch == nil {
+		return errors.New("request must include modifiers or a patch"), http.StatusBadRequest, nil
+	}
+
+	// read the modifiers from the request, starting with those from the patch
+	mods, err := PatchToModifiers(request.Patch)
 	if err != nil {
-		return nil, http.StatusBadRequest, err
+		return err, http.StatusBadRequest, nil
 	}
 
-	// load our contacts
-	contacts, err := models.LoadContacts(ctx, rt.DB, oa, request.ContactIDs)
+	explicitMods, err := goflow.ReadModifiers(oa.SessionAssets(), request.Modifiers, goflow.ErrorOnMissing)
 	if err != nil {
-		return nil, http.StatusBadRequest, errors.Wrapf(err, "unable to load contact")
+		return err, http.StatusBadRequest, nil
 	}
 
-	// convert to map of flow contacts to modifiers
-	modifiersByContact := make(map[*flows.Contact][]flows.Modifier, len(contacts))
-	for _, contact := range contacts {
-		flowContact, err := contact.FlowContact(oa)
+	mods = append(mods, explicitMods...)
+
+	// resolve any external ids to contact ids
+	contactIDs := request.ContactIDs
+	var unknownExternalIDs []string
+
+	if len(request.ExternalIDs) > 0 {
+		idsByExternalID, err := models.GetContactIDsByExternalIDs(ctx, rt.DB, oa.OrgID(), request.ExternalIDs)
 		if err != nil {
-			return nil, http.StatusBadRequest, errors.Wrapf(err, "error creating flow contact for contact: %d", contact.ID())
+			return nil, http.StatusInternalServerError, err
 		}
 
-		modifiersByContact[flowContact] = mods
+		for _, externalID := range request.ExternalIDs {
+			if contactID, found := idsByExternalID[externalID]; found {
+				contactIDs = append(contactIDs, contactID)
+			} else {
+				unknownExternalIDs = append(unknownExternalIDs, externalID)
+			}
+		}
 	}
 
-	eventsByContact, err := models.ApplyModifiers(ctx, rt, oa, request.UserID, modifiersByContact)
+	// load our contacts
+	scenes, err := models.NewScenesForContactIDs(ctx, rt.DB, oa, contactIDs, request.UserID)
 	if err != nil {
-		return nil, http.StatusBadRequest, err
+		return nil, http.StatusBadRequest, errors.Wrapf(err, "unable to load contacts")
+	}
+
+	// convert to map of flow contacts to modifiers
+	modifiersByContact := make(map[*flows.Contact][]flows.Modifier, len(scenes))
+	for _, scene := range scenes {
+		modifiersByContact[scene.Contact()] = mods
 	}
 
+	// contacts which fail don't prevent the others from being modified
+	eventsByContact, errsByContact := models.ApplyModifiersForEach(ctx, rt, oa, request.UserID, modifiersByContact)
+
 	// create our results
-	results := make(map[flows.ContactID]modifyResult, len(contacts))
+	results := make(map[string]interface{}, len(scenes)+len(unknownExternalIDs))
 	for flowContact := range modifiersByContact {
-		results[flowContact.ID()] = modifyResult{
+		if err := errsByContact[flowContact]; err != nil {
+			results[fmt.Sprint(flowContact.ID())] = modifyError{Error: err.Error()}
+			continue
+		}
+
+		results[fmt.Sprint(flowContact.ID())] = modifyResult{
 			Contact: flowContact,
 			Events:  eventsByContact[flowContact],
 		}
 	}
+	for _, externalID := range unknownExternalIDs {
+		results[fmt.Sprintf("%s:%s", urns.ExternalScheme, externalID)] = modifyError{Error: fmt.Sprintf("no contact with external id: %s", externalID)}
+	}
 
 	return results, http.StatusOK, nil
 }
@@ -186,7 +467,7 @@ type resolveRequest struct {
 func handleResolve(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
 	request := &resolveRequest{}
 	if err := web.ReadAndValidateJSON(r, request); err != nil {
-		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+		return web.NewValidationError(err), http.StatusBadRequest, nil
 	}
 
 	// grab our org
@@ -245,13 +526,171 @@ type interruptRequest struct {
 func handleInterrupt(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
 	request := &interruptRequest{}
 	if err := web.ReadAndValidateJSON(r, request); err != nil {
-		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+		return web.NewValidationError(err), http.StatusBadRequest, nil
 	}
 
-	count, err := models.InterruptSessionsForContacts(ctx, rt.DB, []models.ContactID{request.ContactID})
+	count, err := models.InterruptSessionsForContacts(ctx, rt, []models.ContactID{request.ContactID})
 	if err != nil {
 		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to interrupt contact")
 	}
 
 	return map[string]interface{}{"sessions": count}, http.StatusOK, nil
 }
+
+// Request to validate and normalize a set of URNs using the org's default country.
+//
+//	{
+//	  "org_id": 1,
+//	  "urns": ["tel:(605) 574-2222", "twitter:@Jim"]
+//	}
+type parseURNsRequest struct {
+	OrgID models.OrgID `json:"org_id" validate:"required"`
+	URNs  []urns.URN   `json:"urns"   validate:"required"`
+}
+
+// Response for a URN parsing request with a result for each input URN.
+//
+//	{
+//	  "urns": [
+//	    {"input": "tel:(605) 574-2222", "normalized": "tel:+16055742222", "scheme": "tel"},
+//	    {"input": "tel:*", "error": "scheme or path cannot be empty"}
+//	  ]
+//	}
+type parsedURN struct {
+	Input      urns.URN `json:"input"`
+	Normalized urns.URN `json:"normalized,omitempty"`
+	Scheme     string   `json:"scheme,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// handles a request to validate and normalize URNs
+func handleParseURNs(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &parseURNsRequest{}
+	if err := web.ReadAndValidateJSON(r, request); err != nil {
+		return web.NewValidationError(err), http.StatusBadRequest, nil
+	}
+
+	// grab our org
+	oa, err := models.GetOrgAssets(ctx, rt, request.OrgID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	country := string(oa.Env().DefaultCountry())
+	results := make([]*parsedURN, len(request.URNs))
+
+	for i, input := range request.URNs {
+		// normalize twice for the same reason as in handleResolve
+		urn := input.Normalize(country).Normalize(country)
+
+		if err := urn.Validate(); err != nil {
+			results[i] = &parsedURN{Input: input, Error: err.Error()}
+		} else {
+			results[i] = &parsedURN{Input: input, Normalized: urn, Scheme: urn.Scheme()}
+		}
+	}
+
+	return map[string]interface{}{"urns": results}, http.StatusOK, nil
+}
+
+// Request for the most recent sessions of a contact.
+//
+//	{
+//	  "org_id": 1,
+//	  "contact_id": 235,
+//	  "limit": 10
+//	}
+type sessionsRequest struct {
+	OrgID     models.OrgID     `json:"org_id"     validate:"required"`
+	ContactID models.ContactID `json:"contact_id" validate:"required"`
+	Limit     int              `json:"limit"      validate:"min=0,max=100"`
+}
+
+// Response for a contact sessions request, newest first. Flows which have since been deleted are null.
+//
+//	{
+//	  "sessions": [
+//	    {
+//	      "id": 3456,
+//	      "session_type": "M",
+//	      "status": "W",
+//	      "flow": {"uuid": "9de3663f-c5c5-4c92-9f45-ecbc09abcc85", "name": "Favorites"},
+//	      "current_flow": {"uuid": "9de3663f-c5c5-4c92-9f45-ecbc09abcc85", "name": "Favorites"},
+//	      "created_on": "2022-04-20T12:30:00Z",
+//	      "ended_on": null
+//	    }
+//	  ]
+//	}
+type contactSession struct {
+	ID          models.SessionID      `json:"id"`
+	SessionType models.FlowType       `json:"session_type"`
+	Status      models.SessionStatus  `json:"status"`
+	Flow        *assets.FlowReference `json:"flow"`
+	CurrentFlow *assets.FlowReference `json:"current_flow"`
+	CreatedOn   time.Time             `json:"created_on"`
+	EndedOn     *time.Time            `json:"ended_on"`
+}
+
+// default number of sessions returned for a contact
+const defaultSessionsLimit = 20
+
+// handles a request for a contact's recent sessions
+func handleSessions(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &sessionsRequest{}
+	if err := web.ReadAndValidateJSON(r, request); err != nil {
+		return web.NewValidationError(err), http.StatusBadRequest, nil
+	}
+
+	if request.Limit == 0 {
+		request.Limit = defaultSessionsLimit
+	}
+
+	oa, err := models.GetOrgAssets(ctx, rt, request.OrgID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	sessions, err := models.GetContactSessions(ctx, rt.ReadonlyDB, request.OrgID, request.ContactID, request.Limit)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	// looks up the reference for a flow, which will be nil if the flow no longer exists
+	flowRef := func(flowID models.FlowID) (*assets.FlowReference, error) {
+		if flowID == models.NilFlowID {
+			return nil, nil
+		}
+		flow, err := oa.FlowByID(flowID)
+		if err == models.ErrNotFound {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "error loading flow #%d", flowID)
+		}
+		return flow.Reference(), nil
+	}
+
+	results := make([]*contactSession, len(sessions))
+	for i, s := range sessions {
+		flow, err := flowRef(s.FlowID)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		currentFlow, err := flowRef(s.CurrentFlowID)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+
+		results[i] = &contactSession{
+			ID:          s.ID,
+			SessionType: s.SessionType,
+			Status:      s.Status,
+			Flow:        flow,
+			CurrentFlow: currentFlow,
+			CreatedOn:   s.CreatedOn,
+			EndedOn:     s.EndedOn,
+		}
+	}
+
+	return map[string]interface{}{"sessions": results}, http.StatusOK, nil
+}
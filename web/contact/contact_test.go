@@ -1,15 +1,26 @@
 package contact
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/gocommon/dbutil/assertdb"
 	_ "github.com/nyaruka/mailroom/core/handlers"
 	"github.com/nyaruka/mailroom/core/models"
 	_ "github.com/nyaruka/mailroom/services/tickets/intern"
 	"github.com/nyaruka/mailroom/testsuite"
 	"github.com/nyaruka/mailroom/testsuite/testdata"
 	"github.com/nyaruka/mailroom/web"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestCreateContacts(t *testing.T) {
@@ -52,6 +63,26 @@ func TestModifyContacts(t *testing.T) {
 	models.FlushCache()
 }
 
+func TestModifyContactsByExternalID(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	// to be deterministic, update the creation date on cathy
+	db.MustExec(`UPDATE contacts_contact SET created_on = $1 WHERE id = $2`, time.Date(2018, 7, 6, 12, 30, 0, 123456789, time.UTC), testdata.Cathy.ID)
+
+	// clear out cathy's fields, groups and URNs and give her an ext URN
+	db.MustExec(`UPDATE contacts_contact SET fields = NULL WHERE id = $1`, testdata.Cathy.ID)
+	db.MustExec(`DELETE FROM contacts_contactgroup_contacts WHERE contact_id = $1`, testdata.Cathy.ID)
+	db.MustExec(`UPDATE contacts_contacturn SET contact_id = NULL WHERE contact_id = $1`, testdata.Cathy.ID)
+	testdata.InsertContactURN(db, testdata.Org1, testdata.Cathy, "ext:A1234", 1000)
+
+	// and give a contact in another org the unknown external id
+	testdata.InsertContactURN(db, testdata.Org2, testdata.Org2Contact, "ext:B5678", 1000)
+
+	web.RunWebTests(t, ctx, rt, "testdata/modify_external.json", nil)
+}
+
 func TestResolveContacts(t *testing.T) {
 	ctx, rt, db, _ := testsuite.Get()
 
@@ -79,3 +110,283 @@ func TestInterruptContact(t *testing.T) {
 
 	web.RunWebTests(t, ctx, rt, "testdata/interrupt.json", nil)
 }
+
+func TestContactSessions(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	// give Cathy a completed session, and a more recent waiting session
+	s1ID := testdata.InsertFlowSession(db, testdata.Org1, testdata.Cathy, models.FlowTypeMessaging, models.SessionStatusCompleted, testdata.Favorites, models.NilCallID)
+	testdata.InsertFlowRun(db, testdata.Org1, s1ID, testdata.Cathy, testdata.Favorites, models.RunStatusCompleted)
+	s2ID := testdata.InsertWaitingSession(db, testdata.Org1, testdata.Cathy, models.FlowTypeMessaging, testdata.PickANumber, models.NilCallID, time.Now(), time.Now().Add(time.Hour), false, nil)
+	testdata.InsertFlowRun(db, testdata.Org1, s2ID, testdata.Cathy, testdata.PickANumber, models.RunStatusWaiting)
+
+	db.MustExec(`UPDATE flows_flowsession SET created_on = '2022-04-20T12:30:00Z', ended_on = '2022-04-20T12:35:00Z', current_flow_id = NULL WHERE id = $1`, s1ID)
+	db.MustExec(`UPDATE flows_flowsession SET created_on = '2022-04-21T09:00:00Z' WHERE id = $1`, s2ID)
+
+	// give Bob a session which shouldn't be included
+	testdata.InsertFlowSession(db, testdata.Org1, testdata.Bob, models.FlowTypeMessaging, models.SessionStatusCompleted, testdata.Favorites, models.NilCallID)
+
+	web.RunWebTests(t, ctx, rt, "testdata/sessions.json", map[string]string{
+		"cathy_session1_id": fmt.Sprint(s1ID),
+		"cathy_session2_id": fmt.Sprint(s2ID),
+	})
+}
+
+func TestParseURNs(t *testing.T) {
+	ctx, rt, _, _ := testsuite.Get()
+
+	web.RunWebTests(t, ctx, rt, "testdata/parse_urns.json", nil)
+}
+
+func TestCreateContactIdempotency(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData | testsuite.ResetRedis)
+
+	wg := &sync.WaitGroup{}
+
+	server := web.NewServer(ctx, rt, wg)
+	server.Start()
+
+	// give our server time to start
+	time.Sleep(time.Second)
+
+	defer server.Stop()
+
+	create := func(body string) (int, []byte) {
+		req, err := http.NewRequest("POST", "http://localhost:8090/mr/contact/create", bytes.NewReader([]byte(body)))
+		require.NoError(t, err)
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+
+		content, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, content
+	}
+
+	body := `{"org_id": 1, "user_id": 1, "contact": {"name": "Zoë", "urns": ["tel:+16055700099"], "fields": {"age": "39"}}, "idempotency_key": "abc123"}`
+
+	status1, response1 := create(body)
+	assert.Equal(t, http.StatusOK, status1)
+
+	// retrying with the same key returns the same contact rather than creating another
+	status2, response2 := create(body)
+	assert.Equal(t, http.StatusOK, status2)
+	assert.JSONEq(t, string(response1), string(response2))
+
+	assertdb.Query(t, db, `SELECT count(*) FROM contacts_contact WHERE name = 'Zoë'`).Returns(1)
+
+	// the key is scoped to the org
+	status3, _ := create(`{"org_id": 2, "user_id": 1, "contact": {"name": "Zoë"}, "idempotency_key": "abc123"}`)
+	assert.Equal(t, http.StatusOK, status3)
+
+	assertdb.Query(t, db, `SELECT count(*) FROM contacts_contact WHERE name = 'Zoë'`).Returns(2)
+
+	// and without a key, a retry creates a new contact
+	create(`{"org_id": 1, "user_id": 1, "contact": {"name": "Zoë"}}`)
+	create(`{"org_id": 1, "user_id": 1, "contact": {"name": "Zoë"}}`)
+
+	assertdb.Query(t, db, `SELECT count(*) FROM contacts_contact WHERE name = 'Zoë'`).Returns(4)
+
+	// a request whose key is reserved by another request which hasn't finished is rejected
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	_, err := rc.Do("SET", "contact_create:1:def456", "pending")
+	require.NoError(t, err)
+
+	status4, response4 := create(`{"org_id": 1, "user_id": 1, "contact": {"name": "Zoë"}, "idempotency_key": "def456"}`)
+	assert.Equal(t, http.StatusConflict, status4)
+	assert.JSONEq(t, `{"error": "a request with this idempotency key is already in progress"}`, string(response4))
+
+	assertdb.Query(t, db, `SELECT count(*) FROM contacts_contact WHERE name = 'Zoë'`).Returns(4)
+
+	// and a request which fails releases its key so that it can be retried
+	status5, _ := create(`{"org_id": 1, "user_id": 1, "contact": {"name": "Zoë", "urns": ["tel:+16055741111"]}, "idempotency_key": "ghi789"}`)
+	assert.Equal(t, http.StatusBadRequest, status5)
+
+	exists, err := redis.Bool(rc.Do("EXISTS", "contact_create:1:ghi789"))
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestCreateContactMergeOnURN(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	wg := &sync.WaitGroup{}
+
+	server := web.NewServer(ctx, rt, wg)
+	server.Start()
+
+	// give our server time to start
+	time.Sleep(time.Second)
+
+	defer server.Stop()
+
+	create := func(body string) (int, map[string]interface{}) {
+		req, err := http.NewRequest("POST", "http://localhost:8090/mr/contact/create", bytes.NewReader([]byte(body)))
+		require.NoError(t, err)
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+
+		content, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		response := make(map[string]interface{})
+		require.NoError(t, json.Unmarshal(content, &response))
+		return resp.StatusCode, response
+	}
+
+	// URNs that don't exist yet create a new contact as normal
+	status, response := create(`{"org_id": 1, "user_id": 1, "contact": {"name": "Zoë", "urns": ["tel:+16055700099"]}, "merge_on_urn": true}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "Zoë", response["contact"].(map[string]interface{})["name"])
+
+	assertdb.Query(t, db, `SELECT count(*) FROM contacts_contact WHERE name = 'Zoë'`).Returns(1)
+
+	// a URN owned by an existing contact updates that contact instead
+	status, response = create(`{"org_id": 1, "user_id": 1, "contact": {"language": "fra", "urns": ["tel:+16055742222", "twitter:bobby"], "fields": {"age": "42"}}, "merge_on_urn": true}`)
+	assert.Equal(t, http.StatusOK, status)
+
+	contact := response["contact"].(map[string]interface{})
+	assert.Equal(t, float64(testdata.Bob.ID), contact["id"])
+	assert.Equal(t, "Bob", contact["name"]) // name wasn't provided so is unchanged
+	assert.Equal(t, "fra", contact["language"])
+
+	assertdb.Query(t, db, `SELECT count(*) FROM contacts_contact WHERE id = $1 AND language = 'fra' AND fields->$2->>'text' = '42'`, testdata.Bob.ID, testdata.AgeField.UUID).Returns(1)
+	assertdb.Query(t, db, `SELECT count(*) FROM contacts_contacturn WHERE contact_id = $1`, testdata.Bob.ID).Returns(2)
+	assertdb.Query(t, db, `SELECT count(*) FROM contacts_contacturn WHERE identity = 'twitter:bobby' AND contact_id = $1`, testdata.Bob.ID).Returns(1)
+
+	// URNs belonging to different contacts are ambiguous
+	status, response = create(`{"org_id": 1, "user_id": 1, "contact": {"name": "Who", "urns": ["tel:+16055741111", "tel:+16055742222"]}, "merge_on_urn": true}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "URNs belong to different contacts", response["error"])
+
+	assertdb.Query(t, db, `SELECT count(*) FROM contacts_contact WHERE name = 'Who'`).Returns(0)
+
+	// and without merge_on_urn, taken URNs are still an error
+	status, response = create(`{"org_id": 1, "user_id": 1, "contact": {"name": "Bob 2", "urns": ["tel:+16055742222"]}}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "URNs in use by other contacts", response["error"])
+}
+
+func TestCreateContactResponseFields(t *testing.T) {
+	ctx, rt, _, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	wg := &sync.WaitGroup{}
+
+	server := web.NewServer(ctx, rt, wg)
+	server.Start()
+
+	// give our server time to start
+	time.Sleep(time.Second)
+
+	defer server.Stop()
+
+	create := func(body string) (int, map[string]interface{}) {
+		req, err := http.NewRequest("POST", "http://localhost:8090/mr/contact/create", bytes.NewReader([]byte(body)))
+		require.NoError(t, err)
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+
+		content, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		response := make(map[string]interface{})
+		require.NoError(t, json.Unmarshal(content, &response))
+		return resp.StatusCode, response
+	}
+
+	// without response fields we get the full contact
+	status, response := create(`{"org_id": 1, "user_id": 1, "contact": {"name": "Ann", "urns": ["tel:+16055700101"], "fields": {"age": "39", "gender": "F"}}}`)
+	assert.Equal(t, http.StatusOK, status)
+
+	contact := response["contact"].(map[string]interface{})
+	assert.Equal(t, "Ann", contact["name"])
+	assert.NotNil(t, contact["urns"])
+	assert.Len(t, contact["fields"], 2)
+
+	// with response fields the contact is trimmed to the ids and requested field values
+	status, response = create(`{"org_id": 1, "user_id": 1, "contact": {"name": "Bea", "fields": {"age": "40", "gender": "F"}}, "response_fields": ["age"]}`)
+	assert.Equal(t, http.StatusOK, status)
+
+	contact = response["contact"].(map[string]interface{})
+	assert.Len(t, contact, 3)
+	assert.NotEmpty(t, contact["uuid"])
+	assert.NotEmpty(t, contact["id"])
+	assert.Equal(t, map[string]interface{}{"age": map[string]interface{}{"text": "40", "number": float64(40)}}, contact["fields"])
+
+	// an empty list gives us just the ids
+	status, response = create(`{"org_id": 1, "user_id": 1, "contact": {"name": "Cat", "fields": {"age": "41"}}, "response_fields": []}`)
+	assert.Equal(t, http.StatusOK, status)
+
+	contact = response["contact"].(map[string]interface{})
+	assert.Len(t, contact, 2)
+	assert.NotEmpty(t, contact["uuid"])
+	assert.NotEmpty(t, contact["id"])
+
+	// and unknown fields are an error
+	status, response = create(`{"org_id": 1, "user_id": 1, "contact": {"name": "Dee"}, "response_fields": ["xyz"]}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "unknown contact field 'xyz'", response["error"])
+}
+
+func TestModifyContactsPartialFailure(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	// add a trigger which fails any update to Bob
+	db.MustExec(`CREATE FUNCTION test_fail_bob() RETURNS trigger AS $$ BEGIN IF NEW.id = 10001 THEN RAISE EXCEPTION 'bob is read only'; END IF; RETURN NEW; END; $$ LANGUAGE plpgsql`)
+	db.MustExec(`CREATE TRIGGER test_fail_bob BEFORE UPDATE ON contacts_contact FOR EACH ROW EXECUTE PROCEDURE test_fail_bob()`)
+	defer db.MustExec(`DROP FUNCTION test_fail_bob() CASCADE`)
+
+	wg := &sync.WaitGroup{}
+
+	server := web.NewServer(ctx, rt, wg)
+	server.Start()
+
+	// give our server time to start
+	time.Sleep(time.Second)
+
+	defer server.Stop()
+
+	body := fmt.Sprintf(`{"org_id": 1, "user_id": 1, "contact_ids": [%d, %d], "patch": {"name": "Changed"}}`, testdata.Cathy.ID, testdata.Bob.ID)
+	req, err := http.NewRequest("POST", "http://localhost:8090/mr/contact/modify", bytes.NewReader([]byte(body)))
+	require.NoError(t, err)
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	results := make(map[string]struct {
+		Contact *struct {
+			Name string `json:"name"`
+		} `json:"contact"`
+		Error string `json:"error"`
+	})
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&results))
+
+	// Cathy was modified
+	cathy := results[fmt.Sprint(testdata.Cathy.ID)]
+	require.NotNil(t, cathy.Contact)
+	assert.Equal(t, "Changed", cathy.Contact.Name)
+	assert.Equal(t, "", cathy.Error)
+
+	// but Bob failed with an error
+	bob := results[fmt.Sprint(testdata.Bob.ID)]
+	assert.Nil(t, bob.Contact)
+	assert.Contains(t, bob.Error, "bob is read only")
+
+	assertdb.Query(t, db, `SELECT name FROM contacts_contact WHERE id = $1`, testdata.Cathy.ID).Returns("Changed")
+	assertdb.Query(t, db, `SELECT name FROM contacts_contact WHERE id = $1`, testdata.Bob.ID).Returns("Bob")
+}
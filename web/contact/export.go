@@ -0,0 +1,153 @@
+package contact
+
+import (
+	"context"
+	"encoding/csv"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/nyaruka/goflow/envs"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/search"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterRoute(http.MethodPost, "/mr/contact/export", web.RequireAuthTokenForHandler(handleExport))
+}
+
+// number of contacts we fetch from elastic and the database and write to the response at a time
+const exportBatchSize = 100
+
+// what we replace URNs with for orgs which are anonymous
+const exportRedactionMask = "********"
+
+// Exports the contacts matching a query as CSV with columns for id, name, URNs and the given fields
+//
+//	{
+//	  "org_id": 1,
+//	  "query": "age > 10",
+//	  "fields": ["age", "gender"]
+//	}
+type exportRequest struct {
+	OrgID  models.OrgID `json:"org_id" validate:"required"`
+	Query  string       `json:"query"  validate:"required"`
+	Fields []string     `json:"fields"`
+}
+
+func handleExport(ctx context.Context, rt *runtime.Runtime, r *http.Request, w http.ResponseWriter) error {
+	request := &exportRequest{}
+	if err := web.ReadAndValidateJSON(r, request); err != nil {
+		return web.WriteErrorResponse(w, http.StatusBadRequest, web.NewValidationError(err))
+	}
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, request.OrgID, searchRefresh)
+	if err != nil {
+		return errors.Wrapf(err, "unable to load org assets")
+	}
+
+	fields := make([]*models.Field, len(request.Fields))
+	for i, key := range request.Fields {
+		fields[i] = oa.FieldByKey(key)
+		if fields[i] == nil {
+			return web.WriteErrorResponse(w, http.StatusBadRequest, errors.Errorf("no such field: %s", key))
+		}
+	}
+
+	redactURNs := oa.Env().RedactionPolicy() == envs.RedactionPolicyURNs
+	flusher, _ := w.(http.Flusher)
+	cw := csv.NewWriter(w)
+	started := false
+
+	// load and write contacts a page at a time, flushing after each so large exports aren't buffered in memory
+	err = search.ScrollContactIDsForQuery(ctx, rt.ES, oa, request.Query, exportBatchSize, func(ids []models.ContactID) error {
+		contacts, err := models.LoadContacts(ctx, rt.ReadonlyDB, oa, ids)
+		if err != nil {
+			return errors.Wrapf(err, "error loading contacts for export")
+		}
+
+		if !started {
+			writeExportHeader(w, cw, fields)
+			started = true
+		}
+
+		// write rows in the order of our search results
+		byID := make(map[models.ContactID]*models.Contact, len(contacts))
+		for _, c := range contacts {
+			byID[c.ID()] = c
+		}
+		for _, id := range ids {
+			if c := byID[id]; c != nil {
+				cw.Write(exportRow(c, fields, redactURNs))
+			}
+		}
+
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return errors.Wrapf(err, "error writing contacts export")
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+
+	if err != nil {
+		// once we've started writing CSV all we can do is abort the response
+		if started {
+			return err
+		}
+		if qerr, isQueryError := err.(*search.QueryError); isQueryError {
+			return web.WriteErrorResponse(w, http.StatusBadRequest, qerr)
+		}
+		return errors.Wrapf(err, "error exporting contacts")
+	}
+
+	// no matches still gives us a header
+	if !started {
+		writeExportHeader(w, cw, fields)
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// writes our response headers and the CSV header row
+func writeExportHeader(w http.ResponseWriter, cw *csv.Writer, fields []*models.Field) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="contacts.csv"`)
+	w.WriteHeader(http.StatusOK)
+
+	header := []string{"id", "name", "urns"}
+	for _, f := range fields {
+		header = append(header, f.Key())
+	}
+	cw.Write(header)
+}
+
+// builds the CSV row for the given contact
+func exportRow(c *models.Contact, fields []*models.Field, redactURNs bool) []string {
+	urnz := make([]string, len(c.URNs()))
+	for i, u := range c.URNs() {
+		if redactURNs {
+			urnz[i] = exportRedactionMask
+		} else {
+			urnz[i] = string(u.Identity())
+		}
+	}
+
+	row := []string{strconv.FormatInt(int64(c.ID()), 10), c.Name(), strings.Join(urnz, ", ")}
+
+	for _, f := range fields {
+		value := ""
+		if v := c.Fields()[f.Key()]; v != nil {
+			value = v.Text.Native()
+		}
+		row = append(row, value)
+	}
+	return row
+}
@@ -0,0 +1,111 @@
+package contact
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContactExport(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	wg := &sync.WaitGroup{}
+
+	mockES := testsuite.NewMockElasticServer()
+	defer mockES.Close()
+
+	rt.ES = mockES.Client()
+
+	server := web.NewServer(ctx, rt, wg)
+	server.Start()
+
+	// give our server time to start
+	time.Sleep(time.Second)
+
+	defer server.Stop()
+
+	db.MustExec(`UPDATE contacts_contact SET fields = $2 WHERE id = $1`, testdata.Cathy.ID, fmt.Sprintf(`{"%s": {"text": "39", "number": 39}, "%s": {"text": "F"}}`, testdata.AgeField.UUID, testdata.GenderField.UUID))
+	db.MustExec(`UPDATE contacts_contact SET fields = NULL WHERE id = $1`, testdata.Bob.ID)
+
+	doExport := func(body string) (*http.Response, []byte) {
+		req, err := http.NewRequest("POST", "http://localhost:8090/mr/contact/export", bytes.NewReader([]byte(body)))
+		require.NoError(t, err)
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+
+		content, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, content
+	}
+
+	// unknown fields are rejected before anything is written
+	resp, content := doExport(`{"org_id": 1, "query": "age > 10", "fields": ["xyz"]}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.JSONEq(t, `{"error": "no such field: xyz"}`, string(content))
+
+	// as are invalid queries
+	resp, content = doExport(`{"org_id": 1, "query": "birthday = tomorrow"}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Contains(t, string(content), "can't resolve 'birthday' to attribute, scheme or field")
+
+	mockES.AddResponse(testdata.Bob.ID, testdata.Cathy.ID)
+
+	resp, content = doExport(`{"org_id": 1, "query": "age > 10 OR name = bob", "fields": ["age", "gender"]}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/csv; charset=utf-8", resp.Header.Get("Content-Type"))
+
+	rows, err := csv.NewReader(bytes.NewReader(content)).ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"id", "name", "urns", "age", "gender"},
+		{fmt.Sprint(testdata.Bob.ID), "Bob", "tel:+16055742222", "", ""},
+		{fmt.Sprint(testdata.Cathy.ID), "Cathy", "tel:+16055741111", "39", "F"},
+	}, rows)
+
+	// no matches gives us just the header
+	mockES.AddResponse()
+
+	resp, content = doExport(`{"org_id": 1, "query": "age > 100"}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "id,name,urns\n", string(content))
+
+	// URNs are redacted for anonymous orgs
+	db.MustExec(`UPDATE orgs_org SET is_anon = TRUE WHERE id = $1`, testdata.Org1.ID)
+	models.FlushCache()
+
+	mockES.AddResponse(testdata.Cathy.ID)
+
+	resp, content = doExport(`{"org_id": 1, "query": "age > 10"}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	rows, err = csv.NewReader(bytes.NewReader(content)).ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"id", "name", "urns"},
+		{fmt.Sprint(testdata.Cathy.ID), "Cathy", "********"},
+	}, rows)
+
+	// and requests without our auth token are rejected if we have one
+	rt.Config.AuthToken = "sesame"
+	defer func() { rt.Config.AuthToken = "" }()
+
+	resp, content = doExport(`{"org_id": 1, "query": "age > 10"}`)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.JSONEq(t, `{"error": "invalid or missing authorization header, denying"}`, string(content))
+}
@@ -2,21 +2,27 @@ package contact
 
 import (
 	"context"
+	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/nyaruka/goflow/assets"
 	"github.com/nyaruka/goflow/contactql"
+	"github.com/nyaruka/goflow/flows"
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/core/search"
 	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/correlation"
 	"github.com/nyaruka/mailroom/web"
 
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
 func init() {
 	web.RegisterJSONRoute(http.MethodPost, "/mr/contact/search", web.RequireAuthToken(handleSearch))
 	web.RegisterJSONRoute(http.MethodPost, "/mr/contact/parse_query", web.RequireAuthToken(handleParseQuery))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/contact/query_match", web.RequireAuthToken(handleQueryMatch))
 }
 
 // Searches the contacts for an org
@@ -25,7 +31,8 @@ func init() {
 //	  "org_id": 1,
 //	  "group_id": 234,
 //	  "query": "age > 10",
-//	  "sort": "-age"
+//	  "sort": "-age",
+//	  "fields": ["age"]
 //	}
 type searchRequest struct {
 	OrgID      models.OrgID       `json:"org_id"     validate:"required"`
@@ -33,16 +40,28 @@ type searchRequest struct {
 	GroupUUID  assets.GroupUUID   `json:"group_uuid"` // deprecated
 	ExcludeIDs []models.ContactID `json:"exclude_ids"`
 	Query      string             `json:"query"`
-	PageSize   int                `json:"page_size"`
-	Offset     int                `json:"offset"`
+	PageSize   int                `json:"page_size"  validate:"min=0"`
+	Offset     int                `json:"offset"     validate:"min=0"`
 	Sort       string             `json:"sort"`
+	Fields     []string           `json:"fields"     validate:"omitempty,max=10"`
 }
 
-// Response for a contact search
+// maximum page size when contact summaries are requested
+const maxSummaryPageSize = 100
+
+// assets which queries can reference and so must be fresh when parsing them, i.e. fields and groups
+const searchRefresh = models.RefreshFields | models.RefreshGroups
+
+// Response for a contact search. If fields were requested, contacts will contain a summary of each matching contact
+// in the same order as contact_ids.
 //
 //	{
 //	  "query": "age > 10",
 //	  "contact_ids": [5,10,15],
+//	  "contacts": [
+//	    {"id": 5, "name": "Bob", "fields": {"age": "34"}},
+//	    ...
+//	  ],
 //	  "total": 3,
 //	  "offset": 0,
 //	  "metadata": {
@@ -53,12 +72,13 @@ type searchRequest struct {
 //	  }
 //	}
 type searchResponse struct {
-	Query      string                `json:"query"`
-	ContactIDs []models.ContactID    `json:"contact_ids"`
-	Total      int64                 `json:"total"`
-	Offset     int                   `json:"offset"`
-	Sort       string                `json:"sort"`
-	Metadata   *contactql.Inspection `json:"metadata,omitempty"`
+	Query      string                   `json:"query"`
+	ContactIDs []models.ContactID       `json:"contact_ids"`
+	Contacts   []*search.ContactSummary `json:"contacts,omitempty"`
+	Total      int64                    `json:"total"`
+	Offset     int                      `json:"offset"`
+	Sort       string                   `json:"sort"`
+	Metadata   *contactql.Inspection    `json:"metadata,omitempty"`
 }
 
 // handles a contact search request
@@ -69,15 +89,42 @@ func handleSearch(ctx context.Context, rt *runtime.Runtime, r *http.Request) (in
 		Sort:     "-id",
 	}
 	if err := web.ReadAndValidateJSON(r, request); err != nil {
-		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+		return web.NewValidationError(err), http.StatusBadRequest, nil
+	}
+
+	// large pages are reduced to our configured maximum
+	if rt.Config.SearchMaxPageSize > 0 && request.PageSize > rt.Config.SearchMaxPageSize {
+		request.PageSize = rt.Config.SearchMaxPageSize
+	}
+
+	// protect elastic from any one org making too many searches
+	if rt.Config.SearchRateLimit > 0 {
+		limiter := web.NewRateLimiter("contact_search", rt.Config.SearchRateLimit, time.Minute)
+		if err := limiter.Allow(rt.RP, fmt.Sprint(request.OrgID)); err != nil {
+			if rateLimited, isRateLimited := err.(*web.RateLimitError); isRateLimited {
+				return rateLimited, http.StatusTooManyRequests, nil
+			}
+			return nil, http.StatusInternalServerError, err
+		}
 	}
 
 	// grab our org assets
-	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, request.OrgID, models.RefreshFields|models.RefreshGroups)
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, request.OrgID, searchRefresh)
 	if err != nil {
 		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
 	}
 
+	return searchContacts(ctx, rt, oa, request)
+}
+
+// performs a contact search using the given org assets, which callers that have just loaded or refreshed assets can
+// pass in to avoid refreshing them again
+func searchContacts(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, request *searchRequest) (interface{}, int, error) {
+	// elastic may not be configured, e.g. if search is disabled
+	if rt.ES == nil {
+		return errors.New("search unavailable"), http.StatusServiceUnavailable, nil
+	}
+
 	var group *models.Group
 	if request.GroupID != 0 {
 		group = oa.GroupByID(request.GroupID)
@@ -85,12 +132,49 @@ func handleSearch(ctx context.Context, rt *runtime.Runtime, r *http.Request) (in
 		group = oa.GroupByUUID(request.GroupUUID)
 	}
 
+	// reject queries which would be too expensive for elastic, leaving invalid queries to fail when we search
+	if rt.Config.SearchMaxQueryCost > 0 && request.Query != "" {
+		if parsed, err := contactql.ParseQuery(oa.Env(), request.Query, oa.SessionAssets()); err == nil {
+			if cost := search.EstimateQueryCost(parsed); cost > rt.Config.SearchMaxQueryCost {
+				return &search.QueryCostError{Cost: cost, MaxCost: rt.Config.SearchMaxQueryCost}, http.StatusBadRequest, nil
+			}
+		}
+	}
+
+	var parsed *contactql.ContactQuery
+	var hits []models.ContactID
+	var summaries []*search.ContactSummary
+	var total int64
+	var err error
+
+	start := time.Now()
+
 	// perform our search
-	parsed, hits, total, err := search.GetContactIDsForQueryPage(ctx, rt.ES, oa, group, request.ExcludeIDs, request.Query, request.Sort, request.Offset, request.PageSize)
+	if len(request.Fields) > 0 {
+		fields := make([]*models.Field, len(request.Fields))
+		for i, key := range request.Fields {
+			fields[i] = oa.FieldByKey(key)
+			if fields[i] == nil {
+				return errors.Errorf("no such field: %s", key), http.StatusBadRequest, nil
+			}
+		}
+
+		if request.PageSize > maxSummaryPageSize {
+			request.PageSize = maxSummaryPageSize
+		}
+
+		parsed, summaries, total, err = search.GetContactSummariesForQueryPage(ctx, rt.ES, oa, group, request.ExcludeIDs, request.Query, request.Sort, request.Offset, request.PageSize, fields)
+
+		hits = make([]models.ContactID, len(summaries))
+		for i := range summaries {
+			hits[i] = summaries[i].ID
+		}
+	} else {
+		parsed, hits, total, err = search.GetContactIDsForQueryPage(ctx, rt.ES, oa, group, request.ExcludeIDs, request.Query, request.Sort, request.Offset, request.PageSize)
+	}
 
 	if err != nil {
-		isQueryError, qerr := contactql.IsQueryError(err)
-		if isQueryError {
+		if qerr, isQueryError := err.(*search.QueryError); isQueryError {
 			return qerr, http.StatusBadRequest, nil
 		}
 		return nil, http.StatusInternalServerError, err
@@ -105,10 +189,23 @@ func handleSearch(ctx context.Context, rt *runtime.Runtime, r *http.Request) (in
 		metadata = contactql.Inspect(parsed)
 	}
 
+	// log slow searches so we can identify pathological queries
+	elapsed := time.Since(start)
+	if rt.Config.SearchSlowThreshold > 0 && elapsed > time.Duration(rt.Config.SearchSlowThreshold)*time.Millisecond {
+		correlation.Logger(ctx).WithFields(logrus.Fields{
+			"org_id":    oa.OrgID(),
+			"query":     normalized,
+			"page_size": request.PageSize,
+			"total":     total,
+			"elapsed":   elapsed,
+		}).Warn("slow contact search")
+	}
+
 	// build our response
 	response := &searchResponse{
 		Query:      normalized,
 		ContactIDs: hits,
+		Contacts:   summaries,
 		Total:      total,
 		Offset:     request.Offset,
 		Sort:       request.Sort,
@@ -155,11 +252,11 @@ type parseResponse struct {
 func handleParseQuery(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
 	request := &parseRequest{}
 	if err := web.ReadAndValidateJSON(r, request); err != nil {
-		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+		return web.NewValidationError(err), http.StatusBadRequest, nil
 	}
 
 	// grab our org assets
-	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, request.OrgID, models.RefreshFields|models.RefreshGroups)
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, request.OrgID, searchRefresh)
 	if err != nil {
 		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
 	}
@@ -192,10 +289,9 @@ func handleParseQuery(ctx context.Context, rt *runtime.Runtime, r *http.Request)
 
 	var elasticSource interface{}
 	if !request.ParseOnly {
-		eq := search.BuildElasticQuery(oa, group, models.NilContactStatus, nil, parsed)
-		elasticSource, err = eq.Source()
+		elasticSource, err = search.BuildElasticSource(oa, group, models.NilContactStatus, nil, parsed)
 		if err != nil {
-			return nil, http.StatusInternalServerError, errors.Wrap(err, "error getting elastic source")
+			return nil, http.StatusInternalServerError, err
 		}
 	}
 
@@ -208,3 +304,99 @@ func handleParseQuery(ctx context.Context, rt *runtime.Runtime, r *http.Request)
 
 	return response, http.StatusOK, nil
 }
+
+// Request to evaluate a query against a single contact
+//
+//	{
+//	  "org_id": 1,
+//	  "contact_id": 12345,
+//	  "query": "age > 10 AND gender = F"
+//	}
+type queryMatchRequest struct {
+	OrgID     models.OrgID     `json:"org_id"     validate:"required"`
+	ContactID models.ContactID `json:"contact_id" validate:"required"`
+	Query     string           `json:"query"      validate:"required"`
+}
+
+// Response for a query match request. If the contact doesn't match, failed_clause is the part of the query which
+// caused that, i.e. the first failing condition of an AND or the whole of an OR whose conditions all failed.
+//
+//	{
+//	  "query": "age > 10 AND gender = \"F\"",
+//	  "matches": false,
+//	  "failed_clause": "gender = \"F\""
+//	}
+type queryMatchResponse struct {
+	Query        string `json:"query"`
+	Matches      bool   `json:"matches"`
+	FailedClause string `json:"failed_clause,omitempty"`
+}
+
+// handles a request to evaluate a query against a contact in memory, rather than in elastic
+func handleQueryMatch(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &queryMatchRequest{}
+	if err := web.ReadAndValidateJSON(r, request); err != nil {
+		return web.NewValidationError(err), http.StatusBadRequest, nil
+	}
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, request.OrgID, searchRefresh)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	parsed, err := contactql.ParseQuery(oa.Env(), request.Query, oa.SessionAssets())
+	if err != nil {
+		isQueryError, qerr := contactql.IsQueryError(err)
+		if isQueryError {
+			return qerr, http.StatusBadRequest, nil
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+
+	contact, err := models.LoadContact(ctx, rt.ReadonlyDB, oa, request.ContactID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error loading contact")
+	}
+	if contact == nil {
+		return errors.Errorf("no such contact: %d", request.ContactID), http.StatusNotFound, nil
+	}
+
+	flowContact, err := contact.FlowContact(oa)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error creating flow contact")
+	}
+
+	failed, err := failedClause(oa, flowContact, parsed.Root())
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error evaluating query")
+	}
+
+	return &queryMatchResponse{Query: parsed.String(), Matches: failed == "", FailedClause: failed}, http.StatusOK, nil
+}
+
+// evaluates the given query node against a contact, returning the clause that caused it not to match, or the empty
+// string if it matches
+func failedClause(oa *models.OrgAssets, contact *flows.Contact, node contactql.QueryNode) (string, error) {
+	if combo, isCombo := node.(*contactql.BoolCombination); isCombo && combo.Operator() == contactql.BoolOperatorAnd {
+		for _, child := range combo.Children() {
+			failed, err := failedClause(oa, contact, child)
+			if failed != "" || err != nil {
+				return failed, err
+			}
+		}
+		return "", nil
+	}
+
+	// anything else is evaluated as a whole by re-parsing it as a query of its own
+	clause := contactql.Stringify(node)
+
+	query, err := contactql.ParseQuery(oa.Env(), clause, oa.SessionAssets())
+	if err != nil {
+		return "", err
+	}
+
+	if contactql.EvaluateQuery(oa.Env(), query, contact) {
+		return "", nil
+	}
+	return clause, nil
+}
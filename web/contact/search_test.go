@@ -14,11 +14,15 @@ import (
 	"github.com/nyaruka/goflow/test"
 	_ "github.com/nyaruka/mailroom/core/handlers"
 	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/search"
 	"github.com/nyaruka/mailroom/testsuite"
 	"github.com/nyaruka/mailroom/testsuite/testdata"
 	"github.com/nyaruka/mailroom/web"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestContactSearch(t *testing.T) {
@@ -74,6 +78,13 @@ func TestContactSearch(t *testing.T) {
 			expectedStatus: 400,
 			expectedError:  "can't convert 'tomorrow' to a number",
 		},
+		{
+			method:         "POST",
+			url:            "/mr/contact/search",
+			body:           `{"org_id": 1, "query": "", "sort": "-fields.goats"}`,
+			expectedStatus: 400,
+			expectedError:  "no such contact field with key: goats",
+		},
 		{
 			method:               "POST",
 			url:                  "/mr/contact/search",
@@ -165,6 +176,35 @@ func TestContactSearch(t *testing.T) {
 			expectedSchemes:      []string{},
 			expectedAllowAsGroup: true,
 		},
+		{
+			method:               "POST",
+			url:                  "/mr/contact/search",
+			body:                 `{"org_id": 1, "query": "history = \"Favorites\""}`,
+			mockResult:           []models.ContactID{testdata.Bob.ID, testdata.Cathy.ID},
+			expectedStatus:       200,
+			expectedHits:         []models.ContactID{testdata.Bob.ID, testdata.Cathy.ID},
+			expectedQuery:        `history = "Favorites"`,
+			expectedAttributes:   []string{"history"},
+			expectedFields:       []*assets.FieldReference{},
+			expectedSchemes:      []string{},
+			expectedAllowAsGroup: false,
+			expectedESRequest: `{
+				"_source": false,
+				"from": 0,
+				"query": {
+					"bool": {
+						"must": [
+							{"term": {"org_id": 1}},
+							{"term": {"is_active": true}},
+							{"term": {"flow_history_ids": 10000}}
+						]
+					}
+				},
+				"size": 50,
+				"sort": [{"id": {"order": "desc"}}],
+				"track_total_hits": true
+			}`,
+		},
 		{
 			method:               "POST",
 			url:                  "/mr/contact/search",
@@ -228,6 +268,94 @@ func TestContactSearch(t *testing.T) {
 	}
 }
 
+func TestContactSearchSummaries(t *testing.T) {
+	ctx, rt, _, _ := testsuite.Get()
+
+	wg := &sync.WaitGroup{}
+
+	mockES := testsuite.NewMockElasticServer()
+	defer mockES.Close()
+
+	rt.ES = mockES.Client()
+
+	server := web.NewServer(ctx, rt, wg)
+	server.Start()
+
+	// give our server time to start
+	time.Sleep(time.Second)
+
+	defer server.Stop()
+
+	doSearch := func(body string) (int, []byte) {
+		req, err := http.NewRequest("POST", "http://localhost:8090/mr/contact/search", bytes.NewReader([]byte(body)))
+		assert.NoError(t, err)
+
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+
+		content, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return resp.StatusCode, content
+	}
+
+	// request summaries with the age field
+	mockES.AddResponseWithSources([]models.ContactID{testdata.Cathy.ID, testdata.Bob.ID}, []map[string]interface{}{
+		{
+			"name": "Cathy",
+			"fields": []map[string]interface{}{
+				{"field": testdata.AgeField.UUID, "text": "39", "number": 39},
+				{"field": testdata.GenderField.UUID, "text": "F"},
+			},
+		},
+		{
+			"name":   "Bob",
+			"fields": []map[string]interface{}{},
+		},
+	})
+
+	status, content := doSearch(`{"org_id": 1, "query": "age > 10", "fields": ["age"]}`)
+	assert.Equal(t, http.StatusOK, status)
+	r := &searchResponse{}
+	assert.NoError(t, json.Unmarshal(content, r))
+	assert.Equal(t, []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID}, r.ContactIDs)
+	assert.Equal(t, []*search.ContactSummary{
+		{ID: testdata.Cathy.ID, Name: "Cathy", Fields: map[string]string{"age": "39"}},
+		{ID: testdata.Bob.ID, Name: "Bob", Fields: map[string]string{}},
+	}, r.Contacts)
+
+	// elastic was asked only for the source we need
+	assert.Contains(t, mockES.LastRequestBody, `"_source":{"includes":["name","fields"]}`)
+
+	// omitting fields gives the id only response
+	mockES.AddResponse(testdata.Cathy.ID)
+
+	status, content = doSearch(`{"org_id": 1, "query": "age > 10"}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.NotContains(t, string(content), `"contacts"`)
+	assert.Contains(t, mockES.LastRequestBody, `"_source":false`)
+
+	r = &searchResponse{}
+	assert.NoError(t, json.Unmarshal(content, r))
+	assert.Equal(t, []models.ContactID{testdata.Cathy.ID}, r.ContactIDs)
+	assert.Nil(t, r.Contacts)
+
+	// page size is capped when summaries are requested
+	mockES.AddResponseWithSources([]models.ContactID{}, []map[string]interface{}{})
+
+	status, _ = doSearch(`{"org_id": 1, "query": "age > 10", "fields": ["age"], "page_size": 1000}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, mockES.LastRequestBody, `"size":100`)
+
+	// unknown fields are an error
+	status, content = doSearch(`{"org_id": 1, "query": "age > 10", "fields": ["xyz"]}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Contains(t, string(content), "no such field: xyz")
+
+	// as are too many fields
+	status, _ = doSearch(`{"org_id": 1, "query": "age > 10", "fields": ["a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k"]}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
 func TestParseQuery(t *testing.T) {
 	ctx, rt, _, _ := testsuite.Get()
 
@@ -235,3 +363,329 @@ func TestParseQuery(t *testing.T) {
 
 	web.RunWebTests(t, ctx, rt, "testdata/parse_query.json", nil)
 }
+
+func TestQueryMatch(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	db.MustExec(`UPDATE contacts_contact SET fields = $2 WHERE id = $1`, testdata.Cathy.ID, fmt.Sprintf(`{"%s": {"text": "39", "number": 39}}`, testdata.AgeField.UUID))
+
+	web.RunWebTests(t, ctx, rt, "testdata/query_match.json", nil)
+}
+
+func TestContactSearchRateLimit(t *testing.T) {
+	ctx, rt, _, _ := testsuite.Get()
+
+	testsuite.Reset(testsuite.ResetRedis)
+	defer testsuite.Reset(testsuite.ResetRedis)
+
+	rt.Config.SearchRateLimit = 2
+	defer func() { rt.Config.SearchRateLimit = 600 }()
+
+	wg := &sync.WaitGroup{}
+
+	mockES := testsuite.NewMockElasticServer()
+	defer mockES.Close()
+
+	rt.ES = mockES.Client()
+
+	server := web.NewServer(ctx, rt, wg)
+	server.Start()
+
+	// give our server time to start
+	time.Sleep(time.Second)
+
+	defer server.Stop()
+
+	search := func(orgID models.OrgID) *http.Response {
+		body := fmt.Sprintf(`{"org_id": %d, "query": "Cathy"}`, orgID)
+		req, err := http.NewRequest("POST", "http://localhost:8090/mr/contact/search", bytes.NewReader([]byte(body)))
+		assert.NoError(t, err)
+
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		return resp
+	}
+
+	// first two searches are allowed
+	for i := 0; i < 2; i++ {
+		mockES.AddResponse(testdata.Cathy.ID)
+
+		resp := search(testdata.Org1.ID)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// third is rate limited
+	resp := search(testdata.Org1.ID)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "30", resp.Header.Get("Retry-After"))
+
+	content, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+
+	r := &web.ErrorResponse{}
+	assert.NoError(t, json.Unmarshal(content, r))
+	assert.Contains(t, r.Error, "rate limit exceeded")
+
+	// but other orgs aren't affected
+	mockES.AddResponse(testdata.Org2Contact.ID)
+
+	resp = search(testdata.Org2.ID)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestSearchContactsWithLoadedAssets(t *testing.T) {
+	ctx, rt, _, _ := testsuite.Get()
+
+	mockES := testsuite.NewMockElasticServer()
+	defer mockES.Close()
+
+	rt.ES = mockES.Client()
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshFields|models.RefreshGroups)
+	require.NoError(t, err)
+
+	request := &searchRequest{OrgID: testdata.Org1.ID, Query: "age > 10", PageSize: 50, Sort: "-id"}
+
+	// search twice with the same loaded assets
+	mockES.AddResponse(testdata.Cathy.ID, testdata.Bob.ID)
+	mockES.AddResponse(testdata.Cathy.ID, testdata.Bob.ID)
+
+	r1, status, err := searchContacts(ctx, rt, oa, request)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	esRequest1 := mockES.LastRequestBody
+
+	r2, status, err := searchContacts(ctx, rt, oa, request)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+
+	assert.Equal(t, r1, r2)
+	assert.Equal(t, esRequest1, mockES.LastRequestBody)
+	assert.Equal(t, []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID}, r1.(*searchResponse).ContactIDs)
+	assert.Equal(t, "age > 10", r1.(*searchResponse).Query)
+
+	// the cached assets weren't refreshed and replaced by either search
+	cached, err := models.GetOrgAssets(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+	assert.Same(t, oa, cached)
+}
+
+func TestContactSearchPageSize(t *testing.T) {
+	ctx, rt, _, _ := testsuite.Get()
+
+	wg := &sync.WaitGroup{}
+
+	mockES := testsuite.NewMockElasticServer()
+	defer mockES.Close()
+
+	rt.ES = mockES.Client()
+	rt.Config.SearchMaxPageSize = 100
+
+	defer func() { rt.Config.SearchMaxPageSize = 1000 }()
+
+	server := web.NewServer(ctx, rt, wg)
+	server.Start()
+
+	// give our server time to start
+	time.Sleep(time.Second)
+
+	defer server.Stop()
+
+	doSearch := func(body string) (int, []byte) {
+		req, err := http.NewRequest("POST", "http://localhost:8090/mr/contact/search", bytes.NewReader([]byte(body)))
+		require.NoError(t, err)
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+
+		content, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, content
+	}
+
+	requestedSize := func() int {
+		body := &struct {
+			Size int `json:"size"`
+		}{}
+		require.NoError(t, json.Unmarshal([]byte(mockES.LastRequestBody), body))
+		return body.Size
+	}
+
+	// page size defaults to 50
+	mockES.AddResponse(testdata.Cathy.ID)
+
+	status, _ := doSearch(`{"org_id": 1, "query": "Cathy"}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 50, requestedSize())
+
+	// page sizes within the maximum are left alone
+	mockES.AddResponse(testdata.Cathy.ID)
+
+	status, _ = doSearch(`{"org_id": 1, "query": "Cathy", "page_size": 75}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 75, requestedSize())
+
+	// but larger page sizes are clamped
+	mockES.AddResponse(testdata.Cathy.ID)
+
+	status, _ = doSearch(`{"org_id": 1, "query": "Cathy", "page_size": 5000}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 100, requestedSize())
+
+	// negative page sizes and offsets are rejected
+	status, content := doSearch(`{"org_id": 1, "query": "Cathy", "page_size": -1}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Contains(t, string(content), "page_size")
+
+	status, content = doSearch(`{"org_id": 1, "query": "Cathy", "offset": -10}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Contains(t, string(content), "offset")
+}
+
+func TestContactSearchWithNewGroup(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	wg := &sync.WaitGroup{}
+
+	mockES := testsuite.NewMockElasticServer()
+	defer mockES.Close()
+
+	rt.ES = mockES.Client()
+
+	server := web.NewServer(ctx, rt, wg)
+	server.Start()
+
+	// give our server time to start
+	time.Sleep(time.Second)
+
+	defer server.Stop()
+
+	// load org assets into the cache before the group exists
+	_, err := models.GetOrgAssets(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	reporters := testdata.InsertContactGroup(db, testdata.Org1, "a7b4a8f6-2b2e-4ab5-8b1c-65d9f7b3e6a1", "Reporters", "")
+
+	mockES.AddResponse(testdata.Cathy.ID)
+
+	req, err := http.NewRequest("POST", "http://localhost:8090/mr/contact/search", bytes.NewReader([]byte(`{"org_id": 1, "query": "group = \"Reporters\""}`)))
+	require.NoError(t, err)
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+
+	content, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	// group is resolved from refreshed assets rather than the stale cached ones
+	assert.Equal(t, http.StatusOK, resp.StatusCode, string(content))
+	assert.Contains(t, mockES.LastRequestBody, string(reporters.UUID))
+}
+
+func TestContactSearchSlowLogging(t *testing.T) {
+	ctx, rt, _, _ := testsuite.Get()
+
+	mockES := testsuite.NewMockElasticServer()
+	defer mockES.Close()
+
+	rt.ES = mockES.Client()
+	rt.Config.SearchSlowThreshold = 50
+
+	logHook := logtest.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+
+	oa, err := models.GetOrgAssets(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	request := &searchRequest{OrgID: testdata.Org1.ID, Query: "AGE > 10", PageSize: 50, Sort: "-id"}
+
+	slowLogs := func() []*logrus.Entry {
+		entries := make([]*logrus.Entry, 0)
+		for _, e := range logHook.AllEntries() {
+			if e.Message == "slow contact search" {
+				entries = append(entries, e)
+			}
+		}
+		return entries
+	}
+
+	// fast searches aren't logged
+	mockES.AddResponse(testdata.Cathy.ID)
+
+	_, status, err := searchContacts(ctx, rt, oa, request)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Len(t, slowLogs(), 0)
+
+	// but slow ones are
+	mockES.Delay = 100 * time.Millisecond
+	mockES.AddResponse(testdata.Cathy.ID)
+
+	_, status, err = searchContacts(ctx, rt, oa, request)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+
+	entries := slowLogs()
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, logrus.WarnLevel, entries[0].Level)
+		assert.Equal(t, testdata.Org1.ID, entries[0].Data["org_id"])
+		assert.Equal(t, "age > 10", entries[0].Data["query"])
+		assert.Equal(t, 50, entries[0].Data["page_size"])
+		assert.Equal(t, int64(1), entries[0].Data["total"])
+		assert.True(t, entries[0].Data["elapsed"].(time.Duration) >= 100*time.Millisecond)
+	}
+}
+
+func TestContactSearchQueryCost(t *testing.T) {
+	ctx, rt, _, _ := testsuite.Get()
+
+	mockES := testsuite.NewMockElasticServer()
+	defer mockES.Close()
+
+	rt.ES = mockES.Client()
+	rt.Config.SearchMaxQueryCost = 10
+	defer func() { rt.Config.SearchMaxQueryCost = 500 }()
+
+	oa, err := models.GetOrgAssets(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	// cheap queries are searched as normal
+	mockES.AddResponse(testdata.Cathy.ID)
+
+	_, status, err := searchContacts(ctx, rt, oa, &searchRequest{OrgID: testdata.Org1.ID, Query: "age > 10", PageSize: 50, Sort: "-id"})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+
+	// expensive ones are rejected without searching
+	value, status, err := searchContacts(ctx, rt, oa, &searchRequest{OrgID: testdata.Org1.ID, Query: `name ~ "bob" OR name ~ "jim"`, PageSize: 50, Sort: "-id"})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	response := web.NewErrorResponse(value.(error))
+	assert.Equal(t, "query is too expensive to run (cost 20 exceeds maximum of 10)", response.Error)
+	assert.Equal(t, "query_too_expensive", response.Code)
+	assert.Equal(t, map[string]string{"cost": "20", "max_cost": "10"}, response.Extra)
+
+	// invalid queries still fail as query errors
+	_, status, err = searchContacts(ctx, rt, oa, &searchRequest{OrgID: testdata.Org1.ID, Query: "birthday = tomorrow", PageSize: 50, Sort: "-id"})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestContactSearchWithoutElastic(t *testing.T) {
+	ctx, rt, _, _ := testsuite.Get()
+
+	rt.ES = nil
+
+	oa, err := models.GetOrgAssets(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	value, status, err := searchContacts(ctx, rt, oa, &searchRequest{OrgID: testdata.Org1.ID, Query: "age > 10", PageSize: 50, Sort: "-id"})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.EqualError(t, value.(error), "search unavailable")
+}
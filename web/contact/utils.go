@@ -35,9 +35,17 @@ func SpecToCreation(s *models.ContactSpec, env envs.Environment, sa flows.Sessio
 		}
 	}
 
+	// URNs are compared after normalization so that different forms of the same URN are caught
 	validated.URNs = make([]urns.URN, len(s.URNs))
+	seen := make(map[urns.URN]bool, len(s.URNs))
 	for i, urn := range s.URNs {
 		validated.URNs[i] = urn.Normalize(country)
+
+		identity := validated.URNs[i].Identity()
+		if seen[identity] {
+			return nil, errors.Errorf("duplicate URN '%s'", identity)
+		}
+		seen[identity] = true
 	}
 
 	validated.Mods = make([]flows.Modifier, 0, len(s.Fields))
@@ -70,3 +78,35 @@ func SpecToCreation(s *models.ContactSpec, env envs.Environment, sa flows.Sessio
 
 	return validated, nil
 }
+
+// ContactPatch is a set of simple contact attribute changes
+type ContactPatch struct {
+	Name     *string `json:"name"`
+	Language *string `json:"language"`
+}
+
+// PatchToModifiers converts the given patch to the equivalent modifiers
+func PatchToModifiers(p *ContactPatch) ([]flows.Modifier, error) {
+	mods := make([]flows.Modifier, 0, 2)
+	if p == nil {
+		return mods, nil
+	}
+
+	if p.Name != nil {
+		mods = append(mods, modifiers.NewName(*p.Name))
+	}
+
+	if p.Language != nil {
+		language := envs.NilLanguage
+		if *p.Language != "" {
+			var err error
+			language, err = envs.ParseLanguage(*p.Language)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid language")
+			}
+		}
+		mods = append(mods, modifiers.NewLanguage(language))
+	}
+
+	return mods, nil
+}
@@ -3,8 +3,11 @@ package contact_test
 import (
 	"testing"
 
+	"github.com/nyaruka/gocommon/urns"
 	"github.com/nyaruka/goflow/assets"
 	"github.com/nyaruka/goflow/envs"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/flows/modifiers"
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/testsuite"
 	"github.com/nyaruka/mailroom/testsuite/testdata"
@@ -52,4 +55,41 @@ func TestSpecToCreation(t *testing.T) {
 	s = &models.ContactSpec{Groups: []assets.GroupUUID{"52f6c50e-f9a8-4f24-bb80-5c9f144ed27f"}}
 	_, err = contact.SpecToCreation(s, env, sa)
 	assert.EqualError(t, err, "unknown contact group '52f6c50e-f9a8-4f24-bb80-5c9f144ed27f'")
+
+	// try to include the same URN twice
+	s = &models.ContactSpec{URNs: []urns.URN{"tel:+16055700001", "twitter:bob", "tel:+16055700001"}}
+	_, err = contact.SpecToCreation(s, env, sa)
+	assert.EqualError(t, err, "duplicate URN 'tel:+16055700001'")
+
+	// including when they only match after normalization
+	s = &models.ContactSpec{URNs: []urns.URN{"tel:+1 605 570 0001", "tel:+16055700001"}}
+	_, err = contact.SpecToCreation(s, env, sa)
+	assert.EqualError(t, err, "duplicate URN 'tel:+16055700001'")
+
+	// URNs with different params are still the same URN
+	s = &models.ContactSpec{URNs: []urns.URN{"tel:+16055700001", "tel:+16055700001?channel=a4f2ab40-2b1a-4e3c-b9a3-1e2d8cbd8c39"}}
+	_, err = contact.SpecToCreation(s, env, sa)
+	assert.EqualError(t, err, "duplicate URN 'tel:+16055700001'")
+}
+
+func TestPatchToModifiers(t *testing.T) {
+	// no patch is no modifiers
+	mods, err := contact.PatchToModifiers(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []flows.Modifier{}, mods)
+
+	name, lang := "Bob", "eng"
+	mods, err = contact.PatchToModifiers(&contact.ContactPatch{Name: &name, Language: &lang})
+	assert.NoError(t, err)
+	assert.Equal(t, []flows.Modifier{modifiers.NewName("Bob"), modifiers.NewLanguage(envs.Language("eng"))}, mods)
+
+	// empty values clear attributes
+	name, lang = "", ""
+	mods, err = contact.PatchToModifiers(&contact.ContactPatch{Name: &name, Language: &lang})
+	assert.NoError(t, err)
+	assert.Equal(t, []flows.Modifier{modifiers.NewName(""), modifiers.NewLanguage(envs.NilLanguage)}, mods)
+
+	lang = "xyzd"
+	_, err = contact.PatchToModifiers(&contact.ContactPatch{Language: &lang})
+	assert.EqualError(t, err, "invalid language: iso-639-3 codes must be 3 characters, got: xyzd")
 }
@@ -1,11 +1,20 @@
 package web
 
 import (
+	"net/http"
+
+	"github.com/nyaruka/gocommon/jsonx"
 	"github.com/nyaruka/goflow/utils"
 
 	"github.com/pkg/errors"
 )
 
+// error codes for errors which don't provide their own
+const (
+	ErrorCodeInvalidRequest = "invalid_request"
+	ErrorCodeServerError    = "server_error"
+)
+
 // ErrorResponse is the type for our error responses
 type ErrorResponse struct {
 	Error string            `json:"error"`
@@ -25,3 +34,35 @@ func NewErrorResponse(err error) *ErrorResponse {
 	}
 	return &ErrorResponse{Error: err.Error()}
 }
+
+// WriteErrorResponse writes the passed in error as a JSON error response, for use by handlers which write their own
+// responses before they've started writing anything else
+func WriteErrorResponse(w http.ResponseWriter, status int, err error) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, werr := w.Write(jsonx.MustMarshal(NewErrorResponse(err)))
+	return werr
+}
+
+// creates an error response for an error that occurred handling a request, i.e. a server side error
+func newServerErrorResponse(err error) *ErrorResponse {
+	r := NewErrorResponse(err)
+	if r.Code == "" {
+		r.Code = ErrorCodeServerError
+	}
+	return r
+}
+
+// ValidationError is returned by handlers when a request couldn't be read or failed validation
+type ValidationError struct {
+	err error
+}
+
+// NewValidationError creates a new validation error from the error returned by reading the request
+func NewValidationError(err error) *ValidationError {
+	return &ValidationError{err: err}
+}
+
+func (e *ValidationError) Error() string            { return "request failed validation: " + e.err.Error() }
+func (e *ValidationError) Code() string             { return ErrorCodeInvalidRequest }
+func (e *ValidationError) Extra() map[string]string { return nil }
@@ -1,11 +1,17 @@
 package web_test
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
 
 	"github.com/nyaruka/gocommon/jsonx"
 	"github.com/nyaruka/goflow/contactql"
 	"github.com/nyaruka/goflow/envs"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/testsuite"
 	"github.com/nyaruka/mailroom/web"
 
 	"github.com/pkg/errors"
@@ -31,4 +37,55 @@ func TestErrorResponse(t *testing.T) {
 	er2JSON, err := jsonx.Marshal(er2)
 	assert.NoError(t, err)
 	assert.JSONEq(t, `{"error": "mismatched input '$' expecting {'(', TEXT, STRING}", "code": "unexpected_token", "extra": {"token": "$"}}`, string(er2JSON))
+
+	// create a validation error
+	er3 := web.NewErrorResponse(web.NewValidationError(errors.New("field 'org_id' is required")))
+
+	er3JSON, err := jsonx.Marshal(er3)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"error": "request failed validation: field 'org_id' is required", "code": "invalid_request"}`, string(er3JSON))
+}
+
+func TestErrorEnvelope(t *testing.T) {
+	ctx, rt, _, _ := testsuite.Get()
+
+	server := web.NewServer(ctx, rt, &sync.WaitGroup{})
+
+	_, queryErr := contactql.ParseQuery(envs.NewBuilder().Build(), "$$", nil)
+
+	tcs := []struct {
+		handler  web.JSONHandler
+		status   int
+		response string
+	}{
+		{ // validation error
+			func(context.Context, *runtime.Runtime, *http.Request) (interface{}, int, error) {
+				return web.NewValidationError(errors.New("field 'org_id' is required")), http.StatusBadRequest, nil
+			},
+			http.StatusBadRequest,
+			`{"error": "request failed validation: field 'org_id' is required", "code": "invalid_request"}`,
+		},
+		{ // query error keeps its own code
+			func(context.Context, *runtime.Runtime, *http.Request) (interface{}, int, error) {
+				return queryErr, http.StatusBadRequest, nil
+			},
+			http.StatusBadRequest,
+			`{"error": "mismatched input '$' expecting {'(', TEXT, STRING}", "code": "unexpected_token", "extra": {"token": "$"}}`,
+		},
+		{ // internal error
+			func(context.Context, *runtime.Runtime, *http.Request) (interface{}, int, error) {
+				return nil, 0, errors.New("boom")
+			},
+			http.StatusInternalServerError,
+			`{"error": "boom", "code": "server_error"}`,
+		},
+	}
+
+	for i, tc := range tcs {
+		w := httptest.NewRecorder()
+		server.WrapJSONHandler(tc.handler)(w, httptest.NewRequest(http.MethodPost, "/mr/test", nil))
+
+		assert.Equal(t, tc.status, w.Code, "%d: status mismatch", i)
+		assert.JSONEq(t, tc.response, w.Body.String(), "%d: response mismatch", i)
+	}
 }
@@ -31,7 +31,7 @@ type migrateResponse struct {
 func handleMigrate(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
 	request := &migrateRequest{}
 	if err := web.ReadAndValidateJSON(r, request); err != nil {
-		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+		return web.NewValidationError(err), http.StatusBadRequest, nil
 	}
 
 	migrated, err := expressions.MigrateTemplate(request.Expression, nil)
@@ -38,7 +38,7 @@ type migrateRequest struct {
 func handleMigrate(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
 	request := &migrateRequest{}
 	if err := web.ReadAndValidateJSON(r, request); err != nil {
-		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+		return web.NewValidationError(err), http.StatusBadRequest, nil
 	}
 
 	// do a JSON to JSON migration of the definition
@@ -64,32 +64,61 @@ func handleMigrate(ctx context.Context, rt *runtime.Runtime, r *http.Request) (i
 //	  "flow": { "uuid": "468621a8-32e6-4cd2-afc1-04416f7151f0", "nodes": [...]},
 //	  "org_id": 1
 //	}
+//
+// Instead of a definition, an existing flow can be inspected by its ID, in which case `org_id` is required, e.g.
+//
+//	{
+//	  "flow_id": 10001,
+//	  "org_id": 1
+//	}
 type inspectRequest struct {
-	Flow  json.RawMessage `json:"flow" validate:"required"`
-	OrgID models.OrgID    `json:"org_id"`
+	Flow   json.RawMessage `json:"flow"    validate:"required_without=FlowID"`
+	FlowID models.FlowID   `json:"flow_id"`
+	OrgID  models.OrgID    `json:"org_id"`
 }
 
 func handleInspect(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
 	request := &inspectRequest{}
 	if err := web.ReadAndValidateJSON(r, request); err != nil {
-		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
-	}
-
-	flow, err := goflow.ReadFlow(rt.Config, request.Flow)
-	if err != nil {
-		return errors.Wrapf(err, "unable to read flow"), http.StatusUnprocessableEntity, nil
+		return web.NewValidationError(err), http.StatusBadRequest, nil
 	}
 
+	var oa *models.OrgAssets
 	var sa flows.SessionAssets
+	var err error
+
 	// if we have an org ID, create session assets to look for missing dependencies
 	if request.OrgID != models.NilOrgID {
-		oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, request.OrgID, models.RefreshFields|models.RefreshGroups|models.RefreshFlows)
+		oa, err = models.GetOrgAssetsWithRefresh(ctx, rt, request.OrgID, models.RefreshFields|models.RefreshGroups|models.RefreshFlows|models.RefreshChannels)
 		if err != nil {
 			return nil, 0, err
 		}
 		sa = oa.SessionAssets()
 	}
 
+	definition := []byte(request.Flow)
+
+	// if we have a flow ID, inspect the saved definition of that flow
+	if request.FlowID != models.NilFlowID {
+		if oa == nil {
+			return errors.New("org_id is required when inspecting by flow_id"), http.StatusBadRequest, nil
+		}
+
+		dbFlow, err := oa.FlowByID(request.FlowID)
+		if err == models.ErrNotFound {
+			return errors.Errorf("no such flow with id %d", request.FlowID), http.StatusNotFound, nil
+		}
+		if err != nil {
+			return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load flow")
+		}
+		definition = dbFlow.Definition()
+	}
+
+	flow, err := goflow.ReadFlow(rt.Config, definition)
+	if err != nil {
+		return errors.Wrapf(err, "unable to read flow"), http.StatusUnprocessableEntity, nil
+	}
+
 	return flow.Inspect(sa), http.StatusOK, nil
 }
 
@@ -110,7 +139,7 @@ type cloneRequest struct {
 func handleClone(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
 	request := &cloneRequest{}
 	if err := web.ReadAndValidateJSON(r, request); err != nil {
-		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+		return web.NewValidationError(err), http.StatusBadRequest, nil
 	}
 
 	// try to clone the flow definition
@@ -142,7 +171,7 @@ type changeLanguageRequest struct {
 func handleChangeLanguage(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
 	request := &changeLanguageRequest{}
 	if err := web.ReadAndValidateJSON(r, request); err != nil {
-		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+		return web.NewValidationError(err), http.StatusBadRequest, nil
 	}
 
 	flow, err := goflow.ReadFlow(rt.Config, request.Flow)
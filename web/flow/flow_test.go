@@ -1,17 +1,24 @@
 package flow_test
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
 	"github.com/nyaruka/mailroom/web"
 )
 
 func TestServer(t *testing.T) {
-	ctx, rt, _, _ := testsuite.Get()
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	// a saved flow which references a group that doesn't exist
+	missingDeps := testdata.InsertFlow(db, testdata.Org1, testsuite.ReadFile("testdata/missing_deps_flow.json"))
 
 	web.RunWebTests(t, ctx, rt, "testdata/change_language.json", nil)
 	web.RunWebTests(t, ctx, rt, "testdata/clone.json", nil)
-	web.RunWebTests(t, ctx, rt, "testdata/inspect.json", nil)
+	web.RunWebTests(t, ctx, rt, "testdata/inspect.json", map[string]string{"flow_id": fmt.Sprint(missingDeps.ID)})
 	web.RunWebTests(t, ctx, rt, "testdata/migrate.json", nil)
 }
@@ -3,12 +3,15 @@ package flow
 import (
 	"context"
 	"net/http"
+	"sort"
 
 	"github.com/nyaruka/gocommon/urns"
 	"github.com/nyaruka/goflow/assets"
 	"github.com/nyaruka/goflow/contactql"
 	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/flows/triggers"
 	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/runner"
 	"github.com/nyaruka/mailroom/core/search"
 	"github.com/nyaruka/mailroom/runtime"
 	"github.com/nyaruka/mailroom/web"
@@ -17,6 +20,7 @@ import (
 
 func init() {
 	web.RegisterJSONRoute(http.MethodPost, "/mr/flow/preview_start", web.RequireAuthToken(handlePreviewStart))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/flow/start", web.RequireAuthToken(handleStart))
 }
 
 // Generates a preview of which contacts will be started in the given flow.
@@ -73,7 +77,7 @@ type previewStartResponse struct {
 func handlePreviewStart(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
 	request := &previewStartRequest{}
 	if err := web.ReadAndValidateJSON(r, request); err != nil {
-		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+		return web.NewValidationError(err), http.StatusBadRequest, nil
 	}
 
 	oa, err := models.GetOrgAssets(ctx, rt, request.OrgID)
@@ -120,3 +124,95 @@ func handlePreviewStart(ctx context.Context, rt *runtime.Runtime, r *http.Reques
 		Metadata:  inspection,
 	}, http.StatusOK, nil
 }
+
+// maximum number of contacts that can be started synchronously, larger sets should be started with a flow start
+const maxSyncStartContacts = 100
+
+// Starts the given flow for a small set of contacts synchronously, returning the ids of the contacts actually started.
+//
+//	{
+//	  "org_id": 1,
+//	  "user_id": 3,
+//	  "flow_id": 2,
+//	  "contact_ids": [12, 34],
+//	  "restart_participants": false,
+//	  "include_active": false
+//	}
+//
+//	{
+//	  "contact_ids": [12]
+//	}
+type startRequest struct {
+	OrgID               models.OrgID       `json:"org_id"      validate:"required"`
+	UserID              models.UserID      `json:"user_id"`
+	FlowID              models.FlowID      `json:"flow_id"     validate:"required"`
+	ContactIDs          []models.ContactID `json:"contact_ids" validate:"required"`
+	RestartParticipants bool               `json:"restart_participants"`
+	IncludeActive       bool               `json:"include_active"`
+}
+
+type startResponse struct {
+	ContactIDs []models.ContactID `json:"contact_ids"`
+}
+
+func handleStart(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &startRequest{}
+	if err := web.ReadAndValidateJSON(r, request); err != nil {
+		return web.NewValidationError(err), http.StatusBadRequest, nil
+	}
+
+	if len(request.ContactIDs) > maxSyncStartContacts {
+		return errors.Errorf("can't start more than %d contacts synchronously, use a flow start", maxSyncStartContacts), http.StatusBadRequest, nil
+	}
+
+	oa, err := models.GetOrgAssets(ctx, rt, request.OrgID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	flow, err := oa.FlowByID(request.FlowID)
+	if err == models.ErrNotFound {
+		return errors.Errorf("no such flow with id %d", request.FlowID), http.StatusBadRequest, nil
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load flow")
+	}
+	if flow.FlowType() == models.FlowTypeVoice {
+		return errors.Errorf("can't synchronously start voice flow with id %d", request.FlowID), http.StatusBadRequest, nil
+	}
+
+	var flowUser *flows.User
+	if request.UserID != models.NilUserID {
+		user := oa.UserByID(request.UserID)
+		if user != nil {
+			flowUser = oa.SessionAssets().Users().Get(user.Email())
+		}
+	}
+
+	batchStart := len(request.ContactIDs) > 1
+
+	options := runner.NewStartOptions()
+	options.ExcludeStartedPreviously = !request.RestartParticipants
+	options.ExcludeInAFlow = !request.IncludeActive
+	options.Interrupt = flow.FlowType().Interrupts()
+	options.TriggerBuilder = func(contact *flows.Contact) flows.Trigger {
+		tb := triggers.NewBuilder(oa.Env(), flow.Reference(), contact).Manual()
+		if batchStart {
+			tb = tb.AsBatch()
+		}
+		return tb.WithUser(flowUser).Build()
+	}
+
+	sessions, err := runner.StartFlow(ctx, rt, oa, flow, request.ContactIDs, options)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error starting flow")
+	}
+
+	started := make([]models.ContactID, len(sessions))
+	for i, s := range sessions {
+		started[i] = s.ContactID()
+	}
+	sort.Slice(started, func(i, j int) bool { return started[i] < started[j] })
+
+	return &startResponse{ContactIDs: started}, http.StatusOK, nil
+}
@@ -3,6 +3,7 @@ package flow_test
 import (
 	"testing"
 
+	_ "github.com/nyaruka/mailroom/core/handlers"
 	"github.com/nyaruka/mailroom/testsuite"
 	"github.com/nyaruka/mailroom/testsuite/testdata"
 	"github.com/nyaruka/mailroom/web"
@@ -23,3 +24,11 @@ func TestPreviewStart(t *testing.T) {
 
 	web.RunWebTests(t, ctx, rt, "testdata/preview_start.json", nil)
 }
+
+func TestStart(t *testing.T) {
+	ctx, rt, _, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	web.RunWebTests(t, ctx, rt, "testdata/start.json", nil)
+}
@@ -9,9 +9,26 @@ import (
 	"time"
 
 	"github.com/go-chi/chi/middleware"
+	"github.com/nyaruka/mailroom/utils/correlation"
 	log "github.com/sirupsen/logrus"
 )
 
+// takes the correlation id from the request header, or falls back to the request id assigned by chi's RequestID
+// middleware, and adds it to the request context so it can be included in logs by the handler and any model functions
+// it calls
+func correlationID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(correlation.Header)
+		if id == "" {
+			id = middleware.GetReqID(r.Context())
+		}
+
+		w.Header().Set(correlation.Header, id)
+
+		next.ServeHTTP(w, r.WithContext(correlation.NewContext(r.Context(), id)))
+	})
+}
+
 func requestLogger(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
@@ -29,7 +46,7 @@ func requestLogger(next http.Handler) http.Handler {
 		ww.Header().Set("X-Elapsed-NS", strconv.FormatInt(int64(elapsed), 10))
 
 		if r.RequestURI != "/" {
-			log.WithFields(log.Fields{
+			correlation.Logger(r.Context()).WithFields(log.Fields{
 				"method":     r.Method,
 				"status":     ww.Status(),
 				"elapsed":    elapsed,
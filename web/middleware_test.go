@@ -0,0 +1,55 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/go-chi/chi/middleware"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/utils/correlation"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCorrelationID(t *testing.T) {
+	ctx, rt, _, _ := testsuite.Get()
+
+	server := NewServer(ctx, rt, &sync.WaitGroup{})
+
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	// correlation id provided by the caller is used in our logs and returned
+	req := httptest.NewRequest(http.MethodGet, "/mr/", nil)
+	req.Header.Set(correlation.Header, "7bd2e0e9-1c9f-4e68-a4f1-6e1b7b0d2ef0")
+	w := httptest.NewRecorder()
+	server.httpServer.Handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "7bd2e0e9-1c9f-4e68-a4f1-6e1b7b0d2ef0", w.Header().Get(correlation.Header))
+
+	require.NotNil(t, hook.LastEntry())
+	assert.Equal(t, "request completed", hook.LastEntry().Message)
+	assert.Equal(t, "7bd2e0e9-1c9f-4e68-a4f1-6e1b7b0d2ef0", hook.LastEntry().Data[correlation.LogField])
+
+	// if caller doesn't provide one, we use the request id
+	req = httptest.NewRequest(http.MethodGet, "/mr/", nil)
+	req.Header.Set(middleware.RequestIDHeader, "req-1234")
+	w = httptest.NewRecorder()
+	server.httpServer.Handler.ServeHTTP(w, req)
+
+	assert.Equal(t, "req-1234", w.Header().Get(correlation.Header))
+	assert.Equal(t, "req-1234", hook.LastEntry().Data[correlation.LogField])
+
+	// which chi generates if there isn't one
+	req = httptest.NewRequest(http.MethodGet, "/mr/", nil)
+	w = httptest.NewRecorder()
+	server.httpServer.Handler.ServeHTTP(w, req)
+
+	generated := w.Header().Get(correlation.Header)
+	assert.NotEmpty(t, generated)
+	assert.Equal(t, generated, hook.LastEntry().Data[correlation.LogField])
+}
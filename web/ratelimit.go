@@ -0,0 +1,80 @@
+package web
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// RateLimitError is returned by handlers when a client has exceeded a rate limit, and is written as a 429 response
+// with a Retry-After header
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limit exceeded, retry after %s", e.RetryAfter)
+}
+
+var tokenBucketScript = redis.NewScript(1, `
+local key, rate, burst = KEYS[1], tonumber(ARGV[1]), tonumber(ARGV[2])
+
+local t = redis.call("TIME")
+local now = tonumber(t[1]) + tonumber(t[2]) / 1000000
+
+-- refill the bucket based on the time since we last took from it
+local bucket = redis.call("HMGET", key, "tokens", "ts")
+local tokens = tonumber(bucket[1]) or burst
+local ts = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + (now - ts) * rate)
+
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+else
+	wait = math.ceil((1 - tokens) / rate * 1000)
+end
+
+redis.call("HSET", key, "tokens", tostring(tokens), "ts", tostring(now))
+redis.call("EXPIRE", key, math.ceil(burst / rate) + 1)
+
+return wait
+`)
+
+// RateLimiter is a token bucket rate limiter backed by Redis
+type RateLimiter struct {
+	name   string
+	limit  int
+	period time.Duration
+}
+
+// NewRateLimiter creates a new rate limiter which allows limit requests per period for each key, all of which can be
+// used in a single burst
+func NewRateLimiter(name string, limit int, period time.Duration) *RateLimiter {
+	return &RateLimiter{name: name, limit: limit, period: period}
+}
+
+// Allow takes a token from the bucket for the given key, returning a *RateLimitError if the bucket is empty
+func (l *RateLimiter) Allow(rp *redis.Pool, key string) error {
+	rc := rp.Get()
+	defer rc.Close()
+
+	rate := float64(l.limit) / l.period.Seconds() // tokens per second
+
+	waitMillis, err := redis.Int(tokenBucketScript.Do(rc, fmt.Sprintf("ratelimit:%s:%s", l.name, key), rate, l.limit))
+	if err != nil {
+		return errors.Wrapf(err, "error checking rate limit")
+	}
+	if waitMillis > 0 {
+		return &RateLimitError{RetryAfter: time.Duration(waitMillis) * time.Millisecond}
+	}
+	return nil
+}
+
+// returns the value to use for a Retry-After header, i.e. whole seconds rounded up
+func retryAfterSeconds(d time.Duration) string {
+	return fmt.Sprintf("%d", int(math.Ceil(d.Seconds())))
+}
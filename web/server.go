@@ -12,6 +12,7 @@ import (
 	"github.com/go-chi/chi/middleware"
 	"github.com/nyaruka/gocommon/jsonx"
 	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/correlation"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
@@ -63,6 +64,7 @@ func NewServer(ctx context.Context, rt *runtime.Runtime, wg *sync.WaitGroup) *Se
 	//  set up our middlewares
 	router.Use(middleware.Compress(flate.DefaultCompression))
 	router.Use(middleware.RequestID)
+	router.Use(correlationID)
 	router.Use(middleware.RealIP)
 	router.Use(panicRecovery)
 	router.Use(middleware.Timeout(60 * time.Second))
@@ -105,25 +107,30 @@ func (s *Server) WrapJSONHandler(handler JSONHandler) http.HandlerFunc {
 
 		// handler errored (a hard error)
 		if err != nil {
-			value = NewErrorResponse(err)
+			value = newServerErrorResponse(err)
 		} else {
 			// handler returned an error to use as a the response
 			asError, isError := value.(error)
 			if isError {
+				if rateLimited, isRateLimited := asError.(*RateLimitError); isRateLimited {
+					w.Header().Set("Retry-After", retryAfterSeconds(rateLimited.RetryAfter))
+					status = http.StatusTooManyRequests
+				}
+
 				value = NewErrorResponse(asError)
 			}
 		}
 
 		serialized, serr := jsonx.MarshalPretty(value)
 		if serr != nil {
-			logrus.WithError(err).WithField("http_request", r).Error("error serializing handler response")
+			correlation.Logger(r.Context()).WithError(err).WithField("http_request", r).Error("error serializing handler response")
 			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(`{"error": "error serializing handler response"}`))
+			w.Write([]byte(`{"error": "error serializing handler response", "code": "server_error"}`))
 			return
 		}
 
 		if err != nil {
-			logrus.WithError(err).WithField("http_request", r).Error("error handling request")
+			correlation.Logger(r.Context()).WithError(err).WithField("http_request", r).Error("error handling request")
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write(serialized)
 			return
@@ -142,9 +149,9 @@ func (s *Server) WrapHandler(handler Handler) http.HandlerFunc {
 			return
 		}
 
-		logrus.WithError(err).WithField("http_request", r).Error("error handling request")
+		correlation.Logger(r.Context()).WithError(err).WithField("http_request", r).Error("error handling request")
 		w.WriteHeader(http.StatusInternalServerError)
-		serialized := jsonx.MustMarshal(NewErrorResponse(err))
+		serialized := jsonx.MustMarshal(newServerErrorResponse(err))
 		w.Write(serialized)
 	}
 }
@@ -0,0 +1,153 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/goflow/envs"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterJSONRoute(http.MethodPost, "/mr/session/timeline", web.RequireAuthToken(handleTimeline))
+}
+
+// what we replace URNs with for orgs which are anonymous
+const redactionMask = "********"
+
+// Request for the events timeline of a session.
+//
+//	{
+//	  "org_id": 1,
+//	  "session_id": 12345
+//	}
+type timelineRequest struct {
+	OrgID     models.OrgID     `json:"org_id"     validate:"required"`
+	SessionID models.SessionID `json:"session_id" validate:"required"`
+}
+
+// Response with the events of all runs in a session, ordered by when they were created.
+//
+//	{
+//	  "session_uuid": "3a7f5b4c-8d3e-4b1f-9f3a-2e6d8c1b0a9f",
+//	  "status": "C",
+//	  "events": [
+//	    {
+//	      "run_uuid": "692926ea-09d6-4942-bd38-d266ec8d3716",
+//	      "flow": {"uuid": "9de3663f-c5c5-4c92-9f45-ecbc09abcc85", "name": "Favorites"},
+//	      "event": {"type": "msg_created", "created_on": "2018-07-06T12:30:00.123456789Z", ...}
+//	    },
+//	    ...
+//	  ]
+//	}
+type timelineResponse struct {
+	SessionUUID flows.SessionUUID    `json:"session_uuid"`
+	Status      models.SessionStatus `json:"status"`
+	Events      []*timelineEvent     `json:"events"`
+}
+
+type timelineEvent struct {
+	RunUUID flows.RunUUID         `json:"run_uuid"`
+	Flow    *assets.FlowReference `json:"flow"`
+	Event   json.RawMessage       `json:"event"`
+
+	event flows.Event
+}
+
+// handles a request for a session's timeline
+func handleTimeline(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &timelineRequest{}
+	if err := web.ReadAndValidateJSON(r, request); err != nil {
+		return web.NewValidationError(err), http.StatusBadRequest, nil
+	}
+
+	oa, err := models.GetOrgAssets(ctx, rt, request.OrgID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	session, err := models.GetSessionByID(ctx, rt.DB, rt.SessionStorage, oa, request.SessionID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error loading session")
+	}
+	if session == nil {
+		return errors.Errorf("no such session #%d", request.SessionID), http.StatusNotFound, nil
+	}
+
+	fs, err := session.FlowSession(rt.Config, oa.SessionAssets(), oa.Env())
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error reading session output")
+	}
+
+	redactURNs := oa.Env().RedactionPolicy() == envs.RedactionPolicyURNs
+	timeline := make([]*timelineEvent, 0, 20)
+
+	for _, run := range fs.Runs() {
+		for _, e := range run.Events() {
+			eventJSON, err := json.Marshal(e)
+			if err != nil {
+				return nil, http.StatusInternalServerError, errors.Wrapf(err, "error marshaling event")
+			}
+			if redactURNs {
+				if eventJSON, err = redactEventURNs(eventJSON); err != nil {
+					return nil, http.StatusInternalServerError, err
+				}
+			}
+
+			timeline = append(timeline, &timelineEvent{RunUUID: run.UUID(), Flow: run.FlowReference(), Event: eventJSON, event: e})
+		}
+	}
+
+	// order events across all runs by when they happened
+	sort.SliceStable(timeline, func(i, j int) bool {
+		return timeline[i].event.CreatedOn().Before(timeline[j].event.CreatedOn())
+	})
+
+	return &timelineResponse{SessionUUID: session.UUID(), Status: session.Status(), Events: timeline}, http.StatusOK, nil
+}
+
+// replaces any URN values in the given event JSON with a mask
+func redactEventURNs(eventJSON []byte) ([]byte, error) {
+	// decode numbers as json.Number so that large ids survive the round trip
+	decoder := json.NewDecoder(bytes.NewReader(eventJSON))
+	decoder.UseNumber()
+
+	var event interface{}
+	if err := decoder.Decode(&event); err != nil {
+		return nil, errors.Wrapf(err, "error unmarshaling event for redaction")
+	}
+
+	var redact func(v interface{})
+	redact = func(v interface{}) {
+		switch typed := v.(type) {
+		case map[string]interface{}:
+			for key, child := range typed {
+				if _, isString := child.(string); isString && key == "urn" {
+					typed[key] = redactionMask
+				} else if urns, isList := child.([]interface{}); isList && key == "urns" {
+					for i := range urns {
+						urns[i] = redactionMask
+					}
+				} else {
+					redact(child)
+				}
+			}
+		case []interface{}:
+			for _, child := range typed {
+				redact(child)
+			}
+		}
+	}
+	redact(event)
+
+	return json.Marshal(event)
+}
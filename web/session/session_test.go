@@ -0,0 +1,133 @@
+package session
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/test"
+	_ "github.com/nyaruka/mailroom/core/handlers"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeline(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	oa, err := models.GetOrgAssets(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	modelContact, _ := testdata.Cathy.Load(db, oa)
+
+	// start Cathy in the favorites flow and give it a couple of answers
+	sa, flowSession, sprint := test.NewSessionBuilder().WithAssets(oa.SessionAssets()).WithFlow(testdata.Favorites.UUID).
+		WithContact(testdata.Cathy.UUID, flows.ContactID(testdata.Cathy.ID), "Cathy", "eng", "").MustBuild()
+
+	tx := db.MustBegin()
+	sessions, err := models.InsertSessions(ctx, rt, tx, oa, []flows.Session{flowSession}, []flows.Sprint{sprint}, []*models.Contact{modelContact}, nil)
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+
+	session := sessions[0]
+
+	for _, answer := range []string{"red", "primus"} {
+		flowSession, sprint, err = test.ResumeSession(flowSession, sa, answer)
+		require.NoError(t, err)
+
+		tx = db.MustBegin()
+		require.NoError(t, session.Update(ctx, rt, tx, oa, flowSession, sprint, modelContact, nil))
+		require.NoError(t, tx.Commit())
+	}
+
+	wg := &sync.WaitGroup{}
+	server := web.NewServer(ctx, rt, wg)
+	server.Start()
+
+	// give our server time to start
+	time.Sleep(time.Second)
+
+	defer server.Stop()
+
+	timeline := func(orgID models.OrgID, sessionID models.SessionID) (int, []byte) {
+		body := fmt.Sprintf(`{"org_id": %d, "session_id": %d}`, orgID, sessionID)
+		req, err := http.NewRequest("POST", "http://localhost:8090/mr/session/timeline", bytes.NewReader([]byte(body)))
+		require.NoError(t, err)
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+
+		content, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, content
+	}
+
+	status, content := timeline(testdata.Org1.ID, session.ID())
+	assert.Equal(t, http.StatusOK, status)
+
+	response := &timelineResponse{}
+	require.NoError(t, json.Unmarshal(content, response))
+
+	assert.Equal(t, session.UUID(), response.SessionUUID)
+	assert.Equal(t, models.SessionStatusWaiting, response.Status)
+
+	// every event from the session output should be included...
+	numEvents := 0
+	for _, r := range flowSession.Runs() {
+		numEvents += len(r.Events())
+	}
+	require.Equal(t, numEvents, len(response.Events))
+
+	// ...in chronological order
+	types := make([]string, len(response.Events))
+	var lastCreatedOn time.Time
+
+	for i, e := range response.Events {
+		event := &struct {
+			Type      string    `json:"type"`
+			CreatedOn time.Time `json:"created_on"`
+		}{}
+		require.NoError(t, json.Unmarshal(e.Event, event))
+
+		assert.False(t, event.CreatedOn.Before(lastCreatedOn), "event %d is out of order", i)
+		assert.Equal(t, testdata.Favorites.UUID, e.Flow.UUID)
+
+		lastCreatedOn = event.CreatedOn
+		types[i] = event.Type
+	}
+
+	assert.Equal(t, "msg_created", types[0])
+	assert.Contains(t, types, "msg_wait")
+	assert.Contains(t, types, "msg_received")
+	assert.Equal(t, "msg_wait", types[len(types)-1])
+
+	// sessions from other orgs aren't found
+	status, _ = timeline(testdata.Org2.ID, session.ID())
+	assert.Equal(t, http.StatusNotFound, status)
+
+	// nor are sessions that don't exist
+	status, _ = timeline(testdata.Org1.ID, 123456)
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestRedactEventURNs(t *testing.T) {
+	redacted, err := redactEventURNs([]byte(`{"type": "msg_created", "msg": {"id": 12345678901, "urn": "tel:+16055741111", "text": "Hi"}}`))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"type": "msg_created", "msg": {"id": 12345678901, "urn": "********", "text": "Hi"}}`, string(redacted))
+
+	redacted, err = redactEventURNs([]byte(`{"type": "contact_urns_changed", "urns": ["tel:+16055741111", "twitter:bob"]}`))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"type": "contact_urns_changed", "urns": ["********", "********"]}`, string(redacted))
+}
@@ -66,9 +66,8 @@ func RequireUserToken(handler JSONHandler) JSONHandler {
 // RequireAuthToken wraps a handler to require that our request to have our global authorization header
 func RequireAuthToken(handler JSONHandler) JSONHandler {
 	return func(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
-		auth := r.Header.Get("authorization")
-		if rt.Config.AuthToken != "" && fmt.Sprintf("Token %s", rt.Config.AuthToken) != auth {
-			return fmt.Errorf("invalid or missing authorization header, denying"), http.StatusUnauthorized, nil
+		if err := checkAuthToken(rt, r); err != nil {
+			return err, http.StatusUnauthorized, nil
 		}
 
 		// we are authenticated, call our chain
@@ -76,6 +75,27 @@ func RequireAuthToken(handler JSONHandler) JSONHandler {
 	}
 }
 
+// RequireAuthTokenForHandler is the equivalent of RequireAuthToken for handlers which write their own responses
+func RequireAuthTokenForHandler(handler Handler) Handler {
+	return func(ctx context.Context, rt *runtime.Runtime, r *http.Request, w http.ResponseWriter) error {
+		if err := checkAuthToken(rt, r); err != nil {
+			return WriteErrorResponse(w, http.StatusUnauthorized, err)
+		}
+
+		// we are authenticated, call our chain
+		return handler(ctx, rt, r, w)
+	}
+}
+
+// checks that the request has our global authorization header, if we have one
+func checkAuthToken(rt *runtime.Runtime, r *http.Request) error {
+	auth := r.Header.Get("authorization")
+	if rt.Config.AuthToken != "" && fmt.Sprintf("Token %s", rt.Config.AuthToken) != auth {
+		return fmt.Errorf("invalid or missing authorization header, denying")
+	}
+	return nil
+}
+
 // LoggingJSONHandler is a JSON web handler which logs HTTP logs
 type LoggingJSONHandler func(ctx context.Context, rt *runtime.Runtime, r *http.Request, l *models.HTTPLogger) (interface{}, int, error)
 